@@ -5,8 +5,15 @@ import (
 	"os"
 
 	"github.com/aws/aws-cdk-go/awscdk/v2"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awsapigatewayv2"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awsapigatewayv2integrations"
 	"github.com/aws/aws-cdk-go/awscdk/v2/awsdynamodb"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awsevents"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awseventstargets"
 	"github.com/aws/aws-cdk-go/awscdk/v2/awslambda"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awslambdaeventsources"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awss3assets"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awssqs"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/constructs-go/constructs/v10"
 	"github.com/aws/jsii-runtime-go"
@@ -30,6 +37,9 @@ func NewStack(scope constructs.Construct, id string, props *awscdk.StackProps) a
 		DeletionProtection: aws.Bool(true),
 		ReadCapacity:       &readCapacity,
 		WriteCapacity:      &writeCapacity,
+		Stream:             awsdynamodb.StreamViewType_NEW_AND_OLD_IMAGES,
+		// Undelivered outbox events expire after the retention period
+		TimeToLiveAttribute: jsii.String("ttl"),
 	})
 
 	table.AddGlobalSecondaryIndex(&awsdynamodb.GlobalSecondaryIndexProps{
@@ -49,13 +59,132 @@ func NewStack(scope constructs.Construct, id string, props *awscdk.StackProps) a
 	// Create a Lambda function
 	lambdaFunction := awslambda.NewFunction(stack, jsii.String("TaskManagementFunction"), &awslambda.FunctionProps{
 		Runtime: awslambda.Runtime_PROVIDED_AL2(),
-		Code:    awslambda.Code_FromAsset(jsii.String("../lambda"), nil),
+		// The other functions are deployed from their own asset directories
+		Code: awslambda.Code_FromAsset(jsii.String("../lambda"), &awss3assets.AssetOptions{
+			Exclude: jsii.Strings("stream", "websocket", "scheduler", "webhook"),
+		}),
 		Handler: jsii.String("bootstrap"),
+		Environment: jwtEnvironment(),
 	})
 	
 		// Grant the Lambda function read/write permissions to the table
 	table.GrantReadWriteData(lambdaFunction)
 
+	// WebSocket API for real-time task updates
+	webSocketFunction := awslambda.NewFunction(stack, jsii.String("TaskWebSocketFunction"), &awslambda.FunctionProps{
+		Runtime: awslambda.Runtime_PROVIDED_AL2(),
+		Code:    awslambda.Code_FromAsset(jsii.String("../lambda/websocket"), nil),
+		Handler: jsii.String("bootstrap"),
+		Environment: jwtEnvironment(),
+	})
+	table.GrantReadWriteData(webSocketFunction)
+
+	webSocketIntegration := func(id string) *awsapigatewayv2.WebSocketRouteOptions {
+		return &awsapigatewayv2.WebSocketRouteOptions{
+			Integration: awsapigatewayv2integrations.NewWebSocketLambdaIntegration(jsii.String(id), webSocketFunction, nil),
+		}
+	}
+	webSocketApi := awsapigatewayv2.NewWebSocketApi(stack, jsii.String("TaskWebSocketApi"), &awsapigatewayv2.WebSocketApiProps{
+		ConnectRouteOptions:    webSocketIntegration("ConnectIntegration"),
+		DisconnectRouteOptions: webSocketIntegration("DisconnectIntegration"),
+	})
+	webSocketApi.AddRoute(jsii.String("subscribe"), webSocketIntegration("SubscribeIntegration"))
+	webSocketApi.AddRoute(jsii.String("unsubscribe"), webSocketIntegration("UnsubscribeIntegration"))
+	webSocketStage := awsapigatewayv2.NewWebSocketStage(stack, jsii.String("TaskWebSocketStage"), &awsapigatewayv2.WebSocketStageProps{
+		WebSocketApi: webSocketApi,
+		StageName:    jsii.String("prod"),
+		AutoDeploy:   jsii.Bool(true),
+	})
+
+	// Domain events relayed from the outbox
+	eventBus := awsevents.NewEventBus(stack, jsii.String("TaskEventBus"), &awsevents.EventBusProps{
+		EventBusName: jsii.String("TaskEvents"),
+	})
+
+	// Webhook deliveries are queued by the stream function and retried with a growing delay
+	webhookDeadLetterQueue := awssqs.NewQueue(stack, jsii.String("TaskWebhookDeadLetterQueue"), &awssqs.QueueProps{
+		RetentionPeriod: awscdk.Duration_Days(jsii.Number(14)),
+	})
+	webhookQueue := awssqs.NewQueue(stack, jsii.String("TaskWebhookQueue"), &awssqs.QueueProps{
+		VisibilityTimeout: awscdk.Duration_Minutes(jsii.Number(1)),
+		DeadLetterQueue: &awssqs.DeadLetterQueue{
+			Queue:           webhookDeadLetterQueue,
+			MaxReceiveCount: jsii.Number(5),
+		},
+	})
+	webhookFunction := awslambda.NewFunction(stack, jsii.String("TaskWebhookFunction"), &awslambda.FunctionProps{
+		Runtime: awslambda.Runtime_PROVIDED_AL2(),
+		Code:    awslambda.Code_FromAsset(jsii.String("../lambda/webhook"), nil),
+		Handler: jsii.String("bootstrap"),
+		Timeout: awscdk.Duration_Seconds(jsii.Number(30)),
+		Environment: &map[string]*string{
+			"WEBHOOK_QUEUE_URL": webhookQueue.QueueUrl(),
+		},
+	})
+	table.GrantReadWriteData(webhookFunction)
+	webhookQueue.GrantSendMessages(webhookFunction)
+	webhookFunction.AddEventSource(awslambdaeventsources.NewSqsEventSource(webhookQueue, &awslambdaeventsources.SqsEventSourceProps{
+		BatchSize:               jsii.Number(10),
+		ReportBatchItemFailures: jsii.Bool(true),
+	}))
+
+	// Consume the table stream and publish task-level change events
+	streamDeadLetterQueue := awssqs.NewQueue(stack, jsii.String("TaskStreamDeadLetterQueue"), &awssqs.QueueProps{
+		RetentionPeriod: awscdk.Duration_Days(jsii.Number(14)),
+	})
+	streamFunction := awslambda.NewFunction(stack, jsii.String("TaskStreamFunction"), &awslambda.FunctionProps{
+		Runtime: awslambda.Runtime_PROVIDED_AL2(),
+		Code:    awslambda.Code_FromAsset(jsii.String("../lambda/stream"), nil),
+		Handler: jsii.String("bootstrap"),
+		// Tag rename and merge jobs rewrite a batch of tasks per invocation
+		Timeout: awscdk.Duration_Minutes(jsii.Number(1)),
+		Environment: &map[string]*string{
+			"EVENT_BUS_NAME":     eventBus.EventBusName(),
+			"WEBSOCKET_ENDPOINT": webSocketStage.CallbackUrl(),
+			"WEBHOOK_QUEUE_URL":  webhookQueue.QueueUrl(),
+		},
+	})
+	webhookQueue.GrantSendMessages(streamFunction)
+	table.GrantReadWriteData(streamFunction)
+	eventBus.GrantPutEventsTo(streamFunction)
+	webSocketApi.GrantManageConnections(streamFunction)
+	streamFunction.AddEventSource(awslambdaeventsources.NewDynamoEventSource(table, &awslambdaeventsources.DynamoEventSourceProps{
+		StartingPosition:   awslambda.StartingPosition_TRIM_HORIZON,
+		BatchSize:          jsii.Number(100),
+		BisectBatchOnError: jsii.Bool(true),
+		RetryAttempts:      jsii.Number(5),
+		// Records that still fail are sent here; their outbox events are re-published by the sweeper
+		OnFailure: awslambdaeventsources.NewSqsDlq(streamDeadLetterQueue),
+	}))
+
+	// Create scheduled occurrences of recurring tasks
+	schedulerFunction := awslambda.NewFunction(stack, jsii.String("TaskSchedulerFunction"), &awslambda.FunctionProps{
+		Runtime: awslambda.Runtime_PROVIDED_AL2(),
+		Code:    awslambda.Code_FromAsset(jsii.String("../lambda/scheduler"), nil),
+		Handler: jsii.String("bootstrap"),
+		Timeout: awscdk.Duration_Minutes(jsii.Number(5)),
+		Environment: &map[string]*string{
+			"EVENT_BUS_NAME": eventBus.EventBusName(),
+		},
+	})
+	table.GrantReadWriteData(schedulerFunction)
+	eventBus.GrantPutEventsTo(schedulerFunction)
+	awsevents.NewRule(stack, jsii.String("TaskSchedulerRule"), &awsevents.RuleProps{
+		Schedule: awsevents.Schedule_Rate(awscdk.Duration_Hours(jsii.Number(1))),
+		Targets: &[]awsevents.IRuleTarget{
+			awseventstargets.NewLambdaFunction(schedulerFunction, nil),
+		},
+	})
+	// Re-publish outbox events the stream function did not relay
+	awsevents.NewRule(stack, jsii.String("TaskOutboxSweepRule"), &awsevents.RuleProps{
+		Schedule: awsevents.Schedule_Rate(awscdk.Duration_Minutes(jsii.Number(5))),
+		Targets: &[]awsevents.IRuleTarget{
+			awseventstargets.NewLambdaFunction(schedulerFunction, &awseventstargets.LambdaFunctionProps{
+				Event: awsevents.RuleTargetInput_FromObject(map[string]string{"task": "sweepOutbox"}),
+			}),
+		},
+	})
+
 	return stack
 }
 
@@ -74,6 +203,19 @@ func main() {
 	app.Synth(nil)
 }
 
+// Tokens are verified against the JWKS, issuer and audience from .env; synth fails if any is missing
+func jwtEnvironment() *map[string]*string {
+	environment := map[string]*string{}
+	for _, name := range []string{"JWKS", "JWT_ISSUER", "JWT_AUDIENCE"} {
+		value := os.Getenv(name)
+		if value == "" {
+			log.Fatalf("%s is required in .env", name)
+		}
+		environment[name] = jsii.String(value)
+	}
+	return &environment
+}
+
 func env() *awscdk.Environment {
 	awsAccountId := os.Getenv("AWS_ACCOUNT_ID")
 	awsRegion := os.Getenv("AWS_REGION")
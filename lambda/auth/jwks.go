@@ -0,0 +1,137 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"time"
+)
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type jsonWebKeySet struct {
+	Keys []jsonWebKey `json:"keys"`
+}
+
+// kidごとの公開鍵
+type KeySet map[string]crypto.PublicKey
+
+func ParseKeySet(data []byte) (KeySet, error) {
+	jwks := jsonWebKeySet{}
+	if err := json.Unmarshal(data, &jwks); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal JWKS: %v", err)
+	}
+
+	keys := KeySet{}
+	for _, k := range jwks.Keys {
+		switch k.Kty {
+		case "RSA":
+			key, err := rsaPublicKey(k)
+			if err != nil {
+				return nil, fmt.Errorf("invalid RSA key %q: %v", k.Kid, err)
+			}
+			keys[k.Kid] = key
+		case "EC":
+			key, err := ecdsaPublicKey(k)
+			if err != nil {
+				return nil, fmt.Errorf("invalid EC key %q: %v", k.Kid, err)
+			}
+			keys[k.Kid] = key
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no supported keys in JWKS")
+	}
+	return keys, nil
+}
+
+func LoadKeySetFile(path string) (KeySet, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseKeySet(data)
+}
+
+func rsaPublicKey(k jsonWebKey) (*rsa.PublicKey, error) {
+	n, err := base64.RawURLEncoding.DecodeString(k.N)
+	if err != nil {
+		return nil, err
+	}
+	e, err := base64.RawURLEncoding.DecodeString(k.E)
+	if err != nil {
+		return nil, err
+	}
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(n),
+		E: int(new(big.Int).SetBytes(e).Int64()),
+	}, nil
+}
+
+func ecdsaPublicKey(k jsonWebKey) (*ecdsa.PublicKey, error) {
+	if k.Crv != "P-256" {
+		return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+	}
+	x, err := base64.RawURLEncoding.DecodeString(k.X)
+	if err != nil {
+		return nil, err
+	}
+	y, err := base64.RawURLEncoding.DecodeString(k.Y)
+	if err != nil {
+		return nil, err
+	}
+	key := &ecdsa.PublicKey{
+		Curve: elliptic.P256(),
+		X:     new(big.Int).SetBytes(x),
+		Y:     new(big.Int).SetBytes(y),
+	}
+	if _, err := key.ECDH(); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// 環境変数JWKSまたはJWKS_FILEの鍵と、JWT_ISSUER・JWT_AUDIENCEで検証する。いずれかが欠けている場合はエラー
+func NewVerifierFromEnv() (*Verifier, error) {
+	issuer, audience := os.Getenv("JWT_ISSUER"), os.Getenv("JWT_AUDIENCE")
+	if issuer == "" || audience == "" {
+		return nil, errors.New("JWT_ISSUER and JWT_AUDIENCE are required")
+	}
+
+	var keys KeySet
+	var err error
+	switch {
+	case os.Getenv("JWKS") != "":
+		keys, err = ParseKeySet([]byte(os.Getenv("JWKS")))
+	case os.Getenv("JWKS_FILE") != "":
+		keys, err = LoadKeySetFile(os.Getenv("JWKS_FILE"))
+	default:
+		err = errors.New("JWKS or JWKS_FILE is required")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &Verifier{
+		Keys:     keys,
+		Issuer:   issuer,
+		Audience: audience,
+		Leeway:   30 * time.Second,
+	}, nil
+}
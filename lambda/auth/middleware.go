@@ -0,0 +1,95 @@
+package auth
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+type Handler func(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error)
+
+type Middleware func(next Handler) Handler
+
+type Principal struct {
+	Subject  string
+	TenantID string
+	Roles    []string
+}
+
+// マシン間連携用のAPIキーを検証する。無効なキーの場合はエラーを返す
+type APIKeyAuthenticator func(token string) (*Principal, error)
+
+// 検証済みの呼び出し元をオーソライザーコンテキストに書き込み、タスクのハンドラーから参照できるようにする
+func Authenticate(verifier *Verifier, apiKeys APIKeyAuthenticator) Middleware {
+	return func(next Handler) Handler {
+		return func(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+			scheme, token, ok := credentials(request.Headers)
+			if !ok {
+				return unauthorized("", "Missing credentials"), nil
+			}
+
+			var principal *Principal
+			switch {
+			case strings.EqualFold(scheme, "Bearer"):
+				// 鍵を読み込めなかった場合はトークンをすべて拒否する
+				if verifier == nil {
+					return unauthorized("invalid_token", "Token verification is not configured"), nil
+				}
+				claims, err := verifier.Verify(token)
+				if err != nil {
+					return unauthorized("invalid_token", err.Error()), nil
+				}
+				principal = &Principal{Subject: claims.Subject, TenantID: claims.TenantID, Roles: claims.Roles}
+			case strings.EqualFold(scheme, "ApiKey") && apiKeys != nil:
+				p, err := apiKeys(token)
+				if err != nil {
+					return unauthorized("invalid_token", err.Error()), nil
+				}
+				principal = p
+			default:
+				return unauthorized("", "Unsupported authorization scheme"), nil
+			}
+
+			request.RequestContext.Authorizer = map[string]interface{}{
+				"principalId": principal.Subject,
+				"tenantId":    principal.TenantID,
+				"roles":       strings.Join(principal.Roles, ","),
+			}
+			return next(request)
+		}
+	}
+}
+
+func credentials(headers map[string]string) (string, string, bool) {
+	value := headerValue(headers, "Authorization")
+	scheme, token, found := strings.Cut(value, " ")
+	token = strings.TrimSpace(token)
+	if !found || token == "" {
+		return "", "", false
+	}
+	return scheme, token, true
+}
+
+// API Gatewayはヘッダー名の大文字小文字を保持するため、区別せずに探す
+func headerValue(headers map[string]string, name string) string {
+	for k, v := range headers {
+		if strings.EqualFold(k, name) {
+			return v
+		}
+	}
+	return ""
+}
+
+func unauthorized(code string, description string) events.APIGatewayProxyResponse {
+	challenge := `Bearer realm="task-management"`
+	if code != "" {
+		challenge += fmt.Sprintf(`, error="%s", error_description="%s"`, code, strings.ReplaceAll(description, `"`, `'`))
+	}
+	return events.APIGatewayProxyResponse{
+		StatusCode: http.StatusUnauthorized,
+		Headers:    map[string]string{"WWW-Authenticate": challenge},
+		Body:       "Unauthorized",
+	}
+}
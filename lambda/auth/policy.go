@@ -0,0 +1,153 @@
+package auth
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+type Role int
+
+const (
+	NoRole Role = iota
+	Viewer
+	Editor
+	Admin
+)
+
+var roleNames = map[string]Role{
+	"viewer": Viewer,
+	"editor": Editor,
+	"admin":  Admin,
+}
+
+func (r Role) String() string {
+	for name, role := range roleNames {
+		if role == r {
+			return name
+		}
+	}
+	return "none"
+}
+
+// 操作ごとに必要なロール
+type Policy map[string]Role
+
+var DefaultPolicy = Policy{
+	"task:read":         Viewer,
+	"task:create":       Editor,
+	"task:update":       Editor,
+	"task:move":         Editor,
+	"task:delete":       Admin,
+	"task:bulk":         Admin,
+	"comment:read":      Viewer,
+	"comment:create":    Editor,
+	"comment:update":    Editor,
+	"comment:delete":    Editor,
+	"tag:read":          Viewer,
+	"tag:create":        Editor,
+	"tag:update":        Editor,
+	"tag:rewrite":       Admin,
+	"job:read":          Viewer,
+	"job:resume":        Admin,
+	"project:read":      Viewer,
+	"project:create":    Admin,
+	"project:update":    Admin,
+	"project:archive":   Admin,
+	"field:define":      Admin,
+	"recurrence:read":   Viewer,
+	"recurrence:create": Editor,
+	"recurrence:delete": Editor,
+	"template:read":     Viewer,
+	"template:create":   Editor,
+	"template:update":   Editor,
+	"template:delete":   Editor,
+	"time:read":         Viewer,
+	"time:track":        Editor,
+	"time:report":       Viewer,
+	"apikey:create":     Admin,
+	"apikey:read":       Admin,
+	"apikey:revoke":     Admin,
+	"webhook:create":    Admin,
+	"webhook:read":      Admin,
+	"webhook:update":    Admin,
+	"webhook:delete":    Admin,
+	// バッチ内の各リクエストはそれぞれの操作で認可する
+	"batch:execute": Viewer,
+}
+
+// ロールは"editor"のようにテナント全体、または"editor:WEB"のようにプロジェクト単位で付与する
+func EffectiveRole(roles []string, project string) Role {
+	effective := NoRole
+	for _, r := range roles {
+		name, scope, scoped := strings.Cut(strings.TrimSpace(r), ":")
+		if scoped && (project == "" || scope != project) {
+			continue
+		}
+		if role := roleNames[name]; role > effective {
+			effective = role
+		}
+	}
+	return effective
+}
+
+// 許可されない場合は理由を返す
+func (p Policy) Check(action string, roles []string, project string) error {
+	required, ok := p[action]
+	if !ok {
+		return fmt.Errorf("action %s is not allowed", action)
+	}
+	if role := EffectiveRole(roles, project); role < required {
+		if project != "" {
+			return fmt.Errorf("role %s is required for %s in project %s", required, action, project)
+		}
+		return fmt.Errorf("role %s is required for %s", required, action)
+	}
+	return nil
+}
+
+type ProjectResolver func(request events.APIGatewayProxyRequest) (string, error)
+
+// テナント全体のロールで足りない場合のみ、プロジェクトを特定してプロジェクト単位のロールを確認する
+func Authorize(policy Policy, action string, resolveProject ProjectResolver) Middleware {
+	return func(next Handler) Handler {
+		return func(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+			roles := []string{}
+			if value, _ := request.RequestContext.Authorizer["roles"].(string); value != "" {
+				roles = strings.Split(value, ",")
+			}
+
+			err := policy.Check(action, roles, "")
+			if err != nil && hasScopedRole(roles) && resolveProject != nil {
+				project, resolveErr := resolveProject(request)
+				if resolveErr != nil {
+					return events.APIGatewayProxyResponse{
+						StatusCode: http.StatusInternalServerError,
+						Body:       fmt.Sprintf("Failed to resolve project: %v", resolveErr),
+					}, nil
+				}
+				if project != "" {
+					err = policy.Check(action, roles, project)
+				}
+			}
+			if err != nil {
+				return events.APIGatewayProxyResponse{
+					StatusCode: http.StatusForbidden,
+					Body:       fmt.Sprintf("Forbidden: %v", err),
+				}, nil
+			}
+			return next(request)
+		}
+	}
+}
+
+func hasScopedRole(roles []string) bool {
+	for _, r := range roles {
+		if strings.Contains(r, ":") {
+			return true
+		}
+	}
+	return false
+}
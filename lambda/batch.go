@@ -0,0 +1,504 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+
+	"task-management-app/lambda/task"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+const (
+	BatchSequential = "sequential"
+	BatchParallel   = "parallel"
+
+	// 1回のバッチで送れるリクエスト数の上限
+	maxBatchRequests = 25
+	// 一括で書き込む場合は1つのトランザクションに収める必要がある
+	maxAtomicWrites = 100
+)
+
+type batchRequest struct {
+	Requests []subRequest `json:"requests"`
+	// sequentialは配列の順に1件ずつ、parallelは依存関係のないリクエストを並行して実行する
+	Order string `json:"order"`
+	// すべて成功した場合だけ書き込む。順に実行し、最初に失敗したリクエストで止める
+	Atomic bool `json:"atomic"`
+}
+
+type subRequest struct {
+	ID      string            `json:"id"`
+	Method  string            `json:"method"`
+	Path    string            `json:"path"`
+	Query   map[string]string `json:"query"`
+	Headers map[string]string `json:"headers"`
+	// JSONの値はそのまま、文字列は中身をリクエストのボディにする
+	Body json.RawMessage `json:"body"`
+	// 先に成功している必要があるリクエストのID。配列の前にあるリクエストだけを指定できる
+	DependsOn []string `json:"dependsOn"`
+}
+
+type subResponse struct {
+	ID      string            `json:"id"`
+	Status  int               `json:"status"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    json.RawMessage   `json:"body,omitempty"`
+}
+
+type batchResponse struct {
+	Responses []subResponse `json:"responses"`
+	// 一括で書き込む場合に、書き込みが確定したか
+	Committed *bool `json:"committed,omitempty"`
+}
+
+// /batch自身を参照するとroutesの初期化が循環するため、ここで追加する
+func init() {
+	routes = append(routes, route{method: "POST", path: "/batch", action: "batch:execute", handler: batch})
+}
+
+// 複数のAPI呼び出しをまとめて実行し、リクエストごとのレスポンスを返す
+// 各リクエストは通常のリクエストと同じルーターと認可を通り、認証はバッチのリクエストのものを引き継ぐ
+func batch(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	body := batchRequest{}
+	if err := json.Unmarshal([]byte(request.Body), &body); err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       fmt.Sprintf("Failed to unmarshal request: %v", err),
+		}, nil
+	}
+	if err := validateBatch(&body); err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       err.Error(),
+		}, nil
+	}
+
+	var result batchResponse
+	if body.Atomic {
+		result = executeAtomic(task.Svc, request, body.Requests)
+	} else {
+		result = batchResponse{Responses: executeBatch(request, body.Requests, body.Order == BatchParallel)}
+	}
+
+	response, err := json.Marshal(result)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to marshal response: %v", err),
+		}, nil
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: http.StatusOK,
+		Body:       string(response),
+	}, nil
+}
+
+// IDのないリクエストには配列の位置をIDにする
+func validateBatch(body *batchRequest) error {
+	if len(body.Requests) == 0 {
+		return errors.New("Missing requests")
+	}
+	if len(body.Requests) > maxBatchRequests {
+		return fmt.Errorf("Too many requests: %d (max %d)", len(body.Requests), maxBatchRequests)
+	}
+	switch body.Order {
+	case "":
+		body.Order = BatchSequential
+	case BatchSequential, BatchParallel:
+	default:
+		return fmt.Errorf("Unknown order: %s", body.Order)
+	}
+	if body.Atomic && body.Order == BatchParallel {
+		return errors.New("Atomic batches run sequentially")
+	}
+
+	seen := map[string]bool{}
+	for i := range body.Requests {
+		r := &body.Requests[i]
+		if r.ID == "" {
+			r.ID = strconv.Itoa(i)
+		}
+		if seen[r.ID] {
+			return fmt.Errorf("Duplicate request id: %s", r.ID)
+		}
+		for _, d := range r.DependsOn {
+			if !seen[d] {
+				return fmt.Errorf("Request %s depends on %s, which must come before it", r.ID, d)
+			}
+		}
+		seen[r.ID] = true
+		if r.Method == "" || r.Path == "" {
+			return fmt.Errorf("Missing method or path in request %s", r.ID)
+		}
+		if _, ok := matchPath("/batch", r.Path); ok {
+			return errors.New("Batches cannot be nested")
+		}
+	}
+	if body.Atomic {
+		return validateAtomic(body.Requests)
+	}
+	return nil
+}
+
+// 一括で書き込む場合、前のリクエストの書き込みは後のリクエストから見えない
+// タスクを作成・削除するリクエストと同じタスクを対象にするリクエストは、結果が書き込みの順序に依存するため受け付けない
+func validateAtomic(requests []subRequest) error {
+	lifecycle := map[string]string{}
+	targets := map[string]string{}
+	for _, r := range requests {
+		if len(r.DependsOn) > 0 {
+			return fmt.Errorf("Request %s depends on other requests, which cannot see each other's writes in an atomic batch", r.ID)
+		}
+		taskId, changesLifecycle := atomicTarget(r)
+		if taskId == "" {
+			continue
+		}
+		if other, ok := lifecycle[taskId]; ok {
+			return fmt.Errorf("Requests %s and %s both use task %s, which %s creates or deletes in the same atomic batch", other, r.ID, taskId, other)
+		}
+		if other, ok := targets[taskId]; ok && changesLifecycle {
+			return fmt.Errorf("Requests %s and %s both use task %s, which %s creates or deletes in the same atomic batch", other, r.ID, taskId, r.ID)
+		}
+		targets[taskId] = r.ID
+		if changesLifecycle {
+			lifecycle[taskId] = r.ID
+		}
+	}
+	return nil
+}
+
+// リクエストが対象にするタスクと、そのタスクを作成または削除するか
+func atomicTarget(r subRequest) (string, bool) {
+	if _, ok := matchPath("/tasks", r.Path); ok && r.Method == "POST" {
+		body := struct {
+			ID string `json:"id"`
+		}{}
+		var text string
+		if json.Unmarshal(r.Body, &text) == nil {
+			json.Unmarshal([]byte(text), &body)
+		} else {
+			json.Unmarshal(r.Body, &body)
+		}
+		return body.ID, body.ID != ""
+	}
+	parts := strings.Split(strings.Trim(r.Path, "/"), "/")
+	if len(parts) < 2 || parts[0] != "tasks" || parts[1] == "bulk" {
+		return "", false
+	}
+	return parts[1], len(parts) == 2 && r.Method == "DELETE"
+}
+
+// 依存先が成功したリクエストだけを実行する。並行して実行する場合も依存先の完了を待つ
+func executeBatch(request events.APIGatewayProxyRequest, requests []subRequest, parallel bool) []subResponse {
+	responses := make([]subResponse, len(requests))
+	index := map[string]int{}
+	done := make([]chan struct{}, len(requests))
+	for i, r := range requests {
+		index[r.ID] = i
+		done[i] = make(chan struct{})
+	}
+
+	run := func(i int) {
+		defer close(done[i])
+		r := requests[i]
+		for _, d := range r.DependsOn {
+			<-done[index[d]]
+			if !succeeded(responses[index[d]].Status) {
+				responses[i] = textResponse(r.ID, http.StatusFailedDependency, fmt.Sprintf("Dependency %s failed", d))
+				return
+			}
+		}
+		responses[i] = executeSubRequest(request, r)
+	}
+
+	if !parallel {
+		for i := range requests {
+			run(i)
+		}
+		return responses
+	}
+	var wg sync.WaitGroup
+	for i := range requests {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			run(i)
+		}(i)
+	}
+	wg.Wait()
+	return responses
+}
+
+// 書き込みをバッファーにため、すべて成功した場合に1つのトランザクションで書き込む
+// 各リクエストにはバッファーを書き込み先のクライアントとして渡し、読み取りはsvcから行う
+func executeAtomic(svc dynamodbiface.DynamoDBAPI, request events.APIGatewayProxyRequest, requests []subRequest) batchResponse {
+	buffer := &transactionBuffer{DynamoDBAPI: svc}
+	request = task.WithClient(request, buffer)
+
+	responses := make([]subResponse, len(requests))
+	failed := -1
+	for i, r := range requests {
+		if failed >= 0 {
+			responses[i] = textResponse(r.ID, http.StatusFailedDependency, fmt.Sprintf("Not executed because request %s failed", requests[failed].ID))
+			continue
+		}
+		buffer.request = r.ID
+		responses[i] = executeSubRequest(request, r)
+		if !succeeded(responses[i].Status) {
+			failed = i
+		}
+	}
+
+	rollback := func(status int, message string) batchResponse {
+		for i := range responses {
+			if succeeded(responses[i].Status) {
+				responses[i] = textResponse(responses[i].ID, status, message)
+			}
+		}
+		return batchResponse{Responses: responses, Committed: aws.Bool(false)}
+	}
+	if failed >= 0 {
+		return rollback(http.StatusFailedDependency, fmt.Sprintf("Rolled back because request %s failed", requests[failed].ID))
+	}
+
+	if err := buffer.commit(svc); err != nil {
+		var conflict *writeConflictError
+		if errors.Is(err, errTooManyWrites) || errors.As(err, &conflict) {
+			return rollback(http.StatusBadRequest, err.Error())
+		}
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeTransactionCanceledException {
+			return rollback(http.StatusConflict, fmt.Sprintf("Failed to commit batch: %v", err))
+		}
+		return rollback(http.StatusInternalServerError, fmt.Sprintf("Failed to commit batch: %v", err))
+	}
+	return batchResponse{Responses: responses, Committed: aws.Bool(true)}
+}
+
+// バッチのリクエストの認証情報を引き継いで、通常のルーターに渡す
+func executeSubRequest(request events.APIGatewayProxyRequest, r subRequest) subResponse {
+	headers := map[string]string{}
+	for k, v := range request.Headers {
+		headers[k] = v
+	}
+	for k, v := range r.Headers {
+		headers[k] = v
+	}
+
+	body := string(r.Body)
+	var text string
+	if json.Unmarshal(r.Body, &text) == nil {
+		body = text
+	}
+
+	query := map[string]string{}
+	for k, v := range r.Query {
+		query[k] = v
+	}
+
+	got, err := dispatch(routes, events.APIGatewayProxyRequest{
+		HTTPMethod:            r.Method,
+		Path:                  r.Path,
+		Headers:               headers,
+		QueryStringParameters: query,
+		Body:                  body,
+		RequestContext:        request.RequestContext,
+	})
+	if err != nil {
+		return textResponse(r.ID, http.StatusInternalServerError, err.Error())
+	}
+
+	response := subResponse{ID: r.ID, Status: got.StatusCode, Headers: got.Headers}
+	if got.Body != "" {
+		response.Body = jsonBody(got.Body)
+	}
+	return response
+}
+
+func textResponse(id string, status int, message string) subResponse {
+	return subResponse{ID: id, Status: status, Body: jsonBody(message)}
+}
+
+// JSONのボディはそのまま埋め込み、それ以外は文字列にする
+func jsonBody(body string) json.RawMessage {
+	if json.Valid([]byte(body)) {
+		return json.RawMessage(body)
+	}
+	quoted, _ := json.Marshal(body)
+	return quoted
+}
+
+func succeeded(status int) bool {
+	return status >= 200 && status < 300
+}
+
+var errTooManyWrites = fmt.Errorf("Too many writes for an atomic batch (max %d)", maxAtomicWrites)
+
+// 別々のリクエストが同じアイテムに書き込む場合、後のリクエストは前の書き込みを前提にできない
+type writeConflictError struct {
+	first, second, key string
+}
+
+func (e *writeConflictError) Error() string {
+	return fmt.Sprintf("Requests %s and %s both write %s; requests in an atomic batch cannot depend on each other's writes", e.first, e.second, e.key)
+}
+
+// 書き込みを実行せずにため、commitで1つのトランザクションにまとめて書き込むDynamoDBクライアント
+// 読み取りはそのまま元のクライアントに渡す
+type transactionBuffer struct {
+	dynamodbiface.DynamoDBAPI
+	mu sync.Mutex
+	// 書き込みをためているリクエストのID
+	request  string
+	items    []*dynamodb.TransactWriteItem
+	requests []string
+}
+
+func (b *transactionBuffer) add(items ...*dynamodb.TransactWriteItem) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for range items {
+		b.requests = append(b.requests, b.request)
+	}
+	b.items = append(b.items, items...)
+}
+
+// 1つのトランザクションでは同じアイテムに複数回書き込めない
+// 別々のリクエストが同じ条件で同じアイテムを確認するだけであれば1つにまとめ、それ以外は競合として返す
+func (b *transactionBuffer) merged() ([]*dynamodb.TransactWriteItem, error) {
+	items := []*dynamodb.TransactWriteItem{}
+	seen := map[string]int{}
+	for i, item := range b.items {
+		key := transactKey(item)
+		j, ok := seen[key]
+		if !ok {
+			seen[key] = len(items)
+			items = append(items, item)
+			continue
+		}
+		if item.ConditionCheck != nil && reflect.DeepEqual(item, items[j]) {
+			continue
+		}
+		if b.requests[i] == b.owner(items[j]) {
+			// 同じリクエストの書き込みはそのまま渡し、DynamoDBの検証に任せる
+			items = append(items, item)
+			continue
+		}
+		return nil, &writeConflictError{first: b.owner(items[j]), second: b.requests[i], key: key}
+	}
+	return items, nil
+}
+
+// アイテムを追加したリクエストのID
+func (b *transactionBuffer) owner(item *dynamodb.TransactWriteItem) string {
+	for i := range b.items {
+		if b.items[i] == item {
+			return b.requests[i]
+		}
+	}
+	return ""
+}
+
+func transactKey(item *dynamodb.TransactWriteItem) string {
+	var key map[string]*dynamodb.AttributeValue
+	switch {
+	case item.Put != nil:
+		key = item.Put.Item
+	case item.Update != nil:
+		key = item.Update.Key
+	case item.Delete != nil:
+		key = item.Delete.Key
+	case item.ConditionCheck != nil:
+		key = item.ConditionCheck.Key
+	}
+	return aws.StringValue(key["id"].S) + "/" + aws.StringValue(key["DataType"].S)
+}
+
+func (b *transactionBuffer) commit(svc dynamodbiface.DynamoDBAPI) error {
+	items, err := b.merged()
+	if err != nil {
+		return err
+	}
+	if len(items) == 0 {
+		return nil
+	}
+	if len(items) > maxAtomicWrites {
+		return errTooManyWrites
+	}
+	_, err = svc.TransactWriteItems(&dynamodb.TransactWriteItemsInput{TransactItems: items})
+	return err
+}
+
+func (b *transactionBuffer) TransactWriteItems(input *dynamodb.TransactWriteItemsInput) (*dynamodb.TransactWriteItemsOutput, error) {
+	b.add(input.TransactItems...)
+	return &dynamodb.TransactWriteItemsOutput{}, nil
+}
+
+func (b *transactionBuffer) PutItem(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	b.add(&dynamodb.TransactWriteItem{
+		Put: &dynamodb.Put{
+			TableName:                 input.TableName,
+			Item:                      input.Item,
+			ConditionExpression:       input.ConditionExpression,
+			ExpressionAttributeNames:  input.ExpressionAttributeNames,
+			ExpressionAttributeValues: input.ExpressionAttributeValues,
+		},
+	})
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+// 更新後の値は確定するまでわからないため、ReturnValuesを使う更新はまとめられない
+func (b *transactionBuffer) UpdateItem(input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	if rv := aws.StringValue(input.ReturnValues); rv != "" && rv != dynamodb.ReturnValueNone {
+		return nil, errors.New("update with return values is not supported in an atomic batch")
+	}
+	b.add(&dynamodb.TransactWriteItem{
+		Update: &dynamodb.Update{
+			TableName:                 input.TableName,
+			Key:                       input.Key,
+			UpdateExpression:          input.UpdateExpression,
+			ConditionExpression:       input.ConditionExpression,
+			ExpressionAttributeNames:  input.ExpressionAttributeNames,
+			ExpressionAttributeValues: input.ExpressionAttributeValues,
+		},
+	})
+	return &dynamodb.UpdateItemOutput{}, nil
+}
+
+func (b *transactionBuffer) DeleteItem(input *dynamodb.DeleteItemInput) (*dynamodb.DeleteItemOutput, error) {
+	b.add(&dynamodb.TransactWriteItem{
+		Delete: &dynamodb.Delete{
+			TableName:                 input.TableName,
+			Key:                       input.Key,
+			ConditionExpression:       input.ConditionExpression,
+			ExpressionAttributeNames:  input.ExpressionAttributeNames,
+			ExpressionAttributeValues: input.ExpressionAttributeValues,
+		},
+	})
+	return &dynamodb.DeleteItemOutput{}, nil
+}
+
+func (b *transactionBuffer) BatchWriteItem(input *dynamodb.BatchWriteItemInput) (*dynamodb.BatchWriteItemOutput, error) {
+	for table, requests := range input.RequestItems {
+		for _, r := range requests {
+			switch {
+			case r.PutRequest != nil:
+				b.add(&dynamodb.TransactWriteItem{Put: &dynamodb.Put{TableName: aws.String(table), Item: r.PutRequest.Item}})
+			case r.DeleteRequest != nil:
+				b.add(&dynamodb.TransactWriteItem{Delete: &dynamodb.Delete{TableName: aws.String(table), Key: r.DeleteRequest.Key}})
+			}
+		}
+	}
+	return &dynamodb.BatchWriteItemOutput{}, nil
+}
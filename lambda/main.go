@@ -1,19 +1,205 @@
 package main
 
 import (
-	"net/http"
+	"encoding/json"
+	"log"
+
+	"task-management-app/lambda/auth"
+	"task-management-app/lambda/task"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
 )
 
+var routes = []route{
+	{method: "POST", path: "/tasks", action: "task:create", handler: task.CreateTask, project: bodyProject},
+	{method: "GET", path: "/tasks", action: "task:read", handler: listTasks},
+	{method: "POST", path: "/tasks/bulk", action: "task:bulk", handler: task.BulkUpdateTasks},
+	{method: "GET", path: "/tasks/{id}", action: "task:read", handler: getTask, project: taskProject},
+	{method: "GET", path: "/changes", action: "task:read", handler: task.GetChanges},
+	{method: "DELETE", path: "/tasks/{id}", action: "task:delete", handler: task.DeleteTask, project: taskProject},
+	{method: "PUT", path: "/tasks/{id}/title", action: "task:update", handler: updateTaskAttribute("Title", "title"), project: taskProject},
+	{method: "PUT", path: "/tasks/{id}/description", action: "task:update", handler: updateTaskAttribute("Description", "description"), project: taskProject},
+	{method: "PUT", path: "/tasks/{id}/status", action: "task:update", handler: updateTaskAttribute("Status", "status"), project: taskProject},
+	{method: "POST", path: "/tasks/{id}/tags", action: "task:update", handler: task.AddTagToTask, project: taskProject},
+	{method: "PUT", path: "/tasks/{id}/tags", action: "task:update", handler: task.UpdateTagOnTask, project: taskProject},
+	{method: "PUT", path: "/tasks/{id}/fields/{name}", action: "task:update", handler: task.SetCustomField, project: taskProject},
+	{method: "PUT", path: "/tasks/{id}/project", action: "task:move", handler: auth.Authorize(auth.DefaultPolicy, "task:move", bodyProject)(task.MoveTask), project: taskProject},
+	{method: "POST", path: "/tasks/{id}/subtasks", action: "task:update", handler: task.AddSubtask, project: taskProject},
+	{method: "PUT", path: "/tasks/{id}/subtasks/order", action: "task:update", handler: task.ReorderSubtasks, project: taskProject},
+	{method: "DELETE", path: "/tasks/{id}/subtasks/{childId}", action: "task:update", handler: task.RemoveSubtask, project: taskProject},
+	{method: "POST", path: "/tasks/{id}/checklist", action: "task:update", handler: task.AddChecklistItem, project: taskProject},
+	{method: "PUT", path: "/tasks/{id}/checklist/{itemId}", action: "task:update", handler: task.UpdateChecklistItem, project: taskProject},
+	{method: "DELETE", path: "/tasks/{id}/checklist/{itemId}", action: "task:update", handler: task.DeleteChecklistItem, project: taskProject},
+	{method: "GET", path: "/tasks/{id}/dependencies", action: "task:read", handler: task.GetDependencies, project: taskProject},
+	{method: "POST", path: "/tasks/{id}/dependencies", action: "task:update", handler: task.AddDependency, project: taskProject},
+	{method: "DELETE", path: "/tasks/{id}/dependencies/{blockerId}", action: "task:update", handler: task.RemoveDependency, project: taskProject},
+	{method: "GET", path: "/tasks/{id}/history", action: "task:read", handler: task.GetHistory, project: taskProject},
+	{method: "GET", path: "/tasks/{id}/revisions/diff", action: "task:read", handler: task.DiffRevisions, project: taskProject},
+	{method: "GET", path: "/tasks/{id}/revisions/{n}", action: "task:read", handler: task.GetRevision, project: taskProject},
+	{method: "POST", path: "/tasks/{id}/revert", action: "task:update", handler: task.RevertTask, project: taskProject},
+	{method: "POST", path: "/tasks/{id}/sync", action: "task:update", handler: task.SyncTask, project: taskProject},
+	{method: "GET", path: "/tasks/{id}/comments", action: "comment:read", handler: task.GetComments, project: taskProject},
+	{method: "POST", path: "/tasks/{id}/comments", action: "comment:create", handler: task.CreateComment, project: taskProject},
+	{method: "PUT", path: "/tasks/{id}/comments/{commentId}", action: "comment:update", handler: task.UpdateComment, project: taskProject},
+	{method: "DELETE", path: "/tasks/{id}/comments/{commentId}", action: "comment:delete", handler: task.DeleteComment, project: taskProject},
+	{method: "GET", path: "/tasks/{id}/time", action: "time:read", handler: task.GetTimeEntries, project: taskProject},
+	{method: "POST", path: "/tasks/{id}/time", action: "time:track", handler: task.CreateTimeEntry, project: taskProject},
+	{method: "DELETE", path: "/tasks/{id}/time/{entryId}", action: "time:track", handler: task.DeleteTimeEntry, project: taskProject},
+	{method: "POST", path: "/tasks/{id}/timer/start", action: "time:track", handler: task.StartTimer, project: taskProject},
+	{method: "GET", path: "/timer", action: "time:read", handler: task.GetTimer, project: runningTimerProject},
+	{method: "POST", path: "/timer/stop", action: "time:track", handler: task.StopTimer, project: runningTimerProject},
+	{method: "GET", path: "/time/report", action: "time:report", handler: task.GetTimeReport},
+	{method: "POST", path: "/tags", action: "tag:create", handler: task.CreateTag},
+	{method: "GET", path: "/tags", action: "tag:read", handler: task.GetTags},
+	{method: "GET", path: "/tags/tree", action: "tag:read", handler: task.GetTagTree},
+	{method: "PUT", path: "/tags/{name}", action: "tag:update", handler: task.UpdateTag},
+	{method: "POST", path: "/tags/{name}/rename", action: "tag:rewrite", handler: task.RenameTag},
+	{method: "POST", path: "/tags/{name}/merge", action: "tag:rewrite", handler: task.MergeTag},
+	{method: "GET", path: "/jobs/{id}", action: "job:read", handler: task.GetJob},
+	{method: "POST", path: "/jobs/{id}/resume", action: "job:resume", handler: task.ResumeJob},
+	{method: "POST", path: "/projects", action: "project:create", handler: task.CreateProject},
+	{method: "GET", path: "/projects", action: "project:read", handler: task.GetProjects},
+	{method: "PUT", path: "/projects/{key}", action: "project:update", handler: task.UpdateProject, project: pathProject("key")},
+	{method: "PUT", path: "/projects/{key}/archive", action: "project:archive", handler: task.ArchiveProject, project: pathProject("key")},
+	{method: "GET", path: "/projects/{key}/fields", action: "project:read", handler: task.GetFieldDefinitions, project: pathProject("key")},
+	{method: "PUT", path: "/projects/{key}/fields/{name}", action: "field:define", handler: task.PutFieldDefinition, project: pathProject("key")},
+	{method: "DELETE", path: "/projects/{key}/fields/{name}", action: "field:define", handler: task.DeleteFieldDefinition, project: pathProject("key")},
+	{method: "GET", path: "/projects/{project}/tasks", action: "task:read", handler: listTasks, project: pathProject("project")},
+	{method: "POST", path: "/recurrences", action: "recurrence:create", handler: task.CreateRecurrence, project: bodyProject},
+	{method: "GET", path: "/recurrences", action: "recurrence:read", handler: task.GetRecurrences},
+	{method: "GET", path: "/recurrences/preview", action: "recurrence:read", handler: task.PreviewRecurrence},
+	{method: "GET", path: "/recurrences/{id}", action: "recurrence:read", handler: task.GetRecurrence, project: recurrenceProject},
+	{method: "GET", path: "/recurrences/{id}/preview", action: "recurrence:read", handler: task.PreviewRecurrence, project: recurrenceProject},
+	{method: "DELETE", path: "/recurrences/{id}", action: "recurrence:delete", handler: task.DeleteRecurrence, project: recurrenceProject},
+	{method: "POST", path: "/templates", action: "template:create", handler: task.CreateTemplate, project: bodyProject},
+	{method: "GET", path: "/templates", action: "template:read", handler: task.GetTemplates},
+	{method: "GET", path: "/templates/{id}", action: "template:read", handler: task.GetTemplate, project: templateProject},
+	{method: "PUT", path: "/templates/{id}", action: "template:update", handler: auth.Authorize(auth.DefaultPolicy, "template:update", bodyProject)(task.UpdateTemplate), project: templateProject},
+	{method: "DELETE", path: "/templates/{id}", action: "template:delete", handler: task.DeleteTemplate, project: templateProject},
+	{method: "POST", path: "/templates/{id}/instantiate", action: "task:create", handler: task.InstantiateTemplate, project: templateTargetProject},
+	{method: "POST", path: "/apikeys", action: "apikey:create", handler: task.CreateApiKey},
+	{method: "GET", path: "/apikeys", action: "apikey:read", handler: task.GetApiKeys},
+	{method: "DELETE", path: "/apikeys/{id}", action: "apikey:revoke", handler: task.RevokeApiKey},
+	{method: "POST", path: "/webhooks", action: "webhook:create", handler: task.CreateWebhook},
+	{method: "GET", path: "/webhooks", action: "webhook:read", handler: task.GetWebhooks},
+	{method: "DELETE", path: "/webhooks/{id}", action: "webhook:delete", handler: task.DeleteWebhook},
+	{method: "PUT", path: "/webhooks/{id}/enable", action: "webhook:update", handler: task.EnableWebhook},
+	{method: "GET", path: "/webhooks/{id}/deliveries", action: "webhook:read", handler: task.GetWebhookDeliveries},
+}
+
+var policy = auth.DefaultPolicy
+
 func handler(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
-	return events.APIGatewayProxyResponse{
-		Body:       "Invalid request",
-		StatusCode: http.StatusBadRequest,
-	}, nil
+	return dispatch(routes, request)
+}
+
+func getTask(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	return task.GetTaskById(task.TenantFromRequest(request), request.QueryStringParameters["id"])
+}
+
+func updateTaskAttribute(attributeKey string, attributeValue string) auth.Handler {
+	return func(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		return task.UpdateTaskAttribute(request, attributeKey, attributeValue)
+	}
+}
+
+// プロジェクト単位のロールは、サーバー側の状態または書き込む内容から特定したプロジェクトに対してだけ確認する
+// クライアントが任意に付けられるクエリパラメーターは使わない
+
+// パスの{id}のタスクが現在所属するプロジェクト
+func taskProject(request events.APIGatewayProxyRequest) (string, error) {
+	return task.ProjectOfTask(task.TenantFromRequest(request), request.PathParameters["id"])
+}
+
+// パスパラメーターで指定したプロジェクト
+func pathProject(name string) auth.ProjectResolver {
+	return func(request events.APIGatewayProxyRequest) (string, error) {
+		return request.PathParameters[name], nil
+	}
+}
+
+// 作成先・移動先として本文で指定したプロジェクト。指定がなければテナント全体のロールが必要
+func bodyProject(request events.APIGatewayProxyRequest) (string, error) {
+	body := struct {
+		Project string `json:"project"`
+	}{}
+	if err := json.Unmarshal([]byte(request.Body), &body); err != nil {
+		return "", nil
+	}
+	return body.Project, nil
+}
+
+// 繰り返しで作成するタスクの作成先
+func recurrenceProject(request events.APIGatewayProxyRequest) (string, error) {
+	return task.RecurrenceProject(task.TenantFromRequest(request), request.PathParameters["id"])
+}
+
+// テンプレートの既定の作成先
+func templateProject(request events.APIGatewayProxyRequest) (string, error) {
+	return task.TemplateProject(task.TenantFromRequest(request), request.PathParameters["id"])
+}
+
+// テンプレートから作成するタスクの作成先。指定がなければテンプレートの既定の作成先
+func templateTargetProject(request events.APIGatewayProxyRequest) (string, error) {
+	body := struct {
+		Project string `json:"project"`
+	}{}
+	if err := json.Unmarshal([]byte(request.Body), &body); err == nil && body.Project != "" {
+		return body.Project, nil
+	}
+	return templateProject(request)
+}
+
+// 止めるタイマーのタスクのプロジェクト
+func runningTimerProject(request events.APIGatewayProxyRequest) (string, error) {
+	identity := task.IdentityFromRequest(request)
+	return task.RunningTimerProject(identity.TenantID, identity.Subject)
+}
+
+// クエリパラメーターに応じて検索方法を切り替える
+func listTasks(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	query := request.QueryStringParameters
+	_, inProject := query["project"]
+
+	if _, ok := query["field"]; ok {
+		return task.GetTasksByCustomField(request)
+	}
+	if _, ok := query["tag"]; ok {
+		if inProject {
+			return task.GetTasksByTagInProject(request)
+		}
+		return task.GetTasksByTag(request)
+	}
+	for _, attributeKey := range []string{"Title", "Description", "Status"} {
+		if _, ok := query[attributeKey]; ok {
+			if inProject {
+				return task.GetTasksByAttributeInProject(request, attributeKey, attributeKey)
+			}
+			return task.GetTasksByAttribute(request, attributeKey, attributeKey)
+		}
+	}
+	return task.GetTasksByProject(request)
+}
+
+func authenticateApiKey(token string) (*auth.Principal, error) {
+	key, err := task.LookupApiKey(token)
+	if err != nil {
+		return nil, err
+	}
+	return &auth.Principal{Subject: "apikey:" + key.ID, TenantID: key.TenantID, Roles: key.Scopes}, nil
 }
 
 func main() {
-	lambda.Start(handler)
-}
\ No newline at end of file
+	// 設定に誤りがあってもAPIキーでは呼び出せるよう起動は続け、JWTはすべて拒否する
+	verifier, err := auth.NewVerifierFromEnv()
+	if err != nil {
+		log.Printf("JWT authentication is disabled: %v", err)
+	}
+
+	task.Svc = dynamodb.New(session.Must(session.NewSession()))
+
+	lambda.Start(auth.Authenticate(verifier, authenticateApiKey)(handler))
+}
@@ -1,14 +1,33 @@
 package main
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
 	"net/http"
+	"net/http/httptest"
 	"reflect"
-	"testing"
-	"task-management-app/lambda/task"
+	"strconv"
+	"strings"
+	"task-management-app/lambda/auth"
 	"task-management-app/lambda/mocks"
+	"task-management-app/lambda/task"
+	"testing"
+	"time"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
 	"github.com/golang/mock/gomock"
@@ -26,6 +45,20 @@ func newMockDynamoDBClient(ctrl *gomock.Controller) *mockDynamoDBClient {
 	return mock
 }
 
+// テスト用にオーソライザーのテナントIDを設定する
+func tenantContext(tenantId string) events.APIGatewayProxyRequestContext {
+	return events.APIGatewayProxyRequestContext{
+		Authorizer: map[string]interface{}{"tenantId": tenantId},
+	}
+}
+
+// テスト用にテナントIDとロールを設定する
+func callerContext(tenantId string, roles string) events.APIGatewayProxyRequestContext {
+	return events.APIGatewayProxyRequestContext{
+		Authorizer: map[string]interface{}{"principalId": "user-1", "tenantId": tenantId, "roles": roles},
+	}
+}
+
 // func setup() {
 // 	// 本番環境では実際のDynamoDBクライアントを使用する
 // 	svc = &mockDynamoDBClient{}
@@ -44,7 +77,7 @@ func Test_createTask(t *testing.T) {
 
 	// DynamoDBのモッククライアントを作成
 	mockDynamoDB := mockdb.NewMockDynamoDBAPI(ctrl)
-	mockDynamoDB.EXPECT().PutItem(gomock.Any()).Return(&dynamodb.PutItemOutput{}, nil).Times(1)
+	mockDynamoDB.EXPECT().TransactWriteItems(gomock.Any()).Return(&dynamodb.TransactWriteItemsOutput{}, nil).Times(1)
 
 	task.Svc = mockDynamoDB
 
@@ -61,8 +94,9 @@ func Test_createTask(t *testing.T) {
 			name: "Valid Request",
 			args: args{
 				request: events.APIGatewayProxyRequest{
-					Body:       "{\"id\":\"1\", \"dataType\":\"Description\", \"dataValue\":\"Task Title\"}",
-					HTTPMethod: "POST",
+					RequestContext: tenantContext("tenant1"),
+					Body:           "{\"id\":\"1\", \"title\":\"Task Title\", \"project\":\"WEB\"}",
+					HTTPMethod:     "POST",
 				},
 			},
 			want: events.APIGatewayProxyResponse{
@@ -71,6 +105,36 @@ func Test_createTask(t *testing.T) {
 			},
 			wantErr: false,
 		},
+		{
+			name: "Missing Project",
+			args: args{
+				request: events.APIGatewayProxyRequest{
+					RequestContext: tenantContext("tenant1"),
+					Body:           "{\"id\":\"2\", \"title\":\"Task Title\"}",
+					HTTPMethod:     "POST",
+				},
+			},
+			want: events.APIGatewayProxyResponse{
+				Body:       "Missing id or project in the task",
+				StatusCode: http.StatusBadRequest,
+			},
+			wantErr: false,
+		},
+		{
+			name: "Reserved ID",
+			args: args{
+				request: events.APIGatewayProxyRequest{
+					RequestContext: tenantContext("tenant1"),
+					Body:           "{\"id\":\"Outbox\", \"title\":\"Task Title\", \"project\":\"WEB\"}",
+					HTTPMethod:     "POST",
+				},
+			},
+			want: events.APIGatewayProxyResponse{
+				Body:       "Invalid task id",
+				StatusCode: http.StatusBadRequest,
+			},
+			wantErr: false,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -93,30 +157,28 @@ func Test_GetTaskById(t *testing.T) {
 
 	// DynamoDBのモッククライアントを作成
 	mockDynamoDB := mockdb.NewMockDynamoDBAPI(ctrl)
-	mockDynamoDB.EXPECT().Query(gomock.Any()).Return(&dynamodb.QueryOutput{
-		Items: []map[string]*dynamodb.AttributeValue{
-			{
-				"id":        {S: aws.String("1")},
-				"dataType":  {S: aws.String("Title")},
-				"dataValue": {S: aws.String("Task Title")},
-			},
-			{
-				"id":        {S: aws.String("1")},
-				"dataType":  {S: aws.String("Description")},
-				"dataValue": {S: aws.String("Description of the task1")},
-			},
-			{
-				"id":        {S: aws.String("2")},
-				"dataType":  {S: aws.String("Title")},
-				"dataValue": {S: aws.String("Task Title")},
-			},
-			{
-				"id":        {S: aws.String("2")},
-				"dataType":  {S: aws.String("Description")},
-				"dataValue": {S: aws.String("Description of the task2")},
-			},
+	mockDynamoDB.EXPECT().Query(gomock.Any()).DoAndReturn(rangeQuery([]map[string]*dynamodb.AttributeValue{
+		{
+			"id":        {S: aws.String("tenant1#1")},
+			"DataType":  {S: aws.String("Title")},
+			"DataValue": {S: aws.String("tenant1#Task Title")},
 		},
-	}, nil).Times(1) // 期待される呼び出し回数を指定
+		{
+			"id":        {S: aws.String("tenant1#1")},
+			"DataType":  {S: aws.String("Description")},
+			"DataValue": {S: aws.String("tenant1#Description of the task1")},
+		},
+		{
+			"id":        {S: aws.String("tenant1#2")},
+			"DataType":  {S: aws.String("Title")},
+			"DataValue": {S: aws.String("tenant1#Task Title")},
+		},
+		{
+			"id":        {S: aws.String("tenant1#2")},
+			"DataType":  {S: aws.String("Description")},
+			"DataValue": {S: aws.String("tenant1#Description of the task2")},
+		},
+	})).Times(3) // 期待される呼び出し回数を指定
 
 	task.Svc = mockDynamoDB
 
@@ -133,6 +195,7 @@ func Test_GetTaskById(t *testing.T) {
 			name: "Valid ID",
 			args: args{
 				request: events.APIGatewayProxyRequest{
+					RequestContext:        tenantContext("tenant1"),
 					QueryStringParameters: map[string]string{"id": "1"},
 					HTTPMethod:            "GET",
 				},
@@ -148,7 +211,7 @@ func Test_GetTaskById(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			taskID := tt.args.request.QueryStringParameters["id"]
-			got, err := task.GetTaskById(taskID)
+			got, err := task.GetTaskById("tenant1", taskID)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("getTasksById() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -166,57 +229,55 @@ func Test_getTasksByTag(t *testing.T) {
 	defer ctrl.Finish()
 
 	mockDynamoDB := mockdb.NewMockDynamoDBAPI(ctrl)
+	// 下位の階層のタグはカタログにない
+	mockDynamoDB.EXPECT().Query(gomock.Any()).Return(&dynamodb.QueryOutput{}, nil).Times(1)
 	mockDynamoDB.EXPECT().Query(gomock.Any()).Return(&dynamodb.QueryOutput{
 		Items: []map[string]*dynamodb.AttributeValue{
 			{
-				"id":        {S: aws.String("1")},
-				"dataType":  {S: aws.String("Tags")},
-				"dataValue": {S: aws.String("Tag1")},
+				"id":        {S: aws.String("tenant1#1")},
+				"DataType":  {S: aws.String("Tags#Tag1")},
+				"DataValue": {S: aws.String("tenant1#Tag1")},
 			},
 			{
-				"id":        {S: aws.String("2")},
-				"dataType":  {S: aws.String("Tags")},
-				"dataValue": {S: aws.String("Tag1")},
+				"id":        {S: aws.String("tenant1#2")},
+				"DataType":  {S: aws.String("Tags#Tag1")},
+				"DataValue": {S: aws.String("tenant1#Tag1")},
 			},
 		},
 	}, nil).Times(1)
 
-	mockDynamoDB.EXPECT().BatchGetItem(gomock.Any()).Return(&dynamodb.BatchGetItemOutput{
-		Responses: map[string][]map[string]*dynamodb.AttributeValue{
-			"TaskManagement": {
-				{
-					"id":        {S: aws.String("1")},
-					"dataType":  {S: aws.String("Title")},
-					"dataValue": {S: aws.String("Task Title")},
-				},
-				{
-					"id":        {S: aws.String("1")},
-					"dataType":  {S: aws.String("Tags")},
-					"dataValue": {S: aws.String("Tag1")},
-				},
-				{
-					"id":        {S: aws.String("1")},
-					"dataType":  {S: aws.String("Description")},
-					"dataValue": {S: aws.String("Description of the task1")},
-				},
-				{
-					"id":        {S: aws.String("2")},
-					"dataType":  {S: aws.String("Title")},
-					"dataValue": {S: aws.String("Task Title")},
-				},
-				{
-					"id":        {S: aws.String("2")},
-					"dataType":  {S: aws.String("Tags")},
-					"dataValue": {S: aws.String("Tag1")},
-				},
-				{
-					"id":        {S: aws.String("2")},
-					"dataType":  {S: aws.String("Description")},
-					"dataValue": {S: aws.String("Description of the task2")},
-				},
-			},
+	mockDynamoDB.EXPECT().Query(gomock.Any()).DoAndReturn(partitionQuery([]map[string]*dynamodb.AttributeValue{
+		{
+			"id":        {S: aws.String("tenant1#1")},
+			"DataType":  {S: aws.String("Title")},
+			"DataValue": {S: aws.String("tenant1#Task Title")},
 		},
-	}, nil).Times(1)
+		{
+			"id":        {S: aws.String("tenant1#1")},
+			"DataType":  {S: aws.String("Tags#Tag1")},
+			"DataValue": {S: aws.String("tenant1#Tag1")},
+		},
+		{
+			"id":        {S: aws.String("tenant1#1")},
+			"DataType":  {S: aws.String("Description")},
+			"DataValue": {S: aws.String("tenant1#Description of the task1")},
+		},
+		{
+			"id":        {S: aws.String("tenant1#2")},
+			"DataType":  {S: aws.String("Title")},
+			"DataValue": {S: aws.String("tenant1#Task Title")},
+		},
+		{
+			"id":        {S: aws.String("tenant1#2")},
+			"DataType":  {S: aws.String("Tags#Tag1")},
+			"DataValue": {S: aws.String("tenant1#Tag1")},
+		},
+		{
+			"id":        {S: aws.String("tenant1#2")},
+			"DataType":  {S: aws.String("Description")},
+			"DataValue": {S: aws.String("tenant1#Description of the task2")},
+		},
+	})).Times(4)
 
 	task.Svc = mockDynamoDB
 
@@ -233,6 +294,7 @@ func Test_getTasksByTag(t *testing.T) {
 			name: "Valid Tag",
 			args: args{
 				request: events.APIGatewayProxyRequest{
+					RequestContext:        tenantContext("tenant1"),
 					QueryStringParameters: map[string]string{"tag": "Tag1"},
 					HTTPMethod:            "GET",
 				},
@@ -264,7 +326,7 @@ func Test_addTagToTask(t *testing.T) {
 	defer ctrl.Finish()
 
 	mockDynamoDB := mockdb.NewMockDynamoDBAPI(ctrl)
-	mockDynamoDB.EXPECT().UpdateItem(gomock.Any()).Return(&dynamodb.UpdateItemOutput{}, nil).Times(1)
+	mockDynamoDB.EXPECT().TransactWriteItems(gomock.Any()).Return(&dynamodb.TransactWriteItemsOutput{}, nil).Times(1)
 
 	task.Svc = mockDynamoDB
 	type args struct {
@@ -280,8 +342,9 @@ func Test_addTagToTask(t *testing.T) {
 			name: "Valid Request",
 			args: args{
 				request: events.APIGatewayProxyRequest{
-					Body:       "{\"id\":\"1\", \"tag\":\"Tag1\"}",
-					HTTPMethod: "POST",
+					RequestContext: tenantContext("tenant1"),
+					Body:           "{\"id\":\"1\", \"tag\":\"Tag1\"}",
+					HTTPMethod:     "POST",
 				},
 			},
 			want: events.APIGatewayProxyResponse{
@@ -290,6 +353,21 @@ func Test_addTagToTask(t *testing.T) {
 			},
 			wantErr: false,
 		},
+		{
+			name: "Empty tag segment",
+			args: args{
+				request: events.APIGatewayProxyRequest{
+					RequestContext:        tenantContext("tenant1"),
+					QueryStringParameters: map[string]string{"id": "1", "tag": "area//db"},
+					HTTPMethod:            "POST",
+				},
+			},
+			want: events.APIGatewayProxyResponse{
+				Body:       "Tag name must not have empty segments: area//db",
+				StatusCode: http.StatusBadRequest,
+			},
+			wantErr: false,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -312,8 +390,60 @@ func Test_deleteTaskById(t *testing.T) {
 	mockDynamoDB := mockdb.NewMockDynamoDBAPI(ctrl)
 	task.Svc = mockDynamoDB
 
-	// DeleteItemの期待される呼び出しを設定
-	mockDynamoDB.EXPECT().DeleteItem(gomock.Any()).Return(&dynamodb.DeleteItemOutput{}, nil).Times(1)
+	// 先にタグを外し、タグのアイテムの削除と使用数の減算を同じトランザクションで行う
+	mockDynamoDB.EXPECT().Query(gomock.Any()).DoAndReturn(func(input *dynamodb.QueryInput) (*dynamodb.QueryOutput, error) {
+		if input.ExpressionAttributeValues[":prefix"] == nil || *input.ExpressionAttributeValues[":prefix"].S != "Tags#" {
+			t.Fatalf("tags must be queried before the partition is deleted, got %v", input)
+		}
+		return &dynamodb.QueryOutput{
+			Items: []map[string]*dynamodb.AttributeValue{
+				{"id": {S: aws.String("tenant1#1")}, "DataType": {S: aws.String("Tags#x")}},
+			},
+		}, nil
+	}).Times(1)
+	mockDynamoDB.EXPECT().TransactWriteItems(gomock.Any()).DoAndReturn(func(input *dynamodb.TransactWriteItemsInput) (*dynamodb.TransactWriteItemsOutput, error) {
+		if len(input.TransactItems) != 2 || *input.TransactItems[0].Delete.Key["DataType"].S != "Tags#x" ||
+			*input.TransactItems[1].Update.Key["id"].S != "tenant1#Tag#x" || *input.TransactItems[1].Update.ExpressionAttributeValues[":delta"].N != "-1" {
+			t.Errorf("tag x must be removed and its count decremented, got %v", input.TransactItems)
+		}
+		return &dynamodb.TransactWriteItemsOutput{}, nil
+	}).Times(1)
+
+	// タスクのアイテムとコメントをまとめて削除する
+	mockDynamoDB.EXPECT().Query(gomock.Any()).Return(&dynamodb.QueryOutput{
+		Items: []map[string]*dynamodb.AttributeValue{
+			{"id": {S: aws.String("tenant1#1")}, "DataType": {S: aws.String("Title")}},
+			{"id": {S: aws.String("tenant1#1")}, "DataType": {S: aws.String("Project")}},
+			{"id": {S: aws.String("tenant1#1")}, "DataType": {S: aws.String("Comment#00000000000000000001#abc")}},
+			{"id": {S: aws.String("tenant1#1")}, "DataType": {S: aws.String("Parent")}, "DataValue": {S: aws.String("tenant1#9")}},
+			{"id": {S: aws.String("tenant1#1")}, "DataType": {S: aws.String("Subtask#5")}},
+		},
+	}, nil).Times(1)
+	mockDynamoDB.EXPECT().BatchWriteItem(gomock.Any()).DoAndReturn(func(input *dynamodb.BatchWriteItemInput) (*dynamodb.BatchWriteItemOutput, error) {
+		keys := map[string]bool{}
+		for _, r := range input.RequestItems["TaskManagement"] {
+			keys[*r.DeleteRequest.Key["id"].S+"/"+*r.DeleteRequest.Key["DataType"].S] = true
+		}
+		// 親タスクのサブタスクの一覧と、子タスクの親も削除する
+		if len(keys) != 7 || !keys["tenant1#9/Subtask#1"] || !keys["tenant1#5/Parent"] {
+			t.Errorf("BatchWriteItem deletes = %v, want 5 items and the subtask links", keys)
+		}
+		return &dynamodb.BatchWriteItemOutput{}, nil
+	}).Times(1)
+	// 削除のイベントと変更ログをあわせて書き込む
+	mockDynamoDB.EXPECT().TransactWriteItems(gomock.Any()).DoAndReturn(func(input *dynamodb.TransactWriteItemsInput) (*dynamodb.TransactWriteItemsOutput, error) {
+		if len(input.TransactItems) != 2 {
+			t.Fatalf("len(TransactItems) = %d, want 2", len(input.TransactItems))
+		}
+		event, change := input.TransactItems[0].Put.Item, input.TransactItems[1].Put.Item
+		if *event["id"].S != "tenant1#Outbox" || !strings.Contains(*event["event"].S, "\"type\":\"TaskDeleted\"") {
+			t.Errorf("outbox item = %v, want TaskDeleted", event)
+		}
+		if *change["id"].S != "tenant1#Changes" || *change["taskId"].S != "1" || *change["type"].S != "delete" {
+			t.Errorf("change log item = %v, want deletion of 1", change)
+		}
+		return &dynamodb.TransactWriteItemsOutput{}, nil
+	}).Times(1)
 
 	type args struct {
 		id string
@@ -335,10 +465,33 @@ func Test_deleteTaskById(t *testing.T) {
 			},
 			wantErr: false,
 		},
+		{
+			// テナントのAPIキーなど、タスク以外のパーティションは削除しない
+			name: "Reserved Partition",
+			args: args{
+				id: "ApiKeys",
+			},
+			wantResponse: events.APIGatewayProxyResponse{
+				Body:       "Invalid task id",
+				StatusCode: http.StatusBadRequest,
+			},
+			wantErr: false,
+		},
+		{
+			name: "Partition With Separator",
+			args: args{
+				id: "Project#WEB",
+			},
+			wantResponse: events.APIGatewayProxyResponse{
+				Body:       "Invalid task id",
+				StatusCode: http.StatusBadRequest,
+			},
+			wantErr: false,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			gotResponse, err := task.DeleteTaskById(tt.args.id)
+			gotResponse, err := task.DeleteTaskById("tenant1", tt.args.id)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("deleteTaskById() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -350,13 +503,67 @@ func Test_deleteTaskById(t *testing.T) {
 	}
 }
 
+func Test_deleteTaskTags(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockDynamoDB := mockdb.NewMockDynamoDBAPI(ctrl)
+	task.Svc = mockDynamoDB
+
+	tags := []map[string]*dynamodb.AttributeValue{}
+	for i := 0; i < 60; i++ {
+		tags = append(tags, map[string]*dynamodb.AttributeValue{"id": {S: aws.String("tenant1#1")}, "DataType": {S: aws.String(fmt.Sprintf("Tags#t%02d", i))}})
+	}
+	// 1つのトランザクションは100アイテムまでなので、60個のタグは2回に分けて外す
+	// パーティションの削除に失敗した後の再実行では、外したタグの使用数を二重に減らさない
+	decremented := map[string]int{}
+	gomock.InOrder(
+		mockDynamoDB.EXPECT().Query(gomock.Any()).Return(&dynamodb.QueryOutput{Items: tags}, nil),
+		mockDynamoDB.EXPECT().TransactWriteItems(gomock.Any()).DoAndReturn(func(input *dynamodb.TransactWriteItemsInput) (*dynamodb.TransactWriteItemsOutput, error) {
+			for _, item := range input.TransactItems {
+				if item.Update != nil {
+					decremented[*item.Update.Key["id"].S]++
+				}
+			}
+			if len(input.TransactItems) > 100 {
+				t.Errorf("len(TransactItems) = %d, want at most 100", len(input.TransactItems))
+			}
+			return &dynamodb.TransactWriteItemsOutput{}, nil
+		}).Times(2),
+		mockDynamoDB.EXPECT().Query(gomock.Any()).Return(&dynamodb.QueryOutput{
+			Items: []map[string]*dynamodb.AttributeValue{{"id": {S: aws.String("tenant1#1")}, "DataType": {S: aws.String("Project")}}},
+		}, nil),
+		mockDynamoDB.EXPECT().BatchWriteItem(gomock.Any()).Return(nil, errors.New("throttled")),
+		mockDynamoDB.EXPECT().Query(gomock.Any()).Return(&dynamodb.QueryOutput{}, nil),
+		mockDynamoDB.EXPECT().Query(gomock.Any()).Return(&dynamodb.QueryOutput{
+			Items: []map[string]*dynamodb.AttributeValue{{"id": {S: aws.String("tenant1#1")}, "DataType": {S: aws.String("Project")}}},
+		}, nil),
+		mockDynamoDB.EXPECT().BatchWriteItem(gomock.Any()).Return(&dynamodb.BatchWriteItemOutput{}, nil),
+		mockDynamoDB.EXPECT().TransactWriteItems(gomock.Any()).Return(&dynamodb.TransactWriteItemsOutput{}, nil),
+	)
+
+	if got, _ := task.DeleteTaskById("tenant1", "1"); got.StatusCode != http.StatusInternalServerError {
+		t.Errorf("DeleteTaskById() status = %v, want 500", got.StatusCode)
+	}
+	if got, _ := task.DeleteTaskById("tenant1", "1"); got.StatusCode != http.StatusOK {
+		t.Errorf("DeleteTaskById() status = %v, want 200 on retry", got.StatusCode)
+	}
+	if len(decremented) != 60 {
+		t.Errorf("decremented %d tags, want 60", len(decremented))
+	}
+	for tag, n := range decremented {
+		if n != 1 {
+			t.Errorf("tag %s decremented %d times, want once", tag, n)
+		}
+	}
+}
+
 func Test_updateTagOnTask(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
 
 	mockDynamoDB := mockdb.NewMockDynamoDBAPI(ctrl)
 	task.Svc = mockDynamoDB
-	mockDynamoDB.EXPECT().UpdateItem(gomock.Any()).Return(&dynamodb.UpdateItemOutput{}, nil).Times(1)
+	mockDynamoDB.EXPECT().TransactWriteItems(gomock.Any()).Return(&dynamodb.TransactWriteItemsOutput{}, nil).Times(1)
 
 	type args struct {
 		request events.APIGatewayProxyRequest
@@ -371,8 +578,9 @@ func Test_updateTagOnTask(t *testing.T) {
 			name: "Valid Request",
 			args: args{
 				request: events.APIGatewayProxyRequest{
-					Body:       "{\"id\":\"1\", \"oldTag\":\"Tag1\", \"newTag\":\"Tag2\"}",
-					HTTPMethod: "PUT",
+					RequestContext: tenantContext("tenant1"),
+					Body:           "{\"id\":\"1\", \"oldTag\":\"Tag1\", \"newTag\":\"Tag2\"}",
+					HTTPMethod:     "PUT",
 				},
 			},
 			want: events.APIGatewayProxyResponse{
@@ -401,7 +609,10 @@ func Test_updateTaskAttribute(t *testing.T) {
 	defer ctrl.Finish()
 
 	mockDynamoDB := mockdb.NewMockDynamoDBAPI(ctrl)
-	mockDynamoDB.EXPECT().UpdateItem(gomock.Any()).Return(&dynamodb.UpdateItemOutput{}, nil).Times(1)
+	mockDynamoDB.EXPECT().GetItem(gomock.Any()).Return(&dynamodb.GetItemOutput{
+		Item: map[string]*dynamodb.AttributeValue{"DataValue": {S: aws.String("tenant1#Open")}},
+	}, nil).Times(1)
+	mockDynamoDB.EXPECT().TransactWriteItems(gomock.Any()).Return(&dynamodb.TransactWriteItemsOutput{}, nil).Times(1)
 
 	task.Svc = mockDynamoDB
 	type args struct {
@@ -419,8 +630,9 @@ func Test_updateTaskAttribute(t *testing.T) {
 			name: "Valid Request",
 			args: args{
 				request: events.APIGatewayProxyRequest{
-					Body:       "{\"id\":\"1\", \"attributeValue\":\"Completed\"}",
-					HTTPMethod: "PUT",
+					RequestContext: tenantContext("tenant1"),
+					Body:           "{\"id\":\"1\", \"attributeValue\":\"Completed\"}",
+					HTTPMethod:     "PUT",
 				},
 				attributeKey:   "Status",
 				attributeValue: "Completed",
@@ -454,66 +666,62 @@ func Test_getTasksByAttribute(t *testing.T) {
 
 	// Queryの期待される呼び出しを設定（引数を具体的に指定）
 	mockDynamoDB.EXPECT().Query(&dynamodb.QueryInput{
-    ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
-        ":dataValue": {S: aws.String("Task Title")},
-        ":dataType": {S: aws.String("Title")},
-    },
-    IndexName: aws.String("GSI1"),
-    KeyConditionExpression: aws.String("dataType = :dataType AND dataValue = :dataValue"),
-    TableName: aws.String("TaskManagement"),
-}).Return(&dynamodb.QueryOutput{
-    Items: []map[string]*dynamodb.AttributeValue{
-        {
-            "id":        {S: aws.String("1")},
-            "dataType":  {S: aws.String("Title")},
-            "dataValue": {S: aws.String("Task Title")},
-        },
-        {
-            "id":        {S: aws.String("2")},
-            "dataType":  {S: aws.String("Title")},
-            "dataValue": {S: aws.String("Task Title")},
-        },
-    },
-}, nil)
-
-
-	mockDynamoDB.EXPECT().BatchGetItem(gomock.Any()).Return(&dynamodb.BatchGetItemOutput{
-		Responses: map[string][]map[string]*dynamodb.AttributeValue{
-			"TaskManagement": {
-				{
-					"id":        {S: aws.String("1")},
-					"dataType":  {S: aws.String("Title")},
-					"dataValue": {S: aws.String("Task Title")},
-				},
-				{
-					"id":        {S: aws.String("1")},
-					"dataType":  {S: aws.String("Tags")},
-					"dataValue": {S: aws.String("Tag1")},
-				},
-				{
-					"id":        {S: aws.String("1")},
-					"dataType":  {S: aws.String("Description")},
-					"dataValue": {S: aws.String("Description of the task1")},
-			},
-			{
-					"id":        {S: aws.String("2")},
-					"dataType":  {S: aws.String("Title")},
-					"dataValue": {S: aws.String("Task Title")},
-			},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":dataValue": {S: aws.String("tenant1#Task Title")},
+			":dataType":  {S: aws.String("Title")},
+		},
+		IndexName:              aws.String("GSI1"),
+		KeyConditionExpression: aws.String("DataValue = :dataValue"),
+		FilterExpression:       aws.String("DataType = :dataType"),
+		TableName:              aws.String("TaskManagement"),
+	}).Return(&dynamodb.QueryOutput{
+		Items: []map[string]*dynamodb.AttributeValue{
 			{
-					"id":        {S: aws.String("2")},
-					"dataType":  {S: aws.String("Tags")},
-					"dataValue": {S: aws.String("Tag2")},
+				"id":        {S: aws.String("tenant1#1")},
+				"DataType":  {S: aws.String("Title")},
+				"DataValue": {S: aws.String("tenant1#Task Title")},
 			},
 			{
-					"id":        {S: aws.String("2")},
-					"dataType":  {S: aws.String("Description")},
-					"dataValue": {S: aws.String("Description of the task2")},
-			},
+				"id":        {S: aws.String("tenant1#2")},
+				"DataType":  {S: aws.String("Title")},
+				"DataValue": {S: aws.String("tenant1#Task Title")},
 			},
 		},
 	}, nil)
 
+	mockDynamoDB.EXPECT().Query(gomock.Any()).DoAndReturn(partitionQuery([]map[string]*dynamodb.AttributeValue{
+		{
+			"id":        {S: aws.String("tenant1#1")},
+			"DataType":  {S: aws.String("Title")},
+			"DataValue": {S: aws.String("tenant1#Task Title")},
+		},
+		{
+			"id":        {S: aws.String("tenant1#1")},
+			"DataType":  {S: aws.String("Tags#Tag1")},
+			"DataValue": {S: aws.String("tenant1#Tag1")},
+		},
+		{
+			"id":        {S: aws.String("tenant1#1")},
+			"DataType":  {S: aws.String("Description")},
+			"DataValue": {S: aws.String("tenant1#Description of the task1")},
+		},
+		{
+			"id":        {S: aws.String("tenant1#2")},
+			"DataType":  {S: aws.String("Title")},
+			"DataValue": {S: aws.String("tenant1#Task Title")},
+		},
+		{
+			"id":        {S: aws.String("tenant1#2")},
+			"DataType":  {S: aws.String("Tags#Tag2")},
+			"DataValue": {S: aws.String("tenant1#Tag2")},
+		},
+		{
+			"id":        {S: aws.String("tenant1#2")},
+			"DataType":  {S: aws.String("Description")},
+			"DataValue": {S: aws.String("tenant1#Description of the task2")},
+		},
+	})).Times(4)
+
 	type args struct {
 		request        events.APIGatewayProxyRequest
 		attributeKey   string
@@ -529,6 +737,7 @@ func Test_getTasksByAttribute(t *testing.T) {
 			name: "Valid Title",
 			args: args{
 				request: events.APIGatewayProxyRequest{
+					RequestContext:        tenantContext("tenant1"),
 					QueryStringParameters: map[string]string{"Title": "Task Title"},
 					HTTPMethod:            "GET",
 				},
@@ -556,3 +765,3361 @@ func Test_getTasksByAttribute(t *testing.T) {
 		})
 	}
 }
+
+func Test_createProject(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockDynamoDB := mockdb.NewMockDynamoDBAPI(ctrl)
+	mockDynamoDB.EXPECT().PutItem(gomock.Any()).Return(&dynamodb.PutItemOutput{}, nil).Times(1)
+
+	task.Svc = mockDynamoDB
+
+	type args struct {
+		request events.APIGatewayProxyRequest
+	}
+	tests := []struct {
+		name    string
+		args    args
+		want    events.APIGatewayProxyResponse
+		wantErr bool
+	}{
+		{
+			name: "Valid Request",
+			args: args{
+				request: events.APIGatewayProxyRequest{
+					RequestContext: tenantContext("tenant1"),
+					Body:           "{\"key\":\"WEB\", \"name\":\"Website\", \"description\":\"Corporate website\"}",
+					HTTPMethod:     "POST",
+				},
+			},
+			want: events.APIGatewayProxyResponse{
+				Body:       "Project created successfully",
+				StatusCode: http.StatusCreated,
+			},
+			wantErr: false,
+		},
+		{
+			name: "Missing Key",
+			args: args{
+				request: events.APIGatewayProxyRequest{
+					RequestContext: tenantContext("tenant1"),
+					Body:           "{\"name\":\"Website\"}",
+					HTTPMethod:     "POST",
+				},
+			},
+			want: events.APIGatewayProxyResponse{
+				Body:       "Missing key or name in the project",
+				StatusCode: http.StatusBadRequest,
+			},
+			wantErr: false,
+		},
+	}
+	// タスクのProjectアイテムがプロジェクトの一覧に混ざるキーや、"#"を含むキーは使えない
+	for _, key := range []string{"Project", "Tag", "ApiKeys", "A#B", "a b"} {
+		tests = append(tests, struct {
+			name    string
+			args    args
+			want    events.APIGatewayProxyResponse
+			wantErr bool
+		}{
+			name: "Invalid Key " + key,
+			args: args{
+				request: events.APIGatewayProxyRequest{
+					RequestContext: tenantContext("tenant1"),
+					Body:           "{\"key\":\"" + key + "\", \"name\":\"Website\"}",
+					HTTPMethod:     "POST",
+				},
+			},
+			want: events.APIGatewayProxyResponse{
+				Body:       "Invalid project key: use 1-64 letters, digits, '-' or '_' and not a reserved word",
+				StatusCode: http.StatusBadRequest,
+			},
+		})
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := task.CreateProject(tt.args.request)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("createProject() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("createProject() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_getProjects(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockDynamoDB := mockdb.NewMockDynamoDBAPI(ctrl)
+	mockDynamoDB.EXPECT().Query(gomock.Any()).Return(&dynamodb.QueryOutput{
+		Items: []map[string]*dynamodb.AttributeValue{
+			{
+				"id":          {S: aws.String("tenant1#Project#WEB")},
+				"DataType":    {S: aws.String("Project")},
+				"DataValue":   {S: aws.String("tenant1#Project")},
+				"key":         {S: aws.String("WEB")},
+				"name":        {S: aws.String("Website")},
+				"description": {S: aws.String("")},
+				"archived":    {BOOL: aws.Bool(false)},
+			},
+			{
+				"id":          {S: aws.String("tenant1#Project#OLD")},
+				"DataType":    {S: aws.String("Project")},
+				"DataValue":   {S: aws.String("tenant1#Project")},
+				"key":         {S: aws.String("OLD")},
+				"name":        {S: aws.String("Legacy")},
+				"description": {S: aws.String("")},
+				"archived":    {BOOL: aws.Bool(true)},
+			},
+		},
+	}, nil).Times(2)
+
+	task.Svc = mockDynamoDB
+
+	type args struct {
+		request events.APIGatewayProxyRequest
+	}
+	tests := []struct {
+		name    string
+		args    args
+		want    events.APIGatewayProxyResponse
+		wantErr bool
+	}{
+		{
+			name: "Active Projects",
+			args: args{
+				request: events.APIGatewayProxyRequest{
+					RequestContext: tenantContext("tenant1"),
+					HTTPMethod:     "GET",
+				},
+			},
+			want: events.APIGatewayProxyResponse{
+				Body:       "[{\"key\":\"WEB\",\"name\":\"Website\",\"archived\":false}]",
+				StatusCode: http.StatusOK,
+			},
+			wantErr: false,
+		},
+		{
+			name: "Include Archived",
+			args: args{
+				request: events.APIGatewayProxyRequest{
+					RequestContext:        tenantContext("tenant1"),
+					QueryStringParameters: map[string]string{"archived": "true"},
+					HTTPMethod:            "GET",
+				},
+			},
+			want: events.APIGatewayProxyResponse{
+				Body:       "[{\"key\":\"OLD\",\"name\":\"Legacy\",\"archived\":true},{\"key\":\"WEB\",\"name\":\"Website\",\"archived\":false}]",
+				StatusCode: http.StatusOK,
+			},
+			wantErr: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := task.GetProjects(tt.args.request)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("getProjects() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("getProjects() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_tagCatalog(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockDynamoDB := mockdb.NewMockDynamoDBAPI(ctrl)
+	task.Svc = mockDynamoDB
+
+	got, _ := task.CreateTag(events.APIGatewayProxyRequest{
+		RequestContext: tenantContext("tenant1"),
+		Body:           "{\"name\":\"urgent\",\"color\":\"red\"}",
+		HTTPMethod:     "POST",
+	})
+	if got.StatusCode != http.StatusBadRequest {
+		t.Errorf("CreateTag() status = %v, want 400 for invalid color", got.StatusCode)
+	}
+
+	mockDynamoDB.EXPECT().PutItem(gomock.Any()).DoAndReturn(func(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+		if *input.Item["id"].S != "tenant1#Tag#urgent" || *input.Item["DataValue"].S != "tenant1#Tag" || *input.Item["usageCount"].N != "0" {
+			t.Errorf("unexpected tag item %v", input.Item)
+		}
+		return &dynamodb.PutItemOutput{}, nil
+	}).Times(1)
+	got, err := task.CreateTag(events.APIGatewayProxyRequest{
+		RequestContext: tenantContext("tenant1"),
+		Body:           "{\"name\":\"urgent\",\"color\":\"#FF0000\",\"description\":\"Needs attention\"}",
+		HTTPMethod:     "POST",
+	})
+	if err != nil || got.StatusCode != http.StatusCreated {
+		t.Errorf("CreateTag() = %v, %v", got, err)
+	}
+
+	mockDynamoDB.EXPECT().Query(gomock.Any()).Return(&dynamodb.QueryOutput{
+		Items: []map[string]*dynamodb.AttributeValue{
+			{"id": {S: aws.String("tenant1#Tag#urgent")}, "DataType": {S: aws.String("Tag")}, "name": {S: aws.String("urgent")}, "color": {S: aws.String("#FF0000")}, "usageCount": {N: aws.String("3")}},
+			{"id": {S: aws.String("tenant1#Tag#bug")}, "DataType": {S: aws.String("Tag")}, "name": {S: aws.String("bug")}, "usageCount": {N: aws.String("1")}},
+		},
+	}, nil).Times(1)
+	got, err = task.GetTags(events.APIGatewayProxyRequest{RequestContext: tenantContext("tenant1"), HTTPMethod: "GET"})
+	want := "[{\"name\":\"bug\",\"count\":1},{\"name\":\"urgent\",\"color\":\"#FF0000\",\"count\":3}]"
+	if err != nil || got.Body != want {
+		t.Errorf("GetTags() = %v, want %v", got.Body, want)
+	}
+
+	// 既定では未登録のタグも使用数とともに作成する
+	addTag := func(tag string) events.APIGatewayProxyResponse {
+		got, err := task.AddTagToTask(events.APIGatewayProxyRequest{
+			RequestContext:        callerContext("tenant1", "editor"),
+			QueryStringParameters: map[string]string{"id": "1", "tag": tag},
+			HTTPMethod:            "POST",
+		})
+		if err != nil {
+			t.Fatalf("AddTagToTask() error = %v", err)
+		}
+		return got
+	}
+	mockDynamoDB.EXPECT().TransactWriteItems(gomock.Any()).DoAndReturn(func(input *dynamodb.TransactWriteItemsInput) (*dynamodb.TransactWriteItemsOutput, error) {
+		count := input.TransactItems[len(input.TransactItems)-1].Update
+		if *count.Key["id"].S != "tenant1#Tag#new" || *count.ExpressionAttributeValues[":delta"].N != "1" || count.ConditionExpression != nil {
+			t.Errorf("unexpected tag count update %v", count)
+		}
+		return &dynamodb.TransactWriteItemsOutput{}, nil
+	}).Times(1)
+	if got := addTag("new"); got.StatusCode != http.StatusOK {
+		t.Errorf("AddTagToTask() = %v", got)
+	}
+
+	// 未登録のタグを拒否する設定では、カタログにあるタグだけを付けられる
+	task.RejectUnknownTags = true
+	defer func() { task.RejectUnknownTags = false }()
+	mockDynamoDB.EXPECT().GetItem(gomock.Any()).DoAndReturn(func(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+		if *input.Key["id"].S == "tenant1#Tag#urgent" {
+			return &dynamodb.GetItemOutput{Item: map[string]*dynamodb.AttributeValue{"name": {S: aws.String("urgent")}}}, nil
+		}
+		return &dynamodb.GetItemOutput{}, nil
+	}).Times(2)
+	if got := addTag("unknown"); got.StatusCode != http.StatusBadRequest {
+		t.Errorf("AddTagToTask() status = %v, want 400 for unknown tag", got.StatusCode)
+	}
+	mockDynamoDB.EXPECT().TransactWriteItems(gomock.Any()).DoAndReturn(func(input *dynamodb.TransactWriteItemsInput) (*dynamodb.TransactWriteItemsOutput, error) {
+		if count := input.TransactItems[len(input.TransactItems)-1].Update; count.ConditionExpression == nil {
+			t.Errorf("tag count update must require the tag to exist")
+		}
+		return nil, awserr.New(dynamodb.ErrCodeTransactionCanceledException, "Transaction cancelled, please refer cancellation reasons for specific reasons [ConditionalCheckFailed, None]", nil)
+	}).Times(1)
+	if got := addTag("urgent"); got.StatusCode != http.StatusConflict {
+		t.Errorf("AddTagToTask() status = %v, want 409 for a tag already on the task", got.StatusCode)
+	}
+
+	// 存在しないタスクにはタグを付けない
+	mockDynamoDB.EXPECT().GetItem(gomock.Any()).Return(&dynamodb.GetItemOutput{Item: map[string]*dynamodb.AttributeValue{"name": {S: aws.String("urgent")}}}, nil).Times(1)
+	mockDynamoDB.EXPECT().TransactWriteItems(gomock.Any()).DoAndReturn(func(input *dynamodb.TransactWriteItemsInput) (*dynamodb.TransactWriteItemsOutput, error) {
+		if check := input.TransactItems[0].ConditionCheck; check == nil || *check.Key["DataType"].S != "Project" {
+			t.Errorf("AddTagToTask() must check that the task exists, got %v", input.TransactItems[0])
+		}
+		return nil, canceledAt(len(input.TransactItems), 0)
+	}).Times(1)
+	if got := addTag("urgent"); got.StatusCode != http.StatusNotFound {
+		t.Errorf("AddTagToTask() status = %v, want 404 for a missing task", got.StatusCode)
+	}
+}
+
+func Test_renameTag(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockDynamoDB := mockdb.NewMockDynamoDBAPI(ctrl)
+	task.Svc = mockDynamoDB
+
+	mockDynamoDB.EXPECT().GetItem(gomock.Any()).DoAndReturn(func(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+		if *input.Key["id"].S == "tenant1#Tag#frontend" {
+			return &dynamodb.GetItemOutput{Item: map[string]*dynamodb.AttributeValue{
+				"name": {S: aws.String("frontend")}, "color": {S: aws.String("#00FF00")}, "usageCount": {N: aws.String("40")},
+			}}, nil
+		}
+		return &dynamodb.GetItemOutput{}, nil
+	}).AnyTimes()
+
+	// ジョブと変更後のタグを作成し、タスクの書き換えはストリームで進める
+	mockDynamoDB.EXPECT().TransactWriteItems(gomock.Any()).DoAndReturn(func(input *dynamodb.TransactWriteItemsInput) (*dynamodb.TransactWriteItemsOutput, error) {
+		job, tag := input.TransactItems[0].Put.Item, input.TransactItems[1].Put.Item
+		if *job["id"].S != "tenant1#Jobs" || *job["status"].S != task.JobRunning || *job["from"].S != "frontend" || *job["to"].S != "web" {
+			t.Errorf("unexpected job item %v", job)
+		}
+		if *tag["id"].S != "tenant1#Tag#web" || *tag["color"].S != "#00FF00" {
+			t.Errorf("renamed tag must keep the color, got %v", tag)
+		}
+		return &dynamodb.TransactWriteItemsOutput{}, nil
+	}).Times(1)
+
+	got, err := handler(events.APIGatewayProxyRequest{
+		RequestContext: callerContext("tenant1", "admin"),
+		HTTPMethod:     "POST",
+		Path:           "/tags/frontend/rename",
+		Body:           "{\"to\":\"web\"}",
+	})
+	job := task.Job{}
+	if err != nil || got.StatusCode != http.StatusAccepted || json.Unmarshal([]byte(got.Body), &job) != nil || job.ID == "" || job.Type != task.JobTagRename {
+		t.Errorf("rename = %v, %v", got, err)
+	}
+
+	got, _ = handler(events.APIGatewayProxyRequest{
+		RequestContext: callerContext("tenant1", "admin"),
+		HTTPMethod:     "POST",
+		Path:           "/tags/frontend/merge",
+		Body:           "{\"to\":\"web\"}",
+	})
+	if got.StatusCode != http.StatusNotFound {
+		t.Errorf("merge status = %v, want 404 for a target outside the catalog", got.StatusCode)
+	}
+
+	got, _ = handler(events.APIGatewayProxyRequest{
+		RequestContext: callerContext("tenant1", "editor"),
+		HTTPMethod:     "POST",
+		Path:           "/tags/frontend/rename",
+		Body:           "{\"to\":\"web\"}",
+	})
+	if got.StatusCode != http.StatusForbidden {
+		t.Errorf("rename status = %v, want 403 for editors", got.StatusCode)
+	}
+
+	got, _ = handler(events.APIGatewayProxyRequest{
+		RequestContext: callerContext("tenant1", "admin"),
+		HTTPMethod:     "POST",
+		Path:           "/tags/frontend/rename",
+		Body:           "{\"to\":\"web/\"}",
+	})
+	if got.StatusCode != http.StatusBadRequest {
+		t.Errorf("rename status = %v, want 400 for a name with an empty segment", got.StatusCode)
+	}
+}
+
+func Test_tagHierarchy(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockDynamoDB := mockdb.NewMockDynamoDBAPI(ctrl)
+	task.Svc = mockDynamoDB
+
+	catalogTag := func(name string, count string) map[string]*dynamodb.AttributeValue {
+		return map[string]*dynamodb.AttributeValue{
+			"id":         {S: aws.String("tenant1#Tag#" + name)},
+			"DataType":   {S: aws.String("Tag")},
+			"name":       {S: aws.String(name)},
+			"usageCount": {N: aws.String(count)},
+		}
+	}
+
+	// 前方一致で拾った別の階層のタグ（area2）はツリーに含めない
+	mockDynamoDB.EXPECT().Query(gomock.Any()).DoAndReturn(func(input *dynamodb.QueryInput) (*dynamodb.QueryOutput, error) {
+		if got := *input.ExpressionAttributeValues[":prefix"].S; got != "tenant1#Tag#area" {
+			t.Errorf("Query :prefix = %v, want tenant1#Tag#area", got)
+		}
+		return &dynamodb.QueryOutput{
+			Items: []map[string]*dynamodb.AttributeValue{
+				catalogTag("area/backend", "2"),
+				catalogTag("area/backend/db", "3"),
+				catalogTag("area/frontend", "1"),
+				catalogTag("area2", "5"),
+			},
+		}, nil
+	}).Times(1)
+	got, err := handler(events.APIGatewayProxyRequest{
+		RequestContext:        callerContext("tenant1", "viewer"),
+		HTTPMethod:            "GET",
+		Path:                  "/tags/tree",
+		QueryStringParameters: map[string]string{"prefix": "area"},
+	})
+	want := "[{\"name\":\"area\",\"path\":\"area\",\"count\":0,\"total\":6,\"children\":[" +
+		"{\"name\":\"backend\",\"path\":\"area/backend\",\"count\":2,\"total\":5,\"children\":[{\"name\":\"db\",\"path\":\"area/backend/db\",\"count\":3,\"total\":3}]}," +
+		"{\"name\":\"frontend\",\"path\":\"area/frontend\",\"count\":1,\"total\":1}]}]"
+	if err != nil || got.Body != want {
+		t.Errorf("GET /tags/tree = %v, want %v", got.Body, want)
+	}
+
+	// 上位のタグで検索すると下位のタグが付いたタスクも返す
+	mockDynamoDB.EXPECT().Query(gomock.Any()).DoAndReturn(func(input *dynamodb.QueryInput) (*dynamodb.QueryOutput, error) {
+		if prefix, ok := input.ExpressionAttributeValues[":prefix"]; ok {
+			if *prefix.S != "tenant1#Tag#area/backend/" {
+				t.Errorf("Query :prefix = %v, want tenant1#Tag#area/backend/", *prefix.S)
+			}
+			return &dynamodb.QueryOutput{Items: []map[string]*dynamodb.AttributeValue{catalogTag("area/backend/db", "3")}}, nil
+		}
+		tagged := map[string][]string{"Tags#area/backend": {"1"}, "Tags#area/backend/db": {"1", "2"}}
+		items := []map[string]*dynamodb.AttributeValue{}
+		for _, id := range tagged[*input.ExpressionAttributeValues[":dataType"].S] {
+			items = append(items, map[string]*dynamodb.AttributeValue{"id": {S: aws.String("tenant1#" + id)}})
+		}
+		return &dynamodb.QueryOutput{Items: items}, nil
+	}).Times(3)
+	mockDynamoDB.EXPECT().Query(gomock.Any()).DoAndReturn(partitionQuery([]map[string]*dynamodb.AttributeValue{
+		{"id": {S: aws.String("tenant1#1")}, "DataType": {S: aws.String("Tags#area/backend")}, "DataValue": {S: aws.String("tenant1#area/backend")}},
+		{"id": {S: aws.String("tenant1#2")}, "DataType": {S: aws.String("Tags#area/backend/db")}, "DataValue": {S: aws.String("tenant1#area/backend/db")}},
+	})).Times(4)
+	got, err = task.GetTasksByTag(events.APIGatewayProxyRequest{
+		RequestContext:        tenantContext("tenant1"),
+		QueryStringParameters: map[string]string{"tag": "area/backend"},
+		HTTPMethod:            "GET",
+	})
+	want = "[{\"id\":\"1\",\"tags\":[\"area/backend\"]},{\"id\":\"2\",\"tags\":[\"area/backend/db\"]}]"
+	if err != nil || got.Body != want {
+		t.Errorf("GetTasksByTag() = %v, want %v", got.Body, want)
+	}
+
+	// パスパラメーターの"/"は%2Fでエンコードする
+	mockDynamoDB.EXPECT().UpdateItem(gomock.Any()).DoAndReturn(func(input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+		if got := *input.Key["id"].S; got != "tenant1#Tag#area/backend" {
+			t.Errorf("UpdateItem id = %v, want tenant1#Tag#area/backend", got)
+		}
+		return &dynamodb.UpdateItemOutput{}, nil
+	}).Times(1)
+	got, err = handler(events.APIGatewayProxyRequest{
+		RequestContext: callerContext("tenant1", "editor"),
+		HTTPMethod:     "PUT",
+		Path:           "/tags/area%2Fbackend",
+		Body:           "{\"color\":\"#0000FF\"}",
+	})
+	if err != nil || got.StatusCode != http.StatusOK {
+		t.Errorf("PUT /tags/area%%2Fbackend = %v, %v", got, err)
+	}
+
+	got, _ = task.CreateTag(events.APIGatewayProxyRequest{
+		RequestContext: tenantContext("tenant1"),
+		Body:           "{\"name\":\"area//db\"}",
+		HTTPMethod:     "POST",
+	})
+	if got.StatusCode != http.StatusBadRequest {
+		t.Errorf("CreateTag() status = %v, want 400 for an empty segment", got.StatusCode)
+	}
+}
+
+func Test_customFields(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockDynamoDB := mockdb.NewMockDynamoDBAPI(ctrl)
+	task.Svc = mockDynamoDB
+
+	got, _ := handler(events.APIGatewayProxyRequest{
+		RequestContext: callerContext("tenant1", "admin"),
+		HTTPMethod:     "PUT",
+		Path:           "/projects/WEB/fields/labels",
+		Body:           "{\"type\":\"multiSelect\"}",
+	})
+	if got.StatusCode != http.StatusBadRequest {
+		t.Errorf("define status = %v, want 400 for a select field without options", got.StatusCode)
+	}
+	got, _ = handler(events.APIGatewayProxyRequest{
+		RequestContext: callerContext("tenant1", "editor"),
+		HTTPMethod:     "PUT",
+		Path:           "/projects/WEB/fields/points",
+		Body:           "{\"type\":\"number\"}",
+	})
+	if got.StatusCode != http.StatusForbidden {
+		t.Errorf("define status = %v, want 403 for editors", got.StatusCode)
+	}
+
+	mockDynamoDB.EXPECT().TransactWriteItems(gomock.Any()).DoAndReturn(func(input *dynamodb.TransactWriteItemsInput) (*dynamodb.TransactWriteItemsOutput, error) {
+		item := input.TransactItems[1].Put.Item
+		if *item["id"].S != "tenant1#Project#WEB" || *item["DataType"].S != "Field#points" || *item["type"].S != "number" || *item["max"].N != "100" {
+			t.Errorf("unexpected field item %v", item)
+		}
+		return &dynamodb.TransactWriteItemsOutput{}, nil
+	}).Times(1)
+	got, err := handler(events.APIGatewayProxyRequest{
+		RequestContext: callerContext("tenant1", "admin"),
+		HTTPMethod:     "PUT",
+		Path:           "/projects/WEB/fields/points",
+		Body:           "{\"type\":\"number\",\"min\":0,\"max\":100}",
+	})
+	if err != nil || got.StatusCode != http.StatusOK {
+		t.Errorf("define = %v, %v", got, err)
+	}
+
+	taskItems := []map[string]*dynamodb.AttributeValue{
+		{"id": {S: aws.String("tenant1#1")}, "DataType": {S: aws.String("Project")}, "DataValue": {S: aws.String("tenant1#WEB")}},
+		{"id": {S: aws.String("tenant1#1")}, "DataType": {S: aws.String("Field#points")}, "DataValue": {S: aws.String("tenant1#5")}},
+		{"id": {S: aws.String("tenant1#1")}, "DataType": {S: aws.String("Field#labels#bug")}, "DataValue": {S: aws.String("tenant1#bug")}},
+	}
+	mockDynamoDB.EXPECT().Query(gomock.Any()).DoAndReturn(rangeQuery(taskItems)).Times(7)
+	mockDynamoDB.EXPECT().GetItem(gomock.Any()).DoAndReturn(func(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+		if *input.Key["id"].S != "tenant1#Project#WEB" || *input.Key["DataType"].S != "Field#labels" {
+			t.Errorf("unexpected field key %v", input.Key)
+		}
+		return &dynamodb.GetItemOutput{Item: map[string]*dynamodb.AttributeValue{
+			"name":    {S: aws.String("labels")},
+			"type":    {S: aws.String("multiSelect")},
+			"options": {L: []*dynamodb.AttributeValue{{S: aws.String("api")}, {S: aws.String("bug")}, {S: aws.String("ui")}}},
+		}}, nil
+	}).Times(2)
+
+	setLabels := func(body string) events.APIGatewayProxyResponse {
+		got, err := task.SetCustomField(events.APIGatewayProxyRequest{
+			RequestContext:        callerContext("tenant1", "editor"),
+			QueryStringParameters: map[string]string{"id": "1", "name": "labels"},
+			Body:                  body,
+		})
+		if err != nil {
+			t.Fatalf("SetCustomField() error = %v", err)
+		}
+		return got
+	}
+	if got := setLabels("{\"value\":[\"bug\",\"docs\"]}"); got.StatusCode != http.StatusBadRequest {
+		t.Errorf("SetCustomField() status = %v, want 400 for an unknown option", got.StatusCode)
+	}
+
+	// 複数選択は選択肢ごとのアイテムを追加・削除する
+	mockDynamoDB.EXPECT().TransactWriteItems(gomock.Any()).DoAndReturn(func(input *dynamodb.TransactWriteItemsInput) (*dynamodb.TransactWriteItemsOutput, error) {
+		deleted, added := input.TransactItems[1].Delete, input.TransactItems[2].Put
+		if deleted == nil || *deleted.Key["DataType"].S != "Field#labels#bug" {
+			t.Errorf("expected Field#labels#bug to be deleted, got %v", input.TransactItems[1])
+		}
+		if added == nil || *added.Item["DataType"].S != "Field#labels#ui" || *added.Item["DataValue"].S != "tenant1#ui" {
+			t.Errorf("expected Field#labels#ui to be added, got %v", input.TransactItems[2])
+		}
+		return &dynamodb.TransactWriteItemsOutput{}, nil
+	}).Times(1)
+	if got := setLabels("{\"value\":[\"ui\"]}"); got.StatusCode != http.StatusOK {
+		t.Errorf("SetCustomField() = %v", got)
+	}
+
+	got, err = task.GetTaskById("tenant1", "1")
+	want := "[{\"id\":\"1\",\"project\":\"WEB\",\"customFields\":{\"labels\":[\"bug\"],\"points\":\"5\"}}]"
+	if err != nil || got.Body != want {
+		t.Errorf("GetTaskById() = %v, want %v", got.Body, want)
+	}
+
+	// 作成時の値もプロジェクトの定義で検証する
+	mockDynamoDB.EXPECT().Query(gomock.Any()).Return(&dynamodb.QueryOutput{
+		Items: []map[string]*dynamodb.AttributeValue{
+			{"name": {S: aws.String("points")}, "type": {S: aws.String("number")}, "max": {N: aws.String("100")}},
+		},
+	}, nil).Times(1)
+	got, _ = task.CreateTask(events.APIGatewayProxyRequest{
+		RequestContext: callerContext("tenant1", "editor"),
+		Body:           "{\"id\":\"2\",\"project\":\"WEB\",\"customFields\":{\"points\":500}}",
+	})
+	if got.StatusCode != http.StatusBadRequest {
+		t.Errorf("CreateTask() status = %v, want 400 for a value out of range", got.StatusCode)
+	}
+}
+
+func Test_recurrence(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockDynamoDB := mockdb.NewMockDynamoDBAPI(ctrl)
+	task.Svc = mockDynamoDB
+
+	tests := []struct {
+		name  string
+		query map[string]string
+		want  string
+	}{
+		{"weekly", map[string]string{"rule": "FREQ=WEEKLY;BYDAY=MO", "start": "2026-10-19", "count": "3"}, `["2026-10-19","2026-10-26","2026-11-02"]`},
+		{"first business day", map[string]string{"rule": "RRULE:FREQ=MONTHLY;BYDAY=MO,TU,WE,TH,FR;BYSETPOS=1", "start": "2026-01-01", "count": "4"}, `["2026-01-01","2026-02-02","2026-03-02","2026-04-01"]`},
+		{"last day of month", map[string]string{"rule": "FREQ=MONTHLY;BYMONTHDAY=-1;COUNT=3", "start": "2026-01-15"}, `["2026-01-31","2026-02-28","2026-03-31"]`},
+		{"leap day", map[string]string{"rule": "FREQ=YEARLY", "start": "2024-02-29", "count": "2"}, `["2024-02-29","2028-02-29"]`},
+		{"until", map[string]string{"rule": "FREQ=DAILY;INTERVAL=2;UNTIL=20260105", "start": "2026-01-01"}, `["2026-01-01","2026-01-03","2026-01-05"]`},
+		{"last friday", map[string]string{"rule": "FREQ=MONTHLY;BYDAY=-1FR", "start": "2026-01-01", "count": "2"}, `["2026-01-30","2026-02-27"]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := handler(events.APIGatewayProxyRequest{
+				RequestContext:        callerContext("tenant1", "viewer"),
+				HTTPMethod:            "GET",
+				Path:                  "/recurrences/preview",
+				QueryStringParameters: tt.query,
+			})
+			if err != nil || got.StatusCode != http.StatusOK || got.Body != tt.want {
+				t.Errorf("preview = %v %v, %v, want %v", got.StatusCode, got.Body, err, tt.want)
+			}
+		})
+	}
+	got, _ := handler(events.APIGatewayProxyRequest{
+		RequestContext:        callerContext("tenant1", "viewer"),
+		HTTPMethod:            "GET",
+		Path:                  "/recurrences/preview",
+		QueryStringParameters: map[string]string{"rule": "FREQ=HOURLY"},
+	})
+	if got.StatusCode != http.StatusBadRequest {
+		t.Errorf("preview status = %v, want 400 for an unsupported FREQ", got.StatusCode)
+	}
+
+	// 最初の発生のタスクと繰り返しを1つのトランザクションで作成する
+	mockDynamoDB.EXPECT().TransactWriteItems(gomock.Any()).DoAndReturn(func(input *dynamodb.TransactWriteItemsInput) (*dynamodb.TransactWriteItemsOutput, error) {
+		due, link, series := false, false, false
+		for _, item := range input.TransactItems {
+			if item.Put == nil {
+				continue
+			}
+			switch *item.Put.Item["DataType"].S {
+			case "Due":
+				due = *item.Put.Item["DataValue"].S == "tenant1#2026-01-01"
+			case "Recurrence":
+				link = strings.HasPrefix(*item.Put.Item["DataValue"].S, "tenant1#")
+			default:
+				if !strings.HasPrefix(*item.Put.Item["DataType"].S, "Recurrence#") {
+					continue
+				}
+				series = true
+				if *item.Put.Item["next"].S != "2026-02-02" || *item.Put.Item["occurrences"].N != "1" || *item.Put.Item["DataValue"].S != "RecurrenceSchedule" {
+					t.Errorf("unexpected recurrence item %v", item.Put.Item)
+				}
+				if *item.Put.ConditionExpression != "attribute_not_exists(id)" {
+					t.Errorf("recurrence must be created only once")
+				}
+			}
+		}
+		if !due || !link || !series {
+			t.Errorf("TransactWriteItems must create the first task, its link and the recurrence")
+		}
+		return &dynamodb.TransactWriteItemsOutput{}, nil
+	}).Times(1)
+	got, err := handler(events.APIGatewayProxyRequest{
+		RequestContext: callerContext("tenant1", "editor"),
+		HTTPMethod:     "POST",
+		Path:           "/recurrences",
+		Body:           "{\"project\":\"WEB\",\"title\":\"Monthly report\",\"rule\":\"FREQ=MONTHLY;BYDAY=MO,TU,WE,TH,FR;BYSETPOS=1\",\"start\":\"2026-01-01\",\"trigger\":\"schedule\"}",
+	})
+	if err != nil || got.StatusCode != http.StatusCreated {
+		t.Errorf("create = %v, %v", got, err)
+	}
+	got, _ = handler(events.APIGatewayProxyRequest{
+		RequestContext: callerContext("tenant1", "viewer"),
+		HTTPMethod:     "POST",
+		Path:           "/recurrences",
+		Body:           "{\"project\":\"WEB\",\"title\":\"Monthly report\",\"rule\":\"FREQ=MONTHLY\"}",
+	})
+	if got.StatusCode != http.StatusForbidden {
+		t.Errorf("create status = %v, want 403 for viewers", got.StatusCode)
+	}
+}
+
+func Test_taskTemplates(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockDynamoDB := mockdb.NewMockDynamoDBAPI(ctrl)
+	task.Svc = mockDynamoDB
+
+	var stored map[string]*dynamodb.AttributeValue
+	mockDynamoDB.EXPECT().PutItem(gomock.Any()).DoAndReturn(func(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+		stored = input.Item
+		if *stored["id"].S != "tenant1#Templates" || !strings.HasPrefix(*stored["DataType"].S, "Template#") {
+			t.Errorf("unexpected template key %v", stored)
+		}
+		return &dynamodb.PutItemOutput{}, nil
+	}).Times(1)
+	got, err := handler(events.APIGatewayProxyRequest{
+		RequestContext: callerContext("tenant1", "editor"),
+		HTTPMethod:     "POST",
+		Path:           "/templates",
+		Body: `{"name":"Release","task":{"title":"Release {{version}}","tags":["release"],"subtasks":[
+			{"title":"Tag v{{ version }}","tags":["release"]},
+			{"title":"Announce","subtasks":[{"title":"Write notes for {{version}}","tags":["docs"]}]}]}}`,
+	})
+	if err != nil || got.StatusCode != http.StatusCreated {
+		t.Fatalf("create = %v, %v", got, err)
+	}
+	template := task.Template{}
+	if err := json.Unmarshal([]byte(got.Body), &template); err != nil || !reflect.DeepEqual(template.Placeholders, []string{"version"}) {
+		t.Errorf("placeholders = %v, %v, want [version]", template.Placeholders, err)
+	}
+
+	mockDynamoDB.EXPECT().GetItem(gomock.Any()).DoAndReturn(func(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+		if *input.Key["DataType"].S == "Template#"+template.ID {
+			return &dynamodb.GetItemOutput{Item: stored}, nil
+		}
+		return &dynamodb.GetItemOutput{}, nil
+	}).AnyTimes()
+	instantiate := func(body string) events.APIGatewayProxyResponse {
+		got, err := handler(events.APIGatewayProxyRequest{
+			RequestContext: callerContext("tenant1", "editor:WEB"),
+			HTTPMethod:     "POST",
+			Path:           "/templates/" + template.ID + "/instantiate",
+			Body:           body,
+		})
+		if err != nil {
+			t.Fatalf("instantiate error = %v", err)
+		}
+		return got
+	}
+	if got := instantiate(`{"project":"WEB"}`); got.StatusCode != http.StatusBadRequest || !strings.Contains(got.Body, "version") {
+		t.Errorf("instantiate = %v %v, want 400 for the missing placeholder", got.StatusCode, got.Body)
+	}
+	if got := instantiate(`{"project":"API","values":{"version":"1.2.0"}}`); got.StatusCode != http.StatusForbidden {
+		t.Errorf("instantiate status = %v, want 403 outside the editor's project", got.StatusCode)
+	}
+
+	// 全てのタスクを1つのトランザクションで作成し、同じタグの使用数は1つの更新にまとめる
+	mockDynamoDB.EXPECT().Query(gomock.Any()).Return(&dynamodb.QueryOutput{}, nil).Times(1)
+	mockDynamoDB.EXPECT().TransactWriteItems(gomock.Any()).DoAndReturn(func(input *dynamodb.TransactWriteItemsInput) (*dynamodb.TransactWriteItemsOutput, error) {
+		titles, links, tagCounts := []string{}, 0, map[string]string{}
+		for _, item := range input.TransactItems {
+			switch {
+			case item.Put != nil && *item.Put.Item["DataType"].S == "Title":
+				titles = append(titles, strings.TrimPrefix(*item.Put.Item["DataValue"].S, "tenant1#"))
+			case item.Put != nil && strings.HasPrefix(*item.Put.Item["DataType"].S, "Subtask#"):
+				links++
+			case item.Update != nil && *item.Update.Key["DataType"].S == "Tag":
+				tagCounts[*item.Update.Key["id"].S] = *item.Update.ExpressionAttributeValues[":delta"].N
+			}
+		}
+		want := []string{"Release 1.2.0", "Tag v1.2.0", "Announce", "Write notes for 1.2.0"}
+		if !reflect.DeepEqual(titles, want) || links != 3 {
+			t.Errorf("titles = %v with %d subtask links, want %v with 3", titles, links, want)
+		}
+		if want := map[string]string{"tenant1#Tag#release": "2", "tenant1#Tag#docs": "1"}; !reflect.DeepEqual(tagCounts, want) {
+			t.Errorf("tag counts = %v, want %v", tagCounts, want)
+		}
+		return &dynamodb.TransactWriteItemsOutput{}, nil
+	}).Times(1)
+	got = instantiate(`{"project":"WEB","values":{"version":"1.2.0"}}`)
+	created := struct {
+		ID      string   `json:"id"`
+		TaskIDs []string `json:"taskIds"`
+	}{}
+	if err := json.Unmarshal([]byte(got.Body), &created); err != nil || got.StatusCode != http.StatusCreated {
+		t.Fatalf("instantiate = %v %v", got.StatusCode, got.Body)
+	}
+	if len(created.TaskIDs) != 4 || created.ID != created.TaskIDs[0] {
+		t.Errorf("instantiate returned %+v, want 4 task ids starting with the top task", created)
+	}
+}
+
+func Test_timeTracking(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockDynamoDB := mockdb.NewMockDynamoDBAPI(ctrl)
+	task.Svc = mockDynamoDB
+
+	start := time.Now().Unix() - 3600
+	mockDynamoDB.EXPECT().GetItem(gomock.Any()).DoAndReturn(func(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+		switch *input.Key["DataType"].S {
+		case "Project":
+			return &dynamodb.GetItemOutput{Item: map[string]*dynamodb.AttributeValue{"DataValue": {S: aws.String("tenant1#WEB")}}}, nil
+		case "Timer#user-1":
+			return &dynamodb.GetItemOutput{Item: map[string]*dynamodb.AttributeValue{
+				"taskId":  {S: aws.String("1")},
+				"entryId": {S: aws.String("e1")},
+				"start":   {N: aws.String(strconv.FormatInt(start, 10))},
+			}}, nil
+		}
+		return &dynamodb.GetItemOutput{}, nil
+	}).AnyTimes()
+
+	// ユーザーごとに実行できるタイマーは1つだけ
+	mockDynamoDB.EXPECT().TransactWriteItems(gomock.Any()).Return(nil, &dynamodb.TransactionCanceledException{
+		Message_:            aws.String("Transaction cancelled, please refer cancellation reasons for specific reasons [None, ConditionalCheckFailed, None]"),
+		CancellationReasons: []*dynamodb.CancellationReason{{Code: aws.String("None")}, {Code: aws.String("ConditionalCheckFailed")}, {Code: aws.String("None")}},
+	}).Times(1)
+	got, _ := handler(events.APIGatewayProxyRequest{
+		RequestContext: callerContext("tenant1", "editor:WEB"),
+		HTTPMethod:     "POST",
+		Path:           "/tasks/1/timer/start",
+	})
+	if got.StatusCode != http.StatusConflict {
+		t.Errorf("start status = %v, want 409 while another timer is running", got.StatusCode)
+	}
+
+	// タイマーを止めると終了日時と時間を記録し、レポートで検索できるようにする
+	mockDynamoDB.EXPECT().TransactWriteItems(gomock.Any()).DoAndReturn(func(input *dynamodb.TransactWriteItemsInput) (*dynamodb.TransactWriteItemsOutput, error) {
+		deleted, update := input.TransactItems[0].Delete, input.TransactItems[1].Update
+		if deleted == nil || *deleted.Key["DataType"].S != "Timer#user-1" || *deleted.ExpressionAttributeValues[":entry"].S != "e1" {
+			t.Errorf("timer must be removed, got %v", input.TransactItems[0])
+		}
+		duration, _ := strconv.ParseInt(*update.ExpressionAttributeValues[":duration"].N, 10, 64)
+		if *update.Key["DataType"].S != "Time#e1" || duration < 3600 || duration > 3660 {
+			t.Errorf("unexpected entry update %v", update)
+		}
+		if bucket := *update.ExpressionAttributeValues[":bucket"].S; bucket != "tenant1#Time#"+time.Unix(start, 0).UTC().Format("2006-01") {
+			t.Errorf("bucket = %v", bucket)
+		}
+		return &dynamodb.TransactWriteItemsOutput{}, nil
+	}).Times(1)
+	got, err := handler(events.APIGatewayProxyRequest{
+		RequestContext: callerContext("tenant1", "editor:WEB"),
+		HTTPMethod:     "POST",
+		Path:           "/timer/stop",
+	})
+	if err != nil || got.StatusCode != http.StatusOK {
+		t.Errorf("stop = %v, %v", got, err)
+	}
+
+	got, _ = handler(events.APIGatewayProxyRequest{
+		RequestContext: callerContext("tenant1", "editor"),
+		HTTPMethod:     "POST",
+		Path:           "/tasks/1/time",
+		Body:           `{"start":1760000000,"end":1760003600,"duration":60}`,
+	})
+	if got.StatusCode != http.StatusBadRequest {
+		t.Errorf("create status = %v, want 400 when duration does not match", got.StatusCode)
+	}
+
+	// タグごとの集計では複数のタグが付いたタスクの時間をそれぞれのタグに数える
+	entry := func(taskId string, user string, start int64, duration int64) map[string]*dynamodb.AttributeValue {
+		return map[string]*dynamodb.AttributeValue{
+			"id":        {S: aws.String("tenant1#" + taskId)},
+			"DataType":  {S: aws.String(fmt.Sprintf("Time#%020d-0123456789ab", start))},
+			"DataValue": {S: aws.String("tenant1#Time#" + time.Unix(start, 0).UTC().Format("2006-01"))},
+			"taskId":    {S: aws.String(taskId)},
+			"userId":    {S: aws.String(user)},
+			"start":     {N: aws.String(strconv.FormatInt(start, 10))},
+			"end":       {N: aws.String(strconv.FormatInt(start+duration, 10))},
+			"duration":  {N: aws.String(strconv.FormatInt(duration, 10))},
+		}
+	}
+	mockDynamoDB.EXPECT().Query(gomock.Any()).DoAndReturn(func(input *dynamodb.QueryInput) (*dynamodb.QueryOutput, error) {
+		switch *input.ExpressionAttributeValues[":dataValue"].S {
+		case "tenant1#Time#2026-09":
+			return &dynamodb.QueryOutput{Items: []map[string]*dynamodb.AttributeValue{entry("2", "user-2", 1790762400, 600)}}, nil
+		case "tenant1#Time#2026-10":
+			return &dynamodb.QueryOutput{Items: []map[string]*dynamodb.AttributeValue{entry("1", "user-1", 1790845200, 3600), entry("2", "user-2", 1790859600, 1800)}}, nil
+		}
+		t.Errorf("unexpected query %v", input.ExpressionAttributeValues)
+		return &dynamodb.QueryOutput{}, nil
+	}).Times(2)
+	mockDynamoDB.EXPECT().Query(gomock.Any()).DoAndReturn(partitionQuery([]map[string]*dynamodb.AttributeValue{
+		{"id": {S: aws.String("tenant1#1")}, "DataType": {S: aws.String("Tags#api")}, "DataValue": {S: aws.String("tenant1#api")}},
+		{"id": {S: aws.String("tenant1#1")}, "DataType": {S: aws.String("Tags#bug")}, "DataValue": {S: aws.String("tenant1#bug")}},
+		{"id": {S: aws.String("tenant1#2")}, "DataType": {S: aws.String("Project")}, "DataValue": {S: aws.String("tenant1#WEB")}},
+	})).Times(4)
+	got, err = handler(events.APIGatewayProxyRequest{
+		RequestContext:        callerContext("tenant1", "viewer"),
+		HTTPMethod:            "GET",
+		Path:                  "/time/report",
+		QueryStringParameters: map[string]string{"from": "2026-09-30", "to": "2026-10-01", "groupBy": "tag"},
+	})
+	report := task.TimeReport{}
+	if err != nil || json.Unmarshal([]byte(got.Body), &report) != nil {
+		t.Fatalf("report = %v, %v", got, err)
+	}
+	wantGroups := []task.TimeReportGroup{{Key: "", Duration: 2400, Entries: 2}, {Key: "api", Duration: 3600, Entries: 1}, {Key: "bug", Duration: 3600, Entries: 1}}
+	if report.Total != 6000 || !reflect.DeepEqual(report.Groups, wantGroups) {
+		t.Errorf("report = %+v, want total 6000 and %+v", report, wantGroups)
+	}
+
+	// タスクには終了した記録の合計を含める
+	mockDynamoDB.EXPECT().Query(gomock.Any()).DoAndReturn(rangeQuery([]map[string]*dynamodb.AttributeValue{
+		{"id": {S: aws.String("tenant1#1")}, "DataType": {S: aws.String("Title")}, "DataValue": {S: aws.String("tenant1#Fix login")}},
+		entry("1", "user-1", 1790845200, 3600),
+		entry("1", "user-2", 1790931600, 900),
+		{"id": {S: aws.String("tenant1#1")}, "DataType": {S: aws.String("Time#running")}, "userId": {S: aws.String("user-1")}, "duration": {N: aws.String("0")}},
+	})).Times(3)
+	got, _ = handler(events.APIGatewayProxyRequest{
+		RequestContext: callerContext("tenant1", "viewer"),
+		HTTPMethod:     "GET",
+		Path:           "/tasks/1",
+	})
+	if !strings.Contains(got.Body, `"timeSpent":4500`) {
+		t.Errorf("GetTaskById() = %v, want timeSpent 4500", got.Body)
+	}
+}
+
+func Test_getTasksByTagInProject(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockDynamoDB := mockdb.NewMockDynamoDBAPI(ctrl)
+	// 下位の階層のタグはカタログにない
+	mockDynamoDB.EXPECT().Query(gomock.Any()).Return(&dynamodb.QueryOutput{}, nil).Times(1)
+	mockDynamoDB.EXPECT().Query(gomock.Any()).Return(&dynamodb.QueryOutput{
+		Items: []map[string]*dynamodb.AttributeValue{
+			{
+				"id":        {S: aws.String("tenant1#1")},
+				"DataType":  {S: aws.String("Tags#Tag1")},
+				"DataValue": {S: aws.String("tenant1#Tag1")},
+			},
+			{
+				"id":        {S: aws.String("tenant1#2")},
+				"DataType":  {S: aws.String("Tags#Tag1")},
+				"DataValue": {S: aws.String("tenant1#Tag1")},
+			},
+		},
+	}, nil).Times(1)
+
+	mockDynamoDB.EXPECT().Query(gomock.Any()).DoAndReturn(partitionQuery([]map[string]*dynamodb.AttributeValue{
+		{
+			"id":        {S: aws.String("tenant1#1")},
+			"DataType":  {S: aws.String("Title")},
+			"DataValue": {S: aws.String("tenant1#Task Title")},
+		},
+		{
+			"id":        {S: aws.String("tenant1#1")},
+			"DataType":  {S: aws.String("Project")},
+			"DataValue": {S: aws.String("tenant1#WEB")},
+		},
+		{
+			"id":        {S: aws.String("tenant1#2")},
+			"DataType":  {S: aws.String("Title")},
+			"DataValue": {S: aws.String("tenant1#Task Title")},
+		},
+		{
+			"id":        {S: aws.String("tenant1#2")},
+			"DataType":  {S: aws.String("Project")},
+			"DataValue": {S: aws.String("tenant1#API")},
+		},
+	})).Times(4)
+
+	task.Svc = mockDynamoDB
+
+	got, err := task.GetTasksByTagInProject(events.APIGatewayProxyRequest{
+		RequestContext:        tenantContext("tenant1"),
+		QueryStringParameters: map[string]string{"tag": "Tag1", "project": "WEB"},
+		HTTPMethod:            "GET",
+	})
+	if err != nil {
+		t.Fatalf("getTasksByTagInProject() error = %v", err)
+	}
+	want := events.APIGatewayProxyResponse{
+		Body:       "[{\"id\":\"1\",\"title\":\"Task Title\",\"project\":\"WEB\"}]",
+		StatusCode: http.StatusOK,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("getTasksByTagInProject() = %v, want %v", got, want)
+	}
+}
+
+// n件のトランザクションでi番目の条件を満たさなかった場合のエラー
+func canceledAt(n int, i int) error {
+	codes := make([]string, n)
+	reasons := make([]*dynamodb.CancellationReason, n)
+	for j := range reasons {
+		codes[j] = "None"
+		if j == i {
+			codes[j] = "ConditionalCheckFailed"
+		}
+		reasons[j] = &dynamodb.CancellationReason{Code: aws.String(codes[j])}
+	}
+	return &dynamodb.TransactionCanceledException{
+		Message_:            aws.String(fmt.Sprintf("Transaction cancelled, please refer cancellation reasons for specific reasons [%s]", strings.Join(codes, ", "))),
+		CancellationReasons: reasons,
+	}
+}
+
+func Test_moveTask(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockDynamoDB := mockdb.NewMockDynamoDBAPI(ctrl)
+	task.Svc = mockDynamoDB
+
+	move := func(project string) events.APIGatewayProxyResponse {
+		got, err := task.MoveTask(events.APIGatewayProxyRequest{
+			RequestContext:        tenantContext("tenant1"),
+			QueryStringParameters: map[string]string{"id": "1"},
+			Body:                  `{"project":"` + project + `"}`,
+			HTTPMethod:            "PUT",
+		})
+		if err != nil {
+			t.Fatalf("moveTask() error = %v", err)
+		}
+		return got
+	}
+	inWeb := &dynamodb.GetItemOutput{Item: map[string]*dynamodb.AttributeValue{"DataValue": {S: aws.String("tenant1#WEB")}}}
+	subtasks := func(ids ...string) *dynamodb.QueryOutput {
+		items := []map[string]*dynamodb.AttributeValue{}
+		for _, id := range ids {
+			items = append(items, map[string]*dynamodb.AttributeValue{"id": {S: aws.String("tenant1#1")}, "DataType": {S: aws.String("Subtask#" + id)}})
+		}
+		return &dynamodb.QueryOutput{Items: items}
+	}
+
+	// プロジェクトの確認とタスクの更新、親がないことの確認、履歴と変更ログの追加が同一トランザクションで行われること
+	mockDynamoDB.EXPECT().GetItem(gomock.Any()).Return(inWeb, nil).Times(1)
+	mockDynamoDB.EXPECT().Query(gomock.Any()).Return(subtasks(), nil).Times(1)
+	mockDynamoDB.EXPECT().TransactWriteItems(gomock.Any()).DoAndReturn(func(input *dynamodb.TransactWriteItemsInput) (*dynamodb.TransactWriteItemsOutput, error) {
+		if len(input.TransactItems) != 5 {
+			t.Fatalf("TransactItems = %d, want 5", len(input.TransactItems))
+		}
+		if got := *input.TransactItems[4].Put.Item["id"].S; got != "tenant1#Changes" {
+			t.Errorf("change log id = %v, want tenant1#Changes", got)
+		}
+		history := input.TransactItems[3].Put.Item
+		if *history["field"].S != "Project" || *history["oldValue"].S != "WEB" || *history["newValue"].S != "API" {
+			t.Errorf("unexpected history entry %v", history)
+		}
+		if input.TransactItems[0].ConditionCheck == nil || *input.TransactItems[0].ConditionCheck.Key["id"].S != "tenant1#Project#API" {
+			t.Errorf("missing condition check on target project")
+		}
+		update := input.TransactItems[1].Update
+		if update == nil || *update.Key["DataType"].S != "Project" || *update.ExpressionAttributeValues[":project"].S != "tenant1#API" {
+			t.Errorf("unexpected update %v", update)
+		}
+		if parent := input.TransactItems[2].ConditionCheck; parent == nil || *parent.Key["DataType"].S != "Parent" || *parent.ConditionExpression != "attribute_not_exists(id)" {
+			t.Errorf("missing condition check on parent")
+		}
+		return &dynamodb.TransactWriteItemsOutput{}, nil
+	}).Times(1)
+	want := events.APIGatewayProxyResponse{
+		Body:       "Task moved successfully",
+		StatusCode: http.StatusOK,
+	}
+	if got := move("API"); !reflect.DeepEqual(got, want) {
+		t.Errorf("moveTask() = %v, want %v", got, want)
+	}
+
+	// 同じプロジェクトへの移動は何も書き込まない
+	mockDynamoDB.EXPECT().GetItem(gomock.Any()).Return(inWeb, nil).Times(1)
+	if got := move("WEB"); got.StatusCode != http.StatusOK || got.Body != "Task is already in the project" {
+		t.Errorf("moveTask() = %v, want no-op", got)
+	}
+
+	// タスクがなければ404、サブタスクがあれば409
+	mockDynamoDB.EXPECT().GetItem(gomock.Any()).Return(&dynamodb.GetItemOutput{}, nil).Times(1)
+	if got := move("API"); got.StatusCode != http.StatusNotFound {
+		t.Errorf("moveTask() status = %v, want 404 for a missing task", got.StatusCode)
+	}
+	mockDynamoDB.EXPECT().GetItem(gomock.Any()).Return(inWeb, nil).Times(1)
+	mockDynamoDB.EXPECT().Query(gomock.Any()).Return(subtasks("2"), nil).Times(1)
+	if got := move("API"); got.StatusCode != http.StatusConflict {
+		t.Errorf("moveTask() status = %v, want 409 for a task with subtasks", got.StatusCode)
+	}
+
+	// 移動先がない・アーカイブ済み、確認後に削除された、確認後に親が設定された場合
+	for i, status := range []int{http.StatusConflict, http.StatusNotFound, http.StatusConflict} {
+		mockDynamoDB.EXPECT().GetItem(gomock.Any()).Return(inWeb, nil).Times(1)
+		mockDynamoDB.EXPECT().Query(gomock.Any()).Return(subtasks(), nil).Times(1)
+		mockDynamoDB.EXPECT().TransactWriteItems(gomock.Any()).Return(nil, canceledAt(5, i)).Times(1)
+		if got := move("API"); got.StatusCode != status {
+			t.Errorf("moveTask() status = %v, want %v when condition %d fails", got.StatusCode, status, i)
+		}
+	}
+}
+
+func Test_tenantIsolation(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockDynamoDB := mockdb.NewMockDynamoDBAPI(ctrl)
+	task.Svc = mockDynamoDB
+
+	// tenant2のキーでしか問い合わせず、tenant1のアイテムが返っても結果に含めない
+	mockDynamoDB.EXPECT().Query(gomock.Any()).DoAndReturn(func(input *dynamodb.QueryInput) (*dynamodb.QueryOutput, error) {
+		if got := *input.ExpressionAttributeValues[":id"].S; got != "tenant2#1" {
+			t.Errorf("Query :id = %v, want tenant2#1", got)
+		}
+		return &dynamodb.QueryOutput{
+			Items: []map[string]*dynamodb.AttributeValue{
+				{
+					"id":        {S: aws.String("tenant1#1")},
+					"DataType":  {S: aws.String("Title")},
+					"DataValue": {S: aws.String("tenant1#Secret")},
+				},
+			},
+		}, nil
+	}).Times(3)
+
+	got, err := task.GetTaskById("tenant2", "1")
+	if err != nil {
+		t.Fatalf("GetTaskById() error = %v", err)
+	}
+	if got.Body != "[]" {
+		t.Errorf("GetTaskById() = %v, want []", got.Body)
+	}
+
+	// GSI1の検索キーにもテナントIDが含まれる
+	mockDynamoDB.EXPECT().Query(gomock.Any()).DoAndReturn(func(input *dynamodb.QueryInput) (*dynamodb.QueryOutput, error) {
+		if got := *input.ExpressionAttributeValues[":prefix"].S; got != "tenant2#Tag#Tag1/" {
+			t.Errorf("Query :prefix = %v, want tenant2#Tag#Tag1/", got)
+		}
+		return &dynamodb.QueryOutput{}, nil
+	}).Times(1)
+	mockDynamoDB.EXPECT().Query(gomock.Any()).DoAndReturn(func(input *dynamodb.QueryInput) (*dynamodb.QueryOutput, error) {
+		if got := *input.ExpressionAttributeValues[":dataValue"].S; got != "tenant2#Tag1" {
+			t.Errorf("Query :dataValue = %v, want tenant2#Tag1", got)
+		}
+		return &dynamodb.QueryOutput{
+			Items: []map[string]*dynamodb.AttributeValue{
+				{
+					"id":        {S: aws.String("tenant1#1")},
+					"DataType":  {S: aws.String("Tags#Tag1")},
+					"DataValue": {S: aws.String("tenant1#Tag1")},
+				},
+			},
+		}, nil
+	}).Times(1)
+
+	got, err = task.GetTasksByTag(events.APIGatewayProxyRequest{
+		RequestContext:        tenantContext("tenant2"),
+		QueryStringParameters: map[string]string{"tag": "Tag1"},
+		HTTPMethod:            "GET",
+	})
+	if err != nil {
+		t.Fatalf("GetTasksByTag() error = %v", err)
+	}
+	if got.Body != "[]" {
+		t.Errorf("GetTasksByTag() = %v, want []", got.Body)
+	}
+
+	// 完了にする前に自テナントのサブタスクを確認する
+	mockDynamoDB.EXPECT().Query(gomock.Any()).DoAndReturn(func(input *dynamodb.QueryInput) (*dynamodb.QueryOutput, error) {
+		if got := *input.ExpressionAttributeValues[":id"].S; got != "tenant2#1" {
+			t.Errorf("Query :id = %v, want tenant2#1", got)
+		}
+		return &dynamodb.QueryOutput{}, nil
+	}).Times(1)
+
+	// 更新は自テナントに存在するアイテムに限られる
+	mockDynamoDB.EXPECT().GetItem(gomock.Any()).DoAndReturn(func(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+		if got := *input.Key["id"].S; got != "tenant2#1" {
+			t.Errorf("GetItem id = %v, want tenant2#1", got)
+		}
+		return &dynamodb.GetItemOutput{
+			Item: map[string]*dynamodb.AttributeValue{"DataValue": {S: aws.String("tenant2#Open")}},
+		}, nil
+	}).Times(1)
+	mockDynamoDB.EXPECT().TransactWriteItems(gomock.Any()).DoAndReturn(func(input *dynamodb.TransactWriteItemsInput) (*dynamodb.TransactWriteItemsOutput, error) {
+		update := input.TransactItems[0].Update
+		if got := *update.Key["id"].S; got != "tenant2#1" {
+			t.Errorf("Update id = %v, want tenant2#1", got)
+		}
+		if update.ConditionExpression == nil || !strings.HasPrefix(*update.ConditionExpression, "attribute_exists(id)") {
+			t.Errorf("Update must not create items in another partition")
+		}
+		if got := *input.TransactItems[2].Put.Item["id"].S; got != "tenant2#1" {
+			t.Errorf("history id = %v, want tenant2#1", got)
+		}
+		return &dynamodb.TransactWriteItemsOutput{}, nil
+	}).Times(1)
+
+	_, err = task.UpdateTaskAttribute(events.APIGatewayProxyRequest{
+		RequestContext:        tenantContext("tenant2"),
+		QueryStringParameters: map[string]string{"id": "1", "status": "done"},
+		HTTPMethod:            "PUT",
+	}, "Status", "status")
+	if err != nil {
+		t.Fatalf("UpdateTaskAttribute() error = %v", err)
+	}
+
+	mockDynamoDB.EXPECT().Query(gomock.Any()).DoAndReturn(func(input *dynamodb.QueryInput) (*dynamodb.QueryOutput, error) {
+		if got := *input.ExpressionAttributeValues[":id"].S; got != "tenant2#1" {
+			t.Errorf("Query :id = %v, want tenant2#1", got)
+		}
+		return &dynamodb.QueryOutput{}, nil
+	}).Times(2)
+
+	_, err = task.DeleteTaskById("tenant2", "1")
+	if err != nil {
+		t.Fatalf("DeleteTaskById() error = %v", err)
+	}
+}
+
+func Test_missingTenant(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	// テナントが特定できない場合はDynamoDBを呼ばずに拒否する
+	mockDynamoDB := mockdb.NewMockDynamoDBAPI(ctrl)
+	task.Svc = mockDynamoDB
+
+	want := events.APIGatewayProxyResponse{
+		Body:       "Missing tenant in the request",
+		StatusCode: http.StatusForbidden,
+	}
+	requests := []events.APIGatewayProxyRequest{
+		{QueryStringParameters: map[string]string{"tag": "Tag1"}},
+		{RequestContext: tenantContext("tenant1#other"), QueryStringParameters: map[string]string{"tag": "Tag1"}},
+	}
+	for _, request := range requests {
+		got, err := task.GetTasksByTag(request)
+		if err != nil {
+			t.Fatalf("GetTasksByTag() error = %v", err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("GetTasksByTag() = %v, want %v", got, want)
+		}
+	}
+
+	got, _ := task.GetTaskById("", "1")
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("GetTaskById() = %v, want %v", got, want)
+	}
+}
+
+// テスト用の鍵で署名したJWTを作成する
+func signToken(t *testing.T, alg string, kid string, key crypto.Signer, claims map[string]interface{}) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+
+	var signature []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		sig, err := rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature = sig
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature = make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func testKeySet(t *testing.T, rsaKey *rsa.PrivateKey, ecKey *ecdsa.PrivateKey) auth.KeySet {
+	t.Helper()
+	jwks, _ := json.Marshal(map[string]interface{}{
+		"keys": []map[string]string{
+			{
+				"kty": "RSA",
+				"kid": "rsa-1",
+				"n":   base64.RawURLEncoding.EncodeToString(rsaKey.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(rsaKey.E)).Bytes()),
+			},
+			{
+				"kty": "EC",
+				"kid": "ec-1",
+				"crv": "P-256",
+				"x":   base64.RawURLEncoding.EncodeToString(ecKey.X.FillBytes(make([]byte, 32))),
+				"y":   base64.RawURLEncoding.EncodeToString(ecKey.Y.FillBytes(make([]byte, 32))),
+			},
+		},
+	})
+	keys, err := auth.ParseKeySet(jwks)
+	if err != nil {
+		t.Fatalf("ParseKeySet() error = %v", err)
+	}
+	return keys
+}
+
+func Test_authenticate(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	now := time.Unix(1700000000, 0)
+
+	verifier := &auth.Verifier{
+		Keys:     testKeySet(t, rsaKey, ecKey),
+		Issuer:   "https://issuer.example.com",
+		Audience: "task-management",
+		Now:      func() time.Time { return now },
+	}
+	claims := func(overrides map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"sub":       "user-1",
+			"iss":       "https://issuer.example.com",
+			"aud":       []string{"task-management"},
+			"exp":       now.Add(time.Hour).Unix(),
+			"tenant_id": "tenant1",
+			"roles":     []string{"editor"},
+		}
+		for k, v := range overrides {
+			c[k] = v
+		}
+		return c
+	}
+
+	// 認証に成功した場合は呼び出し元がハンドラーに渡る
+	var gotIdentity task.Identity
+	next := func(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		gotIdentity = task.IdentityFromRequest(request)
+		return events.APIGatewayProxyResponse{StatusCode: http.StatusOK}, nil
+	}
+	api := auth.Authenticate(verifier, nil)(next)
+
+	tests := []struct {
+		name       string
+		header     string
+		wantStatus int
+	}{
+		{
+			name:       "RS256",
+			header:     "Bearer " + signToken(t, "RS256", "rsa-1", rsaKey, claims(nil)),
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "ES256",
+			header:     "Bearer " + signToken(t, "ES256", "ec-1", ecKey, claims(nil)),
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "Missing Token",
+			header:     "",
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "Invalid Signature",
+			header:     "Bearer " + signToken(t, "RS256", "rsa-1", otherKey, claims(nil)),
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "Expired",
+			header:     "Bearer " + signToken(t, "RS256", "rsa-1", rsaKey, claims(map[string]interface{}{"exp": now.Add(-time.Minute).Unix()})),
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "Wrong Issuer",
+			header:     "Bearer " + signToken(t, "RS256", "rsa-1", rsaKey, claims(map[string]interface{}{"iss": "https://evil.example.com"})),
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "Wrong Audience",
+			header:     "Bearer " + signToken(t, "ES256", "ec-1", ecKey, claims(map[string]interface{}{"aud": "other"})),
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "Algorithm Mismatch",
+			header:     "Bearer " + signToken(t, "ES256", "rsa-1", ecKey, claims(nil)),
+			wantStatus: http.StatusUnauthorized,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotIdentity = task.Identity{}
+			got, err := api(events.APIGatewayProxyRequest{
+				Headers: map[string]string{"authorization": tt.header},
+				// クライアントが送ったオーソライザーの値は上書きされる
+				RequestContext: tenantContext("tenant2"),
+			})
+			if err != nil {
+				t.Fatalf("Authenticate() error = %v", err)
+			}
+			if got.StatusCode != tt.wantStatus {
+				t.Fatalf("Authenticate() status = %v, want %v (%v)", got.StatusCode, tt.wantStatus, got.Headers)
+			}
+			if tt.wantStatus == http.StatusUnauthorized {
+				if !strings.HasPrefix(got.Headers["WWW-Authenticate"], "Bearer ") {
+					t.Errorf("WWW-Authenticate = %q", got.Headers["WWW-Authenticate"])
+				}
+				return
+			}
+			want := task.Identity{Subject: "user-1", TenantID: "tenant1", Roles: []string{"editor"}}
+			if !reflect.DeepEqual(gotIdentity, want) {
+				t.Errorf("identity = %v, want %v", gotIdentity, want)
+			}
+		})
+	}
+
+	// 発行者・対象者が未設定、または鍵を読み込めなかった場合はすべて拒否する
+	token := "Bearer " + signToken(t, "RS256", "rsa-1", rsaKey, claims(nil))
+	for name, v := range map[string]*auth.Verifier{
+		"Unconfigured": {Keys: verifier.Keys, Now: verifier.Now},
+		"Missing":      nil,
+	} {
+		got, _ := auth.Authenticate(v, nil)(next)(events.APIGatewayProxyRequest{
+			Headers: map[string]string{"Authorization": token},
+		})
+		if got.StatusCode != http.StatusUnauthorized {
+			t.Errorf("%s verifier status = %v, want 401", name, got.StatusCode)
+		}
+	}
+}
+
+func Test_handler(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockDynamoDB := mockdb.NewMockDynamoDBAPI(ctrl)
+	task.Svc = mockDynamoDB
+
+	// パスパラメーターがハンドラーに渡ること
+	mockDynamoDB.EXPECT().Query(gomock.Any()).DoAndReturn(func(input *dynamodb.QueryInput) (*dynamodb.QueryOutput, error) {
+		if got := *input.ExpressionAttributeValues[":id"].S; got != "tenant1#42" {
+			t.Errorf("Query :id = %v, want tenant1#42", got)
+		}
+		return &dynamodb.QueryOutput{}, nil
+	}).Times(3)
+
+	got, err := handler(events.APIGatewayProxyRequest{
+		RequestContext: callerContext("tenant1", "viewer"),
+		HTTPMethod:     "GET",
+		Path:           "/tasks/42",
+	})
+	if err != nil || got.StatusCode != http.StatusOK {
+		t.Errorf("handler() = %v, %v", got, err)
+	}
+
+	got, err = handler(events.APIGatewayProxyRequest{
+		RequestContext: callerContext("tenant1", "viewer"),
+		HTTPMethod:     "PATCH",
+		Path:           "/tasks/42",
+	})
+	want := events.APIGatewayProxyResponse{
+		Body:       "Invalid request",
+		StatusCode: http.StatusBadRequest,
+	}
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("handler() = %v, want %v", got, want)
+	}
+}
+
+func Test_batch(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockDynamoDB := mockdb.NewMockDynamoDBAPI(ctrl)
+	task.Svc = mockDynamoDB
+
+	run := func(body string) (events.APIGatewayProxyResponse, batchResponse) {
+		got, err := handler(events.APIGatewayProxyRequest{
+			RequestContext: callerContext("tenant1", "editor"),
+			HTTPMethod:     "POST",
+			Path:           "/batch",
+			Body:           body,
+		})
+		result := batchResponse{}
+		if err != nil || (got.StatusCode == http.StatusOK && json.Unmarshal([]byte(got.Body), &result) != nil) {
+			t.Fatalf("handler() = %v, %v", got, err)
+		}
+		return got, result
+	}
+	statuses := func(result batchResponse) []int {
+		got := []int{}
+		for _, r := range result.Responses {
+			got = append(got, r.Status)
+		}
+		return got
+	}
+
+	// 各リクエストは個別に認可され、失敗したリクエストに依存するリクエストは実行しない
+	mockDynamoDB.EXPECT().TransactWriteItems(gomock.Any()).Return(&dynamodb.TransactWriteItemsOutput{}, nil).Times(1)
+	_, result := run(`{"requests":[
+		{"id":"tag","method":"POST","path":"/tasks/1/tags","query":{"tag":"x"}},
+		{"id":"delete","method":"DELETE","path":"/tasks/1","dependsOn":["tag"]},
+		{"id":"read","method":"GET","path":"/tasks/1","dependsOn":["delete"]}]}`)
+	if want := []int{http.StatusOK, http.StatusForbidden, http.StatusFailedDependency}; !reflect.DeepEqual(statuses(result), want) || result.Committed != nil {
+		t.Errorf("batch statuses = %v, want %v", statuses(result), want)
+	}
+
+	// 一括で書き込む場合は、すべてのリクエストの書き込みを1つのトランザクションにまとめる
+	mockDynamoDB.EXPECT().TransactWriteItems(gomock.Any()).DoAndReturn(func(input *dynamodb.TransactWriteItemsInput) (*dynamodb.TransactWriteItemsOutput, error) {
+		partitions := map[string]bool{}
+		for _, item := range input.TransactItems {
+			if item.Put != nil {
+				partitions[*item.Put.Item["id"].S] = true
+			}
+		}
+		if !partitions["tenant1#1"] || !partitions["tenant1#2"] {
+			t.Errorf("transaction must contain writes of both requests, got %v", partitions)
+		}
+		return &dynamodb.TransactWriteItemsOutput{}, nil
+	}).Times(1)
+	_, result = run(`{"atomic":true,"requests":[
+		{"method":"POST","path":"/tasks/1/tags","query":{"tag":"x"}},
+		{"method":"POST","path":"/tasks/2/tags","query":{"tag":"y"}}]}`)
+	if want := []int{http.StatusOK, http.StatusOK}; !reflect.DeepEqual(statuses(result), want) || result.Committed == nil || !*result.Committed {
+		t.Errorf("atomic batch = %+v, want committed %v", result, want)
+	}
+
+	// 失敗したリクエストがあれば何も書き込まない
+	_, result = run(`{"atomic":true,"requests":[
+		{"method":"POST","path":"/tasks/1/tags","query":{"tag":"x"}},
+		{"method":"DELETE","path":"/tasks/3"},
+		{"method":"POST","path":"/tasks/2/tags","query":{"tag":"y"}}]}`)
+	if want := []int{http.StatusFailedDependency, http.StatusForbidden, http.StatusFailedDependency}; !reflect.DeepEqual(statuses(result), want) || result.Committed == nil || *result.Committed {
+		t.Errorf("atomic batch = %+v, want rolled back %v", result, want)
+	}
+	if task.Svc != mockDynamoDB {
+		t.Errorf("atomic batch must not replace the DynamoDB client")
+	}
+
+	// 同じタスクの存在確認は1つにまとめ、同じアイテムへの書き込みは互いに依存するため受け付けない
+	mockDynamoDB.EXPECT().TransactWriteItems(gomock.Any()).DoAndReturn(func(input *dynamodb.TransactWriteItemsInput) (*dynamodb.TransactWriteItemsOutput, error) {
+		keys := map[string]bool{}
+		for _, item := range input.TransactItems {
+			key := transactKey(item)
+			if keys[key] {
+				t.Errorf("transaction must not contain %s twice", key)
+			}
+			keys[key] = true
+		}
+		return &dynamodb.TransactWriteItemsOutput{}, nil
+	}).Times(1)
+	_, result = run(`{"atomic":true,"requests":[
+		{"method":"POST","path":"/tasks/1/tags","query":{"tag":"x"}},
+		{"method":"POST","path":"/tasks/1/tags","query":{"tag":"y"}}]}`)
+	if want := []int{http.StatusOK, http.StatusOK}; !reflect.DeepEqual(statuses(result), want) || result.Committed == nil || !*result.Committed {
+		t.Errorf("atomic batch = %+v, want committed %v", result, want)
+	}
+	_, result = run(`{"atomic":true,"requests":[
+		{"method":"POST","path":"/tasks/1/tags","query":{"tag":"x"}},
+		{"method":"POST","path":"/tasks/1/tags","query":{"tag":"x"}}]}`)
+	if want := []int{http.StatusBadRequest, http.StatusBadRequest}; !reflect.DeepEqual(statuses(result), want) || result.Committed == nil || *result.Committed {
+		t.Errorf("atomic batch = %+v, want rejected %v", result, want)
+	}
+
+	// 同じバッチで作成したタスクは、書き込むまで後のリクエストから見えない
+	for _, body := range []string{
+		`{"atomic":true,"requests":[
+			{"id":"create","method":"POST","path":"/tasks","body":{"id":"5","title":"New"}},
+			{"id":"tag","method":"POST","path":"/tasks/5/tags","query":{"tag":"x"}}]}`,
+		`{"atomic":true,"requests":[
+			{"id":"tag","method":"POST","path":"/tasks/1/tags","query":{"tag":"x"}},
+			{"id":"delete","method":"DELETE","path":"/tasks/1"}]}`,
+		`{"atomic":true,"requests":[
+			{"id":"tag","method":"POST","path":"/tasks/1/tags","query":{"tag":"x"}},
+			{"id":"read","method":"GET","path":"/tasks/2","dependsOn":["tag"]}]}`,
+	} {
+		if got, _ := run(body); got.StatusCode != http.StatusBadRequest {
+			t.Errorf("dependent atomic batch status = %v, want 400", got.StatusCode)
+		}
+	}
+
+	got, _ := run(`{"requests":[{"method":"POST","path":"/batch"}]}`)
+	if got.StatusCode != http.StatusBadRequest {
+		t.Errorf("nested batch status = %v, want 400", got.StatusCode)
+	}
+}
+
+func Test_policyCheck(t *testing.T) {
+	tests := []struct {
+		name    string
+		action  string
+		roles   []string
+		project string
+		wantErr bool
+	}{
+		{name: "Viewer Reads", action: "task:read", roles: []string{"viewer"}, wantErr: false},
+		{name: "Viewer Cannot Update", action: "task:update", roles: []string{"viewer"}, wantErr: true},
+		{name: "Editor Updates", action: "task:update", roles: []string{"editor"}, wantErr: false},
+		{name: "Editor Cannot Delete", action: "task:delete", roles: []string{"editor"}, wantErr: true},
+		{name: "Admin Deletes", action: "task:delete", roles: []string{"admin"}, wantErr: false},
+		{name: "Admin Bulk", action: "task:bulk", roles: []string{"viewer", "admin"}, wantErr: false},
+		{name: "Scoped Editor In Project", action: "task:update", roles: []string{"editor:WEB"}, project: "WEB", wantErr: false},
+		{name: "Scoped Editor Other Project", action: "task:update", roles: []string{"editor:WEB"}, project: "API", wantErr: true},
+		{name: "Scoped Role Without Project", action: "task:read", roles: []string{"admin:WEB"}, wantErr: true},
+		{name: "Unknown Role", action: "task:read", roles: []string{"owner"}, wantErr: true},
+		{name: "Unknown Action", action: "task:purge", roles: []string{"admin"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := auth.DefaultPolicy.Check(tt.action, tt.roles, tt.project)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Check() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_authorize(t *testing.T) {
+	next := func(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		return events.APIGatewayProxyResponse{StatusCode: http.StatusOK}, nil
+	}
+	resolved := 0
+	resolver := func(request events.APIGatewayProxyRequest) (string, error) {
+		resolved++
+		return "WEB", nil
+	}
+
+	tests := []struct {
+		name         string
+		action       string
+		roles        string
+		wantStatus   int
+		wantBody     string
+		wantResolved int
+	}{
+		{name: "Global Admin", action: "task:delete", roles: "admin", wantStatus: http.StatusOK},
+		{name: "Global Editor", action: "task:delete", roles: "editor", wantStatus: http.StatusForbidden, wantBody: "Forbidden: role admin is required for task:delete"},
+		{name: "Project Admin", action: "task:delete", roles: "viewer,admin:WEB", wantStatus: http.StatusOK, wantResolved: 1},
+		{name: "Other Project Admin", action: "task:delete", roles: "admin:API", wantStatus: http.StatusForbidden, wantBody: "Forbidden: role admin is required for task:delete in project WEB", wantResolved: 1},
+		{name: "No Roles", action: "task:read", roles: "", wantStatus: http.StatusForbidden, wantBody: "Forbidden: role viewer is required for task:read"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resolved = 0
+			got, err := auth.Authorize(auth.DefaultPolicy, tt.action, resolver)(next)(events.APIGatewayProxyRequest{
+				RequestContext: callerContext("tenant1", tt.roles),
+			})
+			if err != nil {
+				t.Fatalf("Authorize() error = %v", err)
+			}
+			if got.StatusCode != tt.wantStatus || got.Body != tt.wantBody {
+				t.Errorf("Authorize() = %v %q, want %v %q", got.StatusCode, got.Body, tt.wantStatus, tt.wantBody)
+			}
+			if resolved != tt.wantResolved {
+				t.Errorf("resolver called %d times, want %d", resolved, tt.wantResolved)
+			}
+		})
+	}
+}
+
+func Test_projectScopedRoutes(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockDynamoDB := mockdb.NewMockDynamoDBAPI(ctrl)
+	task.Svc = mockDynamoDB
+
+	// タスク1はAPIプロジェクトに所属する
+	mockDynamoDB.EXPECT().GetItem(gomock.Any()).Return(&dynamodb.GetItemOutput{
+		Item: map[string]*dynamodb.AttributeValue{"DataValue": {S: aws.String("tenant1#API")}},
+	}, nil).AnyTimes()
+
+	// ?project=はプロジェクトの特定に使わないため、WEBの管理者でも他のプロジェクトやテナント全体の操作はできない
+	project := map[string]string{"project": "WEB"}
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+	}{
+		{name: "Create In Other Project", method: "POST", path: "/tasks", body: `{"id":"9","project":"API"}`},
+		{name: "Task In Other Project", method: "DELETE", path: "/tasks/1"},
+		{name: "Move From Other Project", method: "PUT", path: "/tasks/1/project", body: `{"project":"WEB"}`},
+		{name: "Other Project", method: "PUT", path: "/projects/API/archive"},
+		{name: "Bulk", method: "POST", path: "/tasks/bulk", body: `{"ids":["1"],"operation":{"type":"delete"}}`},
+		{name: "API Keys", method: "POST", path: "/apikeys", body: `{"name":"ci","scopes":["admin"]}`},
+		{name: "Webhooks", method: "GET", path: "/webhooks"},
+		{name: "Tag Rewrite", method: "POST", path: "/tags/bug/rename", body: `{"name":"defect"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := handler(events.APIGatewayProxyRequest{
+				RequestContext:        callerContext("tenant1", "admin:WEB"),
+				HTTPMethod:            tt.method,
+				Path:                  tt.path,
+				QueryStringParameters: project,
+				Body:                  tt.body,
+			})
+			if err != nil || got.StatusCode != http.StatusForbidden {
+				t.Errorf("handler() = %v %v, %v, want 403", got.StatusCode, got.Body, err)
+			}
+		})
+	}
+}
+
+func Test_createApiKey(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockDynamoDB := mockdb.NewMockDynamoDBAPI(ctrl)
+	task.Svc = mockDynamoDB
+
+	var stored map[string]*dynamodb.AttributeValue
+	mockDynamoDB.EXPECT().PutItem(gomock.Any()).DoAndReturn(func(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+		stored = input.Item
+		return &dynamodb.PutItemOutput{}, nil
+	}).Times(1)
+
+	got, err := task.CreateApiKey(events.APIGatewayProxyRequest{
+		RequestContext: callerContext("tenant1", "admin"),
+		Body:           "{\"name\":\"ci-bot\", \"scopes\":[\"editor:WEB\"], \"expiresInDays\":30}",
+		HTTPMethod:     "POST",
+	})
+	if err != nil || got.StatusCode != http.StatusCreated {
+		t.Fatalf("CreateApiKey() = %v, %v", got, err)
+	}
+
+	created := struct {
+		ID     string   `json:"id"`
+		Key    string   `json:"key"`
+		Scopes []string `json:"scopes"`
+	}{}
+	if err := json.Unmarshal([]byte(got.Body), &created); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(created.Key, "tm_"+created.ID+"_") {
+		t.Errorf("key = %v, want prefix tm_%v_", created.Key, created.ID)
+	}
+
+	// 平文のキーは保存せず、ハッシュのみを保存する
+	sum := sha256.Sum256([]byte(created.Key))
+	wantHash := "ApiKey#" + hex.EncodeToString(sum[:])
+	if got := *stored["DataValue"].S; got != wantHash {
+		t.Errorf("stored DataValue = %v, want %v", got, wantHash)
+	}
+	for name, value := range stored {
+		if value.S != nil && strings.Contains(*value.S, created.Key) {
+			t.Errorf("plaintext key stored in %v", name)
+		}
+	}
+	if got := *stored["id"].S; got != "tenant1#ApiKeys" {
+		t.Errorf("stored id = %v, want tenant1#ApiKeys", got)
+	}
+
+	// 呼び出し元が持たないロールや、プロジェクト単位の管理者によるテナント全体のスコープは付与できない
+	for roles, scopes := range map[string]string{
+		"admin:WEB":        `["admin"]`,
+		"admin:WEB,editor": `["admin:API"]`,
+		"editor:WEB":       `["admin:WEB"]`,
+		"admin":            `["owner"]`,
+	} {
+		got, _ := task.CreateApiKey(events.APIGatewayProxyRequest{
+			RequestContext: callerContext("tenant1", roles),
+			Body:           `{"name":"ci-bot","scopes":` + scopes + `}`,
+			HTTPMethod:     "POST",
+		})
+		if got.StatusCode != http.StatusForbidden {
+			t.Errorf("CreateApiKey(%s, %s) status = %v, want 403", roles, scopes, got.StatusCode)
+		}
+	}
+}
+
+func Test_apiKeyAuthentication(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockDynamoDB := mockdb.NewMockDynamoDBAPI(ctrl)
+	task.Svc = mockDynamoDB
+
+	keyItem := func(revoked bool, expiresAt int64) map[string]*dynamodb.AttributeValue {
+		return map[string]*dynamodb.AttributeValue{
+			"id":        {S: aws.String("tenant1#ApiKeys")},
+			"DataType":  {S: aws.String("ApiKey#k1")},
+			"keyId":     {S: aws.String("k1")},
+			"tenantId":  {S: aws.String("tenant1")},
+			"name":      {S: aws.String("ci-bot")},
+			"scopes":    {L: []*dynamodb.AttributeValue{{S: aws.String("editor")}}},
+			"revoked":   {BOOL: aws.Bool(revoked)},
+			"expiresAt": {N: aws.String(fmt.Sprint(expiresAt))},
+		}
+	}
+
+	var gotIdentity task.Identity
+	next := func(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		gotIdentity = task.IdentityFromRequest(request)
+		return events.APIGatewayProxyResponse{StatusCode: http.StatusOK}, nil
+	}
+	api := auth.Authenticate(&auth.Verifier{}, authenticateApiKey)(next)
+	request := events.APIGatewayProxyRequest{
+		Headers: map[string]string{"Authorization": "ApiKey tm_k1_secret"},
+	}
+
+	// 有効なキーでは最終利用日時が更新される
+	mockDynamoDB.EXPECT().Query(gomock.Any()).Return(&dynamodb.QueryOutput{
+		Items: []map[string]*dynamodb.AttributeValue{keyItem(false, 0)},
+	}, nil).Times(1)
+	mockDynamoDB.EXPECT().UpdateItem(gomock.Any()).DoAndReturn(func(input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+		if *input.Key["DataType"].S != "ApiKey#k1" || input.ExpressionAttributeValues[":lastUsedAt"] == nil {
+			t.Errorf("unexpected update %v", input)
+		}
+		return &dynamodb.UpdateItemOutput{}, nil
+	}).Times(1)
+
+	got, err := api(request)
+	if err != nil || got.StatusCode != http.StatusOK {
+		t.Fatalf("Authenticate() = %v, %v", got, err)
+	}
+	want := task.Identity{Subject: "apikey:k1", TenantID: "tenant1", Roles: []string{"editor"}}
+	if !reflect.DeepEqual(gotIdentity, want) {
+		t.Errorf("identity = %v, want %v", gotIdentity, want)
+	}
+
+	// 失効済み・期限切れ・未登録のキーは401
+	for _, output := range []*dynamodb.QueryOutput{
+		{Items: []map[string]*dynamodb.AttributeValue{keyItem(true, 0)}},
+		{Items: []map[string]*dynamodb.AttributeValue{keyItem(false, 1)}},
+		{},
+	} {
+		mockDynamoDB.EXPECT().Query(gomock.Any()).Return(output, nil).Times(1)
+		got, err := api(request)
+		if err != nil || got.StatusCode != http.StatusUnauthorized {
+			t.Errorf("Authenticate() = %v, %v, want 401", got, err)
+		}
+	}
+
+	// 存在しないキーは失効できない
+	mockDynamoDB.EXPECT().UpdateItem(gomock.Any()).Return(nil,
+		awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "The conditional request failed", nil)).Times(1)
+	got, err = task.RevokeApiKey(events.APIGatewayProxyRequest{
+		RequestContext:        callerContext("tenant1", "admin"),
+		QueryStringParameters: map[string]string{"id": "k9"},
+	})
+	if err != nil || got.StatusCode != http.StatusNotFound {
+		t.Errorf("RevokeApiKey() = %v, %v, want 404", got, err)
+	}
+}
+
+func Test_createComment(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockDynamoDB := mockdb.NewMockDynamoDBAPI(ctrl)
+	task.Svc = mockDynamoDB
+
+	// タスクの存在確認とコメントの追加を同一トランザクションで行う
+	mockDynamoDB.EXPECT().TransactWriteItems(gomock.Any()).DoAndReturn(func(input *dynamodb.TransactWriteItemsInput) (*dynamodb.TransactWriteItemsOutput, error) {
+		if input.TransactItems[0].ConditionCheck == nil {
+			t.Errorf("missing condition check on task")
+		}
+		item := input.TransactItems[1].Put.Item
+		if *item["id"].S != "tenant1#1" || !strings.HasPrefix(*item["DataType"].S, "Comment#") {
+			t.Errorf("unexpected comment key %v %v", *item["id"].S, *item["DataType"].S)
+		}
+		if *item["author"].S != "user-1" || *item["body"].S != "Looks good" {
+			t.Errorf("unexpected comment %v", item)
+		}
+		return &dynamodb.TransactWriteItemsOutput{}, nil
+	}).Times(1)
+
+	got, err := task.CreateComment(events.APIGatewayProxyRequest{
+		RequestContext:        callerContext("tenant1", "editor"),
+		QueryStringParameters: map[string]string{"id": "1"},
+		Body:                  "{\"body\":\"Looks good\"}",
+		HTTPMethod:            "POST",
+	})
+	if err != nil || got.StatusCode != http.StatusCreated {
+		t.Fatalf("CreateComment() = %v, %v", got, err)
+	}
+
+	got, _ = task.CreateComment(events.APIGatewayProxyRequest{
+		RequestContext:        callerContext("tenant1", "editor"),
+		QueryStringParameters: map[string]string{"id": "1"},
+		Body:                  "{\"body\":\"  \"}",
+		HTTPMethod:            "POST",
+	})
+	if got.StatusCode != http.StatusBadRequest {
+		t.Errorf("CreateComment() status = %v, want 400", got.StatusCode)
+	}
+
+	mockDynamoDB.EXPECT().TransactWriteItems(gomock.Any()).Return(nil, &dynamodb.TransactionCanceledException{
+		Message_:            aws.String("Transaction cancelled, please refer cancellation reasons for specific reasons [ConditionalCheckFailed, None]"),
+		CancellationReasons: []*dynamodb.CancellationReason{{Code: aws.String("ConditionalCheckFailed")}, {Code: aws.String("None")}},
+	}).Times(1)
+	got, _ = task.CreateComment(events.APIGatewayProxyRequest{
+		RequestContext:        callerContext("tenant1", "editor"),
+		QueryStringParameters: map[string]string{"id": "2"},
+		Body:                  "{\"body\":\"Looks good\"}",
+		HTTPMethod:            "POST",
+	})
+	if got.StatusCode != http.StatusNotFound {
+		t.Errorf("CreateComment() status = %v, want 404 for a missing task", got.StatusCode)
+	}
+}
+
+func Test_updateComment(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockDynamoDB := mockdb.NewMockDynamoDBAPI(ctrl)
+	task.Svc = mockDynamoDB
+
+	mockDynamoDB.EXPECT().UpdateItem(gomock.Any()).DoAndReturn(func(input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+		if got := *input.Key["DataType"].S; got != "Comment#00000000000000000001#abc" {
+			t.Errorf("UpdateItem DataType = %v", got)
+		}
+		if got := *input.ExpressionAttributeValues[":author"].S; got != "user-1" {
+			t.Errorf("UpdateItem :author = %v", got)
+		}
+		return nil, awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "The conditional request failed", nil)
+	}).Times(2)
+	// コメントはあるので投稿者でないことが理由
+	mockDynamoDB.EXPECT().GetItem(gomock.Any()).Return(&dynamodb.GetItemOutput{Item: map[string]*dynamodb.AttributeValue{
+		"id": {S: aws.String("tenant1#1")}, "DataType": {S: aws.String("Comment#00000000000000000001#abc")}, "author": {S: aws.String("user-2")},
+	}}, nil).Times(1)
+
+	got, err := task.UpdateComment(events.APIGatewayProxyRequest{
+		RequestContext:        callerContext("tenant1", "editor"),
+		QueryStringParameters: map[string]string{"id": "1", "commentId": "00000000000000000001-abc"},
+		Body:                  "{\"body\":\"Edited\"}",
+		HTTPMethod:            "PUT",
+	})
+	want := events.APIGatewayProxyResponse{
+		Body:       "Only the author can edit the comment",
+		StatusCode: http.StatusForbidden,
+	}
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("UpdateComment() = %v, want %v", got, want)
+	}
+
+	// コメントがなければ404
+	mockDynamoDB.EXPECT().GetItem(gomock.Any()).Return(&dynamodb.GetItemOutput{}, nil).Times(1)
+	got, _ = task.UpdateComment(events.APIGatewayProxyRequest{
+		RequestContext:        callerContext("tenant1", "editor"),
+		QueryStringParameters: map[string]string{"id": "1", "commentId": "00000000000000000001-abc"},
+		Body:                  "{\"body\":\"Edited\"}",
+		HTTPMethod:            "PUT",
+	})
+	if got.StatusCode != http.StatusNotFound {
+		t.Errorf("UpdateComment() status = %v, want 404 for a missing comment", got.StatusCode)
+	}
+}
+
+func Test_getComments(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockDynamoDB := mockdb.NewMockDynamoDBAPI(ctrl)
+	task.Svc = mockDynamoDB
+
+	lastKey := map[string]*dynamodb.AttributeValue{
+		"id":       {S: aws.String("tenant1#1")},
+		"DataType": {S: aws.String("Comment#00000000000000000001#abc")},
+	}
+	mockDynamoDB.EXPECT().Query(gomock.Any()).DoAndReturn(func(input *dynamodb.QueryInput) (*dynamodb.QueryOutput, error) {
+		if *input.Limit != 1 || input.ExclusiveStartKey != nil {
+			t.Errorf("unexpected first page input %v", input)
+		}
+		return &dynamodb.QueryOutput{
+			Items: []map[string]*dynamodb.AttributeValue{
+				{
+					"id":        lastKey["id"],
+					"DataType":  lastKey["DataType"],
+					"commentId": {S: aws.String("00000000000000000001-abc")},
+					"taskId":    {S: aws.String("1")},
+					"author":    {S: aws.String("user-1")},
+					"body":      {S: aws.String("First")},
+					"createdAt": {N: aws.String("1")},
+				},
+			},
+			LastEvaluatedKey: lastKey,
+		}, nil
+	}).Times(1)
+
+	got, err := task.GetComments(events.APIGatewayProxyRequest{
+		RequestContext:        callerContext("tenant1", "viewer"),
+		QueryStringParameters: map[string]string{"id": "1", "limit": "1"},
+	})
+	if err != nil || got.StatusCode != http.StatusOK {
+		t.Fatalf("GetComments() = %v, %v", got, err)
+	}
+	page := struct {
+		Comments   []task.Comment `json:"comments"`
+		NextCursor string         `json:"nextCursor"`
+	}{}
+	if err := json.Unmarshal([]byte(got.Body), &page); err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Comments) != 1 || page.Comments[0].Body != "First" || page.NextCursor == "" {
+		t.Fatalf("GetComments() = %v", got.Body)
+	}
+
+	// 次のページはカーソルから続きを取得する
+	mockDynamoDB.EXPECT().Query(gomock.Any()).DoAndReturn(func(input *dynamodb.QueryInput) (*dynamodb.QueryOutput, error) {
+		if !reflect.DeepEqual(input.ExclusiveStartKey, lastKey) {
+			t.Errorf("ExclusiveStartKey = %v, want %v", input.ExclusiveStartKey, lastKey)
+		}
+		return &dynamodb.QueryOutput{}, nil
+	}).Times(1)
+
+	got, _ = task.GetComments(events.APIGatewayProxyRequest{
+		RequestContext:        callerContext("tenant1", "viewer"),
+		QueryStringParameters: map[string]string{"id": "1", "limit": "1", "cursor": page.NextCursor},
+	})
+	if got.Body != "{\"comments\":[]}" {
+		t.Errorf("GetComments() = %v", got.Body)
+	}
+
+	// 他のタスクのカーソルは受け付けない
+	got, _ = task.GetComments(events.APIGatewayProxyRequest{
+		RequestContext:        callerContext("tenant1", "viewer"),
+		QueryStringParameters: map[string]string{"id": "2", "cursor": page.NextCursor},
+	})
+	if got.StatusCode != http.StatusBadRequest {
+		t.Errorf("GetComments() status = %v, want 400", got.StatusCode)
+	}
+}
+
+func Test_getTaskWithSubtasks(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockDynamoDB := mockdb.NewMockDynamoDBAPI(ctrl)
+	task.Svc = mockDynamoDB
+
+	mockDynamoDB.EXPECT().Query(gomock.Any()).DoAndReturn(rangeQuery([]map[string]*dynamodb.AttributeValue{
+		{"id": {S: aws.String("tenant1#1")}, "DataType": {S: aws.String("Title")}, "DataValue": {S: aws.String("tenant1#Parent")}},
+		{"id": {S: aws.String("tenant1#1")}, "DataType": {S: aws.String("Subtask#3")}, "position": {N: aws.String("2")}},
+		{"id": {S: aws.String("tenant1#1")}, "DataType": {S: aws.String("Subtask#2")}, "position": {N: aws.String("1")}},
+		{"id": {S: aws.String("tenant1#1")}, "DataType": {S: aws.String("Checklist#a")}, "text": {S: aws.String("Review")}, "done": {BOOL: aws.Bool(true)}, "position": {N: aws.String("1")}},
+	})).Times(3)
+	mockDynamoDB.EXPECT().Query(gomock.Any()).DoAndReturn(partitionQuery([]map[string]*dynamodb.AttributeValue{
+		{"id": {S: aws.String("tenant1#2")}, "DataType": {S: aws.String("Status")}, "DataValue": {S: aws.String("tenant1#Done")}},
+		{"id": {S: aws.String("tenant1#3")}, "DataType": {S: aws.String("Status")}, "DataValue": {S: aws.String("tenant1#Open")}},
+	})).Times(4)
+
+	got, err := task.GetTaskById("tenant1", "1")
+	want := "[{\"id\":\"1\",\"title\":\"Parent\",\"subtasks\":[{\"id\":\"2\",\"status\":\"Done\"},{\"id\":\"3\",\"status\":\"Open\"}]," +
+		"\"checklist\":[{\"id\":\"a\",\"text\":\"Review\",\"done\":true}],\"progress\":{\"done\":2,\"total\":3}}]"
+	if err != nil || got.Body != want {
+		t.Errorf("GetTaskById() = %v, want %v", got.Body, want)
+	}
+}
+
+func Test_checklistItem(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockDynamoDB := mockdb.NewMockDynamoDBAPI(ctrl)
+	task.Svc = mockDynamoDB
+
+	// 存在しないタスクには追加しない
+	mockDynamoDB.EXPECT().TransactWriteItems(gomock.Any()).DoAndReturn(func(input *dynamodb.TransactWriteItemsInput) (*dynamodb.TransactWriteItemsOutput, error) {
+		return nil, canceledAt(len(input.TransactItems), 0)
+	}).Times(1)
+	got, err := task.AddChecklistItem(events.APIGatewayProxyRequest{
+		RequestContext:        callerContext("tenant1", "editor"),
+		QueryStringParameters: map[string]string{"id": "9"},
+		Body:                  "{\"text\":\"Review\"}",
+	})
+	if err != nil || got.StatusCode != http.StatusNotFound {
+		t.Errorf("AddChecklistItem() = %v, want 404 for a missing task", got)
+	}
+
+	// 空のテキストには更新できない
+	got, _ = task.UpdateChecklistItem(events.APIGatewayProxyRequest{
+		RequestContext:        callerContext("tenant1", "editor"),
+		QueryStringParameters: map[string]string{"id": "1", "itemId": "a"},
+		Body:                  "{\"text\":\"  \"}",
+	})
+	if got.StatusCode != http.StatusBadRequest {
+		t.Errorf("UpdateChecklistItem() status = %v, want 400 for blank text", got.StatusCode)
+	}
+
+	// 読み取った後に削除された項目は404を返す
+	mockDynamoDB.EXPECT().GetItem(gomock.Any()).Return(&dynamodb.GetItemOutput{Item: map[string]*dynamodb.AttributeValue{
+		"id": {S: aws.String("tenant1#1")}, "DataType": {S: aws.String("Checklist#a")}, "text": {S: aws.String("Review")}, "done": {BOOL: aws.Bool(false)},
+	}}, nil).Times(1)
+	mockDynamoDB.EXPECT().TransactWriteItems(gomock.Any()).DoAndReturn(func(input *dynamodb.TransactWriteItemsInput) (*dynamodb.TransactWriteItemsOutput, error) {
+		return nil, canceledAt(len(input.TransactItems), 0)
+	}).Times(1)
+	got, _ = task.UpdateChecklistItem(events.APIGatewayProxyRequest{
+		RequestContext:        callerContext("tenant1", "editor"),
+		QueryStringParameters: map[string]string{"id": "1", "itemId": "a"},
+		Body:                  "{\"done\":true}",
+	})
+	if got.StatusCode != http.StatusNotFound {
+		t.Errorf("UpdateChecklistItem() status = %v, want 404 for a deleted item", got.StatusCode)
+	}
+}
+
+func Test_blockParentCompletion(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockDynamoDB := mockdb.NewMockDynamoDBAPI(ctrl)
+	task.Svc = mockDynamoDB
+
+	mockDynamoDB.EXPECT().Query(gomock.Any()).Return(&dynamodb.QueryOutput{
+		Items: []map[string]*dynamodb.AttributeValue{
+			{"id": {S: aws.String("tenant1#1")}, "DataType": {S: aws.String("Subtask#2")}, "position": {N: aws.String("1")}},
+		},
+	}, nil).Times(1)
+	mockDynamoDB.EXPECT().Query(gomock.Any()).DoAndReturn(partitionQuery([]map[string]*dynamodb.AttributeValue{
+		{"id": {S: aws.String("tenant1#2")}, "DataType": {S: aws.String("Status")}, "DataValue": {S: aws.String("tenant1#Open")}},
+	})).Times(2)
+
+	// 未完了のサブタスクがあるため更新しない
+	got, err := task.UpdateTaskAttribute(events.APIGatewayProxyRequest{
+		RequestContext:        tenantContext("tenant1"),
+		QueryStringParameters: map[string]string{"id": "1", "status": "done"},
+		HTTPMethod:            "PUT",
+	}, "Status", "status")
+	want := events.APIGatewayProxyResponse{
+		Body:       "Task has 1 open subtasks",
+		StatusCode: http.StatusConflict,
+	}
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("UpdateTaskAttribute() = %v, want %v", got, want)
+	}
+}
+
+func Test_addSubtask(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockDynamoDB := mockdb.NewMockDynamoDBAPI(ctrl)
+	task.Svc = mockDynamoDB
+
+	// 親タスク1の祖先をたどる: 1の親は3、3は親なし。1はWEBプロジェクトに所属する
+	fields := map[string]string{"tenant1#1/Parent": "tenant1#3", "tenant1#1/Project": "tenant1#WEB"}
+	mockDynamoDB.EXPECT().GetItem(gomock.Any()).DoAndReturn(func(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+		value, ok := fields[*input.Key["id"].S+"/"+*input.Key["DataType"].S]
+		if !ok {
+			return &dynamodb.GetItemOutput{}, nil
+		}
+		return &dynamodb.GetItemOutput{Item: map[string]*dynamodb.AttributeValue{"DataValue": {S: aws.String(value)}}}, nil
+	}).AnyTimes()
+	mockDynamoDB.EXPECT().TransactWriteItems(gomock.Any()).DoAndReturn(func(input *dynamodb.TransactWriteItemsInput) (*dynamodb.TransactWriteItemsOutput, error) {
+		if len(input.TransactItems) != 6 {
+			t.Fatalf("TransactItems = %d, want 6", len(input.TransactItems))
+		}
+		// 子タスクも親タスクと同じプロジェクトに所属していること
+		child := input.TransactItems[1].ConditionCheck
+		if *child.Key["id"].S != "tenant1#2" || *child.ExpressionAttributeValues[":project"].S != "tenant1#WEB" {
+			t.Errorf("unexpected project check %v", child)
+		}
+		parent := input.TransactItems[2].Put.Item
+		if *parent["id"].S != "tenant1#2" || *parent["DataValue"].S != "tenant1#1" {
+			t.Errorf("unexpected parent item %v", parent)
+		}
+		if got := *input.TransactItems[3].Put.Item["DataType"].S; got != "Subtask#2" {
+			t.Errorf("link DataType = %v", got)
+		}
+		return &dynamodb.TransactWriteItemsOutput{}, nil
+	}).Times(1)
+
+	got, err := task.AddSubtask(events.APIGatewayProxyRequest{
+		RequestContext:        tenantContext("tenant1"),
+		QueryStringParameters: map[string]string{"id": "1"},
+		Body:                  "{\"childId\":\"2\"}",
+		HTTPMethod:            "POST",
+	})
+	if err != nil || got.StatusCode != http.StatusOK {
+		t.Fatalf("AddSubtask() = %v, %v", got, err)
+	}
+
+	// 祖先を子タスクにすると循環するため拒否する
+	got, _ = task.AddSubtask(events.APIGatewayProxyRequest{
+		RequestContext:        tenantContext("tenant1"),
+		QueryStringParameters: map[string]string{"id": "1"},
+		Body:                  "{\"childId\":\"3\"}",
+		HTTPMethod:            "POST",
+	})
+	if got.StatusCode != http.StatusConflict {
+		t.Errorf("AddSubtask() status = %v, want 409", got.StatusCode)
+	}
+
+	// 親子関係にないタスクは外せない
+	mockDynamoDB.EXPECT().TransactWriteItems(gomock.Any()).Return(nil, &dynamodb.TransactionCanceledException{
+		Message_:            aws.String("Transaction cancelled, please refer cancellation reasons for specific reasons [ConditionalCheckFailed, None, None, None]"),
+		CancellationReasons: []*dynamodb.CancellationReason{{Code: aws.String("ConditionalCheckFailed")}, {Code: aws.String("None")}, {Code: aws.String("None")}, {Code: aws.String("None")}},
+	}).Times(1)
+	got, _ = task.RemoveSubtask(events.APIGatewayProxyRequest{
+		RequestContext:        tenantContext("tenant1"),
+		QueryStringParameters: map[string]string{"id": "1", "childId": "4"},
+		HTTPMethod:            "DELETE",
+	})
+	if got.StatusCode != http.StatusNotFound {
+		t.Errorf("RemoveSubtask() status = %v, want 404", got.StatusCode)
+	}
+}
+
+// タスクのパーティションのアイテムだけを返すQueryのモック
+func partitionQuery(items []map[string]*dynamodb.AttributeValue) func(input *dynamodb.QueryInput) (*dynamodb.QueryOutput, error) {
+	return func(input *dynamodb.QueryInput) (*dynamodb.QueryOutput, error) {
+		id := *input.ExpressionAttributeValues[":id"].S
+		matched := []map[string]*dynamodb.AttributeValue{}
+		for _, item := range items {
+			if *item["id"].S == id {
+				matched = append(matched, item)
+			}
+		}
+		return &dynamodb.QueryOutput{Items: inDataTypeRange(input, matched)}, nil
+	}
+}
+
+// DataTypeの範囲を指定したQueryでは、範囲に含まれるアイテムだけを返す
+func inDataTypeRange(input *dynamodb.QueryInput, items []map[string]*dynamodb.AttributeValue) []map[string]*dynamodb.AttributeValue {
+	from, to := input.ExpressionAttributeValues[":from"], input.ExpressionAttributeValues[":to"]
+	if from == nil || to == nil {
+		return items
+	}
+	matched := []map[string]*dynamodb.AttributeValue{}
+	for _, item := range items {
+		if dataType := *item["DataType"].S; dataType >= *from.S && dataType <= *to.S {
+			matched = append(matched, item)
+		}
+	}
+	return matched
+}
+
+// パーティションを区別せず、DataTypeの範囲に含まれるアイテムを返すQueryのモック
+func rangeQuery(items []map[string]*dynamodb.AttributeValue) func(input *dynamodb.QueryInput) (*dynamodb.QueryOutput, error) {
+	return func(input *dynamodb.QueryInput) (*dynamodb.QueryOutput, error) {
+		return &dynamodb.QueryOutput{Items: inDataTypeRange(input, items)}, nil
+	}
+}
+
+// パーティションごとの依存関係アイテムを返すQueryのモック
+func linkQuery(links map[string][]string) func(input *dynamodb.QueryInput) (*dynamodb.QueryOutput, error) {
+	return func(input *dynamodb.QueryInput) (*dynamodb.QueryOutput, error) {
+		id := *input.ExpressionAttributeValues[":id"].S
+		prefix := *input.ExpressionAttributeValues[":prefix"].S
+		items := []map[string]*dynamodb.AttributeValue{}
+		for _, dataType := range links[id] {
+			if strings.HasPrefix(dataType, prefix) {
+				items = append(items, map[string]*dynamodb.AttributeValue{
+					"id":       {S: aws.String(id)},
+					"DataType": {S: aws.String(dataType)},
+				})
+			}
+		}
+		return &dynamodb.QueryOutput{Items: items}, nil
+	}
+}
+
+func Test_addDependency(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockDynamoDB := mockdb.NewMockDynamoDBAPI(ctrl)
+	task.Svc = mockDynamoDB
+
+	// 1が2をブロックし、2が3をブロックしている
+	links := linkQuery(map[string][]string{
+		"tenant1#1": {"Blocks#2"},
+		"tenant1#2": {"BlockedBy#1", "Blocks#3"},
+		"tenant1#3": {"BlockedBy#2"},
+	})
+	statuses := partitionQuery([]map[string]*dynamodb.AttributeValue{
+		{"id": {S: aws.String("tenant1#1")}, "DataType": {S: aws.String("Status")}, "DataValue": {S: aws.String("tenant1#Done")}},
+		{"id": {S: aws.String("tenant1#2")}, "DataType": {S: aws.String("Status")}, "DataValue": {S: aws.String("tenant1#Open")}},
+	})
+	// 依存関係はDataTypeの前方一致、タスクの属性はパーティション全体をクエリする
+	// 依存関係は直前に追加されたものを見落とさないよう、強い整合性で読み取る
+	mockDynamoDB.EXPECT().Query(gomock.Any()).DoAndReturn(func(input *dynamodb.QueryInput) (*dynamodb.QueryOutput, error) {
+		if _, ok := input.ExpressionAttributeValues[":prefix"]; ok {
+			if !aws.BoolValue(input.ConsistentRead) {
+				t.Errorf("dependency links must be read with ConsistentRead")
+			}
+			return links(input)
+		}
+		return statuses(input)
+	}).AnyTimes()
+
+	got, err := task.GetDependencies(events.APIGatewayProxyRequest{
+		RequestContext:        tenantContext("tenant1"),
+		QueryStringParameters: map[string]string{"id": "3", "depth": "2"},
+		HTTPMethod:            "GET",
+	})
+	want := "{\"id\":\"3\",\"blocked\":true,\"blockedBy\":[{\"id\":\"2\",\"status\":\"Open\",\"depth\":1},{\"id\":\"1\",\"status\":\"Done\",\"depth\":2}],\"blocks\":[]}"
+	if err != nil || got.Body != want {
+		t.Errorf("GetDependencies() = %v, want %v", got.Body, want)
+	}
+
+	// 循環の確認に使った依存グラフのバージョンが変わっていない場合のみ書き込む
+	mockDynamoDB.EXPECT().GetItem(gomock.Any()).Return(&dynamodb.GetItemOutput{
+		Item: map[string]*dynamodb.AttributeValue{"Version": {N: aws.String("3")}},
+	}, nil).Times(2)
+	mockDynamoDB.EXPECT().TransactWriteItems(gomock.Any()).DoAndReturn(func(input *dynamodb.TransactWriteItemsInput) (*dynamodb.TransactWriteItemsOutput, error) {
+		update := input.TransactItems[2].Update
+		if *update.Key["id"].S != "tenant1#Dependencies" || *update.ConditionExpression != "Version = :version" ||
+			*update.ExpressionAttributeValues[":version"].N != "3" || *update.ExpressionAttributeValues[":next"].N != "4" {
+			t.Errorf("unexpected version update %v", update)
+		}
+		return &dynamodb.TransactWriteItemsOutput{}, nil
+	}).Times(1)
+	got, _ = task.AddDependency(events.APIGatewayProxyRequest{
+		RequestContext:        tenantContext("tenant1"),
+		QueryStringParameters: map[string]string{"id": "4"},
+		Body:                  "{\"blockedBy\":\"3\"}",
+		HTTPMethod:            "POST",
+	})
+	if got.StatusCode != http.StatusOK {
+		t.Errorf("AddDependency() status = %v, want 200", got.StatusCode)
+	}
+
+	// 同時に追加された依存関係があれば409を返す
+	mockDynamoDB.EXPECT().TransactWriteItems(gomock.Any()).Return(nil, &dynamodb.TransactionCanceledException{
+		Message_:            aws.String("Transaction cancelled, please refer cancellation reasons for specific reasons [None, None, ConditionalCheckFailed, None, None]"),
+		CancellationReasons: []*dynamodb.CancellationReason{{Code: aws.String("None")}, {Code: aws.String("None")}, {Code: aws.String("ConditionalCheckFailed")}, {Code: aws.String("None")}, {Code: aws.String("None")}},
+	}).Times(1)
+	got, _ = task.AddDependency(events.APIGatewayProxyRequest{
+		RequestContext:        tenantContext("tenant1"),
+		QueryStringParameters: map[string]string{"id": "4"},
+		Body:                  "{\"blockedBy\":\"3\"}",
+		HTTPMethod:            "POST",
+	})
+	if got.StatusCode != http.StatusConflict {
+		t.Errorf("AddDependency() status = %v, want 409", got.StatusCode)
+	}
+}
+
+func Test_taskHistory(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockDynamoDB := mockdb.NewMockDynamoDBAPI(ctrl)
+	task.Svc = mockDynamoDB
+
+	mockDynamoDB.EXPECT().GetItem(gomock.Any()).Return(&dynamodb.GetItemOutput{
+		Item: map[string]*dynamodb.AttributeValue{"DataValue": {S: aws.String("tenant1#Old title")}},
+	}, nil).Times(2)
+
+	// 変更と履歴の追加は同一トランザクションで、読み取った値から変わっていない場合のみ書き込む
+	mockDynamoDB.EXPECT().TransactWriteItems(gomock.Any()).DoAndReturn(func(input *dynamodb.TransactWriteItemsInput) (*dynamodb.TransactWriteItemsOutput, error) {
+		update := input.TransactItems[0].Update
+		if got := *update.ExpressionAttributeValues[":old_value"].S; got != "tenant1#Old title" {
+			t.Errorf("Update :old_value = %v", got)
+		}
+		history := input.TransactItems[2].Put
+		if *history.ConditionExpression != "attribute_not_exists(id)" || !strings.HasPrefix(*history.Item["DataType"].S, "History#") {
+			t.Errorf("unexpected history put %v", history)
+		}
+		item := history.Item
+		if *item["actor"].S != "user-1" || *item["field"].S != "Title" || *item["oldValue"].S != "Old title" || *item["newValue"].S != "New title" {
+			t.Errorf("unexpected history entry %v", item)
+		}
+		return &dynamodb.TransactWriteItemsOutput{}, nil
+	}).Times(1)
+
+	request := events.APIGatewayProxyRequest{
+		RequestContext:        callerContext("tenant1", "editor"),
+		QueryStringParameters: map[string]string{"id": "1", "title": "New title"},
+		HTTPMethod:            "PUT",
+	}
+	got, err := task.UpdateTaskAttribute(request, "Title", "title")
+	if err != nil || got.StatusCode != http.StatusOK {
+		t.Fatalf("UpdateTaskAttribute() = %v, %v", got, err)
+	}
+
+	// 読み取り後に他のリクエストが更新していれば競合として扱う
+	mockDynamoDB.EXPECT().TransactWriteItems(gomock.Any()).Return(nil,
+		awserr.New(dynamodb.ErrCodeTransactionCanceledException, "Transaction cancelled, please refer cancellation reasons for specific reasons [ConditionalCheckFailed, None]", nil)).Times(1)
+
+	got, _ = task.UpdateTaskAttribute(request, "Title", "title")
+	if got.StatusCode != http.StatusConflict {
+		t.Errorf("UpdateTaskAttribute() status = %v, want 409", got.StatusCode)
+	}
+
+	// 属性アイテムがなければ、タスクが存在することを確認して追加する
+	mockDynamoDB.EXPECT().GetItem(gomock.Any()).Return(&dynamodb.GetItemOutput{}, nil).Times(2)
+	mockDynamoDB.EXPECT().TransactWriteItems(gomock.Any()).DoAndReturn(func(input *dynamodb.TransactWriteItemsInput) (*dynamodb.TransactWriteItemsOutput, error) {
+		put := input.TransactItems[0].Put
+		if put == nil || *put.Item["DataValue"].S != "tenant1#Details" {
+			t.Errorf("expected a put of the new description, got %v", input.TransactItems[0])
+		}
+		if check := input.TransactItems[1].ConditionCheck; check == nil || *check.Key["DataType"].S != "Project" {
+			t.Errorf("expected a task existence check, got %v", input.TransactItems[1])
+		}
+		return &dynamodb.TransactWriteItemsOutput{}, nil
+	}).Times(1)
+	description := events.APIGatewayProxyRequest{
+		RequestContext:        callerContext("tenant1", "editor"),
+		QueryStringParameters: map[string]string{"id": "1", "description": "Details"},
+		HTTPMethod:            "PUT",
+	}
+	got, _ = task.UpdateTaskAttribute(description, "Description", "description")
+	if got.StatusCode != http.StatusOK {
+		t.Errorf("UpdateTaskAttribute() status = %v, want 200", got.StatusCode)
+	}
+
+	// タスク自体がなければ404を返す
+	mockDynamoDB.EXPECT().TransactWriteItems(gomock.Any()).Return(nil, &dynamodb.TransactionCanceledException{
+		Message_:            aws.String("Transaction cancelled, please refer cancellation reasons for specific reasons [None, ConditionalCheckFailed, None]"),
+		CancellationReasons: []*dynamodb.CancellationReason{{Code: aws.String("None")}, {Code: aws.String("ConditionalCheckFailed")}, {Code: aws.String("None")}},
+	}).Times(1)
+	got, _ = task.UpdateTaskAttribute(description, "Description", "description")
+	if got.StatusCode != http.StatusNotFound {
+		t.Errorf("UpdateTaskAttribute() status = %v, want 404", got.StatusCode)
+	}
+
+	mockDynamoDB.EXPECT().Query(gomock.Any()).DoAndReturn(func(input *dynamodb.QueryInput) (*dynamodb.QueryOutput, error) {
+		if *input.ScanIndexForward || *input.ExpressionAttributeValues[":prefix"].S != "History#" {
+			t.Errorf("unexpected query %v", input)
+		}
+		return &dynamodb.QueryOutput{
+			Items: []map[string]*dynamodb.AttributeValue{
+				{
+					"id":        {S: aws.String("tenant1#1")},
+					"DataType":  {S: aws.String("History#00000000000000000002-abc")},
+					"entryId":   {S: aws.String("00000000000000000002-abc")},
+					"taskId":    {S: aws.String("1")},
+					"actor":     {S: aws.String("user-1")},
+					"timestamp": {N: aws.String("2")},
+					"field":     {S: aws.String("Title")},
+					"oldValue":  {S: aws.String("Old title")},
+					"newValue":  {S: aws.String("New title")},
+				},
+			},
+		}, nil
+	}).Times(1)
+
+	got, err = task.GetHistory(events.APIGatewayProxyRequest{
+		RequestContext:        callerContext("tenant1", "viewer"),
+		QueryStringParameters: map[string]string{"id": "1"},
+	})
+	want := "{\"entries\":[{\"id\":\"00000000000000000002-abc\",\"taskId\":\"1\",\"actor\":\"user-1\",\"timestamp\":2,\"field\":\"Title\",\"oldValue\":\"Old title\",\"newValue\":\"New title\"}]}"
+	if err != nil || got.Body != want {
+		t.Errorf("GetHistory() = %v, want %v", got.Body, want)
+	}
+}
+
+func historyItem(mutation string, field string, oldValue string, newValue string) map[string]*dynamodb.AttributeValue {
+	item := map[string]*dynamodb.AttributeValue{
+		"id":        {S: aws.String("tenant1#1")},
+		"DataType":  {S: aws.String("History#" + mutation + "-" + field + newValue)},
+		"entryId":   {S: aws.String(mutation + "-" + field + newValue)},
+		"taskId":    {S: aws.String("1")},
+		"actor":     {S: aws.String("user-1")},
+		"timestamp": {N: aws.String("1")},
+		"field":     {S: aws.String(field)},
+	}
+	if oldValue != "" {
+		item["oldValue"] = &dynamodb.AttributeValue{S: aws.String(oldValue)}
+	}
+	if newValue != "" {
+		item["newValue"] = &dynamodb.AttributeValue{S: aws.String(newValue)}
+	}
+	return item
+}
+
+func Test_taskRevisions(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockDynamoDB := mockdb.NewMockDynamoDBAPI(ctrl)
+	task.Svc = mockDynamoDB
+
+	// 作成、タイトルの変更、タグとステータスの変更の3リビジョン
+	history := []map[string]*dynamodb.AttributeValue{
+		historyItem("0001", "Project", "", "WEB"),
+		historyItem("0001", "Status", "", "Open"),
+		historyItem("0001", "Tags", "", "x"),
+		historyItem("0001", "Title", "", "A"),
+		historyItem("0002", "Title", "A", "B"),
+		historyItem("0003", "Comment", "", "ignored"),
+		historyItem("0004", "Status", "Open", "Closed"),
+		historyItem("0004", "Tags", "x", "y"),
+	}
+	mockDynamoDB.EXPECT().Query(gomock.Any()).DoAndReturn(func(input *dynamodb.QueryInput) (*dynamodb.QueryOutput, error) {
+		if _, ok := input.ExpressionAttributeValues[":prefix"]; ok {
+			return &dynamodb.QueryOutput{Items: history}, nil
+		}
+		// 現在のタスク
+		return &dynamodb.QueryOutput{
+			Items: []map[string]*dynamodb.AttributeValue{
+				{"id": {S: aws.String("tenant1#1")}, "DataType": {S: aws.String("Project")}, "DataValue": {S: aws.String("tenant1#WEB")}},
+				{"id": {S: aws.String("tenant1#1")}, "DataType": {S: aws.String("Status")}, "DataValue": {S: aws.String("tenant1#Closed")}},
+				{"id": {S: aws.String("tenant1#1")}, "DataType": {S: aws.String("Tags#y")}, "DataValue": {S: aws.String("tenant1#y")}},
+				{"id": {S: aws.String("tenant1#1")}, "DataType": {S: aws.String("Title")}, "DataValue": {S: aws.String("tenant1#B")}},
+			},
+		}, nil
+	}).AnyTimes()
+
+	got, err := task.GetRevision(events.APIGatewayProxyRequest{
+		RequestContext:        callerContext("tenant1", "viewer"),
+		QueryStringParameters: map[string]string{"id": "1", "n": "2"},
+	})
+	want := "{\"revision\":2,\"timestamp\":1,\"actor\":\"user-1\",\"task\":{\"id\":\"1\",\"title\":\"B\",\"status\":\"Open\",\"tags\":[\"x\"],\"project\":\"WEB\"}}"
+	if err != nil || got.Body != want {
+		t.Errorf("GetRevision() = %v, want %v", got.Body, want)
+	}
+
+	got, _ = task.GetRevision(events.APIGatewayProxyRequest{
+		RequestContext:        callerContext("tenant1", "viewer"),
+		QueryStringParameters: map[string]string{"id": "1", "n": "4"},
+	})
+	if got.StatusCode != http.StatusNotFound {
+		t.Errorf("GetRevision() status = %v, want 404", got.StatusCode)
+	}
+
+	got, err = task.DiffRevisions(events.APIGatewayProxyRequest{
+		RequestContext:        callerContext("tenant1", "viewer"),
+		QueryStringParameters: map[string]string{"id": "1", "from": "1", "to": "3"},
+	})
+	want = "[{\"field\":\"Title\",\"from\":\"A\",\"to\":\"B\"},{\"field\":\"Status\",\"from\":\"Open\",\"to\":\"Closed\"}," +
+		"{\"field\":\"Tags\",\"from\":\"x\"},{\"field\":\"Tags\",\"to\":\"y\"}]"
+	if err != nil || got.Body != want {
+		t.Errorf("DiffRevisions() = %v, want %v", got.Body, want)
+	}
+
+	// 元に戻す変更は現在の値を条件に書き込み、履歴とステータス・タグのイベントも残す
+	mockDynamoDB.EXPECT().TransactWriteItems(gomock.Any()).DoAndReturn(func(input *dynamodb.TransactWriteItemsInput) (*dynamodb.TransactWriteItemsOutput, error) {
+		if len(input.TransactItems) != 13 {
+			t.Fatalf("TransactItems = %d, want 13", len(input.TransactItems))
+		}
+		title := input.TransactItems[0].Update
+		if *title.ExpressionAttributeValues[":old_value"].S != "tenant1#B" || *title.ExpressionAttributeValues[":new_value"].S != "tenant1#A" {
+			t.Errorf("unexpected title update %v", title)
+		}
+		if input.TransactItems[2].Delete == nil || *input.TransactItems[2].Delete.Key["DataType"].S != "Tags#y" {
+			t.Errorf("tag y must be removed")
+		}
+		if input.TransactItems[3].Put == nil || *input.TransactItems[3].Put.Item["DataType"].S != "Tags#x" {
+			t.Errorf("tag x must be added")
+		}
+		for _, item := range input.TransactItems[4:8] {
+			if !strings.HasPrefix(*item.Put.Item["DataType"].S, "History#") {
+				t.Errorf("missing history entry")
+			}
+		}
+		for _, item := range input.TransactItems[8:10] {
+			if *item.Put.Item["id"].S != "tenant1#Outbox" {
+				t.Errorf("missing outbox event")
+			}
+		}
+		if *input.TransactItems[10].Put.Item["id"].S != "tenant1#Changes" {
+			t.Errorf("missing change log entry")
+		}
+		// タグの使用数はタグごとに増減する
+		counts := map[string]string{}
+		for _, item := range input.TransactItems[11:] {
+			counts[*item.Update.Key["id"].S] = *item.Update.ExpressionAttributeValues[":delta"].N
+		}
+		if want := map[string]string{"tenant1#Tag#x": "1", "tenant1#Tag#y": "-1"}; !reflect.DeepEqual(counts, want) {
+			t.Errorf("tag counts = %v, want %v", counts, want)
+		}
+		return &dynamodb.TransactWriteItemsOutput{}, nil
+	}).Times(1)
+
+	got, err = task.RevertTask(events.APIGatewayProxyRequest{
+		RequestContext:        callerContext("tenant1", "editor"),
+		QueryStringParameters: map[string]string{"id": "1", "to": "1"},
+		HTTPMethod:            "POST",
+	})
+	if err != nil || got.StatusCode != http.StatusOK {
+		t.Errorf("RevertTask() = %v, %v", got, err)
+	}
+}
+
+// トランザクションに含まれるアウトボックスのイベント
+func outboxEvents(t *testing.T, input *dynamodb.TransactWriteItemsInput) []task.DomainEvent {
+	result := []task.DomainEvent{}
+	for _, item := range input.TransactItems {
+		if item.Put == nil || *item.Put.Item["id"].S != "tenant1#Outbox" {
+			continue
+		}
+		event := task.DomainEvent{}
+		if err := json.Unmarshal([]byte(*item.Put.Item["event"].S), &event); err != nil {
+			t.Fatal(err)
+		}
+		result = append(result, event)
+	}
+	return result
+}
+
+func Test_sweepOutbox(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockDynamoDB := mockdb.NewMockDynamoDBAPI(ctrl)
+	task.Svc = mockDynamoDB
+
+	event := func(tenantId string, id string) map[string]*dynamodb.AttributeValue {
+		data, _ := json.Marshal(task.DomainEvent{ID: id, Type: task.TaskCreated, TenantID: tenantId, TaskID: "1"})
+		return map[string]*dynamodb.AttributeValue{
+			"id":        {S: aws.String(tenantId + "#Outbox")},
+			"DataType":  {S: aws.String("Event#" + id)},
+			"DataValue": {S: aws.String("OutboxPending")},
+			"event":     {S: aws.String(string(data))},
+		}
+	}
+	// テナントをまたいで、猶予より前に発生したイベントだけを探す
+	mockDynamoDB.EXPECT().Query(gomock.Any()).DoAndReturn(func(input *dynamodb.QueryInput) (*dynamodb.QueryOutput, error) {
+		if *input.IndexName != "GSI1" || *input.ExpressionAttributeValues[":dataValue"].S != "OutboxPending" || *input.FilterExpression != "DataType < :cutoff" {
+			t.Errorf("unexpected query %v", input)
+		}
+		return &dynamodb.QueryOutput{Items: []map[string]*dynamodb.AttributeValue{event("tenant1", "e1"), event("tenant2", "e2")}}, nil
+	}).Times(1)
+	// 送信できたイベントを削除する
+	mockDynamoDB.EXPECT().BatchWriteItem(gomock.Any()).DoAndReturn(func(input *dynamodb.BatchWriteItemInput) (*dynamodb.BatchWriteItemOutput, error) {
+		if requests := input.RequestItems["TaskManagement"]; len(requests) != 2 || *requests[1].DeleteRequest.Key["id"].S != "tenant2#Outbox" {
+			t.Errorf("unexpected deletes %v", input.RequestItems)
+		}
+		return &dynamodb.BatchWriteItemOutput{}, nil
+	}).Times(1)
+
+	publisher := &task.InMemoryPublisher{}
+	if err := task.SweepOutbox(publisher); err != nil {
+		t.Fatalf("SweepOutbox() error = %v", err)
+	}
+	if got := publisher.Events(); len(got) != 2 || got[0].ID != "e1" || got[1].TenantID != "tenant2" {
+		t.Errorf("published = %v", got)
+	}
+
+	// 送信に失敗したイベントは削除せず、次の実行で送り直す
+	mockDynamoDB.EXPECT().Query(gomock.Any()).Return(&dynamodb.QueryOutput{
+		Items: []map[string]*dynamodb.AttributeValue{event("tenant1", "e3")},
+	}, nil).Times(1)
+	if err := task.SweepOutbox(&task.InMemoryPublisher{Err: errors.New("unavailable")}); err == nil {
+		t.Errorf("SweepOutbox() must fail when the publisher fails")
+	}
+}
+
+func Test_domainEvents(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockDynamoDB := mockdb.NewMockDynamoDBAPI(ctrl)
+	task.Svc = mockDynamoDB
+
+	// 作成時は属性ごとではなくTaskCreatedを1つだけ書き込む
+	mockDynamoDB.EXPECT().TransactWriteItems(gomock.Any()).DoAndReturn(func(input *dynamodb.TransactWriteItemsInput) (*dynamodb.TransactWriteItemsOutput, error) {
+		got := outboxEvents(t, input)
+		if len(got) != 1 || got[0].Type != task.TaskCreated || got[0].TaskID != "1" || got[0].Actor != "user-1" {
+			t.Fatalf("outbox = %v, want one TaskCreated", got)
+		}
+		want := map[string]string{"title": "A", "status": "Open", "project": "WEB", "tags": "a,b"}
+		if !reflect.DeepEqual(got[0].Data, want) {
+			t.Errorf("TaskCreated data = %v, want %v", got[0].Data, want)
+		}
+		return &dynamodb.TransactWriteItemsOutput{}, nil
+	}).Times(1)
+
+	got, err := task.CreateTask(events.APIGatewayProxyRequest{
+		RequestContext: callerContext("tenant1", "editor"),
+		Body:           "{\"id\":\"1\", \"title\":\"A\", \"status\":\"Open\", \"tags\":[\"b\",\"a\"], \"project\":\"WEB\"}",
+		HTTPMethod:     "POST",
+	})
+	if err != nil || got.StatusCode != http.StatusCreated {
+		t.Fatalf("CreateTask() = %v, %v", got, err)
+	}
+
+	mockDynamoDB.EXPECT().GetItem(gomock.Any()).Return(&dynamodb.GetItemOutput{
+		Item: map[string]*dynamodb.AttributeValue{"DataValue": {S: aws.String("tenant1#Open")}},
+	}, nil).Times(1)
+	mockDynamoDB.EXPECT().TransactWriteItems(gomock.Any()).DoAndReturn(func(input *dynamodb.TransactWriteItemsInput) (*dynamodb.TransactWriteItemsOutput, error) {
+		got := outboxEvents(t, input)
+		want := map[string]string{"from": "Open", "to": "Review"}
+		if len(got) != 1 || got[0].Type != task.TaskStatusChanged || !reflect.DeepEqual(got[0].Data, want) {
+			t.Errorf("outbox = %v, want TaskStatusChanged %v", got, want)
+		}
+		return &dynamodb.TransactWriteItemsOutput{}, nil
+	}).Times(1)
+
+	got, err = task.UpdateTaskAttribute(events.APIGatewayProxyRequest{
+		RequestContext:        callerContext("tenant1", "editor"),
+		QueryStringParameters: map[string]string{"id": "1", "status": "Review"},
+		HTTPMethod:            "PUT",
+	}, "Status", "status")
+	if err != nil || got.StatusCode != http.StatusOK {
+		t.Fatalf("UpdateTaskAttribute() = %v, %v", got, err)
+	}
+
+	// イベントは変更と同じトランザクションに含まれるため、変更が失敗すれば書き込まれない
+	mockDynamoDB.EXPECT().TransactWriteItems(gomock.Any()).DoAndReturn(func(input *dynamodb.TransactWriteItemsInput) (*dynamodb.TransactWriteItemsOutput, error) {
+		got := outboxEvents(t, input)
+		if len(got) != 1 || got[0].Type != task.TagAdded || got[0].Data["tag"] != "c" {
+			t.Errorf("outbox = %v, want TagAdded c", got)
+		}
+		return nil, awserr.New(dynamodb.ErrCodeTransactionCanceledException, "canceled", nil)
+	}).Times(1)
+	got, _ = task.AddTagToTask(events.APIGatewayProxyRequest{
+		RequestContext:        callerContext("tenant1", "editor"),
+		QueryStringParameters: map[string]string{"id": "1", "tag": "c"},
+		HTTPMethod:            "POST",
+	})
+	if got.StatusCode != http.StatusInternalServerError {
+		t.Errorf("AddTagToTask() status = %v, want 500", got.StatusCode)
+	}
+}
+
+// 送信したデータを接続ごとに記録する
+type recordingConnections struct {
+	posts map[string][]string
+	gone  map[string]bool
+}
+
+func (c *recordingConnections) PostToConnection(connectionId string, data []byte) error {
+	if c.gone[connectionId] {
+		return task.ErrConnectionGone
+	}
+	c.posts[connectionId] = append(c.posts[connectionId], string(data))
+	return nil
+}
+
+func Test_webSocketFanout(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockDynamoDB := mockdb.NewMockDynamoDBAPI(ctrl)
+	task.Svc = mockDynamoDB
+
+	subscribers := map[string][]string{
+		"tenant1#Subscribers#task#1":      {"a"},
+		"tenant1#Subscribers#project#WEB": {"a", "b"},
+		"tenant1#Subscribers#tag#x":       {"c"},
+		"tenant1#Subscribers#tag#old":     {"d"},
+	}
+	mockDynamoDB.EXPECT().Query(gomock.Any()).DoAndReturn(func(input *dynamodb.QueryInput) (*dynamodb.QueryOutput, error) {
+		id := *input.ExpressionAttributeValues[":id"].S
+		switch {
+		case id == "tenant1#1":
+			return &dynamodb.QueryOutput{Items: []map[string]*dynamodb.AttributeValue{
+				{"id": {S: aws.String("tenant1#1")}, "DataType": {S: aws.String("Project")}, "DataValue": {S: aws.String("tenant1#WEB")}},
+				{"id": {S: aws.String("tenant1#1")}, "DataType": {S: aws.String("Tags#x")}, "DataValue": {S: aws.String("tenant1#x")}},
+			}}, nil
+		case id == "tenant1#Connection#c":
+			return &dynamodb.QueryOutput{Items: []map[string]*dynamodb.AttributeValue{
+				{"id": {S: aws.String(id)}, "DataType": {S: aws.String("Subscription#tag#x")}},
+			}}, nil
+		}
+		items := []map[string]*dynamodb.AttributeValue{}
+		for _, connectionId := range subscribers[id] {
+			items = append(items, map[string]*dynamodb.AttributeValue{
+				"id": {S: aws.String(id)}, "DataType": {S: aws.String("Connection#" + connectionId)},
+			})
+		}
+		return &dynamodb.QueryOutput{Items: items}, nil
+	}).AnyTimes()
+
+	// 切断済みの接続は購読とともに削除する
+	mockDynamoDB.EXPECT().BatchWriteItem(gomock.Any()).DoAndReturn(func(input *dynamodb.BatchWriteItemInput) (*dynamodb.BatchWriteItemOutput, error) {
+		deleted := []string{}
+		for _, r := range input.RequestItems["TaskManagement"] {
+			deleted = append(deleted, *r.DeleteRequest.Key["id"].S+"/"+*r.DeleteRequest.Key["DataType"].S)
+		}
+		want := []string{"tenant1#Connection#c/Subscription#tag#x", "tenant1#Subscribers#tag#x/Connection#c", "tenant1#Connection#c/Connection"}
+		if !reflect.DeepEqual(deleted, want) {
+			t.Errorf("BatchWriteItem deletes = %v, want %v", deleted, want)
+		}
+		return &dynamodb.BatchWriteItemOutput{}, nil
+	}).Times(1)
+
+	connections := &recordingConnections{posts: map[string][]string{}, gone: map[string]bool{"c": true}}
+	change := task.TaskChange{
+		Type:     task.TaskUpdated,
+		TenantID: "tenant1",
+		TaskID:   "1",
+		Changes:  []task.FieldDiff{{Field: "Status", From: "Open", To: "Done"}, {Field: "Tags", From: "old"}},
+	}
+	if err := (task.WebSocketSink{Connections: connections}).Publish([]task.TaskChange{change}); err != nil {
+		t.Fatalf("Publish() error = %v", err)
+	}
+
+	// 複数のトピックで購読していても1回だけ届き、外れたタグの購読者にも届く
+	data, _ := json.Marshal(change)
+	want := map[string][]string{"a": {string(data)}, "b": {string(data)}, "d": {string(data)}}
+	if !reflect.DeepEqual(connections.posts, want) {
+		t.Errorf("posts = %v, want %v", connections.posts, want)
+	}
+}
+
+func Test_webSocketMovedTask(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockDynamoDB := mockdb.NewMockDynamoDBAPI(ctrl)
+	task.Svc = mockDynamoDB
+
+	// aはタスクだけ、bは移動先のプロジェクトも購読している
+	subscribers := map[string][]string{
+		"tenant1#Subscribers#task#1":      {"a", "b", "c"},
+		"tenant1#Subscribers#project#API": {"b"},
+	}
+	mockDynamoDB.EXPECT().Query(gomock.Any()).DoAndReturn(func(input *dynamodb.QueryInput) (*dynamodb.QueryOutput, error) {
+		id := *input.ExpressionAttributeValues[":id"].S
+		if id == "tenant1#1" {
+			return &dynamodb.QueryOutput{Items: []map[string]*dynamodb.AttributeValue{
+				{"id": {S: aws.String("tenant1#1")}, "DataType": {S: aws.String("Project")}, "DataValue": {S: aws.String("tenant1#API")}},
+			}}, nil
+		}
+		items := []map[string]*dynamodb.AttributeValue{}
+		for _, connectionId := range subscribers[id] {
+			items = append(items, map[string]*dynamodb.AttributeValue{
+				"id": {S: aws.String(id)}, "DataType": {S: aws.String("Connection#" + connectionId)},
+			})
+		}
+		return &dynamodb.QueryOutput{Items: items}, nil
+	}).AnyTimes()
+
+	// タスクだけを購読している接続は、接続時の権限で移動先のプロジェクトを読めるか確認する
+	roles := map[string]string{"a": "viewer:WEB", "c": "viewer:API"}
+	mockDynamoDB.EXPECT().GetItem(gomock.Any()).DoAndReturn(func(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+		connectionId := strings.TrimPrefix(*input.Key["id"].S, "tenant1#Connection#")
+		return &dynamodb.GetItemOutput{Item: map[string]*dynamodb.AttributeValue{
+			"connectionId": {S: aws.String(connectionId)},
+			"tenantId":     {S: aws.String("tenant1")},
+			"roles":        {L: []*dynamodb.AttributeValue{{S: aws.String(roles[connectionId])}}},
+		}}, nil
+	}).Times(2)
+	// 読めなくなった接続はタスクの購読を外す
+	mockDynamoDB.EXPECT().BatchWriteItem(gomock.Any()).DoAndReturn(func(input *dynamodb.BatchWriteItemInput) (*dynamodb.BatchWriteItemOutput, error) {
+		deleted := []string{}
+		for _, r := range input.RequestItems["TaskManagement"] {
+			deleted = append(deleted, *r.DeleteRequest.Key["id"].S+"/"+*r.DeleteRequest.Key["DataType"].S)
+		}
+		want := []string{"tenant1#Connection#a/Subscription#task#1", "tenant1#Subscribers#task#1/Connection#a"}
+		if !reflect.DeepEqual(deleted, want) {
+			t.Errorf("BatchWriteItem deletes = %v, want %v", deleted, want)
+		}
+		return &dynamodb.BatchWriteItemOutput{}, nil
+	}).Times(1)
+
+	connections := &recordingConnections{posts: map[string][]string{}}
+	change := task.TaskChange{
+		Type:     task.TaskUpdated,
+		TenantID: "tenant1",
+		TaskID:   "1",
+		Changes:  []task.FieldDiff{{Field: "Project", From: "WEB", To: "API"}},
+	}
+	if err := (task.WebSocketSink{Connections: connections}).Publish([]task.TaskChange{change}); err != nil {
+		t.Fatalf("Publish() error = %v", err)
+	}
+	if _, ok := connections.posts["a"]; ok || len(connections.posts["b"]) != 1 || len(connections.posts["c"]) != 1 {
+		t.Errorf("posts = %v, want b and c only", connections.posts)
+	}
+}
+
+func changeLogItem(dataType string, taskId string, changeType string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"id":       {S: aws.String("tenant1#Changes")},
+		"DataType": {S: aws.String(dataType)},
+		"taskId":   {S: aws.String(taskId)},
+		"type":     {S: aws.String(changeType)},
+	}
+}
+
+func Test_getChanges(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockDynamoDB := mockdb.NewMockDynamoDBAPI(ctrl)
+	task.Svc = mockDynamoDB
+
+	request := func(since string) events.APIGatewayProxyRequest {
+		return events.APIGatewayProxyRequest{
+			RequestContext:        callerContext("tenant1", "viewer"),
+			QueryStringParameters: map[string]string{"since": since},
+		}
+	}
+
+	// カーソルがなければ現在位置のカーソルだけを返す
+	got, err := task.GetChanges(request(""))
+	feed := struct {
+		Changes []task.SyncChange `json:"changes"`
+		Cursor  string            `json:"cursor"`
+	}{}
+	if err != nil || got.StatusCode != http.StatusOK || json.Unmarshal([]byte(got.Body), &feed) != nil || len(feed.Changes) != 0 || feed.Cursor == "" {
+		t.Fatalf("GetChanges() = %v, %v", got, err)
+	}
+
+	time.Sleep(time.Millisecond)
+	base := time.Now().Add(-10 * time.Second).UnixNano()
+	dataType := func(offset int64) string { return fmt.Sprintf("Change#%020d-abc", base+offset) }
+	mockDynamoDB.EXPECT().Query(gomock.Any()).DoAndReturn(func(input *dynamodb.QueryInput) (*dynamodb.QueryOutput, error) {
+		if *input.ExpressionAttributeValues[":id"].S == "tenant1#1" {
+			return &dynamodb.QueryOutput{Items: inDataTypeRange(input, []map[string]*dynamodb.AttributeValue{
+				{"id": {S: aws.String("tenant1#1")}, "DataType": {S: aws.String("Title")}, "DataValue": {S: aws.String("tenant1#A")}},
+				{"id": {S: aws.String("tenant1#1")}, "DataType": {S: aws.String("Project")}, "DataValue": {S: aws.String("tenant1#WEB")}},
+			})}, nil
+		}
+		if *input.ExclusiveStartKey["DataType"].S == "" || *input.ExpressionAttributeValues[":id"].S != "tenant1#Changes" {
+			t.Errorf("unexpected change log query %v", input)
+		}
+		return &dynamodb.QueryOutput{Items: []map[string]*dynamodb.AttributeValue{
+			changeLogItem(dataType(1), "1", "upsert"),
+			changeLogItem(dataType(2), "2", "upsert"),
+			changeLogItem(dataType(3), "2", "delete"),
+			changeLogItem(dataType(4), "1", "upsert"),
+		}}, nil
+	}).Times(3)
+
+	// 同じタスクの変更は最後の1件にまとめ、削除は墓標として返す
+	got, err = task.GetChanges(request(feed.Cursor))
+	want := "{\"changes\":[{\"id\":\"2\",\"type\":\"delete\"},{\"id\":\"1\",\"type\":\"upsert\",\"task\":{\"id\":\"1\",\"title\":\"A\",\"project\":\"WEB\"}}]," +
+		"\"cursor\":\"" + base64.RawURLEncoding.EncodeToString([]byte("{\"DataType\":\""+dataType(4)+"\",\"id\":\"tenant1#Changes\"}")) + "\",\"hasMore\":false}"
+	if err != nil || got.Body != want {
+		t.Errorf("GetChanges() = %v, want %v", got.Body, want)
+	}
+
+	// 変更ログの保存期間より古いカーソルは全件の取得し直しを求める
+	expired := base64.RawURLEncoding.EncodeToString([]byte("{\"DataType\":\"Change#00000000000000000001-abc\",\"id\":\"tenant1#Changes\"}"))
+	got, _ = task.GetChanges(request(expired))
+	if got.StatusCode != http.StatusGone {
+		t.Errorf("GetChanges() status = %v, want 410", got.StatusCode)
+	}
+}
+
+func versionedItem(dataType string, value string, version string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"id":        {S: aws.String("tenant1#1")},
+		"DataType":  {S: aws.String(dataType)},
+		"DataValue": {S: aws.String("tenant1#" + value)},
+		"version":   {N: aws.String(version)},
+	}
+}
+
+func Test_syncTask(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockDynamoDB := mockdb.NewMockDynamoDBAPI(ctrl)
+	task.Svc = mockDynamoDB
+
+	current := []map[string]*dynamodb.AttributeValue{
+		versionedItem("Title", "A", "100"),
+		versionedItem("Description", "D", "300"),
+		versionedItem("Status", "Open", "200"),
+		versionedItem("Project", "WEB", "100"),
+		{"id": {S: aws.String("tenant1#1")}, "DataType": {S: aws.String("Tags#x")}, "DataValue": {S: aws.String("tenant1#x")}},
+	}
+	mockDynamoDB.EXPECT().Query(gomock.Any()).DoAndReturn(func(input *dynamodb.QueryInput) (*dynamodb.QueryOutput, error) {
+		if !aws.BoolValue(input.ConsistentRead) {
+			t.Errorf("task must be read with strong consistency")
+		}
+		return &dynamodb.QueryOutput{Items: current}, nil
+	}).AnyTimes()
+
+	operations := "[{\"field\":\"Title\",\"value\":\"B\",\"baseVersion\":100,\"clientTimestamp\":5}," +
+		"{\"field\":\"Status\",\"value\":\"Done\",\"baseVersion\":150,\"clientTimestamp\":0}," +
+		"{\"field\":\"Description\",\"value\":\"E\",\"baseVersion\":250,\"clientTimestamp\":1}," +
+		"{\"field\":\"Tags\",\"op\":\"add\",\"value\":\"y\"}," +
+		"{\"field\":\"Tags\",\"op\":\"remove\",\"value\":\"x\"}]"
+
+	// 変更されていないタイトルと、後から編集した説明とタグを反映する
+	mockDynamoDB.EXPECT().TransactWriteItems(gomock.Any()).DoAndReturn(func(input *dynamodb.TransactWriteItemsInput) (*dynamodb.TransactWriteItemsOutput, error) {
+		written := []string{}
+		for _, item := range input.TransactItems[:4] {
+			switch {
+			case item.Update != nil:
+				if item.Update.ExpressionAttributeValues[":version"] == nil {
+					t.Errorf("%s must record its version", *item.Update.Key["DataType"].S)
+				}
+				written = append(written, *item.Update.Key["DataType"].S+"="+*item.Update.ExpressionAttributeValues[":new_value"].S)
+			case item.Put != nil:
+				written = append(written, "+"+*item.Put.Item["DataType"].S)
+			case item.Delete != nil:
+				written = append(written, "-"+*item.Delete.Key["DataType"].S)
+			}
+		}
+		want := []string{"Title=tenant1#B", "Description=tenant1#E", "+Tags#y", "-Tags#x"}
+		if !reflect.DeepEqual(written, want) {
+			t.Errorf("written = %v, want %v", written, want)
+		}
+		return &dynamodb.TransactWriteItemsOutput{}, nil
+	}).Times(1)
+
+	got, err := task.SyncTask(events.APIGatewayProxyRequest{
+		RequestContext:        callerContext("tenant1", "editor"),
+		QueryStringParameters: map[string]string{"id": "1"},
+		Body:                  "{\"operations\":" + operations + "}",
+		HTTPMethod:            "POST",
+	})
+	result := struct {
+		Task      task.Task           `json:"task"`
+		Applied   []string            `json:"applied"`
+		Conflicts []task.SyncConflict `json:"conflicts"`
+	}{}
+	if err != nil || got.StatusCode != http.StatusOK || json.Unmarshal([]byte(got.Body), &result) != nil {
+		t.Fatalf("SyncTask() = %v, %v", got, err)
+	}
+	if want := []string{"Title", "Description", "Tags#y", "Tags#x"}; !reflect.DeepEqual(result.Applied, want) {
+		t.Errorf("applied = %v, want %v", result.Applied, want)
+	}
+	wantConflicts := []task.SyncConflict{
+		{Field: "Description", ClientValue: "E", ServerValue: "D", Resolution: task.ResolvedClient},
+		{Field: "Status", ClientValue: "Done", ServerValue: "Open", Resolution: task.ResolvedServer},
+	}
+	if !reflect.DeepEqual(result.Conflicts, wantConflicts) {
+		t.Errorf("conflicts = %v, want %v", result.Conflicts, wantConflicts)
+	}
+	if result.Task.Versions["Title"] != 100 {
+		t.Errorf("task versions = %v", result.Task.Versions)
+	}
+
+	// rejectでは競合した属性を反映せずに返す
+	mockDynamoDB.EXPECT().TransactWriteItems(gomock.Any()).DoAndReturn(func(input *dynamodb.TransactWriteItemsInput) (*dynamodb.TransactWriteItemsOutput, error) {
+		if update := input.TransactItems[0].Update; update == nil || *update.Key["DataType"].S != "Title" {
+			t.Errorf("only the title must be written, got %v", input.TransactItems[0])
+		}
+		return &dynamodb.TransactWriteItemsOutput{}, nil
+	}).Times(1)
+	got, _ = task.SyncTask(events.APIGatewayProxyRequest{
+		RequestContext:        callerContext("tenant1", "editor"),
+		QueryStringParameters: map[string]string{"id": "1"},
+		Body:                  "{\"policy\":\"reject\",\"operations\":" + operations + "}",
+		HTTPMethod:            "POST",
+	})
+	if !strings.Contains(got.Body, "\"applied\":[\"Title\",\"Tags#y\",\"Tags#x\"]") || strings.Count(got.Body, "\"resolution\":\"rejected\"") != 2 {
+		t.Errorf("SyncTask() = %v", got.Body)
+	}
+}
+
+func webhookItem(url string, failureCount int) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"id":           {S: aws.String("tenant1#Webhooks")},
+		"DataType":     {S: aws.String("Webhook#w1")},
+		"webhookId":    {S: aws.String("w1")},
+		"url":          {S: aws.String(url)},
+		"events":       {L: []*dynamodb.AttributeValue{{S: aws.String("TaskUpdated")}}},
+		"secret":       {S: aws.String("whsec_test")},
+		"failureCount": {N: aws.String(fmt.Sprint(failureCount))},
+	}
+}
+
+func Test_bulkTasks(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockDynamoDB := mockdb.NewMockDynamoDBAPI(ctrl)
+	task.Svc = mockDynamoDB
+
+	tasks := map[string][]string{"1": {}, "2": {"urgent"}, "4": {}}
+	mockDynamoDB.EXPECT().Query(gomock.Any()).DoAndReturn(func(input *dynamodb.QueryInput) (*dynamodb.QueryOutput, error) {
+		id := strings.TrimPrefix(*input.ExpressionAttributeValues[":id"].S, "tenant1#")
+		tags, ok := tasks[id]
+		if !ok {
+			return &dynamodb.QueryOutput{}, nil
+		}
+		items := []map[string]*dynamodb.AttributeValue{
+			{"id": {S: aws.String("tenant1#" + id)}, "DataType": {S: aws.String("Project")}, "DataValue": {S: aws.String("tenant1#WEB")}},
+		}
+		for _, tag := range tags {
+			items = append(items, map[string]*dynamodb.AttributeValue{"id": {S: aws.String("tenant1#" + id)}, "DataType": {S: aws.String("Tags#" + tag)}, "DataValue": {S: aws.String("tenant1#" + tag)}})
+		}
+		return &dynamodb.QueryOutput{Items: items}, nil
+	}).AnyTimes()
+
+	// 1つのトランザクションでは同じアイテムを2回書き込めないので、タグの使用数はまとめて1回だけ更新する
+	uniqueKeys := func(input *dynamodb.TransactWriteItemsInput, delta string) {
+		keys := map[string]bool{}
+		for _, item := range input.TransactItems {
+			key := transactKey(item)
+			if keys[key] {
+				t.Errorf("transaction must not contain %s twice", key)
+			}
+			keys[key] = true
+		}
+		if update := input.TransactItems[0].Update; update == nil || *update.Key["id"].S != "tenant1#Tag#urgent" || *update.ExpressionAttributeValues[":delta"].N != delta {
+			t.Errorf("transaction must start with the tag count update by %s, got %v", delta, input.TransactItems[0])
+		}
+	}
+
+	// タスク4が他のリクエストと競合した場合、タスク1だけで再実行する
+	gomock.InOrder(
+		mockDynamoDB.EXPECT().TransactWriteItems(gomock.Any()).DoAndReturn(func(input *dynamodb.TransactWriteItemsInput) (*dynamodb.TransactWriteItemsOutput, error) {
+			if len(input.TransactItems) != 11 {
+				t.Fatalf("len(TransactItems) = %d, want 11", len(input.TransactItems))
+			}
+			uniqueKeys(input, "2")
+			reasons := make([]*dynamodb.CancellationReason, len(input.TransactItems))
+			for i := range reasons {
+				reasons[i] = &dynamodb.CancellationReason{Code: aws.String("None")}
+			}
+			reasons[6].Code = aws.String("ConditionalCheckFailed")
+			return nil, &dynamodb.TransactionCanceledException{CancellationReasons: reasons}
+		}),
+		mockDynamoDB.EXPECT().TransactWriteItems(gomock.Any()).DoAndReturn(func(input *dynamodb.TransactWriteItemsInput) (*dynamodb.TransactWriteItemsOutput, error) {
+			if len(input.TransactItems) != 6 || *input.TransactItems[2].Put.Item["id"].S != "tenant1#1" {
+				t.Fatalf("retry must contain only task 1, got %v", input.TransactItems)
+			}
+			uniqueKeys(input, "1")
+			return &dynamodb.TransactWriteItemsOutput{}, nil
+		}),
+	)
+
+	got, err := task.BulkUpdateTasks(events.APIGatewayProxyRequest{
+		RequestContext: callerContext("tenant1", "admin"),
+		Body:           "{\"ids\":[\"1\",\"2\",\"3\",\"4\",\"1\"],\"operation\":{\"type\":\"addTag\",\"value\":\"urgent\"}}",
+		HTTPMethod:     "POST",
+	})
+	result := struct {
+		Results   []task.BulkResult `json:"results"`
+		Succeeded int               `json:"succeeded"`
+		Skipped   int               `json:"skipped"`
+		Failed    int               `json:"failed"`
+	}{}
+	if err != nil || got.StatusCode != http.StatusOK || json.Unmarshal([]byte(got.Body), &result) != nil {
+		t.Fatalf("BulkUpdateTasks() = %v, %v", got, err)
+	}
+	want := []task.BulkResult{
+		{ID: "1", Status: task.BulkSucceeded},
+		{ID: "2", Status: task.BulkSkipped},
+		{ID: "3", Status: task.BulkFailed, Error: "Task not found"},
+		{ID: "4", Status: task.BulkFailed, Error: "Task was modified by another request"},
+	}
+	if !reflect.DeepEqual(result.Results, want) || result.Succeeded != 1 || result.Skipped != 1 || result.Failed != 2 {
+		t.Errorf("BulkUpdateTasks() = %+v, want %v", result, want)
+	}
+
+	got, _ = task.BulkUpdateTasks(events.APIGatewayProxyRequest{
+		RequestContext: callerContext("tenant1", "admin"),
+		Body:           "{\"ids\":[\"1\"],\"filter\":{\"project\":\"WEB\"},\"operation\":{\"type\":\"delete\"}}",
+		HTTPMethod:     "POST",
+	})
+	if got.StatusCode != http.StatusBadRequest {
+		t.Errorf("BulkUpdateTasks() status = %v, want 400 for both ids and filter", got.StatusCode)
+	}
+}
+
+func Test_bulkMoveHierarchy(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockDynamoDB := mockdb.NewMockDynamoDBAPI(ctrl)
+	task.Svc = mockDynamoDB
+
+	// タスク2は親を持ち、タスク3はサブタスクを持つ
+	items := partitionQuery([]map[string]*dynamodb.AttributeValue{
+		{"id": {S: aws.String("tenant1#1")}, "DataType": {S: aws.String("Project")}, "DataValue": {S: aws.String("tenant1#WEB")}},
+		{"id": {S: aws.String("tenant1#2")}, "DataType": {S: aws.String("Project")}, "DataValue": {S: aws.String("tenant1#WEB")}},
+		{"id": {S: aws.String("tenant1#2")}, "DataType": {S: aws.String("Parent")}, "DataValue": {S: aws.String("tenant1#3")}},
+		{"id": {S: aws.String("tenant1#3")}, "DataType": {S: aws.String("Project")}, "DataValue": {S: aws.String("tenant1#WEB")}},
+	})
+	links := linkQuery(map[string][]string{"tenant1#3": {"Subtask#2"}})
+	mockDynamoDB.EXPECT().Query(gomock.Any()).DoAndReturn(func(input *dynamodb.QueryInput) (*dynamodb.QueryOutput, error) {
+		if input.ExpressionAttributeValues[":prefix"] != nil {
+			return links(input)
+		}
+		return items(input)
+	}).AnyTimes()
+
+	// 移動するのは階層に含まれないタスク1だけで、親が設定されていないことも確認する
+	mockDynamoDB.EXPECT().TransactWriteItems(gomock.Any()).DoAndReturn(func(input *dynamodb.TransactWriteItemsInput) (*dynamodb.TransactWriteItemsOutput, error) {
+		parentChecked := false
+		for _, item := range input.TransactItems {
+			if check := item.ConditionCheck; check != nil && *check.Key["id"].S == "tenant1#1" && *check.Key["DataType"].S == "Parent" {
+				parentChecked = true
+			}
+			if key := transactKey(item); strings.HasPrefix(key, "tenant1#2/") || strings.HasPrefix(key, "tenant1#3/") {
+				t.Errorf("transaction must not write %s", key)
+			}
+		}
+		if !parentChecked {
+			t.Errorf("transaction must check that task 1 has no parent, got %v", input.TransactItems)
+		}
+		return &dynamodb.TransactWriteItemsOutput{}, nil
+	}).Times(1)
+
+	got, err := task.BulkUpdateTasks(events.APIGatewayProxyRequest{
+		RequestContext: callerContext("tenant1", "admin"),
+		Body:           "{\"ids\":[\"1\",\"2\",\"3\"],\"operation\":{\"type\":\"move\",\"value\":\"API\"}}",
+		HTTPMethod:     "POST",
+	})
+	result := struct {
+		Results []task.BulkResult `json:"results"`
+	}{}
+	if err != nil || got.StatusCode != http.StatusOK || json.Unmarshal([]byte(got.Body), &result) != nil {
+		t.Fatalf("BulkUpdateTasks() = %v, %v", got, err)
+	}
+	message := "Tasks with a parent or subtasks cannot be moved to another project"
+	want := []task.BulkResult{
+		{ID: "1", Status: task.BulkSucceeded},
+		{ID: "2", Status: task.BulkFailed, Error: message},
+		{ID: "3", Status: task.BulkFailed, Error: message},
+	}
+	if !reflect.DeepEqual(result.Results, want) {
+		t.Errorf("BulkUpdateTasks() = %+v, want %v", result.Results, want)
+	}
+}
+
+// テストの受信側はループバックアドレスのため、接続先を確認しないクライアントで送る
+func useReceiverClient(t *testing.T, receiver *httptest.Server) {
+	original := task.WebhookClient
+	t.Cleanup(func() { task.WebhookClient = original })
+	client := receiver.Client()
+	client.CheckRedirect = task.WebhookClient.CheckRedirect
+	task.WebhookClient = client
+}
+
+// キューに入れた配信を保持する
+type recordingWebhookQueue struct {
+	attempts []task.WebhookAttempt
+	delays   []time.Duration
+}
+
+func (q *recordingWebhookQueue) Enqueue(attempt task.WebhookAttempt, delay time.Duration) error {
+	q.attempts = append(q.attempts, attempt)
+	q.delays = append(q.delays, delay)
+	return nil
+}
+
+func Test_webhookDelivery(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockDynamoDB := mockdb.NewMockDynamoDBAPI(ctrl)
+	task.Svc = mockDynamoDB
+
+	// 1回目は503を返し、再送で受け付ける
+	requests := 0
+	deliveryIds := map[string]bool{}
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		deliveryIds[r.Header.Get("X-Webhook-Delivery")] = true
+		body, _ := io.ReadAll(r.Body)
+		timestamp, _ := strconv.ParseInt(r.Header.Get("X-Webhook-Timestamp"), 10, 64)
+		if got, want := r.Header.Get("X-Webhook-Signature"), task.SignWebhook("whsec_test", timestamp, body); got != want {
+			t.Errorf("signature = %v, want %v", got, want)
+		}
+		if r.Header.Get("X-Webhook-Event") != task.TaskUpdated {
+			t.Errorf("unexpected event header %v", r.Header.Get("X-Webhook-Event"))
+		}
+		if requests == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer receiver.Close()
+	useReceiverClient(t, receiver)
+
+	// ストリームの処理では送信せず、購読しているイベントだけをキューに入れる
+	queue := &recordingWebhookQueue{}
+	mockDynamoDB.EXPECT().Query(gomock.Any()).Return(&dynamodb.QueryOutput{
+		Items: []map[string]*dynamodb.AttributeValue{webhookItem(receiver.URL, 3)},
+	}, nil).Times(1)
+	err := task.WebhookSink{Queue: queue}.Publish([]task.TaskChange{
+		{EventID: "e1", Type: task.TaskCreated, TenantID: "tenant1", TaskID: "2"},
+		{EventID: "e2", Type: task.TaskUpdated, TenantID: "tenant1", TaskID: "1", Changes: []task.FieldDiff{{Field: "Status", From: "Open", To: "Done"}}},
+	})
+	if err != nil {
+		t.Fatalf("Publish() error = %v", err)
+	}
+	if requests != 0 || len(queue.attempts) != 1 || queue.attempts[0].Change.TaskID != "1" || queue.delays[0] != 0 {
+		t.Fatalf("unexpected queued deliveries %+v, %d requests", queue.attempts, requests)
+	}
+	// ストリームの処理を再実行しても同じ配信IDになり、受信側で重複を除ける
+	if queue.attempts[0].DeliveryID != "e2-w1" {
+		t.Errorf("DeliveryID = %v, want e2-w1", queue.attempts[0].DeliveryID)
+	}
+
+	// 再送できる失敗は、配信ログを書かずに待ち時間を置いてキューに戻す
+	mockDynamoDB.EXPECT().GetItem(gomock.Any()).Return(&dynamodb.GetItemOutput{Item: webhookItem(receiver.URL, 3)}, nil).Times(2)
+	if err := task.DeliverWebhook(queue.attempts[0], queue); err != nil {
+		t.Fatalf("DeliverWebhook() error = %v", err)
+	}
+	if len(queue.attempts) != 2 || queue.attempts[1].Attempts != 1 || queue.delays[1] != task.WebhookRetryDelay {
+		t.Fatalf("unexpected retry %+v, delays %v", queue.attempts, queue.delays)
+	}
+
+	mockDynamoDB.EXPECT().PutItem(gomock.Any()).DoAndReturn(func(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+		item := input.Item
+		if *item["id"].S != "tenant1#Webhook#w1" || !strings.HasPrefix(*item["DataType"].S, "Delivery#") {
+			t.Errorf("unexpected delivery key %v %v", *item["id"].S, *item["DataType"].S)
+		}
+		if !*item["success"].BOOL || *item["attempts"].N != "2" || *item["statusCode"].N != "204" {
+			t.Errorf("unexpected delivery log %v", item)
+		}
+		return &dynamodb.PutItemOutput{}, nil
+	}).Times(1)
+	// 成功したので失敗回数を戻す
+	mockDynamoDB.EXPECT().UpdateItem(gomock.Any()).DoAndReturn(func(input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+		if *input.UpdateExpression != "SET failureCount = :zero" {
+			t.Errorf("UpdateExpression = %v", *input.UpdateExpression)
+		}
+		return &dynamodb.UpdateItemOutput{}, nil
+	}).Times(1)
+
+	if err := task.DeliverWebhook(queue.attempts[1], queue); err != nil {
+		t.Fatalf("DeliverWebhook() error = %v", err)
+	}
+	if requests != 2 || len(queue.attempts) != 2 || len(deliveryIds) != 1 {
+		t.Errorf("receiver got %d requests for %d deliveries, want 2 requests for one delivery", requests, len(deliveryIds))
+	}
+}
+
+func Test_webhookAutoDisable(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockDynamoDB := mockdb.NewMockDynamoDBAPI(ctrl)
+	task.Svc = mockDynamoDB
+
+	requests := 0
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer receiver.Close()
+	useReceiverClient(t, receiver)
+
+	disabled := webhookItem(receiver.URL, 10)
+	disabled["disabled"] = &dynamodb.AttributeValue{BOOL: aws.Bool(true)}
+	gomock.InOrder(
+		mockDynamoDB.EXPECT().GetItem(gomock.Any()).Return(&dynamodb.GetItemOutput{Item: webhookItem(receiver.URL, 9)}, nil),
+		mockDynamoDB.EXPECT().GetItem(gomock.Any()).Return(&dynamodb.GetItemOutput{Item: disabled}, nil),
+	)
+	// 再送の上限に達したので、失敗として記録する
+	mockDynamoDB.EXPECT().PutItem(gomock.Any()).DoAndReturn(func(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+		if *input.Item["success"].BOOL || *input.Item["attempts"].N != fmt.Sprint(task.WebhookMaxAttempts) {
+			t.Errorf("unexpected delivery log %v", input.Item)
+		}
+		return &dynamodb.PutItemOutput{}, nil
+	}).Times(1)
+	gomock.InOrder(
+		mockDynamoDB.EXPECT().UpdateItem(gomock.Any()).Return(&dynamodb.UpdateItemOutput{
+			Attributes: map[string]*dynamodb.AttributeValue{"failureCount": {N: aws.String("10")}},
+		}, nil),
+		// 失敗が閾値に達したので無効にする
+		mockDynamoDB.EXPECT().UpdateItem(gomock.Any()).DoAndReturn(func(input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+			if *input.UpdateExpression != "SET disabled = :true" {
+				t.Errorf("UpdateExpression = %v", *input.UpdateExpression)
+			}
+			return &dynamodb.UpdateItemOutput{}, nil
+		}),
+	)
+
+	queue := &recordingWebhookQueue{}
+	last := task.WebhookAttempt{TenantID: "tenant1", WebhookID: "w1", DeliveryID: "d1", Attempts: task.WebhookMaxAttempts - 1,
+		Change: task.TaskChange{Type: task.TaskUpdated, TenantID: "tenant1", TaskID: "1"}}
+	if err := task.DeliverWebhook(last, queue); err != nil {
+		t.Fatalf("DeliverWebhook() error = %v", err)
+	}
+
+	// 無効にした後に取り出した配信は送信しない
+	next := task.WebhookAttempt{TenantID: "tenant1", WebhookID: "w1", DeliveryID: "d2",
+		Change: task.TaskChange{Type: task.TaskUpdated, TenantID: "tenant1", TaskID: "2"}}
+	if err := task.DeliverWebhook(next, queue); err != nil {
+		t.Fatalf("DeliverWebhook() error = %v", err)
+	}
+	if requests != 1 || len(queue.attempts) != 0 {
+		t.Errorf("receiver got %d requests and %d retries, want 1 request and no retries", requests, len(queue.attempts))
+	}
+}
+
+func Test_webhookBlockedAddress(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockDynamoDB := mockdb.NewMockDynamoDBAPI(ctrl)
+	task.Svc = mockDynamoDB
+
+	requests := 0
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		http.Redirect(w, r, "/internal", http.StatusFound)
+	}))
+	defer receiver.Close()
+
+	logged := []map[string]*dynamodb.AttributeValue{}
+	mockDynamoDB.EXPECT().GetItem(gomock.Any()).Return(&dynamodb.GetItemOutput{Item: webhookItem(receiver.URL, 0)}, nil).Times(2)
+	mockDynamoDB.EXPECT().PutItem(gomock.Any()).DoAndReturn(func(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+		logged = append(logged, input.Item)
+		return &dynamodb.PutItemOutput{}, nil
+	}).Times(2)
+	mockDynamoDB.EXPECT().UpdateItem(gomock.Any()).Return(&dynamodb.UpdateItemOutput{
+		Attributes: map[string]*dynamodb.AttributeValue{"failureCount": {N: aws.String("1")}},
+	}, nil).Times(2)
+
+	// ループバックなど内部のアドレスには接続せず、再送もしない
+	queue := &recordingWebhookQueue{}
+	attempt := task.WebhookAttempt{TenantID: "tenant1", WebhookID: "w1", DeliveryID: "e1-w1",
+		Change: task.TaskChange{EventID: "e1", Type: task.TaskUpdated, TenantID: "tenant1", TaskID: "1"}}
+	if err := task.DeliverWebhook(attempt, queue); err != nil {
+		t.Fatalf("DeliverWebhook() error = %v", err)
+	}
+	if requests != 0 || len(queue.attempts) != 0 || len(logged) != 1 || !strings.Contains(*logged[0]["error"].S, "private, loopback or link-local") {
+		t.Errorf("blocked delivery sent %d requests, queued %d retries, logged %v", requests, len(queue.attempts), logged)
+	}
+
+	// リダイレクトは追わずに失敗として記録する
+	useReceiverClient(t, receiver)
+	if err := task.DeliverWebhook(attempt, queue); err != nil {
+		t.Fatalf("DeliverWebhook() error = %v", err)
+	}
+	if requests != 1 || len(queue.attempts) != 0 || len(logged) != 2 || *logged[1]["statusCode"].N != "302" {
+		t.Errorf("redirect sent %d requests, queued %d retries, logged %v", requests, len(queue.attempts), logged)
+	}
+}
+
+func Test_createWebhook(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockDynamoDB := mockdb.NewMockDynamoDBAPI(ctrl)
+	task.Svc = mockDynamoDB
+
+	got, _ := task.CreateWebhook(events.APIGatewayProxyRequest{
+		RequestContext: callerContext("tenant1", "admin"),
+		Body:           "{\"url\":\"http://example.com/hook\",\"events\":[\"TaskUpdated\"]}",
+		HTTPMethod:     "POST",
+	})
+	if got.StatusCode != http.StatusBadRequest {
+		t.Errorf("CreateWebhook() status = %v, want 400 for http URL", got.StatusCode)
+	}
+
+	mockDynamoDB.EXPECT().PutItem(gomock.Any()).DoAndReturn(func(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+		if *input.Item["id"].S != "tenant1#Webhooks" || !strings.HasPrefix(*input.Item["secret"].S, "whsec_") {
+			t.Errorf("unexpected webhook item %v", input.Item)
+		}
+		return &dynamodb.PutItemOutput{}, nil
+	}).Times(1)
+
+	got, err := task.CreateWebhook(events.APIGatewayProxyRequest{
+		RequestContext: callerContext("tenant1", "admin"),
+		Body:           "{\"url\":\"https://example.com/hook\",\"events\":[\"TaskUpdated\"]}",
+		HTTPMethod:     "POST",
+	})
+	if err != nil || got.StatusCode != http.StatusCreated || !strings.Contains(got.Body, "\"secret\":\"whsec_") {
+		t.Errorf("CreateWebhook() = %v, %v", got, err)
+	}
+}
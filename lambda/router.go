@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"task-management-app/lambda/auth"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+type route struct {
+	method  string
+	path    string
+	action  string
+	handler auth.Handler
+	// プロジェクト単位のロールで許可する場合に、対象のプロジェクトを特定する。省略時はテナント全体のロールが必要
+	project auth.ProjectResolver
+}
+
+// パスパラメーターはQueryStringParametersにも設定し、既存のハンドラーからそのまま参照できるようにする
+func dispatch(routes []route, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	for _, r := range routes {
+		if r.method != request.HTTPMethod {
+			continue
+		}
+		params, ok := matchPath(r.path, request.Path)
+		if !ok {
+			continue
+		}
+
+		query := make(map[string]string, len(request.QueryStringParameters)+len(params))
+		for k, v := range request.QueryStringParameters {
+			query[k] = v
+		}
+		for k, v := range params {
+			query[k] = v
+		}
+		request.PathParameters = params
+		request.QueryStringParameters = query
+		return auth.Authorize(policy, r.action, r.project)(r.handler)(request)
+	}
+
+	return events.APIGatewayProxyResponse{
+		Body:       "Invalid request",
+		StatusCode: http.StatusBadRequest,
+	}, nil
+}
+
+func matchPath(pattern string, path string) (map[string]string, bool) {
+	patternParts := strings.Split(strings.Trim(pattern, "/"), "/")
+	pathParts := strings.Split(strings.Trim(path, "/"), "/")
+	if len(patternParts) != len(pathParts) {
+		return nil, false
+	}
+
+	params := map[string]string{}
+	for i, part := range patternParts {
+		if strings.HasPrefix(part, "{") && strings.HasSuffix(part, "}") {
+			// 階層のあるタグ名のように"/"を含む値は%2Fでエンコードして渡す
+			value, err := url.PathUnescape(pathParts[i])
+			if err != nil || value == "" {
+				return nil, false
+			}
+			params[strings.Trim(part, "{}")] = value
+			continue
+		}
+		if part != pathParts[i] {
+			return nil, false
+		}
+	}
+	return params, true
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"task-management-app/lambda/task"
+
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// 送信されずに残ったアウトボックスのイベントの送信先。設定がなければ送り直さない
+var publisher task.EventPublisher
+
+// 定期実行の種類はルールの入力で指定する。省略時は繰り返しタスクの作成
+type scheduledEvent struct {
+	Task string `json:"task"`
+}
+
+// 定期実行で、発生日になった繰り返しタスクの作成と、残ったアウトボックスのイベントの送り直しを行う
+func handler(event scheduledEvent) error {
+	if event.Task == "sweepOutbox" {
+		if publisher == nil {
+			return nil
+		}
+		return task.SweepOutbox(publisher)
+	}
+	return task.RunSchedules()
+}
+
+func main() {
+	sess := session.Must(session.NewSession())
+	task.Svc = dynamodb.New(sess)
+	publisher = task.PublisherFromEnv(sess)
+	lambda.Start(handler)
+}
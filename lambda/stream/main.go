@@ -0,0 +1,57 @@
+package main
+
+import (
+	"os"
+
+	"task-management-app/lambda/task"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/apigatewaymanagementapi"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// 変更イベントの送信先。Webhookはmainでキューを設定して加える
+var sinks = []task.Sink{task.LogSink{}}
+
+// アウトボックスのドメインイベントの送信先。設定がなければ送信せず、TTLで削除されるまで残る
+var publisher task.EventPublisher
+
+// 送信に失敗した場合はエラーを返し、バッチを再試行させる
+func handler(event events.DynamoDBEvent) error {
+	if publisher != nil {
+		if err := task.RelayOutbox(event.Records, publisher); err != nil {
+			return err
+		}
+	}
+	// タグの一括変更などのジョブを1バッチずつ進める
+	if err := task.RunJobs(event.Records); err != nil {
+		return err
+	}
+	// 完了した繰り返しタスクの次の発生を作成する
+	if err := task.RunRecurrences(event.Records); err != nil {
+		return err
+	}
+	return task.Fanout(task.TaskChangesFromStream(event.Records), sinks...)
+}
+
+func main() {
+	sess := session.Must(session.NewSession())
+	task.Svc = dynamodb.New(sess)
+	publisher = task.PublisherFromEnv(sess)
+	// Webhookの配信と再送はキューを処理する関数に任せる
+	webhooks := task.WebhookSink{}
+	if queueURL := os.Getenv("WEBHOOK_QUEUE_URL"); queueURL != "" {
+		webhooks.Queue = task.SQSWebhookQueue{Client: sqs.New(sess), QueueURL: queueURL}
+	}
+	sinks = append(sinks, webhooks)
+	// WebSocket APIの接続管理エンドポイントが設定されていれば購読者にも送る
+	if endpoint := os.Getenv("WEBSOCKET_ENDPOINT"); endpoint != "" {
+		client := apigatewaymanagementapi.New(sess, aws.NewConfig().WithEndpoint(endpoint))
+		sinks = append(sinks, task.WebSocketSink{Connections: task.APIGatewayConnections{Client: client}})
+	}
+	lambda.Start(handler)
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+
+	"task-management-app/lambda/mocks"
+	"task-management-app/lambda/task"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/golang/mock/gomock"
+)
+
+// 送信された変更イベントを記録する
+type recordingSink struct {
+	changes []task.TaskChange
+	err     error
+}
+
+func (s *recordingSink) Publish(changes []task.TaskChange) error {
+	s.changes = append(s.changes, changes...)
+	return s.err
+}
+
+func loadEvent(t *testing.T, name string) events.DynamoDBEvent {
+	data, err := os.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	event := events.DynamoDBEvent{}
+	if err := json.Unmarshal(data, &event); err != nil {
+		t.Fatal(err)
+	}
+	return event
+}
+
+func Test_handler(t *testing.T) {
+	tests := []struct {
+		name  string
+		event string
+		want  []task.TaskChange
+	}{
+		{
+			name:  "Create task",
+			event: "create_task.json",
+			want: []task.TaskChange{
+				{
+					EventID:   "1",
+					Type:      task.TaskCreated,
+					TenantID:  "tenant1",
+					TaskID:    "1",
+					Actor:     "user-1",
+					Timestamp: 1760000001,
+					Changes: []task.FieldDiff{
+						{Field: "Project", To: "WEB"},
+						{Field: "Title", To: "Write docs"},
+						{Field: "Tags", To: "docs"},
+					},
+				},
+			},
+		},
+		{
+			name:  "Update and delete tasks",
+			event: "update_and_delete.json",
+			want: []task.TaskChange{
+				{
+					EventID:   "10",
+					Type:      task.TaskUpdated,
+					TenantID:  "tenant1",
+					TaskID:    "1",
+					Timestamp: 1760000100,
+					Changes:   []task.FieldDiff{{Field: "Status", From: "Open", To: "Done"}, {Field: "Field#priority", From: "Low", To: "High"}, {Field: "Due", To: "2026-11-01"}},
+				},
+				{
+					EventID:   "11",
+					Type:      task.TaskDeleted,
+					TenantID:  "tenant2",
+					TaskID:    "7",
+					Timestamp: 1760000101,
+					Changes: []task.FieldDiff{
+						{Field: "Project", From: "API"},
+						{Field: "Title", From: "Old task"},
+					},
+				},
+			},
+		},
+	}
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockDynamoDB := mockdb.NewMockDynamoDBAPI(ctrl)
+	task.Svc = mockDynamoDB
+
+	// 完了したタスクは繰り返しの発生かを確認する
+	mockDynamoDB.EXPECT().GetItem(gomock.Any()).Return(&dynamodb.GetItemOutput{}, nil).AnyTimes()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			first, second := &recordingSink{}, &recordingSink{}
+			sinks = []task.Sink{first, second}
+
+			if err := handler(loadEvent(t, tt.event)); err != nil {
+				t.Fatalf("handler() error = %v", err)
+			}
+			if !reflect.DeepEqual(first.changes, tt.want) {
+				t.Errorf("handler() published %+v, want %+v", first.changes, tt.want)
+			}
+			if !reflect.DeepEqual(second.changes, tt.want) {
+				t.Errorf("every sink must receive the changes, got %+v", second.changes)
+			}
+		})
+	}
+}
+
+func Test_handlerSinkFailure(t *testing.T) {
+	failing, ok := &recordingSink{err: errors.New("unavailable")}, &recordingSink{}
+	sinks = []task.Sink{failing, ok}
+
+	// 失敗した送信先があってもほかの送信先には送り、バッチは再試行させる
+	if err := handler(loadEvent(t, "create_task.json")); err == nil {
+		t.Fatal("handler() must return an error when a sink fails")
+	}
+	if len(ok.changes) != 1 {
+		t.Errorf("healthy sink received %d changes, want 1", len(ok.changes))
+	}
+}
+
+func Test_handlerRelayOutbox(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockDynamoDB := mockdb.NewMockDynamoDBAPI(ctrl)
+	task.Svc = mockDynamoDB
+	sinks = []task.Sink{&recordingSink{}}
+
+	memory := &task.InMemoryPublisher{}
+	publisher = memory
+	defer func() { publisher = nil }()
+
+	// 送信できたアウトボックスのアイテムだけを削除する。削除によるREMOVEは送信しない
+	mockDynamoDB.EXPECT().BatchWriteItem(gomock.Any()).DoAndReturn(func(input *dynamodb.BatchWriteItemInput) (*dynamodb.BatchWriteItemOutput, error) {
+		requests := input.RequestItems["TaskManagement"]
+		if len(requests) != 1 || *requests[0].DeleteRequest.Key["DataType"].S != "Event#01760000200000000000-0123456789ab" {
+			t.Errorf("BatchWriteItem = %v, want the delivered outbox item", requests)
+		}
+		return &dynamodb.BatchWriteItemOutput{}, nil
+	}).Times(1)
+	mockDynamoDB.EXPECT().GetItem(gomock.Any()).Return(&dynamodb.GetItemOutput{}, nil).Times(1)
+
+	if err := handler(loadEvent(t, "outbox.json")); err != nil {
+		t.Fatalf("handler() error = %v", err)
+	}
+	want := []task.DomainEvent{{
+		ID:        "01760000200000000000-0123456789ab",
+		Type:      task.TaskStatusChanged,
+		TenantID:  "tenant1",
+		TaskID:    "1",
+		Actor:     "user-1",
+		Timestamp: 1760000200,
+		Data:      map[string]string{"from": "Open", "to": "Done"},
+	}}
+	if got := memory.Events(); !reflect.DeepEqual(got, want) {
+		t.Errorf("published %+v, want %+v", got, want)
+	}
+
+	// 送信に失敗した場合はアイテムを残し、バッチを再試行させる
+	publisher = &task.InMemoryPublisher{Err: errors.New("unavailable")}
+	if err := handler(loadEvent(t, "outbox.json")); err == nil {
+		t.Fatal("handler() must return an error when publishing fails")
+	}
+}
+
+func Test_handlerRunsTagJob(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockDynamoDB := mockdb.NewMockDynamoDBAPI(ctrl)
+	task.Svc = mockDynamoDB
+	sinks = []task.Sink{&recordingSink{}}
+
+	job := map[string]*dynamodb.AttributeValue{
+		"id":        {S: aws.String("tenant1#Jobs")},
+		"DataType":  {S: aws.String("Job#01760000300000000000-0123456789ab")},
+		"jobId":     {S: aws.String("01760000300000000000-0123456789ab")},
+		"type":      {S: aws.String(task.JobTagRename)},
+		"status":    {S: aws.String(task.JobRunning)},
+		"from":      {S: aws.String("frontend")},
+		"to":        {S: aws.String("web")},
+		"processed": {N: aws.String("25")},
+		"batches":   {N: aws.String("1")},
+		"createdBy": {S: aws.String("user-1")},
+		"cursor":    {M: map[string]*dynamodb.AttributeValue{"id": {S: aws.String("tenant1#9")}, "DataType": {S: aws.String("Tags#frontend")}, "DataValue": {S: aws.String("tenant1#frontend")}}},
+	}
+	mockDynamoDB.EXPECT().GetItem(gomock.Any()).DoAndReturn(func(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+		switch *input.Key["DataType"].S {
+		case "Job#01760000300000000000-0123456789ab":
+			return &dynamodb.GetItemOutput{Item: job}, nil
+		case "Tags#frontend":
+			return &dynamodb.GetItemOutput{Item: map[string]*dynamodb.AttributeValue{"DataValue": {S: aws.String("tenant1#frontend")}}}, nil
+		case "Tags#web":
+			// タスク11には変更後のタグが既に付いている
+			if *input.Key["id"].S == "tenant1#11" {
+				return &dynamodb.GetItemOutput{Item: map[string]*dynamodb.AttributeValue{"DataValue": {S: aws.String("tenant1#web")}}}, nil
+			}
+		}
+		return &dynamodb.GetItemOutput{}, nil
+	}).AnyTimes()
+
+	// 前のバッチの続きから検索し、最後のバッチで完了にする
+	mockDynamoDB.EXPECT().Query(gomock.Any()).DoAndReturn(func(input *dynamodb.QueryInput) (*dynamodb.QueryOutput, error) {
+		if *input.IndexName != "GSI1" || *input.ExclusiveStartKey["id"].S != "tenant1#9" {
+			t.Errorf("query must resume from the cursor, got %v", input.ExclusiveStartKey)
+		}
+		return &dynamodb.QueryOutput{Items: []map[string]*dynamodb.AttributeValue{
+			{"id": {S: aws.String("tenant1#10")}, "DataType": {S: aws.String("Tags#frontend")}},
+			{"id": {S: aws.String("tenant1#11")}, "DataType": {S: aws.String("Tags#frontend")}},
+		}}, nil
+	}).Times(1)
+	written := map[string]int{}
+	mockDynamoDB.EXPECT().TransactWriteItems(gomock.Any()).DoAndReturn(func(input *dynamodb.TransactWriteItemsInput) (*dynamodb.TransactWriteItemsOutput, error) {
+		taskId := *input.TransactItems[0].Delete.Key["id"].S
+		written[taskId] = 0
+		for _, item := range input.TransactItems {
+			if item.Put != nil && *item.Put.Item["DataType"].S == "Tags#web" {
+				written[taskId]++
+			}
+		}
+		return &dynamodb.TransactWriteItemsOutput{}, nil
+	}).Times(2)
+	mockDynamoDB.EXPECT().DeleteItem(gomock.Any()).DoAndReturn(func(input *dynamodb.DeleteItemInput) (*dynamodb.DeleteItemOutput, error) {
+		if *input.Key["id"].S != "tenant1#Tag#frontend" {
+			t.Errorf("DeleteItem key = %v, want the renamed tag", input.Key)
+		}
+		return &dynamodb.DeleteItemOutput{}, nil
+	}).Times(1)
+	mockDynamoDB.EXPECT().PutItem(gomock.Any()).DoAndReturn(func(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+		item := input.Item
+		if *item["status"].S != task.JobCompleted || *item["processed"].N != "27" || *item["batches"].N != "2" || item["cursor"] != nil {
+			t.Errorf("unexpected job progress %v", item)
+		}
+		if *input.ExpressionAttributeValues[":batches"].N != "1" {
+			t.Errorf("progress must be conditioned on the previous batch")
+		}
+		return &dynamodb.PutItemOutput{}, nil
+	}).Times(1)
+
+	if err := handler(loadEvent(t, "tag_job.json")); err != nil {
+		t.Fatalf("handler() error = %v", err)
+	}
+	if want := map[string]int{"tenant1#10": 1, "tenant1#11": 0}; !reflect.DeepEqual(written, want) {
+		t.Errorf("tag web added = %v, want %v", written, want)
+	}
+}
+
+func Test_handlerCreatesNextOccurrence(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockDynamoDB := mockdb.NewMockDynamoDBAPI(ctrl)
+	task.Svc = mockDynamoDB
+	sinks = []task.Sink{&recordingSink{}}
+
+	recurrence := map[string]*dynamodb.AttributeValue{
+		"id":           {S: aws.String("tenant1#Recurrences")},
+		"DataType":     {S: aws.String("Recurrence#r1")},
+		"recurrenceId": {S: aws.String("r1")},
+		"project":      {S: aws.String("API")},
+		"title":        {S: aws.String("Daily report")},
+		"rule":         {S: aws.String("FREQ=DAILY")},
+		"start":        {S: aws.String("2099-01-01")},
+		"trigger":      {S: aws.String(task.TriggerCompletion)},
+		"next":         {S: aws.String("2099-01-02")},
+		"occurrences":  {N: aws.String("1")},
+		"lastTask":     {S: aws.String("1")},
+		"createdBy":    {S: aws.String("user-1")},
+	}
+	mockDynamoDB.EXPECT().GetItem(gomock.Any()).DoAndReturn(func(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+		switch *input.Key["DataType"].S {
+		case "Recurrence":
+			return &dynamodb.GetItemOutput{Item: map[string]*dynamodb.AttributeValue{"DataValue": {S: aws.String("tenant1#r1")}}}, nil
+		case "Recurrence#r1":
+			return &dynamodb.GetItemOutput{Item: recurrence}, nil
+		}
+		return &dynamodb.GetItemOutput{}, nil
+	}).Times(2)
+
+	// 次の発生日のタスクを作成し、作成済みの数を条件に繰り返しを進める
+	mockDynamoDB.EXPECT().TransactWriteItems(gomock.Any()).DoAndReturn(func(input *dynamodb.TransactWriteItemsInput) (*dynamodb.TransactWriteItemsOutput, error) {
+		due, series := false, false
+		for _, item := range input.TransactItems {
+			if item.Put == nil {
+				continue
+			}
+			switch *item.Put.Item["DataType"].S {
+			case "Due":
+				due = *item.Put.Item["DataValue"].S == "tenant1#2099-01-02"
+			case "Recurrence#r1":
+				series = true
+				if *item.Put.Item["next"].S != "2099-01-03" || *item.Put.Item["occurrences"].N != "2" {
+					t.Errorf("unexpected recurrence progress %v", item.Put.Item)
+				}
+				if *item.Put.ConditionExpression != "occurrences = :occurrences" || *item.Put.ExpressionAttributeValues[":occurrences"].N != "1" {
+					t.Errorf("progress must be conditioned on the previous occurrences")
+				}
+			}
+		}
+		if !due || !series {
+			t.Errorf("TransactWriteItems must create the task due 2099-01-02 and advance the recurrence")
+		}
+		return &dynamodb.TransactWriteItemsOutput{}, nil
+	}).Times(1)
+
+	if err := handler(loadEvent(t, "recurrence.json")); err != nil {
+		t.Fatalf("handler() error = %v", err)
+	}
+}
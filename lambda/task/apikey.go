@@ -0,0 +1,292 @@
+package task
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"task-management-app/lambda/auth"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+type ApiKey struct {
+	ID         string   `json:"id" dynamodbav:"keyId"`
+	TenantID   string   `json:"tenantId"`
+	Name       string   `json:"name"`
+	Scopes     []string `json:"scopes"`
+	CreatedBy  string   `json:"createdBy,omitempty"`
+	CreatedAt  int64    `json:"createdAt"`
+	ExpiresAt  int64    `json:"expiresAt,omitempty"`
+	LastUsedAt int64    `json:"lastUsedAt,omitempty"`
+	Revoked    bool     `json:"revoked"`
+}
+
+type createApiKeyRequest struct {
+	Name          string   `json:"name"`
+	Scopes        []string `json:"scopes"`
+	ExpiresInDays int      `json:"expiresInDays"`
+}
+
+var ErrInvalidApiKey = errors.New("invalid API key")
+
+// APIキーはテナントのパーティションにまとめ、平文は保存せずハッシュをGSI1のキーにする
+func apiKeyKey(tenantId string, keyId string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"id":       {S: aws.String(tenantKey(tenantId, "ApiKeys"))},
+		"DataType": {S: aws.String("ApiKey#" + keyId)},
+	}
+}
+
+func hashApiKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return "ApiKey#" + hex.EncodeToString(sum[:])
+}
+
+// 呼び出し元が持たないロールは付与できない。テナント全体のスコープはテナント全体の管理者だけが付与できる
+func grantableScope(identity Identity, scope string) bool {
+	_, project, scoped := strings.Cut(strings.TrimSpace(scope), ":")
+	if !scoped {
+		return auth.EffectiveRole([]string{scope}, "") > auth.NoRole && identity.HasRole("admin")
+	}
+	granted := auth.EffectiveRole([]string{scope}, project)
+	return project != "" && granted > auth.NoRole && auth.EffectiveRole(identity.Roles, project) >= granted
+}
+
+func CreateApiKey(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	identity := IdentityFromRequest(request)
+	if identity.TenantID == "" {
+		return missingTenantResponse(), nil
+	}
+
+	body := createApiKeyRequest{}
+	err := json.Unmarshal([]byte(request.Body), &body)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       fmt.Sprintf("Failed to unmarshal API key from JSON: %v", err),
+		}, nil
+	}
+	if body.Name == "" || len(body.Scopes) == 0 {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       "Missing name or scopes in the API key",
+		}, nil
+	}
+	for _, scope := range body.Scopes {
+		if !grantableScope(identity, scope) {
+			return events.APIGatewayProxyResponse{
+				StatusCode: http.StatusForbidden,
+				Body:       fmt.Sprintf("Scope %s cannot be granted by the caller", scope),
+			}, nil
+		}
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return events.APIGatewayProxyResponse{}, err
+	}
+	key := ApiKey{
+		ID:        newId(),
+		TenantID:  identity.TenantID,
+		Name:      body.Name,
+		Scopes:    body.Scopes,
+		CreatedBy: identity.Subject,
+		CreatedAt: now().Unix(),
+	}
+	if body.ExpiresInDays > 0 {
+		key.ExpiresAt = now().Add(time.Duration(body.ExpiresInDays) * 24 * time.Hour).Unix()
+	}
+	token := "tm_" + key.ID + "_" + base64.RawURLEncoding.EncodeToString(secret)
+
+	item, err := dynamodbattribute.MarshalMap(key)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to marshal API key: %v", err),
+		}, nil
+	}
+	for k, v := range apiKeyKey(identity.TenantID, key.ID) {
+		item[k] = v
+	}
+	item["DataValue"] = &dynamodb.AttributeValue{S: aws.String(hashApiKey(token))}
+
+	_, err = identity.db().PutItem(&dynamodb.PutItemInput{
+		TableName:           aws.String(tableName),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(DataType)"),
+	})
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to create API key: %v", err),
+		}, nil
+	}
+
+	// 平文のキーは作成時のレスポンスでしか返さない
+	response, err := json.Marshal(struct {
+		ApiKey
+		Key string `json:"key"`
+	}{key, token})
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to marshal response: %v", err),
+		}, nil
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: http.StatusCreated,
+		Body:       string(response),
+	}, nil
+}
+
+func GetApiKeys(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	tenantId := TenantFromRequest(request)
+	if tenantId == "" {
+		return missingTenantResponse(), nil
+	}
+
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(tableName),
+		KeyConditionExpression: aws.String("id = :id AND begins_with(DataType, :prefix)"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":id":     {S: aws.String(tenantKey(tenantId, "ApiKeys"))},
+			":prefix": {S: aws.String("ApiKey#")},
+		},
+	}
+
+	result, err := Svc.Query(input)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Query failed: %v", err),
+		}, nil
+	}
+
+	keys := make([]ApiKey, 0, len(result.Items))
+	for _, i := range result.Items {
+		key := ApiKey{}
+		if err := dynamodbattribute.UnmarshalMap(i, &key); err != nil {
+			return events.APIGatewayProxyResponse{
+				StatusCode: http.StatusInternalServerError,
+				Body:       fmt.Sprintf("Failed to unmarshal API key: %v", err),
+			}, nil
+		}
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt < keys[j].CreatedAt })
+
+	response, err := json.Marshal(keys)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to marshal response: %v", err),
+		}, nil
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: http.StatusOK,
+		Body:       string(response),
+	}, nil
+}
+
+func RevokeApiKey(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	tenantId := TenantFromRequest(request)
+	if tenantId == "" {
+		return missingTenantResponse(), nil
+	}
+	keyId := request.QueryStringParameters["id"]
+
+	input := &dynamodb.UpdateItemInput{
+		TableName:           aws.String(tableName),
+		Key:                 apiKeyKey(tenantId, keyId),
+		ConditionExpression: aws.String("attribute_exists(DataType)"),
+		UpdateExpression:    aws.String("SET revoked = :revoked"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":revoked": {BOOL: aws.Bool(true)},
+		},
+	}
+
+	_, err := clientFor(request).UpdateItem(input)
+	if err != nil {
+		if isConditionFailed(err) {
+			return events.APIGatewayProxyResponse{
+				StatusCode: http.StatusNotFound,
+				Body:       "API key not found",
+			}, nil
+		}
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to revoke API key: %v", err),
+		}, nil
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: http.StatusOK,
+		Body:       "API key revoked successfully",
+	}, nil
+}
+
+// 平文のキーからAPIキーを検索し、有効であれば最終利用日時を更新する
+func LookupApiKey(token string) (*ApiKey, error) {
+	if !strings.HasPrefix(token, "tm_") {
+		return nil, ErrInvalidApiKey
+	}
+
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(tableName),
+		IndexName:              aws.String("GSI1"),
+		KeyConditionExpression: aws.String("DataValue = :dataValue"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":dataValue": {S: aws.String(hashApiKey(token))},
+		},
+	}
+
+	result, err := Svc.Query(input)
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Items) != 1 {
+		return nil, ErrInvalidApiKey
+	}
+
+	key := ApiKey{}
+	if err := dynamodbattribute.UnmarshalMap(result.Items[0], &key); err != nil {
+		return nil, err
+	}
+	if stringAttr(result.Items[0], "id") != tenantKey(key.TenantID, "ApiKeys") {
+		return nil, ErrInvalidApiKey
+	}
+	if key.Revoked || (key.ExpiresAt != 0 && now().Unix() >= key.ExpiresAt) {
+		return nil, ErrInvalidApiKey
+	}
+
+	key.LastUsedAt = now().Unix()
+	_, err = Svc.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:        aws.String(tableName),
+		Key:              apiKeyKey(key.TenantID, key.ID),
+		UpdateExpression: aws.String("SET lastUsedAt = :lastUsedAt"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":lastUsedAt": {N: aws.String(fmt.Sprint(key.LastUsedAt))},
+		},
+	})
+	if err != nil {
+		// 最終利用日時の更新に失敗しても認証自体は成功させる
+		log.Printf("Failed to update lastUsedAt of API key %s: %v", key.ID, err)
+	}
+
+	return &key, nil
+}
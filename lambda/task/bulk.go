@@ -0,0 +1,436 @@
+package task
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+const (
+	BulkSetStatus = "setStatus"
+	BulkAddTag    = "addTag"
+	BulkRemoveTag = "removeTag"
+	BulkDelete    = "delete"
+	BulkMove      = "move"
+
+	BulkSucceeded = "succeeded"
+	BulkSkipped   = "skipped"
+	BulkFailed    = "failed"
+
+	// 1回のリクエストで操作できるタスク数の上限
+	maxBulkTasks = 1000
+)
+
+// 指定した条件をすべて満たすタスクを対象にする
+type BulkFilter struct {
+	Project string `json:"project,omitempty"`
+	Tag     string `json:"tag,omitempty"`
+	Status  string `json:"status,omitempty"`
+}
+
+type BulkOperation struct {
+	Type  string `json:"type"`
+	Value string `json:"value,omitempty"`
+}
+
+type bulkRequest struct {
+	IDs       []string      `json:"ids"`
+	Filter    *BulkFilter   `json:"filter"`
+	Operation BulkOperation `json:"operation"`
+}
+
+type BulkResult struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type bulkResponse struct {
+	Results   []BulkResult `json:"results"`
+	Succeeded int          `json:"succeeded"`
+	Skipped   int          `json:"skipped"`
+	Failed    int          `json:"failed"`
+}
+
+// 1タスク分の書き込み。resultは結果を書き込むBulkResultの位置
+// タグの使用数はトランザクションごとにまとめるため、itemsには含めずchangeから組み立てる
+type bulkMutation struct {
+	result int
+	items  []*dynamodb.TransactWriteItem
+	change fieldChange
+}
+
+// IDの一覧または条件で選んだタスクに同じ操作を行い、タスクごとの結果を返す
+// 複数タスクの書き込みをトランザクションにまとめ、失敗したタスクを除いて再実行するため、途中で失敗しても残りのタスクは処理する
+func BulkUpdateTasks(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	identity := IdentityFromRequest(request)
+	tenantId := identity.TenantID
+	if tenantId == "" {
+		return missingTenantResponse(), nil
+	}
+
+	body := bulkRequest{}
+	if err := json.Unmarshal([]byte(request.Body), &body); err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       fmt.Sprintf("Failed to unmarshal request: %v", err),
+		}, nil
+	}
+	op := body.Operation
+	switch op.Type {
+	case BulkSetStatus, BulkAddTag, BulkRemoveTag, BulkMove:
+		if op.Value == "" {
+			return events.APIGatewayProxyResponse{
+				StatusCode: http.StatusBadRequest,
+				Body:       fmt.Sprintf("Missing value for %s", op.Type),
+			}, nil
+		}
+	case BulkDelete:
+	default:
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       fmt.Sprintf("Unknown operation: %s", op.Type),
+		}, nil
+	}
+	if (len(body.IDs) > 0) == (body.Filter != nil) {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       "Specify either ids or filter",
+		}, nil
+	}
+
+	ids := uniqueStrings(body.IDs)
+	if body.Filter != nil {
+		var err error
+		ids, err = filterTaskIds(tenantId, *body.Filter)
+		if err != nil {
+			return events.APIGatewayProxyResponse{
+				StatusCode: http.StatusInternalServerError,
+				Body:       fmt.Sprintf("Failed to retrieve tasks: %v", err),
+			}, nil
+		}
+	}
+	if len(ids) > maxBulkTasks {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       fmt.Sprintf("Too many tasks: %d (max %d)", len(ids), maxBulkTasks),
+		}, nil
+	}
+
+	results := make([]BulkResult, len(ids))
+	for i, id := range ids {
+		results[i] = BulkResult{ID: id, Status: BulkSucceeded}
+		if !validTaskId(id) {
+			results[i].Status, results[i].Error = BulkFailed, errInvalidTaskId.Error()
+		}
+	}
+
+	if op.Type == BulkDelete {
+		// 削除はパーティション単位のバッチ削除でトランザクションにできないため、タスクごとに行う
+		for i, id := range ids {
+			if results[i].Status == BulkFailed {
+				continue
+			}
+			found, err := removeTask(identity.db(), tenantId, id)
+			if err == nil && !found {
+				err = errors.New("Task not found")
+			}
+			if err == nil {
+				err = recordDeletion(identity.db(), tenantId, id)
+			}
+			if err != nil {
+				results[i].Status, results[i].Error = BulkFailed, err.Error()
+			}
+		}
+		return bulkResultResponse(results)
+	}
+
+	// 移動先のプロジェクトの確認はタスクごとではなく、トランザクションごとに1回行う
+	shared := []*dynamodb.TransactWriteItem{}
+	if op.Type == BulkMove {
+		shared = append(shared, projectActiveCheck(tenantId, op.Value))
+	}
+	// タグの使用数の更新もトランザクションごとに1つにまとめる
+	reserved := len(shared)
+	if op.Type == BulkAddTag || op.Type == BulkRemoveTag {
+		reserved++
+	}
+	if op.Type == BulkAddTag {
+		if _, err := tagCountUpdates(tenantId, []fieldChange{{"Tags", "", op.Value}}); err != nil {
+			if response, ok := tagErrorResponse(err); ok {
+				return response, nil
+			}
+			return events.APIGatewayProxyResponse{
+				StatusCode: http.StatusInternalServerError,
+				Body:       fmt.Sprintf("Failed to retrieve tag: %v", err),
+			}, nil
+		}
+	}
+
+	batch := []bulkMutation{}
+	size := reserved
+	for i, id := range ids {
+		if results[i].Status == BulkFailed {
+			continue
+		}
+		items, change, err := bulkMutationItems(identity, id, op)
+		if err != nil {
+			results[i].Status, results[i].Error = BulkFailed, err.Error()
+			continue
+		}
+		if items == nil {
+			results[i].Status = BulkSkipped
+			continue
+		}
+		if size+len(items) > maxTransactItems {
+			executeBulkBatch(identity.db(), tenantId, batch, shared, results)
+			batch, size = nil, reserved
+		}
+		batch = append(batch, bulkMutation{result: i, items: items, change: change})
+		size += len(items)
+	}
+	executeBulkBatch(identity.db(), tenantId, batch, shared, results)
+
+	return bulkResultResponse(results)
+}
+
+// タスク1件分の書き込みを組み立てる。変更がない場合はnilを返す
+func bulkMutationItems(identity Identity, taskId string, op BulkOperation) ([]*dynamodb.TransactWriteItem, fieldChange, error) {
+	tenantId := identity.TenantID
+	task, err := loadTask(tenantId, taskId)
+	if err != nil {
+		return nil, fieldChange{}, err
+	}
+	if task == nil {
+		return nil, fieldChange{}, errors.New("Task not found")
+	}
+
+	hasTag := false
+	for _, tag := range task.Tags {
+		hasTag = hasTag || tag == op.Value
+	}
+
+	var transactItems []*dynamodb.TransactWriteItem
+	var change fieldChange
+	switch op.Type {
+	case BulkSetStatus:
+		if task.Status == op.Value {
+			return nil, fieldChange{}, nil
+		}
+		open, err := blockingSubtasks(tenantId, taskId, op.Value)
+		if err != nil {
+			return nil, fieldChange{}, err
+		}
+		if open > 0 {
+			return nil, fieldChange{}, fmt.Errorf("Task has %d open subtasks", open)
+		}
+		transactItems = []*dynamodb.TransactWriteItem{fieldWrite(tenantId, taskId, "Status", task.Status, op.Value)}
+		change = fieldChange{"Status", task.Status, op.Value}
+	case BulkAddTag:
+		if hasTag {
+			return nil, fieldChange{}, nil
+		}
+		transactItems = []*dynamodb.TransactWriteItem{taskExistsCheck(tenantId, taskId), tagWrite(tenantId, taskId, "", op.Value)}
+		change = fieldChange{"Tags", "", op.Value}
+	case BulkRemoveTag:
+		if !hasTag {
+			return nil, fieldChange{}, nil
+		}
+		transactItems = []*dynamodb.TransactWriteItem{tagWrite(tenantId, taskId, op.Value, "")}
+		change = fieldChange{"Tags", op.Value, ""}
+	case BulkMove:
+		if task.Project == op.Value {
+			return nil, fieldChange{}, nil
+		}
+		if task.Parent != "" {
+			return nil, fieldChange{}, errTaskInHierarchy
+		}
+		if err := checkNoSubtasks(tenantId, taskId); err != nil {
+			return nil, fieldChange{}, err
+		}
+		transactItems = []*dynamodb.TransactWriteItem{
+			fieldWrite(tenantId, taskId, "Project", task.Project, op.Value),
+			noParentCheck(tenantId, taskId),
+		}
+		change = fieldChange{"Project", task.Project, op.Value}
+	}
+	transactItems, err = taskRecordItems(identity, taskId, now(), transactItems, []fieldChange{change})
+	if err != nil {
+		return nil, fieldChange{}, err
+	}
+	return transactItems, change, nil
+}
+
+// まとめて書き込み、キャンセルされた場合は失敗したアイテムを含むタスクを除いて再実行する
+// 同じタグの使用数を1つのトランザクションで2回更新できないため、使用数は残っているタスクの分をまとめて毎回組み立てる
+func executeBulkBatch(svc dynamodbiface.DynamoDBAPI, tenantId string, batch []bulkMutation, shared []*dynamodb.TransactWriteItem, results []BulkResult) {
+	fail := func(mutations []bulkMutation, message string) {
+		for _, m := range mutations {
+			results[m.result].Status, results[m.result].Error = BulkFailed, message
+		}
+	}
+
+	for len(batch) > 0 {
+		changes := make([]fieldChange, 0, len(batch))
+		for _, m := range batch {
+			changes = append(changes, m.change)
+		}
+		tagCounts, err := tagCountUpdates(tenantId, changes)
+		if err != nil {
+			fail(batch, err.Error())
+			return
+		}
+		transactItems := append(append([]*dynamodb.TransactWriteItem{}, shared...), tagCounts...)
+		for _, m := range batch {
+			transactItems = append(transactItems, m.items...)
+		}
+		_, err = svc.TransactWriteItems(&dynamodb.TransactWriteItemsInput{TransactItems: transactItems})
+		if err == nil {
+			return
+		}
+
+		var canceled *dynamodb.TransactionCanceledException
+		if !errors.As(err, &canceled) || len(canceled.CancellationReasons) != len(transactItems) {
+			fail(batch, err.Error())
+			return
+		}
+		reasons := canceled.CancellationReasons
+		for _, r := range reasons[:len(shared)] {
+			if cancellationFailed(r) {
+				fail(batch, "Target project does not exist or is archived")
+				return
+			}
+		}
+
+		for _, r := range reasons[len(shared) : len(shared)+len(tagCounts)] {
+			if cancellationFailed(r) {
+				fail(batch, "Tag was deleted by another request")
+				return
+			}
+		}
+
+		remaining := []bulkMutation{}
+		offset := len(shared) + len(tagCounts)
+		for _, m := range batch {
+			var failed *dynamodb.CancellationReason
+			for _, r := range reasons[offset : offset+len(m.items)] {
+				if failed == nil && cancellationFailed(r) {
+					failed = r
+				}
+			}
+			offset += len(m.items)
+			if failed == nil {
+				remaining = append(remaining, m)
+				continue
+			}
+			message := aws.StringValue(failed.Code)
+			if message == "ConditionalCheckFailed" {
+				message = "Task was modified by another request"
+			}
+			fail([]bulkMutation{m}, message)
+		}
+		// 失敗したタスクを特定できなければ、再実行しても同じ結果になる
+		if len(remaining) == len(batch) {
+			fail(batch, err.Error())
+			return
+		}
+		batch = remaining
+	}
+}
+
+func cancellationFailed(reason *dynamodb.CancellationReason) bool {
+	code := aws.StringValue(reason.Code)
+	return code != "" && code != "None"
+}
+
+func filterTaskIds(tenantId string, filter BulkFilter) ([]string, error) {
+	conditions := [][2]string{}
+	if filter.Project != "" {
+		conditions = append(conditions, [2]string{"Project", filter.Project})
+	}
+	if filter.Tag != "" {
+		conditions = append(conditions, [2]string{tagDataType(filter.Tag), filter.Tag})
+	}
+	if filter.Status != "" {
+		conditions = append(conditions, [2]string{"Status", filter.Status})
+	}
+	if len(conditions) == 0 {
+		return nil, errors.New("filter has no conditions")
+	}
+
+	var ids []string
+	for i, c := range conditions {
+		var matched []string
+		var err error
+		if c[0] == tagDataType(c[1]) {
+			// タグは下位の階層のタグが付いたタスクも対象にする
+			matched, err = taskIdsByTag(tenantId, c[1])
+		} else {
+			matched, err = taskIdsByDataValue(tenantId, c[0], c[1])
+		}
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			ids = matched
+			continue
+		}
+		found := map[string]bool{}
+		for _, id := range matched {
+			found[id] = true
+		}
+		filtered := []string{}
+		for _, id := range ids {
+			if found[id] {
+				filtered = append(filtered, id)
+			}
+		}
+		ids = filtered
+	}
+	return ids, nil
+}
+
+func uniqueStrings(values []string) []string {
+	seen := map[string]bool{}
+	result := []string{}
+	for _, v := range values {
+		if v != "" && !seen[v] {
+			seen[v] = true
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+func bulkResultResponse(results []BulkResult) (events.APIGatewayProxyResponse, error) {
+	body := bulkResponse{Results: results}
+	for _, r := range results {
+		switch r.Status {
+		case BulkSucceeded:
+			body.Succeeded++
+		case BulkSkipped:
+			body.Skipped++
+		case BulkFailed:
+			body.Failed++
+		}
+	}
+
+	response, err := json.Marshal(body)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to marshal response: %v", err),
+		}, nil
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: http.StatusOK,
+		Body:       string(response),
+	}, nil
+}
@@ -0,0 +1,201 @@
+package task
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+const (
+	ChangeUpsert = "upsert"
+	ChangeDelete = "delete"
+)
+
+// 同期クライアントに返す変更。削除の場合はTaskを含まない
+type SyncChange struct {
+	ID   string `json:"id"`
+	Type string `json:"type"`
+	Task *Task  `json:"task,omitempty"`
+}
+
+type changeFeed struct {
+	Changes []SyncChange `json:"changes"`
+	Cursor  string       `json:"cursor"`
+	HasMore bool         `json:"hasMore"`
+}
+
+var (
+	// 変更ログを残す期間。これより古いカーソルでは差分を返せないため、全件を取得し直してもらう
+	ChangeLogRetention = 30 * 24 * time.Hour
+	// 書き込み中のトランザクションが先の日時で後からコミットされても取りこぼさないよう、直近の変更は返さない
+	changeLogSettle = 5 * time.Second
+)
+
+// 変更ログはテナントごとに"{テナントID}#Changes"のパーティションに置き、ソートキーは"Change#{日時}-{乱数}"
+func changeLogPartition(tenantId string) string {
+	return tenantKey(tenantId, "Changes")
+}
+
+func changeLogDataType(timestamp time.Time) string {
+	return "Change#" + newEventId(timestamp)
+}
+
+// タスクへの変更と同じトランザクションで書き込む変更ログのアイテム
+func changeLogPut(tenantId string, taskId string, changeType string, timestamp time.Time) *dynamodb.TransactWriteItem {
+	return &dynamodb.TransactWriteItem{
+		Put: &dynamodb.Put{
+			TableName: aws.String(tableName),
+			Item: map[string]*dynamodb.AttributeValue{
+				"id":       {S: aws.String(changeLogPartition(tenantId))},
+				"DataType": {S: aws.String(changeLogDataType(timestamp))},
+				"taskId":   {S: aws.String(taskId)},
+				"type":     {S: aws.String(changeType)},
+				"ttl":      {N: aws.String(fmt.Sprint(timestamp.Add(ChangeLogRetention).Unix()))},
+			},
+			ConditionExpression: aws.String("attribute_not_exists(id)"),
+		},
+	}
+}
+
+// ?since=のカーソル以降の変更を古い順に返す
+// 同じタスクの変更は最後の1件にまとめ、更新は現在のタスクを返す
+// カーソルがない場合は現在位置のカーソルだけを返すため、クライアントはカーソルを取得してから全件を取得する
+func GetChanges(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	tenantId := TenantFromRequest(request)
+	if tenantId == "" {
+		return missingTenantResponse(), nil
+	}
+	partition := changeLogPartition(tenantId)
+	head := fmt.Sprintf("Change#%020d", now().Add(-changeLogSettle).UnixNano())
+
+	since := request.QueryStringParameters["since"]
+	if since == "" {
+		return changeFeedResponse(changeFeed{
+			Changes: []SyncChange{},
+			Cursor:  encodeCursor(changeLogKey(partition, head)),
+		})
+	}
+
+	startKey, err := decodeCursor(since, partition)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       err.Error(),
+		}, nil
+	}
+	if changeLogTime(*startKey["DataType"].S).Before(now().Add(-ChangeLogRetention)) {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusGone,
+			Body:       "Cursor has expired, fetch all tasks again",
+		}, nil
+	}
+	// 返せる範囲より先のカーソルは、新しい変更がまだないものとして扱う
+	if *startKey["DataType"].S >= head {
+		return changeFeedResponse(changeFeed{Changes: []SyncChange{}, Cursor: since})
+	}
+
+	result, err := Svc.Query(&dynamodb.QueryInput{
+		TableName:              aws.String(tableName),
+		KeyConditionExpression: aws.String("id = :id AND DataType BETWEEN :from AND :to"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":id":   {S: aws.String(partition)},
+			":from": {S: aws.String("Change#")},
+			":to":   {S: aws.String(head)},
+		},
+		Limit:             aws.Int64(pageSize(request.QueryStringParameters["limit"])),
+		ExclusiveStartKey: startKey,
+	})
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Query failed: %v", err),
+		}, nil
+	}
+
+	feed := changeFeed{Changes: []SyncChange{}, Cursor: since, HasMore: len(result.LastEvaluatedKey) > 0}
+	if len(result.Items) > 0 {
+		last := result.Items[len(result.Items)-1]
+		feed.Cursor = encodeCursor(changeLogKey(partition, stringAttr(last, "DataType")))
+	}
+
+	latest := map[string]string{}
+	order := []string{}
+	for _, i := range result.Items {
+		taskId := stringAttr(i, "taskId")
+		if _, ok := latest[taskId]; ok {
+			order = removeString(order, taskId)
+		}
+		latest[taskId] = stringAttr(i, "type")
+		order = append(order, taskId)
+	}
+
+	for _, taskId := range order {
+		change := SyncChange{ID: taskId, Type: ChangeDelete}
+		if latest[taskId] == ChangeUpsert {
+			task, err := loadTask(tenantId, taskId)
+			if err != nil {
+				return events.APIGatewayProxyResponse{
+					StatusCode: http.StatusInternalServerError,
+					Body:       fmt.Sprintf("Failed to retrieve task: %v", err),
+				}, nil
+			}
+			// 削除のログがまだ返せない時間内にあっても、タスクがなければ削除として返す
+			if task != nil {
+				change.Type = ChangeUpsert
+				change.Task = task
+			}
+		}
+		feed.Changes = append(feed.Changes, change)
+	}
+
+	return changeFeedResponse(feed)
+}
+
+func changeLogKey(partition string, dataType string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"id":       {S: aws.String(partition)},
+		"DataType": {S: aws.String(dataType)},
+	}
+}
+
+// ソートキーの日時部分を読み取る。読み取れない場合はゼロ時刻になる
+func changeLogTime(dataType string) time.Time {
+	nanos, _, _ := strings.Cut(strings.TrimPrefix(dataType, "Change#"), "-")
+	n, err := strconv.ParseInt(nanos, 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(0, n)
+}
+
+func removeString(values []string, value string) []string {
+	result := values[:0]
+	for _, v := range values {
+		if v != value {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+func changeFeedResponse(feed changeFeed) (events.APIGatewayProxyResponse, error) {
+	response, err := json.Marshal(feed)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to marshal response: %v", err),
+		}, nil
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: http.StatusOK,
+		Body:       string(response),
+	}, nil
+}
@@ -0,0 +1,276 @@
+package task
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+type Comment struct {
+	ID        string `json:"id" dynamodbav:"commentId"`
+	TaskID    string `json:"taskId"`
+	Author    string `json:"author"`
+	Body      string `json:"body"`
+	CreatedAt int64  `json:"createdAt"`
+	EditedAt  int64  `json:"editedAt,omitempty"`
+}
+
+type commentPage struct {
+	Comments   []Comment `json:"comments"`
+	NextCursor string    `json:"nextCursor,omitempty"`
+}
+
+// コメントIDは"{作成日時}-{乱数}"で、ソートキーは"Comment#{作成日時}#{乱数}"になる
+func newCommentId() string {
+	return fmt.Sprintf("%020d-%s", now().UnixNano(), newId()[:12])
+}
+
+func commentKey(tenantId string, taskId string, commentId string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"id":       {S: aws.String(tenantKey(tenantId, taskId))},
+		"DataType": {S: aws.String("Comment#" + strings.Replace(commentId, "-", "#", 1))},
+	}
+}
+
+func CreateComment(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	identity := IdentityFromRequest(request)
+	if identity.TenantID == "" {
+		return missingTenantResponse(), nil
+	}
+	taskId := request.QueryStringParameters["id"]
+
+	comment := Comment{}
+	err := json.Unmarshal([]byte(request.Body), &comment)
+	if err != nil || strings.TrimSpace(comment.Body) == "" {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       "Missing body in the comment",
+		}, nil
+	}
+	comment.ID = newCommentId()
+	comment.TaskID = taskId
+	comment.Author = identity.Subject
+	comment.CreatedAt = now().Unix()
+	comment.EditedAt = 0
+
+	item, err := dynamodbattribute.MarshalMap(comment)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to marshal comment: %v", err),
+		}, nil
+	}
+	for k, v := range commentKey(identity.TenantID, taskId, comment.ID) {
+		item[k] = v
+	}
+
+	_, err = identity.db().TransactWriteItems(&dynamodb.TransactWriteItemsInput{
+		TransactItems: []*dynamodb.TransactWriteItem{
+			taskExistsCheck(identity.TenantID, taskId),
+			{
+				Put: &dynamodb.Put{
+					TableName: aws.String(tableName),
+					Item:      item,
+				},
+			},
+		},
+	})
+	if err != nil {
+		if isConditionFailed(err) {
+			return events.APIGatewayProxyResponse{
+				StatusCode: http.StatusNotFound,
+				Body:       "Task not found",
+			}, nil
+		}
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to create comment: %v", err),
+		}, nil
+	}
+
+	response, err := json.Marshal(comment)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to marshal response: %v", err),
+		}, nil
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: http.StatusCreated,
+		Body:       string(response),
+	}, nil
+}
+
+// コメントを編集できるのは投稿者のみ
+func UpdateComment(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	identity := IdentityFromRequest(request)
+	if identity.TenantID == "" {
+		return missingTenantResponse(), nil
+	}
+	taskId := request.QueryStringParameters["id"]
+	commentId := request.QueryStringParameters["commentId"]
+
+	comment := Comment{}
+	err := json.Unmarshal([]byte(request.Body), &comment)
+	if err != nil || strings.TrimSpace(comment.Body) == "" {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       "Missing body in the comment",
+		}, nil
+	}
+
+	input := &dynamodb.UpdateItemInput{
+		TableName:           aws.String(tableName),
+		Key:                 commentKey(identity.TenantID, taskId, commentId),
+		ConditionExpression: aws.String("attribute_exists(id) AND author = :author"),
+		UpdateExpression:    aws.String("SET body = :body, editedAt = :editedAt"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":author":   {S: aws.String(identity.Subject)},
+			":body":     {S: aws.String(comment.Body)},
+			":editedAt": {N: aws.String(fmt.Sprint(now().Unix()))},
+		},
+	}
+
+	_, err = identity.db().UpdateItem(input)
+	if err != nil {
+		if isConditionFailed(err) {
+			return commentDeniedResponse(identity, taskId, commentId, "Only the author can edit the comment"), nil
+		}
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to update comment: %v", err),
+		}, nil
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: http.StatusOK,
+		Body:       "Comment updated successfully",
+	}, nil
+}
+
+// コメントを削除できるのは投稿者と管理者のみ
+func DeleteComment(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	identity := IdentityFromRequest(request)
+	if identity.TenantID == "" {
+		return missingTenantResponse(), nil
+	}
+	taskId := request.QueryStringParameters["id"]
+	commentId := request.QueryStringParameters["commentId"]
+
+	input := &dynamodb.DeleteItemInput{
+		TableName:           aws.String(tableName),
+		Key:                 commentKey(identity.TenantID, taskId, commentId),
+		ConditionExpression: aws.String("attribute_exists(id) AND author = :author"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":author": {S: aws.String(identity.Subject)},
+		},
+	}
+	if identity.HasRole("admin") {
+		input.ConditionExpression = aws.String("attribute_exists(id)")
+		input.ExpressionAttributeValues = nil
+	}
+
+	_, err := identity.db().DeleteItem(input)
+	if err != nil {
+		if isConditionFailed(err) {
+			return commentDeniedResponse(identity, taskId, commentId, "Only the author can delete the comment"), nil
+		}
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to delete comment: %v", err),
+		}, nil
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: http.StatusOK,
+		Body:       "Comment deleted successfully",
+	}, nil
+}
+
+// 条件付きの書き込みが失敗した理由を区別する。コメントがなければ404、投稿者でなければ403を返す
+func commentDeniedResponse(identity Identity, taskId string, commentId string, message string) events.APIGatewayProxyResponse {
+	result, err := identity.db().GetItem(&dynamodb.GetItemInput{
+		TableName:      aws.String(tableName),
+		Key:            commentKey(identity.TenantID, taskId, commentId),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to get comment: %v", err),
+		}
+	}
+	if len(result.Item) == 0 {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusNotFound,
+			Body:       "Comment not found",
+		}
+	}
+	return events.APIGatewayProxyResponse{
+		StatusCode: http.StatusForbidden,
+		Body:       message,
+	}
+}
+
+func GetComments(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	tenantId := TenantFromRequest(request)
+	if tenantId == "" {
+		return missingTenantResponse(), nil
+	}
+	taskId := request.QueryStringParameters["id"]
+
+	startKey, err := decodeCursor(request.QueryStringParameters["cursor"], tenantKey(tenantId, taskId))
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       err.Error(),
+		}, nil
+	}
+
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(tableName),
+		KeyConditionExpression: aws.String("id = :id AND begins_with(DataType, :prefix)"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":id":     {S: aws.String(tenantKey(tenantId, taskId))},
+			":prefix": {S: aws.String("Comment#")},
+		},
+		Limit:             aws.Int64(pageSize(request.QueryStringParameters["limit"])),
+		ExclusiveStartKey: startKey,
+	}
+
+	result, err := Svc.Query(input)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Query failed: %v", err),
+		}, nil
+	}
+
+	page := commentPage{Comments: []Comment{}, NextCursor: encodeCursor(result.LastEvaluatedKey)}
+	if err := dynamodbattribute.UnmarshalListOfMaps(result.Items, &page.Comments); err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to unmarshal comments: %v", err),
+		}, nil
+	}
+
+	response, err := json.Marshal(page)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to marshal response: %v", err),
+		}, nil
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: http.StatusOK,
+		Body:       string(response),
+	}, nil
+}
@@ -2,14 +2,14 @@ package task
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
 	"net/http"
+	"time"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
-	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
 	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
 )
 
@@ -19,39 +19,57 @@ var (
 )
 
 type Task struct {
-	ID          string   `json:"id"`
-	Title       string   `json:"title,omitempty"`
-	Description string   `json:"description,omitempty"`
-	Status      string   `json:"status,omitempty"`
-	Tags        []string `json:"tags,omitempty"`
-	DataType    string   `json:"DataType,omitempty"`
-	DataValue   string   `json:"DataValue,omitempty"`
+	ID          string          `json:"id"`
+	Title       string          `json:"title,omitempty"`
+	Description string          `json:"description,omitempty"`
+	Status      string          `json:"status,omitempty"`
+	Tags        []string        `json:"tags,omitempty"`
+	Project     string          `json:"project,omitempty"`
+	Parent      string          `json:"parent,omitempty"`
+	Due         string          `json:"due,omitempty"`
+	Subtasks    []Task          `json:"subtasks,omitempty"`
+	Checklist   []ChecklistItem `json:"checklist,omitempty"`
+	Progress    *Progress       `json:"progress,omitempty"`
+	Blocked     bool            `json:"blocked,omitempty"`
+	// 繰り返しから作成されたタスクであれば繰り返しのID
+	Recurrence string `json:"recurrence,omitempty"`
+	// プロジェクトで定義したカスタムフィールドの値。複数選択は配列、それ以外は文字列
+	CustomFields map[string]interface{} `json:"customFields,omitempty"`
+	// 終了した作業時間の記録の合計（秒）
+	TimeSpent int64 `json:"timeSpent,omitempty"`
+	// 属性ごとの最終更新のバージョン。オフライン編集の同期で競合の検出に使う
+	Versions map[string]int64 `json:"versions,omitempty"`
 }
 
 func AddTagToTask(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	identity := IdentityFromRequest(request)
+	tenantId := identity.TenantID
+	if tenantId == "" {
+		return missingTenantResponse(), nil
+	}
 	taskId := request.QueryStringParameters["id"]
 	tag := request.QueryStringParameters["tag"]
 
-	input := &dynamodb.UpdateItemInput{
-		TableName: aws.String(tableName),
-		Key: map[string]*dynamodb.AttributeValue{
-			"id": {
-				S: aws.String(taskId),
-			},
-			"DataType": {
-				S: aws.String("Tags"),
-			},
-		},
-		UpdateExpression: aws.String("ADD dataValue :tag"),
-		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
-			":tag": {
-				SS: []*string{aws.String(tag)},
-			},
-		},
-	}
-
-	_, err := Svc.UpdateItem(input)
+	// 既に付いているタグを重ねて数えないよう、タグがない場合のみ追加する
+	// 存在しないタスクにタグのアイテムだけが作られないよう、タスクの存在も確認する
+	transactItems := []*dynamodb.TransactWriteItem{taskExistsCheck(tenantId, taskId), tagWrite(tenantId, taskId, "", tag)}
+	err := writeTaskMutation(identity, taskId, transactItems, fieldChange{"Tags", "", tag})
 	if err != nil {
+		if response, ok := tagErrorResponse(err); ok {
+			return response, nil
+		}
+		if conditionFailedAt(err, 0) {
+			return events.APIGatewayProxyResponse{
+				StatusCode: http.StatusNotFound,
+				Body:       "Task not found",
+			}, nil
+		}
+		if isConditionFailed(err) {
+			return events.APIGatewayProxyResponse{
+				StatusCode: http.StatusConflict,
+				Body:       "Tag is already on the task",
+			}, nil
+		}
 		return events.APIGatewayProxyResponse{
 			StatusCode: http.StatusInternalServerError,
 			Body:       fmt.Sprintf("Failed to add tag to task: %v", err),
@@ -65,55 +83,96 @@ func AddTagToTask(request events.APIGatewayProxyRequest) (events.APIGatewayProxy
 }
 
 func CreateTask(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	identity := IdentityFromRequest(request)
+	tenantId := identity.TenantID
+	if tenantId == "" {
+		return missingTenantResponse(), nil
+	}
+
 	task := Task{}
 	err := json.Unmarshal([]byte(request.Body), &task)
-
 	if err != nil {
-		log.Fatalf("Failed to unmarshal task from JSON, %v", err)
-		return events.APIGatewayProxyResponse{}, err
-	}
-
-	// データタイプと値を設定
-	if task.Title != "" {
-		task.DataType = "Title"
-		task.DataValue = task.Title
-	} else if task.Status != "" {
-		task.DataType = "Status"
-		task.DataValue = task.Status
-	} else if task.Description != "" {
-		task.DataType = "Description"
-		task.DataValue = task.Description
-	} else if len(task.Tags) > 0 {
-		task.DataType = "Tags"
-		tags, err := json.Marshal(task.Tags)
-		if err != nil {
-			log.Fatalf("Failed to marshal tags into JSON, %v", err)
-			return events.APIGatewayProxyResponse{}, err
-		}
-		task.DataValue = string(tags)
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       fmt.Sprintf("Failed to unmarshal task from JSON: %v", err),
+		}, nil
 	}
 
-	av, err := dynamodbattribute.MarshalMap(task) // タスクオブジェクトをDynamoDBのアイテムに変換
-	if err != nil {
-		log.Fatalf("Failed to marshal task into DynamoDB item, %v", err)
-		return events.APIGatewayProxyResponse{}, err
+	if task.ID == "" || task.Project == "" {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       "Missing id or project in the task",
+		}, nil
 	}
-	if _, ok := av["DataType"]; !ok {
+	if !validTaskId(task.ID) {
 		return events.APIGatewayProxyResponse{
 			StatusCode: http.StatusBadRequest,
-			Body:       "Missing DataType in the item",
-		}, fmt.Errorf("missing DataType in the item")
+			Body:       errInvalidTaskId.Error(),
+		}, nil
 	}
 
-	input := &dynamodb.PutItemInput{
-		Item:      av,
-		TableName: aws.String(tableName),
+	if _, err := time.Parse(dateLayout, task.Due); task.Due != "" && err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       "Due must be a date in YYYY-MM-DD format",
+		}, nil
+	}
+	if err := normalizeCustomFields(tenantId, &task); err != nil {
+		if errors.Is(err, errInvalidField) {
+			return events.APIGatewayProxyResponse{
+				StatusCode: http.StatusBadRequest,
+				Body:       err.Error(),
+			}, nil
+		}
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to get fields of project: %v", err),
+		}, nil
 	}
 
-	_, err = Svc.PutItem(input)
+	// プロジェクトが存在し、アーカイブされていないことを確認してから書き込む
+	transactItems := []*dynamodb.TransactWriteItem{
+		projectActiveCheck(tenantId, task.Project),
+	}
+	for _, item := range taskItems(tenantId, task) {
+		transactItems = append(transactItems, &dynamodb.TransactWriteItem{
+			Put: &dynamodb.Put{
+				TableName:           aws.String(tableName),
+				Item:                item,
+				ConditionExpression: aws.String("attribute_not_exists(id)"),
+			},
+		})
+	}
+	// サブタスクとして作成する場合は同じプロジェクトの親タスクの末尾に追加する
+	if task.Parent != "" {
+		transactItems = append(transactItems,
+			taskInProjectCheck(tenantId, task.Parent, task.Project),
+			subtaskLinkPut(tenantId, task.Parent, task.ID, now().UnixNano()),
+		)
+	}
+
+	// 作成時の値も履歴に残し、リビジョンを履歴から復元できるようにする
+	err = writeTaskMutation(identity, task.ID, transactItems, taskChanges(Task{}, task)...)
 	if err != nil {
-		log.Fatalf("Got error calling PutItem: %s", err)
-		return events.APIGatewayProxyResponse{}, err
+		if err == errTooManyItems {
+			return events.APIGatewayProxyResponse{
+				StatusCode: http.StatusBadRequest,
+				Body:       "Too many tags or custom field values in the task",
+			}, nil
+		}
+		if response, ok := tagErrorResponse(err); ok {
+			return response, nil
+		}
+		if isConditionFailed(err) {
+			return events.APIGatewayProxyResponse{
+				StatusCode: http.StatusConflict,
+				Body:       "Task already exists, the project is not active, or the parent task is not in the project",
+			}, nil
+		}
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to create task: %v", err),
+		}, nil
 	}
 
 	return events.APIGatewayProxyResponse{
@@ -121,3 +180,65 @@ func CreateTask(request events.APIGatewayProxyRequest) (events.APIGatewayProxyRe
 		StatusCode: http.StatusCreated,
 	}, nil
 }
+
+// タスクの各属性をDataType/DataValueのアイテムに分解する
+func taskItems(tenantId string, task Task) []map[string]*dynamodb.AttributeValue {
+	fields := [][2]string{
+		{"Title", task.Title},
+		{"Description", task.Description},
+		{"Status", task.Status},
+		{"Project", task.Project},
+		{"Parent", task.Parent},
+		{"Due", task.Due},
+	}
+	for _, tag := range task.Tags {
+		fields = append(fields, [2]string{tagDataType(tag), tag})
+	}
+	for dataType, value := range customFieldItems(task) {
+		fields = append(fields, [2]string{dataType, value})
+	}
+
+	items := make([]map[string]*dynamodb.AttributeValue, 0, len(fields))
+	for _, field := range fields {
+		if field[1] == "" {
+			continue
+		}
+		items = append(items, map[string]*dynamodb.AttributeValue{
+			"id":        {S: aws.String(tenantKey(tenantId, task.ID))},
+			"DataType":  {S: aws.String(field[0])},
+			"DataValue": {S: aws.String(tenantKey(tenantId, field[1]))},
+		})
+	}
+	return items
+}
+
+// 全てのタスクはProjectアイテムを持つため、その存在でタスクの存在を確認する
+func taskExistsCheck(tenantId string, taskId string) *dynamodb.TransactWriteItem {
+	return &dynamodb.TransactWriteItem{
+		ConditionCheck: &dynamodb.ConditionCheck{
+			TableName: aws.String(tableName),
+			Key: map[string]*dynamodb.AttributeValue{
+				"id":       {S: aws.String(tenantKey(tenantId, taskId))},
+				"DataType": {S: aws.String("Project")},
+			},
+			ConditionExpression: aws.String("attribute_exists(id)"),
+		},
+	}
+}
+
+// 親子のタスクは同じプロジェクトに所属させるため、タスクがプロジェクトに所属していることを確認する
+func taskInProjectCheck(tenantId string, taskId string, project string) *dynamodb.TransactWriteItem {
+	return &dynamodb.TransactWriteItem{
+		ConditionCheck: &dynamodb.ConditionCheck{
+			TableName: aws.String(tableName),
+			Key: map[string]*dynamodb.AttributeValue{
+				"id":       {S: aws.String(tenantKey(tenantId, taskId))},
+				"DataType": {S: aws.String("Project")},
+			},
+			ConditionExpression: aws.String("DataValue = :project"),
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":project": {S: aws.String(tenantKey(tenantId, project))},
+			},
+		},
+	}
+}
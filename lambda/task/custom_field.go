@@ -0,0 +1,623 @@
+package task
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+const (
+	FieldText        = "text"
+	FieldNumber      = "number"
+	FieldDate        = "date"
+	FieldSelect      = "select"
+	FieldMultiSelect = "multiSelect"
+	FieldUser        = "user"
+
+	// タスクのカスタムフィールドの値は"Field#{名前}"、複数選択は選択肢ごとに"Field#{名前}#{選択肢}"のアイテムで保持する
+	customFieldPrefix = "Field#"
+)
+
+var fieldName = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// カスタムフィールドの値が定義に合わない
+var errInvalidField = errors.New("invalid custom field")
+
+// プロジェクトごとに定義するカスタムフィールドと、値の検証ルール
+// Min/Maxは数値、MaxLength/Patternはテキスト、Optionsは単一選択と複数選択で使う
+type FieldDefinition struct {
+	Name      string   `json:"name"`
+	Type      string   `json:"type"`
+	Options   []string `json:"options,omitempty"`
+	Min       *float64 `json:"min,omitempty"`
+	Max       *float64 `json:"max,omitempty"`
+	MaxLength int      `json:"maxLength,omitempty"`
+	Pattern   string   `json:"pattern,omitempty"`
+}
+
+// 定義はプロジェクトのパーティションに"Field#{名前}"で置く
+func fieldDefinitionKey(tenantId string, project string, name string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"id":       {S: aws.String(projectId(tenantId, project))},
+		"DataType": {S: aws.String(customFieldPrefix + name)},
+	}
+}
+
+func (d FieldDefinition) validate() error {
+	if !fieldName.MatchString(d.Name) {
+		return errors.New("name must be 1-64 letters, digits, '-' or '_'")
+	}
+	switch d.Type {
+	case FieldText, FieldNumber, FieldDate, FieldSelect, FieldMultiSelect, FieldUser:
+	default:
+		return fmt.Errorf("unknown field type %q", d.Type)
+	}
+	if (d.Type == FieldSelect || d.Type == FieldMultiSelect) != (len(d.Options) > 0) {
+		return errors.New("options must be set for select and multiSelect fields only")
+	}
+	if len(uniqueStrings(d.Options)) != len(d.Options) {
+		return errors.New("options must be unique and not empty")
+	}
+	if (d.Min != nil || d.Max != nil) && d.Type != FieldNumber {
+		return errors.New("min and max are only for number fields")
+	}
+	if d.Min != nil && d.Max != nil && *d.Min > *d.Max {
+		return errors.New("min must not exceed max")
+	}
+	if (d.MaxLength != 0 || d.Pattern != "") && d.Type != FieldText {
+		return errors.New("maxLength and pattern are only for text fields")
+	}
+	if d.MaxLength < 0 {
+		return errors.New("maxLength must not be negative")
+	}
+	if _, err := regexp.Compile(d.Pattern); err != nil {
+		return fmt.Errorf("invalid pattern: %v", err)
+	}
+	return nil
+}
+
+// JSONから読み取った値を検証し、保存する文字列に正規化する
+// nullと空文字列、空の配列は値の削除として空のスライスを返す
+func (d FieldDefinition) normalize(value interface{}) ([]string, error) {
+	if value == nil || value == "" {
+		return []string{}, nil
+	}
+
+	if d.Type == FieldMultiSelect {
+		list, ok := value.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s must be an array of options", d.Name)
+		}
+		values := []string{}
+		for _, v := range list {
+			s, ok := v.(string)
+			if !ok || !d.hasOption(s) {
+				return nil, fmt.Errorf("%s must be one of %s", d.Name, strings.Join(d.Options, ", "))
+			}
+			values = append(values, s)
+		}
+		values = uniqueStrings(values)
+		sort.Strings(values)
+		return values, nil
+	}
+
+	if d.Type == FieldNumber {
+		n, ok := value.(float64)
+		if !ok {
+			return nil, fmt.Errorf("%s must be a number", d.Name)
+		}
+		if (d.Min != nil && n < *d.Min) || (d.Max != nil && n > *d.Max) {
+			return nil, fmt.Errorf("%s is out of range", d.Name)
+		}
+		return []string{strconv.FormatFloat(n, 'f', -1, 64)}, nil
+	}
+
+	s, ok := value.(string)
+	if !ok {
+		return nil, fmt.Errorf("%s must be a string", d.Name)
+	}
+	switch d.Type {
+	case FieldText:
+		if d.MaxLength > 0 && utf8.RuneCountInString(s) > d.MaxLength {
+			return nil, fmt.Errorf("%s must be at most %d characters", d.Name, d.MaxLength)
+		}
+		if d.Pattern != "" {
+			pattern, err := regexp.Compile(d.Pattern)
+			if err != nil {
+				return nil, err
+			}
+			if !pattern.MatchString(s) {
+				return nil, fmt.Errorf("%s must match %s", d.Name, d.Pattern)
+			}
+		}
+	case FieldDate:
+		if _, err := time.Parse(dateLayout, s); err != nil {
+			return nil, fmt.Errorf("%s must be a date in YYYY-MM-DD format", d.Name)
+		}
+	case FieldSelect:
+		if !d.hasOption(s) {
+			return nil, fmt.Errorf("%s must be one of %s", d.Name, strings.Join(d.Options, ", "))
+		}
+	}
+	return []string{s}, nil
+}
+
+func (d FieldDefinition) hasOption(option string) bool {
+	for _, o := range d.Options {
+		if o == option {
+			return true
+		}
+	}
+	return false
+}
+
+// 正規化した値をTask.CustomFieldsの値にする。複数選択は配列、それ以外は文字列
+func (d FieldDefinition) fieldValue(values []string) interface{} {
+	if d.Type == FieldMultiSelect {
+		return values
+	}
+	return values[0]
+}
+
+// 値のアイテムをタスクに反映する。空の値は削除
+func setCustomField(task *Task, dataType string, dataValue string) {
+	name, option, multi := strings.Cut(strings.TrimPrefix(dataType, customFieldPrefix), "#")
+	if task.CustomFields == nil {
+		task.CustomFields = map[string]interface{}{}
+	}
+	if !multi {
+		if dataValue == "" {
+			delete(task.CustomFields, name)
+		} else {
+			task.CustomFields[name] = dataValue
+		}
+	} else {
+		options := []string{}
+		current, _ := task.CustomFields[name].([]string)
+		for _, o := range current {
+			if o != option {
+				options = append(options, o)
+			}
+		}
+		if dataValue != "" {
+			options = append(options, dataValue)
+		}
+		sort.Strings(options)
+		if len(options) == 0 {
+			delete(task.CustomFields, name)
+		} else {
+			task.CustomFields[name] = options
+		}
+	}
+	if len(task.CustomFields) == 0 {
+		task.CustomFields = nil
+	}
+}
+
+// タスクのカスタムフィールドを値のアイテムのDataTypeとDataValueにする
+func customFieldItems(task Task) map[string]string {
+	items := map[string]string{}
+	for name, value := range task.CustomFields {
+		switch v := value.(type) {
+		case string:
+			items[customFieldPrefix+name] = v
+		case []string:
+			for _, o := range v {
+				items[customFieldPrefix+name+"#"+o] = o
+			}
+		}
+	}
+	return items
+}
+
+// fromからtoへのカスタムフィールドの変更を値のアイテムごとに返す
+func customFieldChanges(from Task, to Task) []fieldChange {
+	old, new := customFieldItems(from), customFieldItems(to)
+	dataTypes := []string{}
+	for dataType := range old {
+		if old[dataType] != new[dataType] {
+			dataTypes = append(dataTypes, dataType)
+		}
+	}
+	for dataType := range new {
+		if _, exists := old[dataType]; !exists {
+			dataTypes = append(dataTypes, dataType)
+		}
+	}
+	sort.Strings(dataTypes)
+
+	changes := []fieldChange{}
+	for _, dataType := range dataTypes {
+		changes = append(changes, fieldChange{dataType, old[dataType], new[dataType]})
+	}
+	return changes
+}
+
+// プロジェクトのカスタムフィールドの定義を名前順に返す
+func fieldDefinitions(tenantId string, project string) ([]FieldDefinition, error) {
+	definitions := []FieldDefinition{}
+	var startKey map[string]*dynamodb.AttributeValue
+	for {
+		result, err := Svc.Query(&dynamodb.QueryInput{
+			TableName:              aws.String(tableName),
+			KeyConditionExpression: aws.String("id = :id AND begins_with(DataType, :prefix)"),
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":id":     {S: aws.String(projectId(tenantId, project))},
+				":prefix": {S: aws.String(customFieldPrefix)},
+			},
+			ExclusiveStartKey: startKey,
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, i := range result.Items {
+			definition := FieldDefinition{}
+			if err := dynamodbattribute.UnmarshalMap(i, &definition); err != nil {
+				return nil, err
+			}
+			definitions = append(definitions, definition)
+		}
+		if len(result.LastEvaluatedKey) == 0 {
+			break
+		}
+		startKey = result.LastEvaluatedKey
+	}
+	sort.Slice(definitions, func(i, j int) bool { return definitions[i].Name < definitions[j].Name })
+	return definitions, nil
+}
+
+// 定義がなければnilを返す
+func lookupFieldDefinition(tenantId string, project string, name string) (*FieldDefinition, error) {
+	result, err := Svc.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(tableName),
+		Key:       fieldDefinitionKey(tenantId, project, name),
+	})
+	if err != nil || len(result.Item) == 0 {
+		return nil, err
+	}
+	definition := FieldDefinition{}
+	if err := dynamodbattribute.UnmarshalMap(result.Item, &definition); err != nil {
+		return nil, err
+	}
+	return &definition, nil
+}
+
+// タスクの作成時に指定されたカスタムフィールドを、プロジェクトの定義で検証して正規化する
+func normalizeCustomFields(tenantId string, task *Task) error {
+	if len(task.CustomFields) == 0 {
+		return nil
+	}
+	definitions, err := fieldDefinitions(tenantId, task.Project)
+	if err != nil {
+		return err
+	}
+	return applyFieldDefinitions(definitions, task)
+}
+
+// 読み込み済みの定義でタスクのカスタムフィールドを検証して正規化する
+func applyFieldDefinitions(definitions []FieldDefinition, task *Task) error {
+	if len(task.CustomFields) == 0 {
+		return nil
+	}
+	defined := map[string]FieldDefinition{}
+	for _, d := range definitions {
+		defined[d.Name] = d
+	}
+
+	normalized := map[string]interface{}{}
+	for name, value := range task.CustomFields {
+		definition, ok := defined[name]
+		if !ok {
+			return fmt.Errorf("%w: %s is not defined in project %s", errInvalidField, name, task.Project)
+		}
+		values, err := definition.normalize(value)
+		if err != nil {
+			return fmt.Errorf("%w: %v", errInvalidField, err)
+		}
+		if len(values) > 0 {
+			normalized[name] = definition.fieldValue(values)
+		}
+	}
+	task.CustomFields = normalized
+	if len(normalized) == 0 {
+		task.CustomFields = nil
+	}
+	return nil
+}
+
+func GetFieldDefinitions(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	tenantId := TenantFromRequest(request)
+	if tenantId == "" {
+		return missingTenantResponse(), nil
+	}
+
+	definitions, err := fieldDefinitions(tenantId, request.QueryStringParameters["key"])
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Query failed: %v", err),
+		}, nil
+	}
+
+	response, err := json.Marshal(definitions)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to marshal response: %v", err),
+		}, nil
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: http.StatusOK,
+		Body:       string(response),
+	}, nil
+}
+
+// カスタムフィールドを定義する。既にある定義は置き換えるが、保存済みの値は検証し直さない
+func PutFieldDefinition(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	tenantId := TenantFromRequest(request)
+	if tenantId == "" {
+		return missingTenantResponse(), nil
+	}
+	project := request.QueryStringParameters["key"]
+	definition := FieldDefinition{}
+	if err := json.Unmarshal([]byte(request.Body), &definition); err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       fmt.Sprintf("Failed to unmarshal field from JSON: %v", err),
+		}, nil
+	}
+	definition.Name = request.QueryStringParameters["name"]
+	if err := definition.validate(); err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       fmt.Sprintf("Invalid field: %v", err),
+		}, nil
+	}
+
+	item, err := dynamodbattribute.MarshalMap(definition)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to marshal field: %v", err),
+		}, nil
+	}
+	for k, v := range fieldDefinitionKey(tenantId, project, definition.Name) {
+		item[k] = v
+	}
+
+	_, err = clientFor(request).TransactWriteItems(&dynamodb.TransactWriteItemsInput{
+		TransactItems: []*dynamodb.TransactWriteItem{
+			projectActiveCheck(tenantId, project),
+			{Put: &dynamodb.Put{TableName: aws.String(tableName), Item: item}},
+		},
+	})
+	if err != nil {
+		if isConditionFailed(err) {
+			return events.APIGatewayProxyResponse{
+				StatusCode: http.StatusNotFound,
+				Body:       "Project not found or archived",
+			}, nil
+		}
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to define field: %v", err),
+		}, nil
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: http.StatusOK,
+		Body:       "Field defined successfully",
+	}, nil
+}
+
+// 定義を削除する。タスクに保存済みの値は残り、値の変更は削除だけができる
+func DeleteFieldDefinition(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	tenantId := TenantFromRequest(request)
+	if tenantId == "" {
+		return missingTenantResponse(), nil
+	}
+
+	_, err := clientFor(request).DeleteItem(&dynamodb.DeleteItemInput{
+		TableName:           aws.String(tableName),
+		Key:                 fieldDefinitionKey(tenantId, request.QueryStringParameters["key"], request.QueryStringParameters["name"]),
+		ConditionExpression: aws.String("attribute_exists(id)"),
+	})
+	if err != nil {
+		if isConditionFailed(err) {
+			return events.APIGatewayProxyResponse{
+				StatusCode: http.StatusNotFound,
+				Body:       "Field not found",
+			}, nil
+		}
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to delete field: %v", err),
+		}, nil
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: http.StatusOK,
+		Body:       "Field deleted successfully",
+	}, nil
+}
+
+type customFieldRequest struct {
+	Value interface{} `json:"value"`
+}
+
+// タスクのカスタムフィールドの値を設定する。nullまたは空の値で削除する
+func SetCustomField(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	identity := IdentityFromRequest(request)
+	tenantId := identity.TenantID
+	if tenantId == "" {
+		return missingTenantResponse(), nil
+	}
+	taskId := request.QueryStringParameters["id"]
+	name := request.QueryStringParameters["name"]
+	body := customFieldRequest{}
+	if err := json.Unmarshal([]byte(request.Body), &body); err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       fmt.Sprintf("Failed to unmarshal request: %v", err),
+		}, nil
+	}
+
+	current, err := loadTask(tenantId, taskId)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to get task: %v", err),
+		}, nil
+	}
+	if current == nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusNotFound,
+			Body:       "Task not found",
+		}, nil
+	}
+	definition, err := lookupFieldDefinition(tenantId, current.Project, name)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to get field: %v", err),
+		}, nil
+	}
+
+	values := []string{}
+	if definition != nil {
+		values, err = definition.normalize(body.Value)
+	} else if body.Value != nil && body.Value != "" {
+		err = fmt.Errorf("Field %s is not defined in project %s", name, current.Project)
+	}
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       err.Error(),
+		}, nil
+	}
+
+	target := *current
+	target.CustomFields = map[string]interface{}{}
+	for k, v := range current.CustomFields {
+		target.CustomFields[k] = v
+	}
+	delete(target.CustomFields, name)
+	if len(values) > 0 {
+		target.CustomFields[name] = definition.fieldValue(values)
+	}
+
+	transactItems := []*dynamodb.TransactWriteItem{taskExistsCheck(tenantId, taskId)}
+	changes := customFieldChanges(*current, target)
+	for _, c := range changes {
+		transactItems = append(transactItems, fieldWrite(tenantId, taskId, c.Field, c.OldValue, c.NewValue))
+	}
+	if len(changes) == 0 {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusOK,
+			Body:       fmt.Sprintf("%s is already set to the value", name),
+		}, nil
+	}
+
+	err = writeTaskMutation(identity, taskId, transactItems, changes...)
+	if err != nil {
+		if err == errTooManyItems {
+			return events.APIGatewayProxyResponse{
+				StatusCode: http.StatusBadRequest,
+				Body:       "Too many options in the value",
+			}, nil
+		}
+		if isConditionFailed(err) {
+			return events.APIGatewayProxyResponse{
+				StatusCode: http.StatusConflict,
+				Body:       fmt.Sprintf("%s was modified by another request", name),
+			}, nil
+		}
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to update %s on task: %v", name, err),
+		}, nil
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: http.StatusOK,
+		Body:       fmt.Sprintf("%s updated on task successfully", name),
+	}, nil
+}
+
+// プロジェクト内でカスタムフィールドの値が一致するタスクをGSI1で検索する。複数選択はいずれかの選択肢が一致すればよい
+func GetTasksByCustomField(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	tenantId := TenantFromRequest(request)
+	if tenantId == "" {
+		return missingTenantResponse(), nil
+	}
+	project := request.QueryStringParameters["project"]
+	name := request.QueryStringParameters["field"]
+	if project == "" {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       "Custom fields are defined per project, specify the project",
+		}, nil
+	}
+
+	definition, err := lookupFieldDefinition(tenantId, project, name)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to get field: %v", err),
+		}, nil
+	}
+	if definition == nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusNotFound,
+			Body:       fmt.Sprintf("Field %s is not defined in project %s", name, project),
+		}, nil
+	}
+
+	// クエリパラメーターは文字列のため、数値は検証の前に数値に戻す
+	var value interface{} = request.QueryStringParameters["value"]
+	if definition.Type == FieldNumber {
+		if n, err := strconv.ParseFloat(request.QueryStringParameters["value"], 64); err == nil {
+			value = n
+		}
+	}
+	if definition.Type == FieldMultiSelect {
+		value = []interface{}{value}
+	}
+	values, err := definition.normalize(value)
+	if err == nil && len(values) == 0 {
+		err = errors.New("Missing value to search for")
+	}
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       err.Error(),
+		}, nil
+	}
+
+	dataType := customFieldPrefix + name
+	if definition.Type == FieldMultiSelect {
+		dataType += "#" + values[0]
+	}
+	taskMap, err := getTasksByDataValue(tenantId, dataType, values[0])
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to retrieve tasks by %s: %v", name, err),
+		}, nil
+	}
+
+	return tasksResponse(filterTasksByProject(taskMap, project))
+}
@@ -3,23 +3,44 @@ package task
 import (
 	"fmt"
 	"net/http"
+	"strings"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
 )
 
-func DeleteTaskById(id string) (response events.APIGatewayProxyResponse, err error) {
-	input := &dynamodb.DeleteItemInput{
-		TableName: aws.String(tableName),
-		Key: map[string]*dynamodb.AttributeValue{
-			"id": {
-				S: aws.String(id),
-			},
-		},
+const batchWriteSize = 25
+
+// タスクのパーティションにあるアイテム（属性・タグ・コメントなど）をすべて削除する
+func DeleteTaskById(tenantId string, id string) (events.APIGatewayProxyResponse, error) {
+	return deleteTask(Svc, tenantId, id)
+}
+
+func DeleteTask(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	return deleteTask(clientFor(request), TenantFromRequest(request), request.QueryStringParameters["id"])
+}
+
+func deleteTask(svc dynamodbiface.DynamoDBAPI, tenantId string, id string) (response events.APIGatewayProxyResponse, err error) {
+	if tenantId == "" {
+		response = missingTenantResponse()
+		return
+	}
+	if !validTaskId(id) {
+		response = events.APIGatewayProxyResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       errInvalidTaskId.Error(),
+		}
+		return
 	}
 
-	_, err = Svc.DeleteItem(input)
+	// 削除はトランザクションにできないため、すべて削除できてからイベントを書き込む
+	// 書き込みに失敗しても削除の再実行でイベントが書き込まれる
+	found, err := removeTask(svc, tenantId, id)
+	if err == nil && found {
+		err = recordDeletion(svc, tenantId, id)
+	}
 	if err != nil {
 		response = events.APIGatewayProxyResponse{
 			StatusCode: http.StatusInternalServerError,
@@ -34,3 +55,157 @@ func DeleteTaskById(id string) (response events.APIGatewayProxyResponse, err err
 	}
 	return
 }
+
+// タグを外してからパーティションを削除する。アイテムがあった場合はtrueを返す
+func removeTask(svc dynamodbiface.DynamoDBAPI, tenantId string, id string) (bool, error) {
+	tags, err := removeTaskTags(svc, tenantId, id)
+	if err != nil {
+		return false, err
+	}
+	deleted, err := deletePartition(svc, tenantKey(tenantId, id))
+	return len(tags)+len(deleted) > 0, err
+}
+
+// タグのアイテムの削除と使用数の減算を同じトランザクションで行う
+// パーティションの削除が途中で失敗しても、再実行で残っているタグの使用数だけを減らせる
+func removeTaskTags(svc dynamodbiface.DynamoDBAPI, tenantId string, id string) ([]string, error) {
+	tags, err := linkedTaskIds(tenantId, id, tagDataType(""))
+	if err != nil {
+		return nil, err
+	}
+	// タグごとに削除と使用数の更新の2つを書き込む
+	chunk := maxTransactItems / 2
+	for start := 0; start < len(tags); start += chunk {
+		end := start + chunk
+		if end > len(tags) {
+			end = len(tags)
+		}
+		transactItems := make([]*dynamodb.TransactWriteItem, 0, 2*(end-start))
+		for _, tag := range tags[start:end] {
+			transactItems = append(transactItems, tagWrite(tenantId, id, tag, ""), tagCountUpdate(tenantId, tag, -1))
+		}
+		if _, err := svc.TransactWriteItems(&dynamodb.TransactWriteItemsInput{TransactItems: transactItems}); err != nil {
+			return nil, err
+		}
+	}
+	return tags, nil
+}
+
+// 削除のイベントと変更ログを書き込む
+func recordDeletion(svc dynamodbiface.DynamoDBAPI, tenantId string, id string) error {
+	timestamp := now()
+	put, err := outboxPut(DomainEvent{
+		ID:        newEventId(timestamp),
+		Type:      TaskDeleted,
+		TenantID:  tenantId,
+		TaskID:    id,
+		Timestamp: timestamp.Unix(),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = svc.TransactWriteItems(&dynamodb.TransactWriteItemsInput{
+		TransactItems: []*dynamodb.TransactWriteItem{put, changeLogPut(tenantId, id, ChangeDelete, timestamp)},
+	})
+	return err
+}
+
+// パーティションのアイテムをすべて削除し、削除したアイテムのDataTypeを返す
+func deletePartition(svc dynamodbiface.DynamoDBAPI, partition string) ([]string, error) {
+	var startKey map[string]*dynamodb.AttributeValue
+	deleted := []string{}
+	for {
+		result, err := Svc.Query(&dynamodb.QueryInput{
+			TableName:              aws.String(tableName),
+			KeyConditionExpression: aws.String("id = :id"),
+			ProjectionExpression:   aws.String("id, DataType, DataValue"),
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":id": {S: aws.String(partition)},
+			},
+			ExclusiveStartKey: startKey,
+		})
+		if err != nil {
+			return deleted, err
+		}
+
+		keys := make([]map[string]*dynamodb.AttributeValue, 0, len(result.Items))
+		for _, i := range result.Items {
+			keys = append(keys, map[string]*dynamodb.AttributeValue{
+				"id":       i["id"],
+				"DataType": i["DataType"],
+			})
+			if mirror := mirrorKey(partition, i); mirror != nil {
+				keys = append(keys, mirror)
+			}
+		}
+		if err := batchDelete(svc, keys); err != nil {
+			return deleted, err
+		}
+		for _, i := range result.Items {
+			deleted = append(deleted, stringAttr(i, "DataType"))
+		}
+
+		if len(result.LastEvaluatedKey) == 0 {
+			return deleted, nil
+		}
+		startKey = result.LastEvaluatedKey
+	}
+}
+
+// 依存関係と親子関係は相手のタスクにも逆向きのアイテムがあるため、あわせて削除する
+func mirrorKey(partition string, item map[string]*dynamodb.AttributeValue) map[string]*dynamodb.AttributeValue {
+	tenantId, taskId, _ := strings.Cut(partition, "#")
+	dataType := stringAttr(item, "DataType")
+	var other, mirror string
+	switch {
+	case strings.HasPrefix(dataType, blockedByPrefix):
+		other, mirror = strings.TrimPrefix(dataType, blockedByPrefix), blocksPrefix+taskId
+	case strings.HasPrefix(dataType, blocksPrefix):
+		other, mirror = strings.TrimPrefix(dataType, blocksPrefix), blockedByPrefix+taskId
+	case strings.HasPrefix(dataType, "Subtask#"):
+		// 親を削除した子タスクは最上位のタスクになる
+		other, mirror = strings.TrimPrefix(dataType, "Subtask#"), "Parent"
+	case dataType == "Parent":
+		parent, ok := stripTenant(tenantId, stringAttr(item, "DataValue"))
+		if !ok {
+			return nil
+		}
+		other, mirror = parent, "Subtask#"+taskId
+	default:
+		return nil
+	}
+	return map[string]*dynamodb.AttributeValue{
+		"id":       {S: aws.String(tenantKey(tenantId, other))},
+		"DataType": {S: aws.String(mirror)},
+	}
+}
+
+func batchDelete(svc dynamodbiface.DynamoDBAPI, keys []map[string]*dynamodb.AttributeValue) error {
+	for start := 0; start < len(keys); start += batchWriteSize {
+		end := start + batchWriteSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		requests := make([]*dynamodb.WriteRequest, 0, end-start)
+		for _, key := range keys[start:end] {
+			requests = append(requests, &dynamodb.WriteRequest{
+				DeleteRequest: &dynamodb.DeleteRequest{Key: key},
+			})
+		}
+
+		// 処理されなかったリクエストは数回まで再送する
+		pending := map[string][]*dynamodb.WriteRequest{tableName: requests}
+		for attempt := 0; len(pending[tableName]) > 0; attempt++ {
+			if attempt == 5 {
+				return fmt.Errorf("%d items were not deleted", len(pending[tableName]))
+			}
+			result, err := svc.BatchWriteItem(&dynamodb.BatchWriteItemInput{RequestItems: pending})
+			if err != nil {
+				return err
+			}
+			pending = result.UnprocessedItems
+		}
+	}
+	return nil
+}
@@ -0,0 +1,350 @@
+package task
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+type Dependency struct {
+	ID     string `json:"id"`
+	Title  string `json:"title,omitempty"`
+	Status string `json:"status,omitempty"`
+	Depth  int    `json:"depth"`
+}
+
+type dependencyGraph struct {
+	ID        string       `json:"id"`
+	Blocked   bool         `json:"blocked"`
+	BlockedBy []Dependency `json:"blockedBy"`
+	Blocks    []Dependency `json:"blocks"`
+}
+
+const (
+	blockedByPrefix = "BlockedBy#"
+	blocksPrefix    = "Blocks#"
+
+	defaultDependencyDepth = 1
+	maxDependencyDepth     = 10
+	// 循環検出でたどるタスク数の上限
+	maxDependencyNodes = 1000
+)
+
+// 依存関係は両方向に保存する
+// ブロックされるタスクに"BlockedBy#{ブロックするタスクID}"、ブロックするタスクに"Blocks#{ブロックされるタスクID}"
+func dependencyItems(tenantId string, blockerId string, blockedId string) [2]map[string]*dynamodb.AttributeValue {
+	return [2]map[string]*dynamodb.AttributeValue{
+		{
+			"id":       {S: aws.String(tenantKey(tenantId, blockedId))},
+			"DataType": {S: aws.String(blockedByPrefix + blockerId)},
+		},
+		{
+			"id":       {S: aws.String(tenantKey(tenantId, blockerId))},
+			"DataType": {S: aws.String(blocksPrefix + blockedId)},
+		},
+	}
+}
+
+// 依存関係の書き込みを直列化するため、テナントの依存グラフにバージョンを持たせる
+func dependencyVersionKey(tenantId string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"id":       {S: aws.String(tenantKey(tenantId, "Dependencies"))},
+		"DataType": {S: aws.String("Version")},
+	}
+}
+
+// 依存グラフのバージョン。まだ書き込まれていなければ0を返す
+func dependencyVersion(tenantId string) (int, error) {
+	result, err := Svc.GetItem(&dynamodb.GetItemInput{
+		TableName:      aws.String(tableName),
+		Key:            dependencyVersionKey(tenantId),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil || result.Item["Version"] == nil {
+		return 0, err
+	}
+	return strconv.Atoi(aws.StringValue(result.Item["Version"].N))
+}
+
+// 循環の確認に使ったバージョンから変わっていない場合のみ、バージョンを進める
+func dependencyVersionUpdate(tenantId string, version int) *dynamodb.TransactWriteItem {
+	condition := "attribute_not_exists(Version)"
+	values := map[string]*dynamodb.AttributeValue{
+		":next": {N: aws.String(strconv.Itoa(version + 1))},
+	}
+	if version > 0 {
+		condition = "Version = :version"
+		values[":version"] = &dynamodb.AttributeValue{N: aws.String(strconv.Itoa(version))}
+	}
+	return &dynamodb.TransactWriteItem{
+		Update: &dynamodb.Update{
+			TableName:                 aws.String(tableName),
+			Key:                       dependencyVersionKey(tenantId),
+			UpdateExpression:          aws.String("SET Version = :next"),
+			ConditionExpression:       aws.String(condition),
+			ExpressionAttributeValues: values,
+		},
+	}
+}
+
+func AddDependency(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	identity := IdentityFromRequest(request)
+	tenantId := identity.TenantID
+	if tenantId == "" {
+		return missingTenantResponse(), nil
+	}
+	taskId := request.QueryStringParameters["id"]
+
+	body := struct {
+		BlockedBy string `json:"blockedBy"`
+	}{}
+	if err := json.Unmarshal([]byte(request.Body), &body); err != nil || body.BlockedBy == "" {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       "Missing blockedBy in the request",
+		}, nil
+	}
+
+	version, err := dependencyVersion(tenantId)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to check dependencies: %v", err),
+		}, nil
+	}
+
+	// taskIdからBlocksをたどってブロックするタスクに到達できる場合、追加すると循環する
+	cycle, err := reachable(tenantId, taskId, body.BlockedBy)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to check dependencies: %v", err),
+		}, nil
+	}
+	if cycle {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusConflict,
+			Body:       "Dependency would create a cycle",
+		}, nil
+	}
+
+	transactItems := []*dynamodb.TransactWriteItem{
+		taskExistsCheck(tenantId, taskId),
+		taskExistsCheck(tenantId, body.BlockedBy),
+		// 確認してから書き込むまでに他の依存関係が追加されていれば、循環の確認をやり直させる
+		dependencyVersionUpdate(tenantId, version),
+	}
+	for _, item := range dependencyItems(tenantId, body.BlockedBy, taskId) {
+		transactItems = append(transactItems, &dynamodb.TransactWriteItem{
+			Put: &dynamodb.Put{
+				TableName: aws.String(tableName),
+				Item:      item,
+			},
+		})
+	}
+
+	err = writeTaskMutation(identity, taskId, transactItems, fieldChange{Field: "BlockedBy", NewValue: body.BlockedBy})
+	if err != nil {
+		if conditionFailedAt(err, 2) {
+			return events.APIGatewayProxyResponse{
+				StatusCode: http.StatusConflict,
+				Body:       "Dependencies were modified concurrently, please retry",
+			}, nil
+		}
+		if isConditionFailed(err) {
+			return events.APIGatewayProxyResponse{
+				StatusCode: http.StatusNotFound,
+				Body:       "Task not found",
+			}, nil
+		}
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to add dependency: %v", err),
+		}, nil
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: http.StatusOK,
+		Body:       "Dependency added successfully",
+	}, nil
+}
+
+func RemoveDependency(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	identity := IdentityFromRequest(request)
+	tenantId := identity.TenantID
+	if tenantId == "" {
+		return missingTenantResponse(), nil
+	}
+	taskId := request.QueryStringParameters["id"]
+	blockerId := request.QueryStringParameters["blockerId"]
+
+	transactItems := []*dynamodb.TransactWriteItem{}
+	for _, key := range dependencyItems(tenantId, blockerId, taskId) {
+		transactItems = append(transactItems, &dynamodb.TransactWriteItem{
+			Delete: &dynamodb.Delete{
+				TableName: aws.String(tableName),
+				Key:       key,
+			},
+		})
+	}
+
+	err := writeTaskMutation(identity, taskId, transactItems, fieldChange{Field: "BlockedBy", OldValue: blockerId})
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to remove dependency: %v", err),
+		}, nil
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: http.StatusOK,
+		Body:       "Dependency removed successfully",
+	}, nil
+}
+
+// ?depth=Nで指定した深さまで依存関係を展開する
+func GetDependencies(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	tenantId := TenantFromRequest(request)
+	if tenantId == "" {
+		return missingTenantResponse(), nil
+	}
+	taskId := request.QueryStringParameters["id"]
+
+	depth, err := strconv.Atoi(request.QueryStringParameters["depth"])
+	if err != nil || depth <= 0 {
+		depth = defaultDependencyDepth
+	}
+	if depth > maxDependencyDepth {
+		depth = maxDependencyDepth
+	}
+
+	graph := dependencyGraph{ID: taskId}
+	graph.BlockedBy, err = expandDependencies(tenantId, taskId, blockedByPrefix, depth)
+	if err == nil {
+		graph.Blocks, err = expandDependencies(tenantId, taskId, blocksPrefix, depth)
+	}
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to retrieve dependencies: %v", err),
+		}, nil
+	}
+	for _, d := range graph.BlockedBy {
+		if d.Depth == 1 && !isDone(d.Status) {
+			graph.Blocked = true
+		}
+	}
+
+	response, err := json.Marshal(graph)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to marshal response: %v", err),
+		}, nil
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: http.StatusOK,
+		Body:       string(response),
+	}, nil
+}
+
+// 幅優先で依存関係をたどり、最初に到達した深さとともに返す
+func expandDependencies(tenantId string, taskId string, prefix string, maxDepth int) ([]Dependency, error) {
+	depths := map[string]int{taskId: 0}
+	frontier := []string{taskId}
+	ids := []string{}
+	for depth := 1; depth <= maxDepth && len(frontier) > 0; depth++ {
+		next := []string{}
+		for _, id := range frontier {
+			linked, err := linkedTaskIds(tenantId, id, prefix)
+			if err != nil {
+				return nil, err
+			}
+			for _, l := range linked {
+				if _, seen := depths[l]; seen {
+					continue
+				}
+				depths[l] = depth
+				ids = append(ids, l)
+				next = append(next, l)
+			}
+		}
+		frontier = next
+	}
+
+	dependencies := make([]Dependency, 0, len(ids))
+	if len(ids) == 0 {
+		return dependencies, nil
+	}
+	tasks, err := GetTasksByTaskIds(tenantId, ids)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		d := Dependency{ID: id, Depth: depths[id]}
+		if t, ok := tasks[id]; ok {
+			d.Title = t.Title
+			d.Status = t.Status
+		}
+		dependencies = append(dependencies, d)
+	}
+	sort.SliceStable(dependencies, func(i, j int) bool { return dependencies[i].Depth < dependencies[j].Depth })
+	return dependencies, nil
+}
+
+// fromからBlocksをたどってtoに到達できるかを返す
+func reachable(tenantId string, from string, to string) (bool, error) {
+	visited := map[string]bool{}
+	stack := []string{from}
+	for len(stack) > 0 {
+		id := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if id == to {
+			return true, nil
+		}
+		if visited[id] {
+			continue
+		}
+		visited[id] = true
+		if len(visited) > maxDependencyNodes {
+			return false, fmt.Errorf("dependency graph exceeds %d tasks", maxDependencyNodes)
+		}
+
+		linked, err := linkedTaskIds(tenantId, id, blocksPrefix)
+		if err != nil {
+			return false, err
+		}
+		stack = append(stack, linked...)
+	}
+	return false, nil
+}
+
+// 未完了のタスクにブロックされているタスクをblockedにする
+func attachBlockers(tenantId string, taskMap map[string]*Task, items []map[string]*dynamodb.AttributeValue) error {
+	blockers := map[string][]string{}
+	for _, i := range items {
+		taskId, ok := stripTenant(tenantId, stringAttr(i, "id"))
+		dataType := stringAttr(i, "DataType")
+		if !ok || taskMap[taskId] == nil || !strings.HasPrefix(dataType, blockedByPrefix) {
+			continue
+		}
+		blockers[taskId] = append(blockers[taskId], strings.TrimPrefix(dataType, blockedByPrefix))
+	}
+
+	for taskId, ids := range blockers {
+		open, err := countOpen(tenantId, ids)
+		if err != nil {
+			return err
+		}
+		taskMap[taskId].Blocked = open > 0
+	}
+	return nil
+}
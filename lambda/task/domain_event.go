@@ -0,0 +1,215 @@
+package task
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+const (
+	TaskStatusChanged = "TaskStatusChanged"
+	TagAdded          = "TagAdded"
+)
+
+// タスクへの変更を表すドメインイベント
+// TaskCreated・TaskDeletedはストリームの変更イベントと同じ種類名を使う
+type DomainEvent struct {
+	ID        string            `json:"id"`
+	Type      string            `json:"type"`
+	TenantID  string            `json:"tenantId"`
+	TaskID    string            `json:"taskId"`
+	Actor     string            `json:"actor,omitempty"`
+	Timestamp int64             `json:"timestamp"`
+	Data      map[string]string `json:"data,omitempty"`
+}
+
+// 未送信のイベントを残しておく期間。DynamoDBのTTLで削除される
+var OutboxRetention = 7 * 24 * time.Hour
+
+// ストリームで送信されずに残ったイベントを送り直すまでの猶予
+var OutboxSweepDelay = 5 * time.Minute
+
+// 送信を待つアウトボックスのアイテムはテナントをまたいでGSI1のこのDataValueで探す
+const outboxDataValue = "OutboxPending"
+
+// アウトボックスはテナントごとに"{テナントID}#Outbox"のパーティションに置き、ソートキーは"Event#{イベントID}"
+func outboxPartition(tenantId string) string {
+	return tenantKey(tenantId, "Outbox")
+}
+
+// イベントIDは"{発生日時}-{乱数}"で、発生順に並ぶ
+func newEventId(timestamp time.Time) string {
+	return fmt.Sprintf("%020d-%s", timestamp.UnixNano(), newId()[:12])
+}
+
+// 変更内容からドメインイベントを組み立てる
+// Projectアイテムはタスクの存在を表すため、Projectが空から設定される変更はタスクの作成とみなす
+func domainEvents(identity Identity, taskId string, timestamp time.Time, changes []fieldChange) []DomainEvent {
+	newEvent := func(eventType string, data map[string]string) DomainEvent {
+		return DomainEvent{
+			ID:        newEventId(timestamp),
+			Type:      eventType,
+			TenantID:  identity.TenantID,
+			TaskID:    taskId,
+			Actor:     identity.Subject,
+			Timestamp: timestamp.Unix(),
+			Data:      data,
+		}
+	}
+
+	for _, c := range changes {
+		if c.Field == "Project" && c.OldValue == "" && c.NewValue != "" {
+			data := map[string]string{}
+			tags := []string{}
+			for _, c := range changes {
+				if c.Field == "Tags" {
+					tags = append(tags, c.NewValue)
+				} else if c.NewValue != "" {
+					data[strings.ToLower(c.Field)] = c.NewValue
+				}
+			}
+			if len(tags) > 0 {
+				data["tags"] = strings.Join(tags, ",")
+			}
+			return []DomainEvent{newEvent(TaskCreated, data)}
+		}
+	}
+
+	result := []DomainEvent{}
+	for _, c := range changes {
+		switch {
+		case c.Field == "Status" && c.OldValue != c.NewValue:
+			result = append(result, newEvent(TaskStatusChanged, map[string]string{"from": c.OldValue, "to": c.NewValue}))
+		case c.Field == "Tags" && c.NewValue != "":
+			result = append(result, newEvent(TagAdded, map[string]string{"tag": c.NewValue}))
+		}
+	}
+	return result
+}
+
+func outboxItem(event DomainEvent) (map[string]*dynamodb.AttributeValue, error) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]*dynamodb.AttributeValue{
+		"id":        {S: aws.String(outboxPartition(event.TenantID))},
+		"DataType":  {S: aws.String("Event#" + event.ID)},
+		"DataValue": {S: aws.String(outboxDataValue)},
+		"event":     {S: aws.String(string(data))},
+		"ttl":       {N: aws.String(fmt.Sprint(time.Unix(event.Timestamp, 0).Add(OutboxRetention).Unix()))},
+	}, nil
+}
+
+// 変更と同じトランザクションで書き込むアウトボックスのアイテム
+func outboxPut(event DomainEvent) (*dynamodb.TransactWriteItem, error) {
+	item, err := outboxItem(event)
+	if err != nil {
+		return nil, err
+	}
+	return &dynamodb.TransactWriteItem{
+		Put: &dynamodb.Put{
+			TableName:           aws.String(tableName),
+			Item:                item,
+			ConditionExpression: aws.String("attribute_not_exists(id)"),
+		},
+	}, nil
+}
+
+// ストリームに流れたアウトボックスのアイテムを送信し、送信できたものを削除する
+// 送信に失敗した場合はエラーを返してバッチを再試行させるため、同じイベントが複数回届くことがある
+func RelayOutbox(records []events.DynamoDBEventRecord, publisher EventPublisher) error {
+	pending := []DomainEvent{}
+	keys := []map[string]*dynamodb.AttributeValue{}
+	for _, record := range records {
+		if record.EventName != "INSERT" {
+			continue
+		}
+		id := streamString(record.Change.Keys, "id")
+		dataType := streamString(record.Change.Keys, "DataType")
+		tenantId, partition, _ := strings.Cut(id, "#")
+		if partition != "Outbox" || !strings.HasPrefix(dataType, "Event#") {
+			continue
+		}
+
+		event := DomainEvent{}
+		if err := json.Unmarshal([]byte(streamString(record.Change.NewImage, "event")), &event); err != nil {
+			return fmt.Errorf("failed to unmarshal outbox event %s: %w", dataType, err)
+		}
+		if event.TenantID != tenantId {
+			continue
+		}
+		pending = append(pending, event)
+		keys = append(keys, map[string]*dynamodb.AttributeValue{
+			"id":       {S: aws.String(id)},
+			"DataType": {S: aws.String(dataType)},
+		})
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+
+	if err := publisher.Publish(pending); err != nil {
+		return err
+	}
+	return batchDelete(Svc, keys)
+}
+
+// ストリームの処理で送信できずに残ったイベントを送り直し、送信できたものを削除する
+// イベントIDは発生日時で始まるため、猶予より前に発生したイベントだけをソートキーの比較で選ぶ
+func SweepOutbox(publisher EventPublisher) error {
+	cutoff := fmt.Sprintf("Event#%020d", now().Add(-OutboxSweepDelay).UnixNano())
+	var startKey map[string]*dynamodb.AttributeValue
+	for {
+		result, err := Svc.Query(&dynamodb.QueryInput{
+			TableName:              aws.String(tableName),
+			IndexName:              aws.String("GSI1"),
+			KeyConditionExpression: aws.String("DataValue = :dataValue"),
+			FilterExpression:       aws.String("DataType < :cutoff"),
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":dataValue": {S: aws.String(outboxDataValue)},
+				":cutoff":    {S: aws.String(cutoff)},
+			},
+			ExclusiveStartKey: startKey,
+		})
+		if err != nil {
+			return err
+		}
+
+		pending := []DomainEvent{}
+		keys := []map[string]*dynamodb.AttributeValue{}
+		for _, i := range result.Items {
+			id := stringAttr(i, "id")
+			tenantId, partition, _ := strings.Cut(id, "#")
+			event := DomainEvent{}
+			if partition != "Outbox" || json.Unmarshal([]byte(stringAttr(i, "event")), &event) != nil || event.TenantID != tenantId {
+				log.Printf("Skipping malformed outbox item %s %s", id, stringAttr(i, "DataType"))
+				continue
+			}
+			pending = append(pending, event)
+			keys = append(keys, map[string]*dynamodb.AttributeValue{
+				"id":       i["id"],
+				"DataType": i["DataType"],
+			})
+		}
+		if len(pending) > 0 {
+			if err := publisher.Publish(pending); err != nil {
+				return err
+			}
+			if err := batchDelete(Svc, keys); err != nil {
+				return err
+			}
+		}
+
+		if len(result.LastEvaluatedKey) == 0 {
+			return nil
+		}
+		startKey = result.LastEvaluatedKey
+	}
+}
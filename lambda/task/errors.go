@@ -0,0 +1,34 @@
+package task
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// 条件付き書き込みの条件を満たさなかった場合はtrue
+func isConditionFailed(err error) bool {
+	var aerr awserr.Error
+	if !errors.As(err, &aerr) {
+		return false
+	}
+	switch aerr.Code() {
+	case dynamodb.ErrCodeConditionalCheckFailedException:
+		return true
+	case dynamodb.ErrCodeTransactionCanceledException:
+		return strings.Contains(aerr.Message(), "ConditionalCheckFailed")
+	}
+	return false
+}
+
+// トランザクションのi番目の書き込みが条件を満たさなかった場合はtrue
+func conditionFailedAt(err error, i int) bool {
+	var canceled *dynamodb.TransactionCanceledException
+	if !errors.As(err, &canceled) || i >= len(canceled.CancellationReasons) {
+		return false
+	}
+	return aws.StringValue(canceled.CancellationReasons[i].Code) == "ConditionalCheckFailed"
+}
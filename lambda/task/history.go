@@ -0,0 +1,219 @@
+package task
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+type HistoryEntry struct {
+	ID        string `json:"id" dynamodbav:"entryId"`
+	TaskID    string `json:"taskId"`
+	Actor     string `json:"actor"`
+	Timestamp int64  `json:"timestamp"`
+	Field     string `json:"field"`
+	OldValue  string `json:"oldValue,omitempty"`
+	NewValue  string `json:"newValue,omitempty"`
+}
+
+type historyPage struct {
+	Entries    []HistoryEntry `json:"entries"`
+	NextCursor string         `json:"nextCursor,omitempty"`
+}
+
+// 1つの変更で書き換わるフィールドとその前後の値
+type fieldChange struct {
+	Field    string
+	OldValue string
+	NewValue string
+}
+
+// TransactWriteItemsで一度に書き込めるアイテム数の上限
+const maxTransactItems = 100
+
+var errTooManyItems = errors.New("too many items in a transaction")
+
+// タスクへの変更と履歴の追加、アウトボックスへのドメインイベントと変更ログの追加を同一トランザクションで書き込む
+func writeTaskMutation(identity Identity, taskId string, transactItems []*dynamodb.TransactWriteItem, changes ...fieldChange) error {
+	transactItems, err := taskMutationItems(identity, taskId, transactItems, changes...)
+	if err != nil {
+		return err
+	}
+	_, err = identity.db().TransactWriteItems(&dynamodb.TransactWriteItemsInput{
+		TransactItems: transactItems,
+	})
+	return err
+}
+
+// タスクへの変更に履歴・ドメインイベント・変更ログとタグの使用数のアイテムを加える
+// 同じ変更で追加した履歴はIDの日時部分が共通になる
+func taskMutationItems(identity Identity, taskId string, transactItems []*dynamodb.TransactWriteItem, changes ...fieldChange) ([]*dynamodb.TransactWriteItem, error) {
+	tagCounts, err := tagCountUpdates(identity.TenantID, changes)
+	if err != nil {
+		return nil, err
+	}
+	transactItems, err = taskRecordItems(identity, taskId, now(), transactItems, changes)
+	if err != nil {
+		return nil, err
+	}
+	if len(transactItems)+len(tagCounts) > maxTransactItems {
+		return nil, errTooManyItems
+	}
+	return append(transactItems, tagCounts...), nil
+}
+
+// 履歴・ドメインイベント・変更ログのアイテムを加える。タグの使用数は含めない
+// 複数のタスクを1つのトランザクションで書き込む場合は、タグの使用数をまとめて加える
+func taskRecordItems(identity Identity, taskId string, timestamp time.Time, transactItems []*dynamodb.TransactWriteItem, changes []fieldChange) ([]*dynamodb.TransactWriteItem, error) {
+	for _, c := range changes {
+		entry := HistoryEntry{
+			ID:        fmt.Sprintf("%020d-%s", timestamp.UnixNano(), newId()[:12]),
+			TaskID:    taskId,
+			Actor:     identity.Subject,
+			Timestamp: timestamp.Unix(),
+			Field:     c.Field,
+			OldValue:  c.OldValue,
+			NewValue:  c.NewValue,
+		}
+		item, err := dynamodbattribute.MarshalMap(entry)
+		if err != nil {
+			return nil, err
+		}
+		item["id"] = &dynamodb.AttributeValue{S: aws.String(tenantKey(identity.TenantID, taskId))}
+		item["DataType"] = &dynamodb.AttributeValue{S: aws.String("History#" + entry.ID)}
+
+		// 履歴は追記のみで上書きしない
+		transactItems = append(transactItems, &dynamodb.TransactWriteItem{
+			Put: &dynamodb.Put{
+				TableName:           aws.String(tableName),
+				Item:                item,
+				ConditionExpression: aws.String("attribute_not_exists(id)"),
+			},
+		})
+	}
+	stampVersions(identity.TenantID, taskId, transactItems, timestamp.UnixMicro())
+	for _, e := range domainEvents(identity, taskId, timestamp, changes) {
+		put, err := outboxPut(e)
+		if err != nil {
+			return nil, err
+		}
+		transactItems = append(transactItems, put)
+	}
+	return append(transactItems, changeLogPut(identity.TenantID, taskId, ChangeUpsert, timestamp)), nil
+}
+
+// 書き換えるタスクの属性アイテムに変更のバージョンを記録する
+// バージョンはマイクロ秒単位の変更日時で、JavaScriptの数値でも精度を失わない
+func stampVersions(tenantId string, taskId string, transactItems []*dynamodb.TransactWriteItem, version int64) {
+	partition := tenantKey(tenantId, taskId)
+	versioned := func(key map[string]*dynamodb.AttributeValue) bool {
+		if stringAttr(key, "id") != partition {
+			return false
+		}
+		for _, field := range revisionFields {
+			if stringAttr(key, "DataType") == field {
+				return true
+			}
+		}
+		return false
+	}
+
+	value := &dynamodb.AttributeValue{N: aws.String(fmt.Sprint(version))}
+	for _, item := range transactItems {
+		switch {
+		case item.Put != nil && versioned(item.Put.Item):
+			item.Put.Item["version"] = value
+		case item.Update != nil && versioned(item.Update.Key) && strings.HasPrefix(aws.StringValue(item.Update.UpdateExpression), "SET "):
+			item.Update.UpdateExpression = aws.String(*item.Update.UpdateExpression + ", version = :version")
+			if item.Update.ExpressionAttributeValues == nil {
+				item.Update.ExpressionAttributeValues = map[string]*dynamodb.AttributeValue{}
+			}
+			item.Update.ExpressionAttributeValues[":version"] = value
+		}
+	}
+}
+
+// タスクの属性アイテムの現在の値を取得する。アイテムがなければfalseを返す
+func taskFieldValue(tenantId string, taskId string, dataType string) (string, bool, error) {
+	result, err := Svc.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"id":       {S: aws.String(tenantKey(tenantId, taskId))},
+			"DataType": {S: aws.String(dataType)},
+		},
+	})
+	if err != nil {
+		return "", false, err
+	}
+	if len(result.Item) == 0 {
+		return "", false, nil
+	}
+	value, _ := stripTenant(tenantId, stringAttr(result.Item, "DataValue"))
+	return value, true, nil
+}
+
+// 新しい順に履歴を返す
+func GetHistory(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	tenantId := TenantFromRequest(request)
+	if tenantId == "" {
+		return missingTenantResponse(), nil
+	}
+	taskId := request.QueryStringParameters["id"]
+
+	startKey, err := decodeCursor(request.QueryStringParameters["cursor"], tenantKey(tenantId, taskId))
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       err.Error(),
+		}, nil
+	}
+
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(tableName),
+		KeyConditionExpression: aws.String("id = :id AND begins_with(DataType, :prefix)"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":id":     {S: aws.String(tenantKey(tenantId, taskId))},
+			":prefix": {S: aws.String("History#")},
+		},
+		ScanIndexForward:  aws.Bool(false),
+		Limit:             aws.Int64(pageSize(request.QueryStringParameters["limit"])),
+		ExclusiveStartKey: startKey,
+	}
+
+	result, err := Svc.Query(input)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Query failed: %v", err),
+		}, nil
+	}
+
+	page := historyPage{Entries: []HistoryEntry{}, NextCursor: encodeCursor(result.LastEvaluatedKey)}
+	if err := dynamodbattribute.UnmarshalListOfMaps(result.Items, &page.Entries); err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to unmarshal history: %v", err),
+		}, nil
+	}
+
+	response, err := json.Marshal(page)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to marshal response: %v", err),
+		}, nil
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: http.StatusOK,
+		Body:       string(response),
+	}, nil
+}
@@ -0,0 +1,40 @@
+package task
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+)
+
+var now = time.Now
+
+// サーバー側で採番するIDはランダムな16バイトの16進文字列
+func newId() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// タスク以外のアイテムをまとめたテナントのパーティション
+var reservedPartitions = map[string]bool{
+	"ApiKeys":      true,
+	"Changes":      true,
+	"Dependencies": true,
+	"Jobs":         true,
+	"Outbox":       true,
+	"Recurrences":  true,
+	"Templates":    true,
+	"Timers":       true,
+	"Webhooks":     true,
+}
+
+// タスクのパーティションが他のパーティションと重ならないよう、予約された名前と"#"を含むIDは使えない
+func validTaskId(id string) bool {
+	return id != "" && !strings.Contains(id, "#") && !reservedPartitions[id]
+}
+
+var errInvalidTaskId = errors.New("Invalid task id")
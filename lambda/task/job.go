@@ -0,0 +1,259 @@
+package task
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+const (
+	JobRunning   = "running"
+	JobCompleted = "completed"
+	JobFailed    = "failed"
+
+	// 結果に残す失敗したタスクIDの上限
+	maxFailedTasks = 100
+)
+
+// 多数のタスクを書き換える非同期のジョブ
+// ジョブのアイテムの書き込みをDynamoDB Streamsで受け取って1バッチずつ進め、進捗の書き込みで次のバッチを起動する
+type Job struct {
+	ID          string   `json:"id" dynamodbav:"jobId"`
+	Type        string   `json:"type"`
+	Status      string   `json:"status"`
+	From        string   `json:"from,omitempty"`
+	To          string   `json:"to,omitempty"`
+	Processed   int      `json:"processed"`
+	Failed      int      `json:"failed"`
+	FailedTasks []string `json:"failedTasks,omitempty"`
+	Batches     int      `json:"batches"`
+	Error       string   `json:"error,omitempty"`
+	CreatedBy   string   `json:"createdBy"`
+	CreatedAt   int64    `json:"createdAt"`
+	UpdatedAt   int64    `json:"updatedAt"`
+	// 次のバッチの開始位置。最後のバッチまで進むと空になる
+	Cursor map[string]string `json:"-" dynamodbav:"cursor,omitempty"`
+}
+
+// ジョブはテナントごとに"{テナントID}#Jobs"のパーティションに"Job#{ID}"で置く
+func jobPartition(tenantId string) string {
+	return tenantKey(tenantId, "Jobs")
+}
+
+func jobKey(tenantId string, jobId string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"id":       {S: aws.String(jobPartition(tenantId))},
+		"DataType": {S: aws.String("Job#" + jobId)},
+	}
+}
+
+func newJob(identity Identity, jobType string) Job {
+	timestamp := now()
+	return Job{
+		ID:        newEventId(timestamp),
+		Type:      jobType,
+		Status:    JobRunning,
+		CreatedBy: identity.Subject,
+		CreatedAt: timestamp.Unix(),
+		UpdatedAt: timestamp.Unix(),
+	}
+}
+
+func jobPut(tenantId string, job Job) (*dynamodb.TransactWriteItem, error) {
+	item, err := dynamodbattribute.MarshalMap(job)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range jobKey(tenantId, job.ID) {
+		item[k] = v
+	}
+	return &dynamodb.TransactWriteItem{
+		Put: &dynamodb.Put{
+			TableName:           aws.String(tableName),
+			Item:                item,
+			ConditionExpression: aws.String("attribute_not_exists(id)"),
+		},
+	}, nil
+}
+
+// ジョブがなければnilを返す
+func loadJob(tenantId string, jobId string) (*Job, error) {
+	result, err := Svc.GetItem(&dynamodb.GetItemInput{
+		TableName:      aws.String(tableName),
+		Key:            jobKey(tenantId, jobId),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil || len(result.Item) == 0 {
+		return nil, err
+	}
+	job := Job{}
+	if err := dynamodbattribute.UnmarshalMap(result.Item, &job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// バッチの結果を書き込む。同じバッチを重ねて処理した場合は、先に書き込んだ結果を残す
+func saveJobProgress(tenantId string, job *Job, batches int) error {
+	job.UpdatedAt = now().Unix()
+	if len(job.FailedTasks) > maxFailedTasks {
+		job.FailedTasks = job.FailedTasks[:maxFailedTasks]
+	}
+	item, err := dynamodbattribute.MarshalMap(job)
+	if err != nil {
+		return err
+	}
+	for k, v := range jobKey(tenantId, job.ID) {
+		item[k] = v
+	}
+	_, err = Svc.PutItem(&dynamodb.PutItemInput{
+		TableName:           aws.String(tableName),
+		Item:                item,
+		ConditionExpression: aws.String("batches = :batches AND #status = :running"),
+		ExpressionAttributeNames: map[string]*string{
+			"#status": aws.String("status"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":batches": {N: aws.String(fmt.Sprint(batches))},
+			":running": {S: aws.String(JobRunning)},
+		},
+	})
+	if isConditionFailed(err) {
+		return nil
+	}
+	return err
+}
+
+// ストリームのレコードから実行中のジョブを探し、それぞれ1バッチ進める
+// ジョブの失敗はジョブの状態に記録し、進捗を書き込めなかった場合だけエラーを返してバッチを再試行させる
+func RunJobs(records []events.DynamoDBEventRecord) error {
+	for _, record := range records {
+		if record.EventName != "INSERT" && record.EventName != "MODIFY" {
+			continue
+		}
+		tenantId, partition, _ := strings.Cut(streamString(record.Change.Keys, "id"), "#")
+		jobId, isJob := strings.CutPrefix(streamString(record.Change.Keys, "DataType"), "Job#")
+		if partition != "Jobs" || !isJob || streamString(record.Change.NewImage, "status") != JobRunning {
+			continue
+		}
+		if err := runJobBatch(tenantId, jobId); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func runJobBatch(tenantId string, jobId string) error {
+	job, err := loadJob(tenantId, jobId)
+	if err != nil {
+		return err
+	}
+	if job == nil || job.Status != JobRunning {
+		return nil
+	}
+	batches := job.Batches
+
+	switch job.Type {
+	case JobTagRename, JobTagMerge:
+		err = runTagJobBatch(tenantId, job)
+	default:
+		err = fmt.Errorf("unknown job type %s", job.Type)
+	}
+	if err != nil {
+		log.Printf("Job %s failed: %v", job.ID, err)
+		job.Status = JobFailed
+		job.Error = err.Error()
+	}
+	job.Batches = batches + 1
+	return saveJobProgress(tenantId, job, batches)
+}
+
+func GetJob(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	tenantId := TenantFromRequest(request)
+	if tenantId == "" {
+		return missingTenantResponse(), nil
+	}
+
+	job, err := loadJob(tenantId, request.QueryStringParameters["id"])
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to retrieve job: %v", err),
+		}, nil
+	}
+	if job == nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusNotFound,
+			Body:       "Job not found",
+		}, nil
+	}
+	return jobResponse(http.StatusOK, *job)
+}
+
+// 失敗したジョブを、失敗したバッチから再開する
+func ResumeJob(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	tenantId := TenantFromRequest(request)
+	if tenantId == "" {
+		return missingTenantResponse(), nil
+	}
+
+	result, err := clientFor(request).UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:           aws.String(tableName),
+		Key:                 jobKey(tenantId, request.QueryStringParameters["id"]),
+		ConditionExpression: aws.String("#status = :failed"),
+		UpdateExpression:    aws.String("SET #status = :running, updatedAt = :now REMOVE #error"),
+		ExpressionAttributeNames: map[string]*string{
+			"#status": aws.String("status"),
+			"#error":  aws.String("error"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":failed":  {S: aws.String(JobFailed)},
+			":running": {S: aws.String(JobRunning)},
+			":now":     {N: aws.String(fmt.Sprint(now().Unix()))},
+		},
+		ReturnValues: aws.String(dynamodb.ReturnValueAllNew),
+	})
+	if err != nil {
+		if isConditionFailed(err) {
+			return events.APIGatewayProxyResponse{
+				StatusCode: http.StatusConflict,
+				Body:       "Only failed jobs can be resumed",
+			}, nil
+		}
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to resume job: %v", err),
+		}, nil
+	}
+
+	job := Job{}
+	if err := dynamodbattribute.UnmarshalMap(result.Attributes, &job); err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to unmarshal job: %v", err),
+		}, nil
+	}
+	return jobResponse(http.StatusAccepted, job)
+}
+
+func jobResponse(statusCode int, job Job) (events.APIGatewayProxyResponse, error) {
+	response, err := json.Marshal(job)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to marshal response: %v", err),
+		}, nil
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: statusCode,
+		Body:       string(response),
+	}, nil
+}
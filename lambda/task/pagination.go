@@ -0,0 +1,64 @@
+package task
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
+// LastEvaluatedKeyをクライアントに返すカーソル文字列に変換する
+func encodeCursor(key map[string]*dynamodb.AttributeValue) string {
+	if len(key) == 0 {
+		return ""
+	}
+	values := map[string]string{}
+	for k, v := range key {
+		if v.S != nil {
+			values[k] = *v.S
+		}
+	}
+	data, _ := json.Marshal(values)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// カーソルは同じパーティションのものだけを受け付ける
+func decodeCursor(cursor string, partition string) (map[string]*dynamodb.AttributeValue, error) {
+	if cursor == "" {
+		return nil, nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	values := map[string]string{}
+	if err := json.Unmarshal(data, &values); err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	if values["id"] != partition || values["DataType"] == "" {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	return map[string]*dynamodb.AttributeValue{
+		"id":       {S: aws.String(values["id"])},
+		"DataType": {S: aws.String(values["DataType"])},
+	}, nil
+}
+
+func pageSize(value string) int64 {
+	limit, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || limit <= 0 {
+		return defaultPageSize
+	}
+	if limit > maxPageSize {
+		return maxPageSize
+	}
+	return limit
+}
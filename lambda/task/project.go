@@ -0,0 +1,392 @@
+package task
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+type Project struct {
+	Key         string `json:"key"`
+	Name        string `json:"name,omitempty"`
+	Description string `json:"description,omitempty"`
+	Archived    bool   `json:"archived"`
+}
+
+var projectKeyPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// タスクのProjectアイテムのDataValueは"{TenantId}#{キー}"のため、GSI1で一覧の取得に使う値と同じキーは使えない
+var reservedProjectKeys = map[string]bool{
+	"Project": true,
+	"Tag":     true,
+}
+
+func validProjectKey(key string) bool {
+	return projectKeyPattern.MatchString(key) && !reservedProjectKeys[key] && !reservedPartitions[key]
+}
+
+// プロジェクトは1プロジェクト1アイテムで保持し、GSI1のDataValue="{TenantId}#Project"で一覧を取得する
+func projectId(tenantId string, key string) string {
+	return tenantKey(tenantId, "Project#"+key)
+}
+
+func projectKey(tenantId string, key string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"id":       {S: aws.String(projectId(tenantId, key))},
+		"DataType": {S: aws.String("Project")},
+	}
+}
+
+// プロジェクトが存在し、アーカイブされていないことを確認する
+func projectActiveCheck(tenantId string, key string) *dynamodb.TransactWriteItem {
+	return &dynamodb.TransactWriteItem{
+		ConditionCheck: &dynamodb.ConditionCheck{
+			TableName:           aws.String(tableName),
+			Key:                 projectKey(tenantId, key),
+			ConditionExpression: aws.String("attribute_exists(id) AND archived = :false"),
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":false": {BOOL: aws.Bool(false)},
+			},
+		},
+	}
+}
+
+func CreateProject(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	tenantId := TenantFromRequest(request)
+	if tenantId == "" {
+		return missingTenantResponse(), nil
+	}
+	project := Project{}
+	err := json.Unmarshal([]byte(request.Body), &project)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       fmt.Sprintf("Failed to unmarshal project from JSON: %v", err),
+		}, nil
+	}
+	if project.Key == "" || project.Name == "" {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       "Missing key or name in the project",
+		}, nil
+	}
+	if !validProjectKey(project.Key) {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       "Invalid project key: use 1-64 letters, digits, '-' or '_' and not a reserved word",
+		}, nil
+	}
+
+	item := projectKey(tenantId, project.Key)
+	item["DataValue"] = &dynamodb.AttributeValue{S: aws.String(tenantKey(tenantId, "Project"))}
+	item["key"] = &dynamodb.AttributeValue{S: aws.String(project.Key)}
+	item["name"] = &dynamodb.AttributeValue{S: aws.String(project.Name)}
+	item["description"] = &dynamodb.AttributeValue{S: aws.String(project.Description)}
+	item["archived"] = &dynamodb.AttributeValue{BOOL: aws.Bool(false)}
+
+	input := &dynamodb.PutItemInput{
+		TableName:           aws.String(tableName),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(id)"),
+	}
+
+	_, err = clientFor(request).PutItem(input)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to create project: %v", err),
+		}, nil
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: http.StatusCreated,
+		Body:       "Project created successfully",
+	}, nil
+}
+
+func GetProjects(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	tenantId := TenantFromRequest(request)
+	if tenantId == "" {
+		return missingTenantResponse(), nil
+	}
+	includeArchived := request.QueryStringParameters["archived"] == "true"
+
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(tableName),
+		IndexName:              aws.String("GSI1"),
+		KeyConditionExpression: aws.String("DataValue = :dataValue"),
+		FilterExpression:       aws.String("DataType = :dataType"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":dataType":  {S: aws.String("Project")},
+			":dataValue": {S: aws.String(tenantKey(tenantId, "Project"))},
+		},
+	}
+
+	result, err := Svc.Query(input)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Query failed: %v", err),
+		}, nil
+	}
+
+	projects := make([]Project, 0, len(result.Items))
+	for _, i := range result.Items {
+		if _, ok := stripTenant(tenantId, stringAttr(i, "id")); !ok {
+			continue
+		}
+		project := Project{}
+		if err := dynamodbattribute.UnmarshalMap(i, &project); err != nil {
+			return events.APIGatewayProxyResponse{
+				StatusCode: http.StatusInternalServerError,
+				Body:       fmt.Sprintf("Failed to unmarshal project: %v", err),
+			}, nil
+		}
+		if project.Archived && !includeArchived {
+			continue
+		}
+		projects = append(projects, project)
+	}
+	sort.Slice(projects, func(i, j int) bool { return projects[i].Key < projects[j].Key })
+
+	response, err := json.Marshal(projects)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to marshal response: %v", err),
+		}, nil
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: http.StatusOK,
+		Body:       string(response),
+	}, nil
+}
+
+func UpdateProject(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	tenantId := TenantFromRequest(request)
+	if tenantId == "" {
+		return missingTenantResponse(), nil
+	}
+	key := request.QueryStringParameters["key"]
+	project := Project{}
+	err := json.Unmarshal([]byte(request.Body), &project)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       fmt.Sprintf("Failed to unmarshal project from JSON: %v", err),
+		}, nil
+	}
+
+	input := &dynamodb.UpdateItemInput{
+		TableName:           aws.String(tableName),
+		Key:                 projectKey(tenantId, key),
+		ConditionExpression: aws.String("attribute_exists(id)"),
+		UpdateExpression:    aws.String("SET #name = :name, description = :description"),
+		ExpressionAttributeNames: map[string]*string{
+			"#name": aws.String("name"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":name":        {S: aws.String(project.Name)},
+			":description": {S: aws.String(project.Description)},
+		},
+	}
+
+	_, err = clientFor(request).UpdateItem(input)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to update project: %v", err),
+		}, nil
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: http.StatusOK,
+		Body:       "Project updated successfully",
+	}, nil
+}
+
+func ArchiveProject(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	tenantId := TenantFromRequest(request)
+	if tenantId == "" {
+		return missingTenantResponse(), nil
+	}
+	key := request.QueryStringParameters["key"]
+	archived := request.QueryStringParameters["archived"] != "false"
+
+	input := &dynamodb.UpdateItemInput{
+		TableName:           aws.String(tableName),
+		Key:                 projectKey(tenantId, key),
+		ConditionExpression: aws.String("attribute_exists(id)"),
+		UpdateExpression:    aws.String("SET archived = :archived"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":archived": {BOOL: aws.Bool(archived)},
+		},
+	}
+
+	_, err := clientFor(request).UpdateItem(input)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to archive project: %v", err),
+		}, nil
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: http.StatusOK,
+		Body:       "Project archived successfully",
+	}, nil
+}
+
+// タスクの所属プロジェクトだけを書き換えるため、タグなど他のアイテムはそのまま残る
+// 親またはサブタスクのあるタスクは移動できない
+func MoveTask(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	identity := IdentityFromRequest(request)
+	tenantId := identity.TenantID
+	if tenantId == "" {
+		return missingTenantResponse(), nil
+	}
+	taskId := request.QueryStringParameters["id"]
+
+	// 移動先はタスクの作成と同じく本文で指定する
+	body := struct {
+		Project string `json:"project"`
+	}{}
+	if err := json.Unmarshal([]byte(request.Body), &body); err != nil || body.Project == "" {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       "Missing project in the request",
+		}, nil
+	}
+	project := body.Project
+
+	oldProject, err := ProjectOfTask(tenantId, taskId)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to get project of task: %v", err),
+		}, nil
+	}
+	if oldProject == "" {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusNotFound,
+			Body:       "Task not found",
+		}, nil
+	}
+	if oldProject == project {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusOK,
+			Body:       "Task is already in the project",
+		}, nil
+	}
+	if err := checkNoSubtasks(tenantId, taskId); err != nil {
+		return moveErrorResponse(err), nil
+	}
+
+	transactItems := []*dynamodb.TransactWriteItem{
+		projectActiveCheck(tenantId, project),
+		projectWrite(tenantId, taskId, project),
+		noParentCheck(tenantId, taskId),
+	}
+
+	err = writeTaskMutation(identity, taskId, transactItems, fieldChange{"Project", oldProject, project})
+	if err != nil {
+		switch {
+		case conditionFailedAt(err, 0):
+			return events.APIGatewayProxyResponse{
+				StatusCode: http.StatusConflict,
+				Body:       "Target project does not exist or is archived",
+			}, nil
+		case conditionFailedAt(err, 1):
+			return events.APIGatewayProxyResponse{
+				StatusCode: http.StatusNotFound,
+				Body:       "Task not found",
+			}, nil
+		case conditionFailedAt(err, 2):
+			return moveErrorResponse(errTaskInHierarchy), nil
+		}
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to move task: %v", err),
+		}, nil
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: http.StatusOK,
+		Body:       "Task moved successfully",
+	}, nil
+}
+
+// 親子のタスクは同じプロジェクトに所属させるため、親またはサブタスクのあるタスクは移動できない
+var errTaskInHierarchy = errors.New("Tasks with a parent or subtasks cannot be moved to another project")
+
+func moveErrorResponse(err error) events.APIGatewayProxyResponse {
+	if errors.Is(err, errTaskInHierarchy) {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusConflict,
+			Body:       err.Error(),
+		}
+	}
+	return events.APIGatewayProxyResponse{
+		StatusCode: http.StatusInternalServerError,
+		Body:       fmt.Sprintf("Failed to retrieve subtasks: %v", err),
+	}
+}
+
+// サブタスクがあればerrTaskInHierarchyを返す
+func checkNoSubtasks(tenantId string, taskId string) error {
+	children, err := linkedTaskIds(tenantId, taskId, "Subtask#")
+	if err != nil {
+		return err
+	}
+	if len(children) > 0 {
+		return errTaskInHierarchy
+	}
+	return nil
+}
+
+// 移動するまでに親が設定されていないことを確認する
+func noParentCheck(tenantId string, taskId string) *dynamodb.TransactWriteItem {
+	return &dynamodb.TransactWriteItem{
+		ConditionCheck: &dynamodb.ConditionCheck{
+			TableName: aws.String(tableName),
+			Key: map[string]*dynamodb.AttributeValue{
+				"id":       {S: aws.String(tenantKey(tenantId, taskId))},
+				"DataType": {S: aws.String("Parent")},
+			},
+			ConditionExpression: aws.String("attribute_not_exists(id)"),
+		},
+	}
+}
+
+// タスクの所属プロジェクトを書き換える。タスクの存在はProjectアイテムで判定する
+func projectWrite(tenantId string, taskId string, project string) *dynamodb.TransactWriteItem {
+	return &dynamodb.TransactWriteItem{
+		Update: &dynamodb.Update{
+			TableName: aws.String(tableName),
+			Key: map[string]*dynamodb.AttributeValue{
+				"id":       {S: aws.String(tenantKey(tenantId, taskId))},
+				"DataType": {S: aws.String("Project")},
+			},
+			ConditionExpression: aws.String("attribute_exists(id)"),
+			UpdateExpression:    aws.String("SET DataValue = :project"),
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":project": {S: aws.String(tenantKey(tenantId, project))},
+			},
+		},
+	}
+}
+
+// タスクが所属するプロジェクトを取得する
+func ProjectOfTask(tenantId string, taskId string) (string, error) {
+	project, _, err := taskFieldValue(tenantId, taskId, "Project")
+	return project, err
+}
@@ -0,0 +1,184 @@
+package task
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/eventbridge"
+	"github.com/aws/aws-sdk-go/service/eventbridge/eventbridgeiface"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sns/snsiface"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+)
+
+// ドメインイベントの送信先
+type EventPublisher interface {
+	Publish(domainEvents []DomainEvent) error
+}
+
+// 環境変数で指定された送信先を使う。設定がなければnilを返す
+func PublisherFromEnv(sess *session.Session) EventPublisher {
+	switch {
+	case os.Getenv("EVENT_BUS_NAME") != "":
+		return EventBridgePublisher{
+			Client:  eventbridge.New(sess),
+			BusName: os.Getenv("EVENT_BUS_NAME"),
+			Source:  "task-management-app",
+		}
+	case os.Getenv("EVENT_TOPIC_ARN") != "":
+		return SNSPublisher{Client: sns.New(sess), TopicArn: os.Getenv("EVENT_TOPIC_ARN")}
+	case os.Getenv("EVENT_QUEUE_URL") != "":
+		return SQSPublisher{Client: sqs.New(sess), QueueURL: os.Getenv("EVENT_QUEUE_URL")}
+	}
+	return nil
+}
+
+// PutEvents・PublishBatch・SendMessageBatchで一度に送れるイベント数の上限
+const publishBatchSize = 10
+
+func publishInBatches(domainEvents []DomainEvent, publish func([]DomainEvent) error) error {
+	for start := 0; start < len(domainEvents); start += publishBatchSize {
+		end := start + publishBatchSize
+		if end > len(domainEvents) {
+			end = len(domainEvents)
+		}
+		if err := publish(domainEvents[start:end]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// EventBridgeのイベントバスに送る。detail-typeはイベントの種類になる
+type EventBridgePublisher struct {
+	Client  eventbridgeiface.EventBridgeAPI
+	BusName string
+	Source  string
+}
+
+func (p EventBridgePublisher) Publish(domainEvents []DomainEvent) error {
+	return publishInBatches(domainEvents, func(batch []DomainEvent) error {
+		entries := make([]*eventbridge.PutEventsRequestEntry, 0, len(batch))
+		for _, e := range batch {
+			detail, err := json.Marshal(e)
+			if err != nil {
+				return err
+			}
+			entries = append(entries, &eventbridge.PutEventsRequestEntry{
+				EventBusName: aws.String(p.BusName),
+				Source:       aws.String(p.Source),
+				DetailType:   aws.String(e.Type),
+				Detail:       aws.String(string(detail)),
+			})
+		}
+		result, err := p.Client.PutEvents(&eventbridge.PutEventsInput{Entries: entries})
+		if err != nil {
+			return err
+		}
+		if aws.Int64Value(result.FailedEntryCount) > 0 {
+			return fmt.Errorf("%d events were not put to %s", aws.Int64Value(result.FailedEntryCount), p.BusName)
+		}
+		return nil
+	})
+}
+
+// SNSトピックに送る。イベントの種類はメッセージ属性eventTypeでフィルタできる
+type SNSPublisher struct {
+	Client   snsiface.SNSAPI
+	TopicArn string
+}
+
+func (p SNSPublisher) Publish(domainEvents []DomainEvent) error {
+	return publishInBatches(domainEvents, func(batch []DomainEvent) error {
+		entries := make([]*sns.PublishBatchRequestEntry, 0, len(batch))
+		for _, e := range batch {
+			message, err := json.Marshal(e)
+			if err != nil {
+				return err
+			}
+			entries = append(entries, &sns.PublishBatchRequestEntry{
+				Id:      aws.String(e.ID),
+				Message: aws.String(string(message)),
+				MessageAttributes: map[string]*sns.MessageAttributeValue{
+					"eventType": {DataType: aws.String("String"), StringValue: aws.String(e.Type)},
+				},
+			})
+		}
+		result, err := p.Client.PublishBatch(&sns.PublishBatchInput{
+			TopicArn:                   aws.String(p.TopicArn),
+			PublishBatchRequestEntries: entries,
+		})
+		if err != nil {
+			return err
+		}
+		if len(result.Failed) > 0 {
+			return fmt.Errorf("%d events were not published to %s", len(result.Failed), p.TopicArn)
+		}
+		return nil
+	})
+}
+
+// SQSキューに送る
+type SQSPublisher struct {
+	Client   sqsiface.SQSAPI
+	QueueURL string
+}
+
+func (p SQSPublisher) Publish(domainEvents []DomainEvent) error {
+	return publishInBatches(domainEvents, func(batch []DomainEvent) error {
+		entries := make([]*sqs.SendMessageBatchRequestEntry, 0, len(batch))
+		for _, e := range batch {
+			body, err := json.Marshal(e)
+			if err != nil {
+				return err
+			}
+			entries = append(entries, &sqs.SendMessageBatchRequestEntry{
+				Id:          aws.String(e.ID),
+				MessageBody: aws.String(string(body)),
+				MessageAttributes: map[string]*sqs.MessageAttributeValue{
+					"eventType": {DataType: aws.String("String"), StringValue: aws.String(e.Type)},
+				},
+			})
+		}
+		result, err := p.Client.SendMessageBatch(&sqs.SendMessageBatchInput{
+			QueueUrl: aws.String(p.QueueURL),
+			Entries:  entries,
+		})
+		if err != nil {
+			return err
+		}
+		if len(result.Failed) > 0 {
+			return fmt.Errorf("%d events were not sent to %s", len(result.Failed), p.QueueURL)
+		}
+		return nil
+	})
+}
+
+// 送信したイベントをメモリに保持する。テスト用
+type InMemoryPublisher struct {
+	mu     sync.Mutex
+	events []DomainEvent
+	// 設定した場合、Publishはイベントを保持せずにこのエラーを返す
+	Err error
+}
+
+func (p *InMemoryPublisher) Publish(domainEvents []DomainEvent) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.Err != nil {
+		return p.Err
+	}
+	p.events = append(p.events, domainEvents...)
+	return nil
+}
+
+func (p *InMemoryPublisher) Events() []DomainEvent {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]DomainEvent(nil), p.events...)
+}
@@ -4,24 +4,21 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"sort"
+	"strings"
+	"sync"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 )
 
-func GetTaskById(id string) (events.APIGatewayProxyResponse, error) {
-	input := &dynamodb.QueryInput{
-		TableName:              aws.String(tableName),
-		KeyConditionExpression: aws.String("id = :id"),
-		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
-			":id": {
-				S: aws.String(id),
-			},
-		},
+func GetTaskById(tenantId string, id string) (events.APIGatewayProxyResponse, error) {
+	if tenantId == "" {
+		return missingTenantResponse(), nil
 	}
 
-	result, err := Svc.Query(input)
+	items, err := queryTaskItems(tenantId, id, taskDetailRanges, false)
 	if err != nil {
 		return events.APIGatewayProxyResponse{
 			StatusCode: http.StatusInternalServerError,
@@ -29,199 +26,305 @@ func GetTaskById(id string) (events.APIGatewayProxyResponse, error) {
 		}, nil
 	}
 
-	// タスクの地図を作成
-	taskMap := make(map[string]*Task)
-	for _, i := range result.Items {
-		id := *i["id"].S
-		if _, exists := taskMap[id]; !exists {
-			taskMap[id] = &Task{ID: id}
-		}
-		task := taskMap[id]
-		dataType := *i["dataType"].S
-		dataValue := *i["dataValue"].S
-		UpdateTaskField(task, dataType, dataValue)
-	}
-
-	tasks := make([]Task, 0, len(taskMap))
-	for _, task := range taskMap {
-		tasks = append(tasks, *task)
+	taskMap := itemsToTasks(tenantId, items)
+	if err := attachChildren(tenantId, taskMap, items); err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to retrieve subtasks: %v", err),
+		}, nil
 	}
-
-	response, err := json.Marshal(tasks)
-	if err != nil {
+	if err := attachBlockers(tenantId, taskMap, items); err != nil {
 		return events.APIGatewayProxyResponse{
 			StatusCode: http.StatusInternalServerError,
-			Body:       fmt.Sprintf("Failed to marshal tasks: %v", err),
+			Body:       fmt.Sprintf("Failed to retrieve dependencies: %v", err),
 		}, nil
 	}
 
-	return events.APIGatewayProxyResponse{
-		StatusCode: http.StatusOK,
-		Body:       string(response),
-	}, nil
+	return tasksResponse(taskMap)
 }
 
-func GetTasksByTaskIds(ids []string) (map[string]*Task, error) {
-	keys := make([]map[string]*dynamodb.AttributeValue, len(ids))
-	for i, id := range ids {
-		keys[i] = map[string]*dynamodb.AttributeValue{
-			"id": {S: aws.String(id)},
-		}
-	}
-	input := &dynamodb.BatchGetItemInput{
-		RequestItems: map[string]*dynamodb.KeysAndAttributes{
-			tableName: {
-				Keys: keys,
-			},
-		},
-	}
-
-	result, err := Svc.BatchGetItem(input)
+// タスクの属性を取得する。存在しなければnilを返す
+// 書き込み直後の状態を返せるよう、強い整合性で読み取る
+func loadTask(tenantId string, id string) (*Task, error) {
+	items, err := queryTaskItems(tenantId, id, taskFieldRanges, true)
 	if err != nil {
 		return nil, err
 	}
+	return itemsToTasks(tenantId, items)[id], nil
+}
 
-	taskMap := make(map[string]*Task)
-	for _, i := range result.Responses[tableName] {
-		id := *i["id"].S
-		if _, exists := taskMap[id]; !exists {
-			taskMap[id] = &Task{ID: id}
-		}
-		task := taskMap[id]
-
-		switch *i["dataType"].S {
-		case "Title":
-			task.Title = *i["dataValue"].S
-		case "Description":
-			task.Description = *i["dataValue"].S
-		case "Status":
-			task.Status = *i["dataValue"].S
-		case "Tags":
-			if task.Tags == nil {
-				task.Tags = []string{}
+// タスクのパーティションのうち、タスクの表示に使うアイテムのDataTypeの範囲
+// 履歴（History#）とコメント（Comment#）は活動に応じて増え続けるため、範囲に含めない
+var (
+	// 属性・カスタムフィールド（Field#）・タグ（Tags#）・作業時間（Time#）・サブタスクのリンク（Subtask#）
+	taskFieldRanges = [][2]string{{"D", "G"}, {"P", "Z"}}
+	// 詳細では依存関係（BlockedBy#・Blocks#）とチェックリスト（Checklist#）も読む
+	taskDetailRanges = [][2]string{{"A", "Comment#"}, {"D", "G"}, {"P", "Z"}}
+)
+
+// タスクのパーティションのうち、DataTypeが範囲に含まれるアイテムを最後のページまで取得する
+func queryTaskItems(tenantId string, id string, ranges [][2]string, consistent bool) ([]map[string]*dynamodb.AttributeValue, error) {
+	items := []map[string]*dynamodb.AttributeValue{}
+	for _, r := range ranges {
+		var startKey map[string]*dynamodb.AttributeValue
+		for {
+			result, err := Svc.Query(&dynamodb.QueryInput{
+				TableName:              aws.String(tableName),
+				ConsistentRead:         aws.Bool(consistent),
+				KeyConditionExpression: aws.String("id = :id AND DataType BETWEEN :from AND :to"),
+				ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+					":id":   {S: aws.String(tenantKey(tenantId, id))},
+					":from": {S: aws.String(r[0])},
+					":to":   {S: aws.String(r[1])},
+				},
+				ExclusiveStartKey: startKey,
+			})
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, result.Items...)
+			if len(result.LastEvaluatedKey) == 0 {
+				break
 			}
-			task.Tags = append(task.Tags, *i["dataValue"].S)
+			startKey = result.LastEvaluatedKey
 		}
 	}
+	return items, nil
+}
+
+// 同時に実行するパーティションのクエリの数
+const taskQueryConcurrency = 8
 
-	return taskMap, nil
+// タグやカスタムフィールドのようにDataTypeが決まっていないアイテムがあるため、タスクごとにDataTypeの範囲でクエリする
+func GetTasksByTaskIds(tenantId string, ids []string) (map[string]*Task, error) {
+	results := make([][]map[string]*dynamodb.AttributeValue, len(ids))
+	errs := make([]error, len(ids))
+	sem := make(chan struct{}, taskQueryConcurrency)
+	var wg sync.WaitGroup
+	for i, id := range ids {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, id string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			results[i], errs[i] = queryTaskItems(tenantId, id, taskFieldRanges, false)
+		}(i, id)
+	}
+	wg.Wait()
+
+	items := []map[string]*dynamodb.AttributeValue{}
+	for i := range ids {
+		if errs[i] != nil {
+			return nil, errs[i]
+		}
+		items = append(items, results[i]...)
+	}
+	return itemsToTasks(tenantId, items), nil
 }
 
 func GetTasksByAttribute(request events.APIGatewayProxyRequest, attributeKey string, attributeValue string) (events.APIGatewayProxyResponse, error) {
+	tenantId := TenantFromRequest(request)
+	if tenantId == "" {
+		return missingTenantResponse(), nil
+	}
 	value := request.QueryStringParameters[attributeKey]
 
-	input := &dynamodb.QueryInput{
-		TableName:              aws.String("TaskManagement"),
-		IndexName:              aws.String("GSI1"),
-		KeyConditionExpression: aws.String("dataType = :dataType AND dataValue = :dataValue"),
-		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
-			":dataType": {
-				S: aws.String(attributeKey),
-			},
-			":dataValue": {
-				S: aws.String(value),
-			},
-		},
+	taskMap, err := getTasksByDataValue(tenantId, attributeKey, value)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to retrieve tasks by %v: %v", attributeKey, err),
+		}, nil
 	}
 
-	result, err := Svc.Query(input)
+	return tasksResponse(taskMap)
+}
+
+func GetTasksByTag(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	tenantId := TenantFromRequest(request)
+	if tenantId == "" {
+		return missingTenantResponse(), nil
+	}
+	tag := request.QueryStringParameters["tag"]
+
+	taskMap, err := getTasksByTag(tenantId, tag)
 	if err != nil {
 		return events.APIGatewayProxyResponse{
 			StatusCode: http.StatusInternalServerError,
-			Body:       fmt.Sprintf("Query failed: %v", err),
+			Body:       fmt.Sprintf("Failed to retrieve tasks by tag: %v", err),
 		}, nil
 	}
 
-	idsMap := make(map[string]bool)
-	for _, i := range result.Items {
-		id := *i["id"].S
-		if _, exists := idsMap[id]; !exists {
-			idsMap[id] = true
-		}
-	}
+	return tasksResponse(taskMap)
+}
 
-	ids := make([]string, 0, len(idsMap))
-	for id := range idsMap {
-		ids = append(ids, id)
+func GetTasksByProject(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	tenantId := TenantFromRequest(request)
+	if tenantId == "" {
+		return missingTenantResponse(), nil
 	}
+	project := request.QueryStringParameters["project"]
 
-	taskMap, err := GetTasksByTaskIds(ids)
+	taskMap, err := getTasksByDataValue(tenantId, "Project", project)
 	if err != nil {
 		return events.APIGatewayProxyResponse{
 			StatusCode: http.StatusInternalServerError,
-			Body:       fmt.Sprintf("Failed to retrieve tasks by %v", attributeKey),
+			Body:       fmt.Sprintf("Failed to retrieve tasks by project: %v", err),
 		}, nil
 	}
 
-	tasks := make([]Task, 0, len(taskMap))
-	for _, task := range taskMap {
-		tasks = append(tasks, *task)
+	return tasksResponse(filterTasksByProject(taskMap, project))
+}
+
+func GetTasksByAttributeInProject(request events.APIGatewayProxyRequest, attributeKey string, attributeValue string) (events.APIGatewayProxyResponse, error) {
+	tenantId := TenantFromRequest(request)
+	if tenantId == "" {
+		return missingTenantResponse(), nil
 	}
+	project := request.QueryStringParameters["project"]
+	value := request.QueryStringParameters[attributeKey]
 
-	response, err := json.Marshal(tasks)
+	taskMap, err := getTasksByDataValue(tenantId, attributeKey, value)
 	if err != nil {
 		return events.APIGatewayProxyResponse{
 			StatusCode: http.StatusInternalServerError,
-			Body:       fmt.Sprintf("Failed to marshal response: %v", err),
+			Body:       fmt.Sprintf("Failed to retrieve tasks by %v: %v", attributeKey, err),
 		}, nil
 	}
 
-	return events.APIGatewayProxyResponse{
-		StatusCode: http.StatusOK,
-		Body:       string(response),
-	}, nil
+	return tasksResponse(filterTasksByProject(taskMap, project))
 }
 
-func GetTasksByTag(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
-	tag := request.QueryStringParameters["tag"]
-
-	input := &dynamodb.QueryInput{
-		TableName:              aws.String(tableName),
-		IndexName:              aws.String("GSI1"),
-		KeyConditionExpression: aws.String("dataType = :dataType AND dataValue = :dataValue"),
-		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
-			":dataType": {
-				S: aws.String("Tags"),
-			},
-			":dataValue": {
-				S: aws.String(tag),
-			},
-		},
+func GetTasksByTagInProject(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	tenantId := TenantFromRequest(request)
+	if tenantId == "" {
+		return missingTenantResponse(), nil
 	}
+	project := request.QueryStringParameters["project"]
+	tag := request.QueryStringParameters["tag"]
 
-	result, err := Svc.Query(input)
+	taskMap, err := getTasksByTag(tenantId, tag)
 	if err != nil {
 		return events.APIGatewayProxyResponse{
 			StatusCode: http.StatusInternalServerError,
-			Body:       fmt.Sprintf("Query failed: %v", err),
+			Body:       fmt.Sprintf("Failed to retrieve tasks by tag: %v", err),
 		}, nil
 	}
 
+	return tasksResponse(filterTasksByProject(taskMap, project))
+}
+
+// GSI1をDataValueで検索し、該当するタスクを取得する
+func getTasksByDataValue(tenantId string, dataType string, dataValue string) (map[string]*Task, error) {
+	ids, err := taskIdsByDataValue(tenantId, dataType, dataValue)
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return map[string]*Task{}, nil
+	}
+
+	return GetTasksByTaskIds(tenantId, ids)
+}
+
+// 属性の値が一致するタスクのIDをID順に返す
+func taskIdsByDataValue(tenantId string, dataType string, dataValue string) ([]string, error) {
 	idsMap := make(map[string]bool)
-	for _, i := range result.Items {
-		id := *i["id"].S
-		if _, exists := idsMap[id]; !exists {
-			idsMap[id] = true
+	var startKey map[string]*dynamodb.AttributeValue
+	for {
+		input := &dynamodb.QueryInput{
+			TableName:              aws.String(tableName),
+			IndexName:              aws.String("GSI1"),
+			KeyConditionExpression: aws.String("DataValue = :dataValue"),
+			FilterExpression:       aws.String("DataType = :dataType"),
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":dataType": {
+					S: aws.String(dataType),
+				},
+				":dataValue": {
+					S: aws.String(tenantKey(tenantId, dataValue)),
+				},
+			},
+			ExclusiveStartKey: startKey,
+		}
+
+		result, err := Svc.Query(input)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, i := range result.Items {
+			if id, ok := stripTenant(tenantId, stringAttr(i, "id")); ok {
+				idsMap[id] = true
+			}
 		}
+		if len(result.LastEvaluatedKey) == 0 {
+			break
+		}
+		startKey = result.LastEvaluatedKey
 	}
 
 	ids := make([]string, 0, len(idsMap))
 	for id := range idsMap {
 		ids = append(ids, id)
 	}
+	sort.Strings(ids)
+	return ids, nil
+}
 
-	taskMap, err := GetTasksByTaskIds(ids)
-	if err != nil {
-		return events.APIGatewayProxyResponse{
-			StatusCode: http.StatusInternalServerError,
-			Body:       fmt.Sprintf("Failed to retrieve tasks by IDs: %v", err),
-		}, nil
+// 他テナントのアイテムが混ざっていても結果には含めない
+func itemsToTasks(tenantId string, items []map[string]*dynamodb.AttributeValue) map[string]*Task {
+	taskMap := make(map[string]*Task)
+	for _, i := range items {
+		id, ok := stripTenant(tenantId, stringAttr(i, "id"))
+		if !ok {
+			continue
+		}
+		dataValue, ok := stripTenant(tenantId, stringAttr(i, "DataValue"))
+		if !ok {
+			continue
+		}
+		if _, exists := taskMap[id]; !exists {
+			taskMap[id] = &Task{ID: id}
+		}
+		UpdateTaskField(taskMap[id], stringAttr(i, "DataType"), dataValue)
+		if strings.HasPrefix(stringAttr(i, "DataType"), timeEntryPrefix) {
+			taskMap[id].TimeSpent += numberAttr(i, "duration")
+		}
+		if version := numberAttr(i, "version"); version > 0 {
+			if taskMap[id].Versions == nil {
+				taskMap[id].Versions = map[string]int64{}
+			}
+			taskMap[id].Versions[stringAttr(i, "DataType")] = version
+		}
 	}
+	return taskMap
+}
 
+func stringAttr(item map[string]*dynamodb.AttributeValue, name string) string {
+	if v, ok := item[name]; ok && v.S != nil {
+		return *v.S
+	}
+	return ""
+}
+
+func filterTasksByProject(taskMap map[string]*Task, project string) map[string]*Task {
+	filtered := make(map[string]*Task)
+	for id, task := range taskMap {
+		if task.Project == project {
+			filtered[id] = task
+		}
+	}
+	return filtered
+}
+
+// タスクをID順に並べてレスポンスを作成
+func tasksResponse(taskMap map[string]*Task) (events.APIGatewayProxyResponse, error) {
 	tasks := make([]Task, 0, len(taskMap))
 	for _, task := range taskMap {
 		tasks = append(tasks, *task)
 	}
+	sort.Slice(tasks, func(i, j int) bool { return tasks[i].ID < tasks[j].ID })
 
 	response, err := json.Marshal(tasks)
 	if err != nil {
@@ -235,4 +338,4 @@ func GetTasksByTag(request events.APIGatewayProxyRequest) (events.APIGatewayProx
 		StatusCode: http.StatusOK,
 		Body:       string(response),
 	}, nil
-}
\ No newline at end of file
+}
@@ -0,0 +1,391 @@
+package task
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"task-management-app/lambda/auth"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/apigatewaymanagementapi"
+	"github.com/aws/aws-sdk-go/service/apigatewaymanagementapi/apigatewaymanagementapiiface"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+// WebSocketの接続と、接続時に認証した呼び出し元
+type Connection struct {
+	ID          string   `json:"id" dynamodbav:"connectionId"`
+	TenantID    string   `json:"tenantId"`
+	Subject     string   `json:"subject"`
+	Roles       []string `json:"roles"`
+	ConnectedAt int64    `json:"connectedAt"`
+}
+
+// 購読できる対象の種類。トピックは"{種類}#{値}"で表す
+var subscriptionKinds = map[string]bool{"project": true, "tag": true, "task": true}
+
+// API Gatewayは2時間で接続を切断する。切断を受け取れなかった接続もTTLで削除する
+const connectionLifetime = 2*time.Hour + 10*time.Minute
+
+var ErrConnectionGone = errors.New("connection is gone")
+
+// 接続への送信。API Gatewayの管理APIを差し替えてファンアウトを試せるようにする
+type ConnectionManager interface {
+	PostToConnection(connectionId string, data []byte) error
+}
+
+type APIGatewayConnections struct {
+	Client apigatewaymanagementapiiface.ApiGatewayManagementApiAPI
+}
+
+func (c APIGatewayConnections) PostToConnection(connectionId string, data []byte) error {
+	_, err := c.Client.PostToConnection(&apigatewaymanagementapi.PostToConnectionInput{
+		ConnectionId: aws.String(connectionId),
+		Data:         data,
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == apigatewaymanagementapi.ErrCodeGoneException {
+		return ErrConnectionGone
+	}
+	return err
+}
+
+// 接続ごとのパーティションは"{テナントID}#Connection#{接続ID}"で、接続のアイテムと購読中のトピックを置く
+func connectionPartition(tenantId string, connectionId string) string {
+	return tenantKey(tenantId, "Connection#"+connectionId)
+}
+
+// 接続後のリクエストにはテナントが含まれないため、接続のアイテムはGSI1の"Connection#{接続ID}"で探す
+// 接続IDはテナントをまたいで一意になる
+func connectionDataValue(connectionId string) string {
+	return "Connection#" + connectionId
+}
+
+func connectionKey(tenantId string, connectionId string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"id":       {S: aws.String(connectionPartition(tenantId, connectionId))},
+		"DataType": {S: aws.String("Connection")},
+	}
+}
+
+// トピックごとの購読者は"{テナントID}#Subscribers#{トピック}"のパーティションに"Connection#{接続ID}"で置く
+func subscribersPartition(tenantId string, topic string) string {
+	return tenantKey(tenantId, "Subscribers#"+topic)
+}
+
+func SubscriptionTopic(kind string, value string) (string, error) {
+	if !subscriptionKinds[kind] || value == "" {
+		return "", fmt.Errorf("invalid subscription %s:%s", kind, value)
+	}
+	return kind + "#" + value, nil
+}
+
+func connectionExpiry(connectedAt int64) string {
+	return fmt.Sprint(time.Unix(connectedAt, 0).Add(connectionLifetime).Unix())
+}
+
+func Connect(connectionId string, identity Identity) error {
+	connection := Connection{
+		ID:          connectionId,
+		TenantID:    identity.TenantID,
+		Subject:     identity.Subject,
+		Roles:       identity.Roles,
+		ConnectedAt: now().Unix(),
+	}
+	item, err := dynamodbattribute.MarshalMap(connection)
+	if err != nil {
+		return err
+	}
+	item["id"] = &dynamodb.AttributeValue{S: aws.String(connectionPartition(identity.TenantID, connectionId))}
+	item["DataType"] = &dynamodb.AttributeValue{S: aws.String("Connection")}
+	item["DataValue"] = &dynamodb.AttributeValue{S: aws.String(connectionDataValue(connectionId))}
+	item["ttl"] = &dynamodb.AttributeValue{N: aws.String(connectionExpiry(connection.ConnectedAt))}
+
+	_, err = Svc.PutItem(&dynamodb.PutItemInput{
+		TableName: aws.String(tableName),
+		Item:      item,
+	})
+	return err
+}
+
+// 接続IDから接続を探す。接続がなければnilを返す
+// GSI1は結果整合のため、接続の直後は見つからないことがある
+func LookupConnection(connectionId string) (*Connection, error) {
+	result, err := Svc.Query(&dynamodb.QueryInput{
+		TableName:              aws.String(tableName),
+		IndexName:              aws.String("GSI1"),
+		KeyConditionExpression: aws.String("DataValue = :dataValue"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":dataValue": {S: aws.String(connectionDataValue(connectionId))},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, i := range result.Items {
+		connection := Connection{}
+		if err := dynamodbattribute.UnmarshalMap(i, &connection); err != nil {
+			return nil, err
+		}
+		// パーティションのテナントと接続時に記録したテナントが一致するものだけを使う
+		if stringAttr(i, "DataType") == "Connection" && stringAttr(i, "id") == connectionPartition(connection.TenantID, connectionId) {
+			return &connection, nil
+		}
+	}
+	return nil, nil
+}
+
+// テナントの接続を読み取る。接続がなければnilを返す
+func loadConnection(tenantId string, connectionId string) (*Connection, error) {
+	result, err := Svc.GetItem(&dynamodb.GetItemInput{
+		TableName:      aws.String(tableName),
+		Key:            connectionKey(tenantId, connectionId),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil || len(result.Item) == 0 {
+		return nil, err
+	}
+	connection := Connection{}
+	if err := dynamodbattribute.UnmarshalMap(result.Item, &connection); err != nil {
+		return nil, err
+	}
+	return &connection, nil
+}
+
+// 接続側とトピック側の両方に購読を書き込む。切断済みの接続には購読を追加しない
+func Subscribe(connection *Connection, topic string) error {
+	expiry := connectionExpiry(connection.ConnectedAt)
+	_, err := Svc.TransactWriteItems(&dynamodb.TransactWriteItemsInput{
+		TransactItems: []*dynamodb.TransactWriteItem{
+			{
+				ConditionCheck: &dynamodb.ConditionCheck{
+					TableName:           aws.String(tableName),
+					Key:                 connectionKey(connection.TenantID, connection.ID),
+					ConditionExpression: aws.String("attribute_exists(id)"),
+				},
+			},
+			{
+				Put: &dynamodb.Put{
+					TableName: aws.String(tableName),
+					Item: map[string]*dynamodb.AttributeValue{
+						"id":       {S: aws.String(connectionPartition(connection.TenantID, connection.ID))},
+						"DataType": {S: aws.String("Subscription#" + topic)},
+						"ttl":      {N: aws.String(expiry)},
+					},
+				},
+			},
+			{
+				Put: &dynamodb.Put{
+					TableName: aws.String(tableName),
+					Item: map[string]*dynamodb.AttributeValue{
+						"id":       {S: aws.String(subscribersPartition(connection.TenantID, topic))},
+						"DataType": {S: aws.String("Connection#" + connection.ID)},
+						"ttl":      {N: aws.String(expiry)},
+					},
+				},
+			},
+		},
+	})
+	return err
+}
+
+func Unsubscribe(connection *Connection, topic string) error {
+	return batchDelete(Svc, subscriptionKeys(connection.TenantID, connection.ID, topic))
+}
+
+func subscriptionKeys(tenantId string, connectionId string, topic string) []map[string]*dynamodb.AttributeValue {
+	return []map[string]*dynamodb.AttributeValue{
+		{
+			"id":       {S: aws.String(connectionPartition(tenantId, connectionId))},
+			"DataType": {S: aws.String("Subscription#" + topic)},
+		},
+		{
+			"id":       {S: aws.String(subscribersPartition(tenantId, topic))},
+			"DataType": {S: aws.String("Connection#" + connectionId)},
+		},
+	}
+}
+
+// 接続とすべての購読を削除する
+func Disconnect(connectionId string) error {
+	connection, err := LookupConnection(connectionId)
+	if err != nil || connection == nil {
+		return err
+	}
+	return removeConnection(connection.TenantID, connectionId)
+}
+
+func removeConnection(tenantId string, connectionId string) error {
+	partition := connectionPartition(tenantId, connectionId)
+	keys := []map[string]*dynamodb.AttributeValue{}
+	var startKey map[string]*dynamodb.AttributeValue
+	for {
+		result, err := Svc.Query(&dynamodb.QueryInput{
+			TableName:              aws.String(tableName),
+			KeyConditionExpression: aws.String("id = :id AND begins_with(DataType, :prefix)"),
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":id":     {S: aws.String(partition)},
+				":prefix": {S: aws.String("Subscription#")},
+			},
+			ExclusiveStartKey: startKey,
+		})
+		if err != nil {
+			return err
+		}
+		for _, i := range result.Items {
+			topic := strings.TrimPrefix(stringAttr(i, "DataType"), "Subscription#")
+			keys = append(keys, subscriptionKeys(tenantId, connectionId, topic)...)
+		}
+		if len(result.LastEvaluatedKey) == 0 {
+			break
+		}
+		startKey = result.LastEvaluatedKey
+	}
+
+	// 接続のアイテムは最後に消し、途中で失敗しても再実行で購読を削除できるようにする
+	keys = append(keys, connectionKey(tenantId, connectionId))
+	return batchDelete(Svc, keys)
+}
+
+// 変更イベントを購読中の接続に送る
+type WebSocketSink struct {
+	Connections ConnectionManager
+}
+
+// 1つの接続には、複数のトピックで購読していても変更ごとに1回だけ送る
+// 切断済みの接続は購読を削除し、それ以外の送信エラーはログに残して続ける
+func (s WebSocketSink) Publish(changes []TaskChange) error {
+	for _, change := range changes {
+		topics, err := changeTopics(change)
+		if err != nil {
+			return err
+		}
+
+		// 接続ごとに、購読しているトピックを記録する
+		connectionIds := []string{}
+		subscribed := map[string][]string{}
+		for _, topic := range topics {
+			ids, err := linkedTaskIds(change.TenantID, "Subscribers#"+topic, "Connection#")
+			if err != nil {
+				return err
+			}
+			for _, id := range ids {
+				if _, ok := subscribed[id]; !ok {
+					connectionIds = append(connectionIds, id)
+				}
+				subscribed[id] = append(subscribed[id], topic)
+			}
+		}
+		if len(connectionIds) == 0 {
+			continue
+		}
+
+		data, err := json.Marshal(change)
+		if err != nil {
+			return err
+		}
+		taskTopic, _ := SubscriptionTopic("task", change.TaskID)
+		for _, id := range connectionIds {
+			// タスクだけを購読している接続は、移動先のプロジェクトを読めなくなれば購読を外す
+			if project, moved := movedTo(change); moved && len(subscribed[id]) == 1 && subscribed[id][0] == taskTopic {
+				allowed, err := canReadProject(change.TenantID, id, project, taskTopic)
+				if err != nil {
+					return err
+				}
+				if !allowed {
+					continue
+				}
+			}
+
+			err := s.Connections.PostToConnection(id, data)
+			if errors.Is(err, ErrConnectionGone) {
+				if err := removeConnection(change.TenantID, id); err != nil {
+					return err
+				}
+				continue
+			}
+			if err != nil {
+				log.Printf("Failed to post to connection %s: %v", id, err)
+			}
+		}
+	}
+	return nil
+}
+
+// 別のプロジェクトに移動した変更であれば、移動先のプロジェクトを返す
+func movedTo(change TaskChange) (string, bool) {
+	for _, d := range change.Changes {
+		if d.Field == "Project" && d.From != "" && d.To != d.From {
+			return d.To, true
+		}
+	}
+	return "", false
+}
+
+// 接続時の権限でプロジェクトのタスクを読めるか確認し、読めなければトピックの購読を削除する
+func canReadProject(tenantId string, connectionId string, project string, topic string) (bool, error) {
+	connection, err := loadConnection(tenantId, connectionId)
+	if err != nil {
+		return false, err
+	}
+	if connection == nil {
+		return false, batchDelete(Svc, subscriptionKeys(tenantId, connectionId, topic))
+	}
+	if auth.DefaultPolicy.Check("task:read", connection.Roles, project) == nil {
+		return true, nil
+	}
+	return false, Unsubscribe(connection, topic)
+}
+
+// 変更の前後どちらかで該当するプロジェクトとタグのトピック
+// 変わっていないプロジェクトとタグは現在のタスクから取得する
+func changeTopics(change TaskChange) ([]string, error) {
+	topics := []string{}
+	seen := map[string]bool{}
+	add := func(kind string, value string) {
+		if topic, err := SubscriptionTopic(kind, value); err == nil && !seen[topic] {
+			seen[topic] = true
+			topics = append(topics, topic)
+		}
+	}
+	// 上位の階層のタグを購読している接続にも届ける
+	addTag := func(tag string) {
+		if tag == "" {
+			return
+		}
+		for _, t := range tagAncestors(tag) {
+			add("tag", t)
+		}
+	}
+
+	add("task", change.TaskID)
+	for _, d := range change.Changes {
+		switch d.Field {
+		case "Project":
+			add("project", d.From)
+			add("project", d.To)
+		case "Tags":
+			addTag(d.From)
+			addTag(d.To)
+		}
+	}
+
+	if change.Type != TaskDeleted {
+		task, err := loadTask(change.TenantID, change.TaskID)
+		if err != nil {
+			return nil, err
+		}
+		if task != nil {
+			add("project", task.Project)
+			for _, tag := range task.Tags {
+				addTag(tag)
+			}
+		}
+	}
+	return topics, nil
+}
@@ -0,0 +1,568 @@
+package task
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+const (
+	// 発生したタスクを完了にしたときに次を作成する
+	TriggerCompletion = "completion"
+	// 発生日になったら前の発生の状態にかかわらず作成する
+	TriggerSchedule = "schedule"
+
+	// 発生したタスクの最初のステータス
+	occurrenceStatus = "todo"
+
+	// 定期実行で作成を待つ繰り返しはテナントをまたいでGSI1のこのDataValueで探す
+	scheduleDataValue = "RecurrenceSchedule"
+
+	defaultPreviewCount = 10
+	maxPreviewCount     = 100
+)
+
+// 繰り返しタスク。タイトル・説明・タグをテンプレートに、規則で決まる期日のタスクを1つずつ作成する
+type Recurrence struct {
+	ID          string   `json:"id" dynamodbav:"recurrenceId"`
+	Project     string   `json:"project"`
+	Title       string   `json:"title"`
+	Description string   `json:"description,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
+	Rule        string   `json:"rule"`
+	Start       string   `json:"start"`
+	Trigger     string   `json:"trigger"`
+	// 次に作成するタスクの期日。規則の最後まで作成すると空になる
+	Next        string `json:"next,omitempty"`
+	Occurrences int    `json:"occurrences"`
+	LastTask    string `json:"lastTask,omitempty"`
+	CreatedBy   string `json:"createdBy"`
+	CreatedAt   int64  `json:"createdAt"`
+}
+
+// 繰り返しはテナントごとに"{テナントID}#Recurrences"のパーティションに"Recurrence#{ID}"で置く
+func recurrenceKey(tenantId string, recurrenceId string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"id":       {S: aws.String(tenantKey(tenantId, "Recurrences"))},
+		"DataType": {S: aws.String("Recurrence#" + recurrenceId)},
+	}
+}
+
+// 繰り返しがなければnilを返す
+func loadRecurrence(tenantId string, recurrenceId string) (*Recurrence, error) {
+	result, err := Svc.GetItem(&dynamodb.GetItemInput{
+		TableName:      aws.String(tableName),
+		Key:            recurrenceKey(tenantId, recurrenceId),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil || len(result.Item) == 0 {
+		return nil, err
+	}
+	recurrence := Recurrence{}
+	if err := dynamodbattribute.UnmarshalMap(result.Item, &recurrence); err != nil {
+		return nil, err
+	}
+	return &recurrence, nil
+}
+
+// 繰り返しで作成するタスクのプロジェクト。権限の確認に使う
+func RecurrenceProject(tenantId string, recurrenceId string) (string, error) {
+	recurrence, err := loadRecurrence(tenantId, recurrenceId)
+	if err != nil || recurrence == nil {
+		return "", err
+	}
+	return recurrence.Project, nil
+}
+
+// afterより後の最初の発生日。なければ空を返す
+func (r Recurrence) nextAfter(after time.Time) (string, error) {
+	rule, err := parseRule(r.Rule)
+	if err != nil {
+		return "", err
+	}
+	start, err := time.Parse(dateLayout, r.Start)
+	if err != nil {
+		return "", err
+	}
+	dates := rule.occurrences(start, after, 1)
+	if len(dates) == 0 {
+		return "", nil
+	}
+	return dates[0].Format(dateLayout), nil
+}
+
+// 期日dueのタスクを作成し、繰り返しを次の発生日に進める
+// 繰り返しの書き込みは作成済みの数を条件にするため、同じ発生を重ねて作成しようとすると条件で失敗する
+func createOccurrence(tenantId string, recurrence Recurrence, due string) (*Recurrence, error) {
+	dueDate, err := time.Parse(dateLayout, due)
+	if err != nil {
+		return nil, err
+	}
+	next, err := recurrence.nextAfter(dueDate)
+	if err != nil {
+		return nil, err
+	}
+
+	task := Task{
+		ID:          newId(),
+		Title:       recurrence.Title,
+		Description: recurrence.Description,
+		Status:      occurrenceStatus,
+		Tags:        recurrence.Tags,
+		Project:     recurrence.Project,
+		Due:         due,
+	}
+	transactItems := []*dynamodb.TransactWriteItem{projectActiveCheck(tenantId, task.Project)}
+	for _, item := range taskItems(tenantId, task) {
+		transactItems = append(transactItems, &dynamodb.TransactWriteItem{
+			Put: &dynamodb.Put{
+				TableName:           aws.String(tableName),
+				Item:                item,
+				ConditionExpression: aws.String("attribute_not_exists(id)"),
+			},
+		})
+	}
+	// 発生したタスクから繰り返しをたどり、GSI1で繰り返しから発生したタスクを探せるようにする
+	transactItems = append(transactItems, &dynamodb.TransactWriteItem{
+		Put: &dynamodb.Put{
+			TableName: aws.String(tableName),
+			Item: map[string]*dynamodb.AttributeValue{
+				"id":        {S: aws.String(tenantKey(tenantId, task.ID))},
+				"DataType":  {S: aws.String("Recurrence")},
+				"DataValue": {S: aws.String(tenantKey(tenantId, recurrence.ID))},
+			},
+		},
+	})
+
+	previous := recurrence.Occurrences
+	recurrence.Next = next
+	recurrence.LastTask = task.ID
+	recurrence.Occurrences++
+	item, err := dynamodbattribute.MarshalMap(recurrence)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range recurrenceKey(tenantId, recurrence.ID) {
+		item[k] = v
+	}
+	if recurrence.Trigger == TriggerSchedule && next != "" {
+		item["DataValue"] = &dynamodb.AttributeValue{S: aws.String(scheduleDataValue)}
+	}
+	put := &dynamodb.Put{
+		TableName:           aws.String(tableName),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(id)"),
+	}
+	if previous > 0 {
+		put.ConditionExpression = aws.String("occurrences = :occurrences")
+		put.ExpressionAttributeValues = map[string]*dynamodb.AttributeValue{
+			":occurrences": {N: aws.String(strconv.Itoa(previous))},
+		}
+	}
+	transactItems = append(transactItems, &dynamodb.TransactWriteItem{Put: put})
+
+	identity := Identity{Subject: recurrence.CreatedBy, TenantID: tenantId}
+	if err := writeTaskMutation(identity, task.ID, transactItems, taskChanges(Task{}, task)...); err != nil {
+		return nil, err
+	}
+	return &recurrence, nil
+}
+
+// ストリームのレコードから完了になったタスクを探し、完了で次を作成する繰り返しの最新の発生であれば次のタスクを作成する
+func RunRecurrences(records []events.DynamoDBEventRecord) error {
+	for _, record := range records {
+		if record.EventName != "INSERT" && record.EventName != "MODIFY" {
+			continue
+		}
+		tenantId, taskId, ok := strings.Cut(streamString(record.Change.Keys, "id"), "#")
+		if !ok || streamString(record.Change.Keys, "DataType") != "Status" {
+			continue
+		}
+		oldStatus, _ := stripTenant(tenantId, streamString(record.Change.OldImage, "DataValue"))
+		newStatus, _ := stripTenant(tenantId, streamString(record.Change.NewImage, "DataValue"))
+		if !isDone(newStatus) || isDone(oldStatus) {
+			continue
+		}
+		if err := completeOccurrence(tenantId, taskId); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func completeOccurrence(tenantId string, taskId string) error {
+	recurrenceId, exists, err := taskFieldValue(tenantId, taskId, "Recurrence")
+	if err != nil || !exists {
+		return err
+	}
+	recurrence, err := loadRecurrence(tenantId, recurrenceId)
+	if err != nil || recurrence == nil {
+		return err
+	}
+	if recurrence.Trigger != TriggerCompletion || recurrence.LastTask != taskId || recurrence.Next == "" {
+		return nil
+	}
+
+	// 遅れて完了した場合は過ぎた発生日を飛ばし、今日以降の発生日にする
+	due := recurrence.Next
+	if due < today().Format(dateLayout) {
+		if due, err = recurrence.nextAfter(today().AddDate(0, 0, -1)); err != nil {
+			return err
+		}
+	}
+	if due == "" {
+		recurrence.Next = ""
+		return saveRecurrence(tenantId, *recurrence)
+	}
+	_, err = createOccurrence(tenantId, *recurrence, due)
+	if isConditionFailed(err) {
+		log.Printf("Skipped occurrence of recurrence %s: %v", recurrence.ID, err)
+		return nil
+	}
+	return err
+}
+
+// 作成済みの数が変わっていなければ書き込む
+func saveRecurrence(tenantId string, recurrence Recurrence) error {
+	item, err := dynamodbattribute.MarshalMap(recurrence)
+	if err != nil {
+		return err
+	}
+	for k, v := range recurrenceKey(tenantId, recurrence.ID) {
+		item[k] = v
+	}
+	_, err = Svc.PutItem(&dynamodb.PutItemInput{
+		TableName:           aws.String(tableName),
+		Item:                item,
+		ConditionExpression: aws.String("occurrences = :occurrences"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":occurrences": {N: aws.String(strconv.Itoa(recurrence.Occurrences))},
+		},
+	})
+	if isConditionFailed(err) {
+		return nil
+	}
+	return err
+}
+
+// 発生日が今日までになった定期の繰り返しのタスクを作成する。定期実行から呼び出す
+// 止まっていた間の発生日もそれぞれ作成する
+func RunSchedules() error {
+	date := today().Format(dateLayout)
+	errs := []error{}
+	var startKey map[string]*dynamodb.AttributeValue
+	for {
+		result, err := Svc.Query(&dynamodb.QueryInput{
+			TableName:              aws.String(tableName),
+			IndexName:              aws.String("GSI1"),
+			KeyConditionExpression: aws.String("DataValue = :dataValue"),
+			FilterExpression:       aws.String("#next <= :today"),
+			ExpressionAttributeNames: map[string]*string{
+				"#next": aws.String("next"),
+			},
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":dataValue": {S: aws.String(scheduleDataValue)},
+				":today":     {S: aws.String(date)},
+			},
+			ExclusiveStartKey: startKey,
+		})
+		if err != nil {
+			return err
+		}
+		for _, i := range result.Items {
+			tenantId, _, _ := strings.Cut(stringAttr(i, "id"), "#")
+			recurrence := &Recurrence{}
+			if err := dynamodbattribute.UnmarshalMap(i, recurrence); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			for recurrence != nil && recurrence.Next != "" && recurrence.Next <= date {
+				recurrence, err = createOccurrence(tenantId, *recurrence, recurrence.Next)
+				if err != nil {
+					// 他の実行が作成済みの場合や、プロジェクトがアーカイブされた場合は次の実行に任せる
+					log.Printf("Failed to create occurrence of recurrence %s: %v", stringAttr(i, "DataType"), err)
+					if !isConditionFailed(err) {
+						errs = append(errs, err)
+					}
+				}
+			}
+		}
+		if len(result.LastEvaluatedKey) == 0 {
+			break
+		}
+		startKey = result.LastEvaluatedKey
+	}
+	return errors.Join(errs...)
+}
+
+// 繰り返しを作成し、最初の発生のタスクを同じトランザクションで作成する
+func CreateRecurrence(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	identity := IdentityFromRequest(request)
+	tenantId := identity.TenantID
+	if tenantId == "" {
+		return missingTenantResponse(), nil
+	}
+	recurrence := Recurrence{}
+	if err := json.Unmarshal([]byte(request.Body), &recurrence); err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       fmt.Sprintf("Failed to unmarshal recurrence from JSON: %v", err),
+		}, nil
+	}
+	if recurrence.Project == "" || recurrence.Title == "" || recurrence.Rule == "" {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       "Missing project, title or rule in the recurrence",
+		}, nil
+	}
+	if recurrence.Start == "" {
+		recurrence.Start = today().Format(dateLayout)
+	}
+	if recurrence.Trigger == "" {
+		recurrence.Trigger = TriggerCompletion
+	}
+	if recurrence.Trigger != TriggerCompletion && recurrence.Trigger != TriggerSchedule {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       fmt.Sprintf("Trigger must be %s or %s", TriggerCompletion, TriggerSchedule),
+		}, nil
+	}
+	start, err := time.Parse(dateLayout, recurrence.Start)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       "Start must be a date in YYYY-MM-DD format",
+		}, nil
+	}
+	first := ""
+	if _, err = parseRule(recurrence.Rule); err == nil {
+		first, err = recurrence.nextAfter(start.AddDate(0, 0, -1))
+	}
+	if err == nil && first == "" {
+		err = errors.New("no occurrences")
+	}
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       fmt.Sprintf("Invalid rule: %v", err),
+		}, nil
+	}
+
+	timestamp := now()
+	recurrence.ID = newId()
+	recurrence.Next, recurrence.LastTask, recurrence.Occurrences = "", "", 0
+	recurrence.CreatedBy = identity.Subject
+	recurrence.CreatedAt = timestamp.Unix()
+
+	created, err := createOccurrence(tenantId, recurrence, first)
+	if err != nil {
+		if err == errTooManyItems {
+			return events.APIGatewayProxyResponse{
+				StatusCode: http.StatusBadRequest,
+				Body:       "Too many tags in the recurrence",
+			}, nil
+		}
+		if response, ok := tagErrorResponse(err); ok {
+			return response, nil
+		}
+		if isConditionFailed(err) {
+			return events.APIGatewayProxyResponse{
+				StatusCode: http.StatusNotFound,
+				Body:       "Project not found or archived",
+			}, nil
+		}
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to create recurrence: %v", err),
+		}, nil
+	}
+	return recurrenceResponse(http.StatusCreated, created)
+}
+
+func GetRecurrences(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	tenantId := TenantFromRequest(request)
+	if tenantId == "" {
+		return missingTenantResponse(), nil
+	}
+
+	recurrences := []Recurrence{}
+	var startKey map[string]*dynamodb.AttributeValue
+	for {
+		result, err := Svc.Query(&dynamodb.QueryInput{
+			TableName:              aws.String(tableName),
+			KeyConditionExpression: aws.String("id = :id AND begins_with(DataType, :prefix)"),
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":id":     {S: aws.String(tenantKey(tenantId, "Recurrences"))},
+				":prefix": {S: aws.String("Recurrence#")},
+			},
+			ExclusiveStartKey: startKey,
+		})
+		if err != nil {
+			return events.APIGatewayProxyResponse{
+				StatusCode: http.StatusInternalServerError,
+				Body:       fmt.Sprintf("Query failed: %v", err),
+			}, nil
+		}
+		for _, i := range result.Items {
+			recurrence := Recurrence{}
+			if err := dynamodbattribute.UnmarshalMap(i, &recurrence); err != nil {
+				return events.APIGatewayProxyResponse{
+					StatusCode: http.StatusInternalServerError,
+					Body:       fmt.Sprintf("Failed to unmarshal recurrence: %v", err),
+				}, nil
+			}
+			recurrences = append(recurrences, recurrence)
+		}
+		if len(result.LastEvaluatedKey) == 0 {
+			break
+		}
+		startKey = result.LastEvaluatedKey
+	}
+	return recurrenceResponse(http.StatusOK, recurrences)
+}
+
+func GetRecurrence(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	tenantId := TenantFromRequest(request)
+	if tenantId == "" {
+		return missingTenantResponse(), nil
+	}
+
+	recurrence, err := loadRecurrence(tenantId, request.QueryStringParameters["id"])
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to retrieve recurrence: %v", err),
+		}, nil
+	}
+	if recurrence == nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusNotFound,
+			Body:       "Recurrence not found",
+		}, nil
+	}
+	return recurrenceResponse(http.StatusOK, recurrence)
+}
+
+// 繰り返しを止める。作成済みのタスクは残る
+func DeleteRecurrence(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	tenantId := TenantFromRequest(request)
+	if tenantId == "" {
+		return missingTenantResponse(), nil
+	}
+
+	_, err := clientFor(request).DeleteItem(&dynamodb.DeleteItemInput{
+		TableName:           aws.String(tableName),
+		Key:                 recurrenceKey(tenantId, request.QueryStringParameters["id"]),
+		ConditionExpression: aws.String("attribute_exists(id)"),
+	})
+	if err != nil {
+		if isConditionFailed(err) {
+			return events.APIGatewayProxyResponse{
+				StatusCode: http.StatusNotFound,
+				Body:       "Recurrence not found",
+			}, nil
+		}
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to delete recurrence: %v", err),
+		}, nil
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: http.StatusOK,
+		Body:       "Recurrence deleted successfully",
+	}, nil
+}
+
+// 今後の発生日を返す。作成済みの繰り返しはidで、作成前の規則はruleとstartで指定する
+func PreviewRecurrence(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	tenantId := TenantFromRequest(request)
+	if tenantId == "" {
+		return missingTenantResponse(), nil
+	}
+	query := request.QueryStringParameters
+
+	count := defaultPreviewCount
+	if c := query["count"]; c != "" {
+		n, err := strconv.Atoi(c)
+		if err != nil || n < 1 || n > maxPreviewCount {
+			return events.APIGatewayProxyResponse{
+				StatusCode: http.StatusBadRequest,
+				Body:       fmt.Sprintf("Count must be between 1 and %d", maxPreviewCount),
+			}, nil
+		}
+		count = n
+	}
+
+	recurrence := Recurrence{Rule: query["rule"], Start: query["start"]}
+	if recurrence.Start == "" {
+		recurrence.Start = today().Format(dateLayout)
+	}
+	after := recurrence.Start
+	if id := query["id"]; id != "" {
+		stored, err := loadRecurrence(tenantId, id)
+		if err != nil {
+			return events.APIGatewayProxyResponse{
+				StatusCode: http.StatusInternalServerError,
+				Body:       fmt.Sprintf("Failed to retrieve recurrence: %v", err),
+			}, nil
+		}
+		if stored == nil {
+			return events.APIGatewayProxyResponse{
+				StatusCode: http.StatusNotFound,
+				Body:       "Recurrence not found",
+			}, nil
+		}
+		if stored.Next == "" {
+			return recurrenceResponse(http.StatusOK, []string{})
+		}
+		recurrence, after = *stored, stored.Next
+	}
+
+	rule, err := parseRule(recurrence.Rule)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       fmt.Sprintf("Invalid rule: %v", err),
+		}, nil
+	}
+	start, err := time.Parse(dateLayout, recurrence.Start)
+	from, fromErr := time.Parse(dateLayout, after)
+	if err != nil || fromErr != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       "Start must be a date in YYYY-MM-DD format",
+		}, nil
+	}
+
+	dates := []string{}
+	for _, d := range rule.occurrences(start, from.AddDate(0, 0, -1), count) {
+		dates = append(dates, d.Format(dateLayout))
+	}
+	return recurrenceResponse(http.StatusOK, dates)
+}
+
+func recurrenceResponse(statusCode int, body interface{}) (events.APIGatewayProxyResponse, error) {
+	response, err := json.Marshal(body)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to marshal response: %v", err),
+		}, nil
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: statusCode,
+		Body:       string(response),
+	}, nil
+}
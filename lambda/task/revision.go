@@ -0,0 +1,392 @@
+package task
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+type Revision struct {
+	Revision  int    `json:"revision"`
+	Timestamp int64  `json:"timestamp"`
+	Actor     string `json:"actor"`
+	Task      Task   `json:"task"`
+}
+
+type FieldDiff struct {
+	Field string `json:"field"`
+	From  string `json:"from,omitempty"`
+	To    string `json:"to,omitempty"`
+}
+
+// リビジョンに含めるタスクの属性。タグは"Tags"として1タグずつ、カスタムフィールドは値のアイテムのDataTypeで記録する
+var revisionFields = []string{"Title", "Description", "Status", "Project", "Parent", "Due"}
+
+func fieldOf(task Task, field string) string {
+	switch field {
+	case "Title":
+		return task.Title
+	case "Description":
+		return task.Description
+	case "Status":
+		return task.Status
+	case "Project":
+		return task.Project
+	case "Parent":
+		return task.Parent
+	case "Due":
+		return task.Due
+	}
+	return ""
+}
+
+// fromからtoへの変更を属性ごとに返す
+func taskChanges(from Task, to Task) []fieldChange {
+	changes := []fieldChange{}
+	for _, field := range revisionFields {
+		if old, new := fieldOf(from, field), fieldOf(to, field); old != new {
+			changes = append(changes, fieldChange{field, old, new})
+		}
+	}
+
+	oldTags := map[string]bool{}
+	for _, tag := range from.Tags {
+		oldTags[tag] = true
+	}
+	newTags := map[string]bool{}
+	for _, tag := range to.Tags {
+		newTags[tag] = true
+	}
+	removed, added := []string{}, []string{}
+	for tag := range oldTags {
+		if !newTags[tag] {
+			removed = append(removed, tag)
+		}
+	}
+	for tag := range newTags {
+		if !oldTags[tag] {
+			added = append(added, tag)
+		}
+	}
+	sort.Strings(removed)
+	sort.Strings(added)
+	for _, tag := range removed {
+		changes = append(changes, fieldChange{Field: "Tags", OldValue: tag})
+	}
+	for _, tag := range added {
+		changes = append(changes, fieldChange{Field: "Tags", NewValue: tag})
+	}
+	return append(changes, customFieldChanges(from, to)...)
+}
+
+// 履歴の1件をタスクに適用する。リビジョンに含まれない変更であればfalseを返す
+func applyHistoryEntry(task *Task, entry HistoryEntry) bool {
+	if entry.Field == "Tags" {
+		tags := []string{}
+		for _, tag := range task.Tags {
+			if tag != entry.OldValue && tag != entry.NewValue {
+				tags = append(tags, tag)
+			}
+		}
+		if entry.NewValue != "" {
+			tags = append(tags, entry.NewValue)
+		}
+		if len(tags) == 0 {
+			tags = nil
+		}
+		task.Tags = tags
+		return true
+	}
+	if strings.HasPrefix(entry.Field, customFieldPrefix) {
+		setCustomField(task, entry.Field, entry.NewValue)
+		return true
+	}
+	for _, field := range revisionFields {
+		if entry.Field == field {
+			UpdateTaskField(task, field, entry.NewValue)
+			return true
+		}
+	}
+	return false
+}
+
+// 履歴を古い順に再生してリビジョンを組み立てる
+// 1回の変更で追加された履歴が1つのリビジョンになり、作成時がリビジョン1になる
+func taskRevisions(tenantId string, taskId string) ([]Revision, error) {
+	entries := []HistoryEntry{}
+	var startKey map[string]*dynamodb.AttributeValue
+	for {
+		result, err := Svc.Query(&dynamodb.QueryInput{
+			TableName:              aws.String(tableName),
+			KeyConditionExpression: aws.String("id = :id AND begins_with(DataType, :prefix)"),
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":id":     {S: aws.String(tenantKey(tenantId, taskId))},
+				":prefix": {S: aws.String("History#")},
+			},
+			ExclusiveStartKey: startKey,
+		})
+		if err != nil {
+			return nil, err
+		}
+		page := []HistoryEntry{}
+		if err := dynamodbattribute.UnmarshalListOfMaps(result.Items, &page); err != nil {
+			return nil, err
+		}
+		entries = append(entries, page...)
+		if len(result.LastEvaluatedKey) == 0 {
+			break
+		}
+		startKey = result.LastEvaluatedKey
+	}
+
+	revisions := []Revision{}
+	task := Task{ID: taskId}
+	mutation := ""
+	for _, entry := range entries {
+		if !applyHistoryEntry(&task, entry) {
+			continue
+		}
+		if id, _, _ := strings.Cut(entry.ID, "-"); id != mutation {
+			mutation = id
+			revisions = append(revisions, Revision{
+				Revision:  len(revisions) + 1,
+				Timestamp: entry.Timestamp,
+				Actor:     entry.Actor,
+			})
+		}
+		revisions[len(revisions)-1].Task = task
+	}
+	for i := range revisions {
+		sort.Strings(revisions[i].Task.Tags)
+	}
+	return revisions, nil
+}
+
+func revisionNumber(value string, revisions []Revision) (int, bool) {
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 || n > len(revisions) {
+		return 0, false
+	}
+	return n, true
+}
+
+func revisionNotFoundResponse() events.APIGatewayProxyResponse {
+	return events.APIGatewayProxyResponse{
+		StatusCode: http.StatusNotFound,
+		Body:       "Revision not found",
+	}
+}
+
+func GetRevision(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	tenantId := TenantFromRequest(request)
+	if tenantId == "" {
+		return missingTenantResponse(), nil
+	}
+	taskId := request.QueryStringParameters["id"]
+
+	revisions, err := taskRevisions(tenantId, taskId)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to retrieve revisions: %v", err),
+		}, nil
+	}
+	n, ok := revisionNumber(request.QueryStringParameters["n"], revisions)
+	if !ok {
+		return revisionNotFoundResponse(), nil
+	}
+
+	response, err := json.Marshal(revisions[n-1])
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to marshal response: %v", err),
+		}, nil
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: http.StatusOK,
+		Body:       string(response),
+	}, nil
+}
+
+// ?from=a&to=bで指定した2つのリビジョンの差分を属性ごとに返す
+func DiffRevisions(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	tenantId := TenantFromRequest(request)
+	if tenantId == "" {
+		return missingTenantResponse(), nil
+	}
+	taskId := request.QueryStringParameters["id"]
+
+	revisions, err := taskRevisions(tenantId, taskId)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to retrieve revisions: %v", err),
+		}, nil
+	}
+	from, ok := revisionNumber(request.QueryStringParameters["from"], revisions)
+	if !ok {
+		return revisionNotFoundResponse(), nil
+	}
+	to, ok := revisionNumber(request.QueryStringParameters["to"], revisions)
+	if !ok {
+		return revisionNotFoundResponse(), nil
+	}
+
+	diff := []FieldDiff{}
+	for _, c := range taskChanges(revisions[from-1].Task, revisions[to-1].Task) {
+		diff = append(diff, FieldDiff{Field: c.Field, From: c.OldValue, To: c.NewValue})
+	}
+
+	response, err := json.Marshal(diff)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to marshal response: %v", err),
+		}, nil
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: http.StatusOK,
+		Body:       string(response),
+	}, nil
+}
+
+// 現在の値から指定したリビジョンの値に戻す変更を、通常の更新と同じく条件付きで書き込み履歴に残す
+// 親タスクはサブタスクのリンクも張り替える必要があるため、サブタスクのAPIで変更する
+// プロジェクトは移動先の認可と親子の確認が必要なため、移動のAPIで変更する
+func RevertTask(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	identity := IdentityFromRequest(request)
+	tenantId := identity.TenantID
+	if tenantId == "" {
+		return missingTenantResponse(), nil
+	}
+	taskId := request.QueryStringParameters["id"]
+
+	revisions, err := taskRevisions(tenantId, taskId)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to retrieve revisions: %v", err),
+		}, nil
+	}
+	n, ok := revisionNumber(request.QueryStringParameters["to"], revisions)
+	if !ok {
+		return revisionNotFoundResponse(), nil
+	}
+	target := revisions[n-1].Task
+
+	current, err := loadTask(tenantId, taskId)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to get task: %v", err),
+		}, nil
+	}
+	if current == nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusNotFound,
+			Body:       "Task not found",
+		}, nil
+	}
+
+	transactItems := []*dynamodb.TransactWriteItem{}
+	changes := []fieldChange{}
+	for _, c := range taskChanges(*current, target) {
+		switch c.Field {
+		case "Parent", "Project":
+			continue
+		case "Status":
+			open, err := blockingSubtasks(tenantId, taskId, c.NewValue)
+			if err != nil {
+				return events.APIGatewayProxyResponse{
+					StatusCode: http.StatusInternalServerError,
+					Body:       fmt.Sprintf("Failed to retrieve subtasks: %v", err),
+				}, nil
+			}
+			if open > 0 {
+				return events.APIGatewayProxyResponse{
+					StatusCode: http.StatusConflict,
+					Body:       fmt.Sprintf("Task has %d open subtasks", open),
+				}, nil
+			}
+		}
+
+		if c.Field == "Tags" {
+			transactItems = append(transactItems, tagWrite(tenantId, taskId, c.OldValue, c.NewValue))
+		} else {
+			transactItems = append(transactItems, fieldWrite(tenantId, taskId, c.Field, c.OldValue, c.NewValue))
+		}
+		changes = append(changes, c)
+	}
+	if len(changes) == 0 {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusOK,
+			Body:       fmt.Sprintf("Task already matches revision %d", n),
+		}, nil
+	}
+
+	err = writeTaskMutation(identity, taskId, transactItems, changes...)
+	if err != nil {
+		if response, ok := tagErrorResponse(err); ok {
+			return response, nil
+		}
+		if isConditionFailed(err) {
+			return events.APIGatewayProxyResponse{
+				StatusCode: http.StatusConflict,
+				Body:       "Task was modified by another request",
+			}, nil
+		}
+		if err == errTooManyItems {
+			return events.APIGatewayProxyResponse{
+				StatusCode: http.StatusBadRequest,
+				Body:       "Too many changes to revert at once",
+			}, nil
+		}
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to revert task: %v", err),
+		}, nil
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: http.StatusOK,
+		Body:       fmt.Sprintf("Task reverted to revision %d", n),
+	}, nil
+}
+
+// タグの追加(oldTagが空)または削除(newTagが空)
+func tagWrite(tenantId string, taskId string, oldTag string, newTag string) *dynamodb.TransactWriteItem {
+	if newTag == "" {
+		return &dynamodb.TransactWriteItem{
+			Delete: &dynamodb.Delete{
+				TableName: aws.String(tableName),
+				Key: map[string]*dynamodb.AttributeValue{
+					"id":       {S: aws.String(tenantKey(tenantId, taskId))},
+					"DataType": {S: aws.String(tagDataType(oldTag))},
+				},
+				ConditionExpression: aws.String("attribute_exists(id)"),
+			},
+		}
+	}
+	return &dynamodb.TransactWriteItem{
+		Put: &dynamodb.Put{
+			TableName: aws.String(tableName),
+			Item: map[string]*dynamodb.AttributeValue{
+				"id":        {S: aws.String(tenantKey(tenantId, taskId))},
+				"DataType":  {S: aws.String(tagDataType(newTag))},
+				"DataValue": {S: aws.String(tenantKey(tenantId, newTag))},
+			},
+			ConditionExpression: aws.String("attribute_not_exists(id)"),
+		},
+	}
+}
@@ -0,0 +1,320 @@
+package task
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	dateLayout = "2006-01-02"
+
+	// 発生日を探す範囲。条件に合う日がない規則で探し続けないようにする
+	maxRecurrenceYears = 100
+)
+
+var rruleWeekdays = map[string]time.Weekday{
+	"SU": time.Sunday, "MO": time.Monday, "TU": time.Tuesday, "WE": time.Wednesday,
+	"TH": time.Thursday, "FR": time.Friday, "SA": time.Saturday,
+}
+
+// BYDAYの1要素。nは"1MO"や"-1FR"の序数で、0は序数なし
+type rruleWeekday struct {
+	n   int
+	day time.Weekday
+}
+
+// RFC 5545のRRULEのうち、日付単位で使うFREQ, INTERVAL, COUNT, UNTIL, BYDAY, BYMONTHDAY, BYMONTH, BYSETPOSに対応する
+// 週の始まりは月曜日（WKST=MO）に固定する
+type recurrenceRule struct {
+	freq       string
+	interval   int
+	count      int
+	until      time.Time
+	byDay      []rruleWeekday
+	byMonthDay []int
+	byMonth    []int
+	bySetPos   []int
+}
+
+// "FREQ=MONTHLY;BYDAY=MO,TU,WE,TH,FR;BYSETPOS=1"のような規則を読み取る。先頭の"RRULE:"は省略できる
+func parseRule(rule string) (*recurrenceRule, error) {
+	r := &recurrenceRule{interval: 1}
+	seen := map[string]bool{}
+	for _, part := range strings.Split(strings.TrimPrefix(strings.TrimSpace(rule), "RRULE:"), ";") {
+		key, value, ok := strings.Cut(part, "=")
+		if !ok || value == "" {
+			return nil, fmt.Errorf("invalid rule part %q", part)
+		}
+		key = strings.ToUpper(key)
+		if seen[key] {
+			return nil, fmt.Errorf("%s is specified more than once", key)
+		}
+		seen[key] = true
+
+		var err error
+		switch key {
+		case "FREQ":
+			r.freq = strings.ToUpper(value)
+		case "INTERVAL":
+			r.interval, err = strconv.Atoi(value)
+			if err == nil && r.interval < 1 {
+				err = errors.New("must be positive")
+			}
+		case "COUNT":
+			r.count, err = strconv.Atoi(value)
+			if err == nil && r.count < 1 {
+				err = errors.New("must be positive")
+			}
+		case "UNTIL":
+			// 日時で指定された場合も日付だけを使う
+			if len(value) < 8 {
+				err = errors.New("must be YYYYMMDD")
+			} else {
+				r.until, err = time.Parse("20060102", value[:8])
+			}
+		case "BYDAY":
+			for _, v := range strings.Split(value, ",") {
+				v = strings.ToUpper(v)
+				if len(v) < 2 {
+					return nil, fmt.Errorf("invalid BYDAY %q", v)
+				}
+				day, ok := rruleWeekdays[v[len(v)-2:]]
+				if !ok {
+					return nil, fmt.Errorf("invalid BYDAY %q", v)
+				}
+				n := 0
+				if v[:len(v)-2] != "" {
+					if n, err = ruleNumber(v[:len(v)-2], 53); err != nil {
+						return nil, fmt.Errorf("invalid BYDAY %q", v)
+					}
+				}
+				r.byDay = append(r.byDay, rruleWeekday{n, day})
+			}
+		case "BYMONTHDAY":
+			r.byMonthDay, err = ruleNumbers(value, 31)
+		case "BYMONTH":
+			r.byMonth, err = ruleNumbers(value, 12)
+			for _, m := range r.byMonth {
+				if m < 0 {
+					err = errors.New("must be 1-12")
+				}
+			}
+		case "BYSETPOS":
+			r.bySetPos, err = ruleNumbers(value, 366)
+		default:
+			return nil, fmt.Errorf("%s is not supported", key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %v", key, err)
+		}
+	}
+
+	switch r.freq {
+	case "DAILY", "WEEKLY", "MONTHLY", "YEARLY":
+	case "":
+		return nil, errors.New("FREQ is required")
+	default:
+		return nil, fmt.Errorf("FREQ=%s is not supported", r.freq)
+	}
+	if r.count > 0 && !r.until.IsZero() {
+		return nil, errors.New("COUNT and UNTIL must not be used together")
+	}
+	if len(r.bySetPos) > 0 && len(r.byDay)+len(r.byMonthDay)+len(r.byMonth) == 0 {
+		return nil, errors.New("BYSETPOS must be used with another BYxxx rule part")
+	}
+	for _, d := range r.byDay {
+		if d.n != 0 && r.freq != "MONTHLY" && r.freq != "YEARLY" {
+			return nil, errors.New("BYDAY with an ordinal is only for MONTHLY and YEARLY")
+		}
+	}
+	return r, nil
+}
+
+// ±1からmaxまでの0以外の数
+func ruleNumber(value string, max int) (int, error) {
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, err
+	}
+	if n == 0 || n > max || n < -max {
+		return 0, fmt.Errorf("%d is out of range", n)
+	}
+	return n, nil
+}
+
+func ruleNumbers(value string, max int) ([]int, error) {
+	numbers := []int{}
+	for _, v := range strings.Split(value, ",") {
+		n, err := ruleNumber(v, max)
+		if err != nil {
+			return nil, err
+		}
+		numbers = append(numbers, n)
+	}
+	return numbers, nil
+}
+
+// startからの発生日のうち、afterより後のものを古い順にlimit件まで返す
+// startが規則に合わない場合、startは発生日に含めない
+func (r *recurrenceRule) occurrences(start time.Time, after time.Time, limit int) []time.Time {
+	result := []time.Time{}
+	count := 0
+	end := start.AddDate(maxRecurrenceYears, 0, 0)
+	for period := r.periodStart(start); !period.After(end) && len(result) < limit; period = r.addPeriods(period, r.interval) {
+		for _, d := range r.expand(period, start) {
+			if d.Before(start) {
+				continue
+			}
+			if !r.until.IsZero() && d.After(r.until) {
+				return result
+			}
+			count++
+			if r.count > 0 && count > r.count {
+				return result
+			}
+			if d.After(after) {
+				result = append(result, d)
+				if len(result) == limit {
+					break
+				}
+			}
+		}
+	}
+	return result
+}
+
+// startを含む期間（日・週・月・年）の初日
+func (r *recurrenceRule) periodStart(start time.Time) time.Time {
+	switch r.freq {
+	case "WEEKLY":
+		return start.AddDate(0, 0, -((int(start.Weekday()) + 6) % 7))
+	case "MONTHLY":
+		return time.Date(start.Year(), start.Month(), 1, 0, 0, 0, 0, time.UTC)
+	case "YEARLY":
+		return time.Date(start.Year(), time.January, 1, 0, 0, 0, 0, time.UTC)
+	}
+	return start
+}
+
+func (r *recurrenceRule) addPeriods(period time.Time, n int) time.Time {
+	switch r.freq {
+	case "WEEKLY":
+		return period.AddDate(0, 0, 7*n)
+	case "MONTHLY":
+		return period.AddDate(0, n, 0)
+	case "YEARLY":
+		return period.AddDate(n, 0, 0)
+	}
+	return period.AddDate(0, 0, n)
+}
+
+// 期間内の条件に合う日を古い順に返す
+func (r *recurrenceRule) expand(period time.Time, start time.Time) []time.Time {
+	days := []time.Time{}
+	for d, end := period, r.addPeriods(period, 1); d.Before(end); d = d.AddDate(0, 0, 1) {
+		if r.matches(d, start) {
+			days = append(days, d)
+		}
+	}
+	if len(r.bySetPos) == 0 {
+		return days
+	}
+
+	selected := []time.Time{}
+	for _, pos := range r.bySetPos {
+		i := pos - 1
+		if pos < 0 {
+			i = len(days) + pos
+		}
+		if i >= 0 && i < len(days) {
+			selected = append(selected, days[i])
+		}
+	}
+	sort.Slice(selected, func(i, j int) bool { return selected[i].Before(selected[j]) })
+	unique := []time.Time{}
+	for i, d := range selected {
+		if i == 0 || !d.Equal(selected[i-1]) {
+			unique = append(unique, d)
+		}
+	}
+	return unique
+}
+
+func (r *recurrenceRule) matches(d time.Time, start time.Time) bool {
+	if len(r.byMonth) > 0 && !containsInt(r.byMonth, int(d.Month())) {
+		return false
+	}
+	if len(r.byMonthDay) > 0 && !r.matchesMonthDay(d) {
+		return false
+	}
+	if len(r.byDay) > 0 && !r.matchesWeekday(d) {
+		return false
+	}
+
+	// 指定のない部分はstartに合わせる
+	switch r.freq {
+	case "WEEKLY":
+		return len(r.byDay) > 0 || d.Weekday() == start.Weekday()
+	case "MONTHLY":
+		return len(r.byDay)+len(r.byMonthDay) > 0 || d.Day() == start.Day()
+	case "YEARLY":
+		if len(r.byDay)+len(r.byMonthDay) > 0 {
+			return true
+		}
+		return d.Day() == start.Day() && (len(r.byMonth) > 0 || d.Month() == start.Month())
+	}
+	return true
+}
+
+func (r *recurrenceRule) matchesMonthDay(d time.Time) bool {
+	days := daysInMonth(d)
+	for _, md := range r.byMonthDay {
+		if d.Day() == md || d.Day() == days+md+1 {
+			return true
+		}
+	}
+	return false
+}
+
+// 序数は月単位（MONTHLY、またはBYMONTHのあるYEARLY）か年単位で数える
+func (r *recurrenceRule) matchesWeekday(d time.Time) bool {
+	for _, wd := range r.byDay {
+		if wd.day != d.Weekday() {
+			continue
+		}
+		if wd.n == 0 {
+			return true
+		}
+		day, days := d.Day(), daysInMonth(d)
+		if r.freq == "YEARLY" && len(r.byMonth) == 0 {
+			day, days = d.YearDay(), time.Date(d.Year(), time.December, 31, 0, 0, 0, 0, time.UTC).YearDay()
+		}
+		if (wd.n > 0 && (day-1)/7+1 == wd.n) || (wd.n < 0 && -((days-day)/7+1) == wd.n) {
+			return true
+		}
+	}
+	return false
+}
+
+func daysInMonth(d time.Time) int {
+	return time.Date(d.Year(), d.Month()+1, 0, 0, 0, 0, 0, time.UTC).Day()
+}
+
+func containsInt(values []int, value int) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// 日付はUTCの日単位で扱う
+func today() time.Time {
+	t := now().UTC()
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
@@ -0,0 +1,154 @@
+package task
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+const (
+	TaskCreated = "TaskCreated"
+	TaskUpdated = "TaskUpdated"
+	TaskDeleted = "TaskDeleted"
+)
+
+// DynamoDB Streamsの属性アイテムごとの変更をまとめた、タスク単位の変更イベント
+type TaskChange struct {
+	// タスクの最初のレコードのイベントID。同じバッチを再処理しても変わらない
+	EventID   string      `json:"eventId,omitempty"`
+	Type      string      `json:"type"`
+	TenantID  string      `json:"tenantId"`
+	TaskID    string      `json:"taskId"`
+	Actor     string      `json:"actor,omitempty"`
+	Timestamp int64       `json:"timestamp"`
+	Changes   []FieldDiff `json:"changes"`
+}
+
+// 変更イベントの送信先
+type Sink interface {
+	Publish(changes []TaskChange) error
+}
+
+// 変更イベントをJSONでログに出力する
+type LogSink struct{}
+
+func (LogSink) Publish(changes []TaskChange) error {
+	for _, c := range changes {
+		data, err := json.Marshal(c)
+		if err != nil {
+			return err
+		}
+		log.Print(string(data))
+	}
+	return nil
+}
+
+// すべての送信先に送り、失敗した送信先のエラーをまとめて返す
+func Fanout(changes []TaskChange, sinks ...Sink) error {
+	if len(changes) == 0 {
+		return nil
+	}
+	errs := []error{}
+	for _, sink := range sinks {
+		if err := sink.Publish(changes); err != nil {
+			errs = append(errs, fmt.Errorf("%T: %w", sink, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// ストリームのレコードをタスクごとにまとめ、レコードの順に変更イベントを組み立てる
+// タスクの存在はProjectアイテムで判定するため、その追加と削除をタスクの作成と削除とみなす
+func TaskChangesFromStream(records []events.DynamoDBEventRecord) []TaskChange {
+	changes := []TaskChange{}
+	index := map[string]int{}
+	for _, record := range records {
+		id := streamString(record.Change.Keys, "id")
+		dataType := streamString(record.Change.Keys, "DataType")
+		tenantId, taskId, ok := strings.Cut(id, "#")
+		// プロジェクトのカスタムフィールドの定義もDataTypeが"Field#"で始まるため、タスクのパーティションだけを対象にする
+		if !ok || !validTaskId(taskId) || !isTaskItem(tenantId, record, dataType) {
+			continue
+		}
+
+		i, exists := index[id]
+		if !exists {
+			i = len(changes)
+			index[id] = i
+			changes = append(changes, TaskChange{
+				EventID:  record.EventID,
+				Type:     TaskUpdated,
+				TenantID: tenantId,
+				TaskID:   taskId,
+				Changes:  []FieldDiff{},
+			})
+		}
+		change := &changes[i]
+		if t := record.Change.ApproximateCreationDateTime.Unix(); t > change.Timestamp {
+			change.Timestamp = t
+		}
+
+		if strings.HasPrefix(dataType, "History#") {
+			if actor := streamString(record.Change.NewImage, "actor"); actor != "" {
+				change.Actor = actor
+			}
+			continue
+		}
+
+		field := dataType
+		if strings.HasPrefix(dataType, "Tags#") {
+			field = "Tags"
+		}
+		oldValue, _ := stripTenant(tenantId, streamString(record.Change.OldImage, "DataValue"))
+		newValue, _ := stripTenant(tenantId, streamString(record.Change.NewImage, "DataValue"))
+		if oldValue == newValue {
+			continue
+		}
+		change.Changes = append(change.Changes, FieldDiff{Field: field, From: oldValue, To: newValue})
+
+		if dataType == "Project" {
+			switch record.EventName {
+			case "INSERT":
+				change.Type = TaskCreated
+			case "REMOVE":
+				change.Type = TaskDeleted
+			}
+		}
+	}
+
+	// 履歴だけのように属性が変わっていないタスクは除く
+	result := make([]TaskChange, 0, len(changes))
+	for _, c := range changes {
+		if len(c.Changes) > 0 {
+			result = append(result, c)
+		}
+	}
+	return result
+}
+
+// タスクの属性・タグ・カスタムフィールド・履歴のアイテムか
+// プロジェクトもDataTypeが"Project"になるため、DataValueで区別する
+func isTaskItem(tenantId string, record events.DynamoDBEventRecord, dataType string) bool {
+	switch dataType {
+	case "Title", "Description", "Status", "Parent", "Due":
+		return true
+	case "Project":
+		image := record.Change.NewImage
+		if record.EventName == "REMOVE" {
+			image = record.Change.OldImage
+		}
+		return streamString(image, "DataValue") != tenantKey(tenantId, "Project")
+	}
+	return strings.HasPrefix(dataType, "Tags#") || strings.HasPrefix(dataType, customFieldPrefix) || strings.HasPrefix(dataType, "History#")
+}
+
+func streamString(image map[string]events.DynamoDBAttributeValue, name string) string {
+	if v, ok := image[name]; ok && v.DataType() == events.DataTypeString {
+		return v.String()
+	}
+	return ""
+}
@@ -0,0 +1,620 @@
+package task
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+type ChecklistItem struct {
+	ID       string `json:"id"`
+	Text     string `json:"text"`
+	Done     bool   `json:"done"`
+	Position int64  `json:"-"`
+}
+
+// 履歴には"[x] テキスト"の形式で記録する
+func (c ChecklistItem) String() string {
+	if c.Done {
+		return "[x] " + c.Text
+	}
+	return "[ ] " + c.Text
+}
+
+type Progress struct {
+	Done  int `json:"done"`
+	Total int `json:"total"`
+}
+
+// 未完了のサブタスクがある親タスクを完了にできないようにする（BLOCK_PARENT_COMPLETION=falseで無効）
+var BlockParentCompletion = os.Getenv("BLOCK_PARENT_COMPLETION") != "false"
+
+const maxTaskDepth = 50
+
+func isDone(status string) bool {
+	switch strings.ToLower(status) {
+	case "done", "complete", "completed":
+		return true
+	}
+	return false
+}
+
+// 親タスクのパーティションに"Subtask#{子タスクID}"を置き、positionで並び順を保持する
+func subtaskLinkPut(tenantId string, parentId string, childId string, position int64) *dynamodb.TransactWriteItem {
+	return &dynamodb.TransactWriteItem{
+		Put: &dynamodb.Put{
+			TableName: aws.String(tableName),
+			Item: map[string]*dynamodb.AttributeValue{
+				"id":       {S: aws.String(tenantKey(tenantId, parentId))},
+				"DataType": {S: aws.String("Subtask#" + childId)},
+				"position": {N: aws.String(strconv.FormatInt(position, 10))},
+			},
+		},
+	}
+}
+
+func AddSubtask(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	identity := IdentityFromRequest(request)
+	tenantId := identity.TenantID
+	if tenantId == "" {
+		return missingTenantResponse(), nil
+	}
+	parentId := request.QueryStringParameters["id"]
+
+	body := struct {
+		ChildID string `json:"childId"`
+	}{}
+	if err := json.Unmarshal([]byte(request.Body), &body); err != nil || body.ChildID == "" {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       "Missing childId in the request",
+		}, nil
+	}
+
+	// 子タスクを自身の祖先にすることはできない
+	ancestor := parentId
+	for depth := 0; ancestor != ""; depth++ {
+		if ancestor == body.ChildID || depth == maxTaskDepth {
+			return events.APIGatewayProxyResponse{
+				StatusCode: http.StatusConflict,
+				Body:       "A task cannot be a subtask of its own descendant",
+			}, nil
+		}
+		parent, err := parentOfTask(tenantId, ancestor)
+		if err != nil {
+			return events.APIGatewayProxyResponse{
+				StatusCode: http.StatusInternalServerError,
+				Body:       fmt.Sprintf("Failed to get parent task: %v", err),
+			}, nil
+		}
+		ancestor = parent
+	}
+
+	// 親子のタスクは同じプロジェクトに所属している必要がある
+	project, err := ProjectOfTask(tenantId, parentId)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to get project of task: %v", err),
+		}, nil
+	}
+	if project == "" {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusNotFound,
+			Body:       "Task not found",
+		}, nil
+	}
+
+	err = writeTaskMutation(identity, parentId, []*dynamodb.TransactWriteItem{
+		taskInProjectCheck(tenantId, parentId, project),
+		taskInProjectCheck(tenantId, body.ChildID, project),
+		{
+			Put: &dynamodb.Put{
+				TableName: aws.String(tableName),
+				Item: map[string]*dynamodb.AttributeValue{
+					"id":        {S: aws.String(tenantKey(tenantId, body.ChildID))},
+					"DataType":  {S: aws.String("Parent")},
+					"DataValue": {S: aws.String(tenantKey(tenantId, parentId))},
+				},
+				ConditionExpression: aws.String("attribute_not_exists(id)"),
+			},
+		},
+		subtaskLinkPut(tenantId, parentId, body.ChildID, now().UnixNano()),
+	}, fieldChange{Field: "Subtasks", NewValue: body.ChildID})
+	if err != nil {
+		if isConditionFailed(err) {
+			return events.APIGatewayProxyResponse{
+				StatusCode: http.StatusConflict,
+				Body:       "Task does not exist, already has a parent or belongs to another project",
+			}, nil
+		}
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to add subtask: %v", err),
+		}, nil
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: http.StatusOK,
+		Body:       "Subtask added successfully",
+	}, nil
+}
+
+func RemoveSubtask(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	identity := IdentityFromRequest(request)
+	tenantId := identity.TenantID
+	if tenantId == "" {
+		return missingTenantResponse(), nil
+	}
+	parentId := request.QueryStringParameters["id"]
+	childId := request.QueryStringParameters["childId"]
+
+	err := writeTaskMutation(identity, parentId, []*dynamodb.TransactWriteItem{
+		{
+			Delete: &dynamodb.Delete{
+				TableName: aws.String(tableName),
+				Key: map[string]*dynamodb.AttributeValue{
+					"id":       {S: aws.String(tenantKey(tenantId, childId))},
+					"DataType": {S: aws.String("Parent")},
+				},
+				ConditionExpression: aws.String("DataValue = :parent"),
+				ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+					":parent": {S: aws.String(tenantKey(tenantId, parentId))},
+				},
+			},
+		},
+		{
+			Delete: &dynamodb.Delete{
+				TableName: aws.String(tableName),
+				Key: map[string]*dynamodb.AttributeValue{
+					"id":       {S: aws.String(tenantKey(tenantId, parentId))},
+					"DataType": {S: aws.String("Subtask#" + childId)},
+				},
+				ConditionExpression: aws.String("attribute_exists(id)"),
+			},
+		},
+	}, fieldChange{Field: "Subtasks", OldValue: childId})
+	if err != nil {
+		if isConditionFailed(err) {
+			return events.APIGatewayProxyResponse{
+				StatusCode: http.StatusNotFound,
+				Body:       "Task is not a subtask of the parent",
+			}, nil
+		}
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to remove subtask: %v", err),
+		}, nil
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: http.StatusOK,
+		Body:       "Subtask removed successfully",
+	}, nil
+}
+
+func ReorderSubtasks(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	identity := IdentityFromRequest(request)
+	tenantId := identity.TenantID
+	if tenantId == "" {
+		return missingTenantResponse(), nil
+	}
+	parentId := request.QueryStringParameters["id"]
+
+	body := struct {
+		Order []string `json:"order"`
+	}{}
+	if err := json.Unmarshal([]byte(request.Body), &body); err != nil || len(body.Order) == 0 || len(body.Order) > 99 {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       "order must contain between 1 and 99 subtask ids",
+		}, nil
+	}
+
+	transactItems := make([]*dynamodb.TransactWriteItem, 0, len(body.Order))
+	for position, childId := range body.Order {
+		transactItems = append(transactItems, &dynamodb.TransactWriteItem{
+			Update: &dynamodb.Update{
+				TableName: aws.String(tableName),
+				Key: map[string]*dynamodb.AttributeValue{
+					"id":       {S: aws.String(tenantKey(tenantId, parentId))},
+					"DataType": {S: aws.String("Subtask#" + childId)},
+				},
+				ConditionExpression: aws.String("attribute_exists(id)"),
+				UpdateExpression:    aws.String("SET #position = :position"),
+				ExpressionAttributeNames: map[string]*string{
+					"#position": aws.String("position"),
+				},
+				ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+					":position": {N: aws.String(strconv.Itoa(position))},
+				},
+			},
+		})
+	}
+
+	err := writeTaskMutation(identity, parentId, transactItems, fieldChange{Field: "SubtaskOrder", NewValue: strings.Join(body.Order, ",")})
+	if err != nil {
+		if isConditionFailed(err) {
+			return events.APIGatewayProxyResponse{
+				StatusCode: http.StatusConflict,
+				Body:       "order contains ids that are not subtasks of the task",
+			}, nil
+		}
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to reorder subtasks: %v", err),
+		}, nil
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: http.StatusOK,
+		Body:       "Subtasks reordered successfully",
+	}, nil
+}
+
+func AddChecklistItem(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	identity := IdentityFromRequest(request)
+	tenantId := identity.TenantID
+	if tenantId == "" {
+		return missingTenantResponse(), nil
+	}
+	taskId := request.QueryStringParameters["id"]
+
+	item := ChecklistItem{}
+	if err := json.Unmarshal([]byte(request.Body), &item); err != nil || strings.TrimSpace(item.Text) == "" {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       "Missing text in the checklist item",
+		}, nil
+	}
+	item.ID = newId()
+
+	err := writeTaskMutation(identity, taskId, []*dynamodb.TransactWriteItem{
+		taskExistsCheck(tenantId, taskId),
+		{
+			Put: &dynamodb.Put{
+				TableName: aws.String(tableName),
+				Item: map[string]*dynamodb.AttributeValue{
+					"id":       {S: aws.String(tenantKey(tenantId, taskId))},
+					"DataType": {S: aws.String("Checklist#" + item.ID)},
+					"text":     {S: aws.String(item.Text)},
+					"done":     {BOOL: aws.Bool(item.Done)},
+					"position": {N: aws.String(strconv.FormatInt(now().UnixNano(), 10))},
+				},
+			},
+		},
+	}, fieldChange{Field: "Checklist#" + item.ID, NewValue: item.String()})
+	if err != nil {
+		if conditionFailedAt(err, 0) {
+			return events.APIGatewayProxyResponse{
+				StatusCode: http.StatusNotFound,
+				Body:       "Task not found",
+			}, nil
+		}
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to add checklist item: %v", err),
+		}, nil
+	}
+
+	response, err := json.Marshal(item)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to marshal response: %v", err),
+		}, nil
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: http.StatusCreated,
+		Body:       string(response),
+	}, nil
+}
+
+func UpdateChecklistItem(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	identity := IdentityFromRequest(request)
+	tenantId := identity.TenantID
+	if tenantId == "" {
+		return missingTenantResponse(), nil
+	}
+	taskId := request.QueryStringParameters["id"]
+	itemId := request.QueryStringParameters["itemId"]
+
+	body := struct {
+		Text *string `json:"text"`
+		Done *bool   `json:"done"`
+	}{}
+	if err := json.Unmarshal([]byte(request.Body), &body); err != nil || (body.Text == nil && body.Done == nil) {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       "Missing text or done in the checklist item",
+		}, nil
+	}
+	if body.Text != nil && strings.TrimSpace(*body.Text) == "" {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       "Missing text in the checklist item",
+		}, nil
+	}
+
+	oldItem, err := checklistItem(tenantId, taskId, itemId)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to get checklist item: %v", err),
+		}, nil
+	}
+	if oldItem == nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusNotFound,
+			Body:       "Checklist item not found",
+		}, nil
+	}
+	newItem := *oldItem
+
+	updates := []string{}
+	values := map[string]*dynamodb.AttributeValue{}
+	if body.Text != nil {
+		newItem.Text = *body.Text
+		updates = append(updates, "#text = :text")
+		values[":text"] = &dynamodb.AttributeValue{S: body.Text}
+	}
+	if body.Done != nil {
+		newItem.Done = *body.Done
+		updates = append(updates, "done = :done")
+		values[":done"] = &dynamodb.AttributeValue{BOOL: body.Done}
+	}
+	update := &dynamodb.Update{
+		TableName: aws.String(tableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"id":       {S: aws.String(tenantKey(tenantId, taskId))},
+			"DataType": {S: aws.String("Checklist#" + itemId)},
+		},
+		ConditionExpression:       aws.String("attribute_exists(id)"),
+		UpdateExpression:          aws.String("SET " + strings.Join(updates, ", ")),
+		ExpressionAttributeValues: values,
+	}
+	if body.Text != nil {
+		update.ExpressionAttributeNames = map[string]*string{"#text": aws.String("text")}
+	}
+
+	err = writeTaskMutation(identity, taskId, []*dynamodb.TransactWriteItem{{Update: update}},
+		fieldChange{"Checklist#" + itemId, oldItem.String(), newItem.String()})
+	if err != nil {
+		// 読み取った後に他のリクエストで削除された
+		if isConditionFailed(err) {
+			return events.APIGatewayProxyResponse{
+				StatusCode: http.StatusNotFound,
+				Body:       "Checklist item not found",
+			}, nil
+		}
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to update checklist item: %v", err),
+		}, nil
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: http.StatusOK,
+		Body:       "Checklist item updated successfully",
+	}, nil
+}
+
+func DeleteChecklistItem(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	identity := IdentityFromRequest(request)
+	tenantId := identity.TenantID
+	if tenantId == "" {
+		return missingTenantResponse(), nil
+	}
+	taskId := request.QueryStringParameters["id"]
+	itemId := request.QueryStringParameters["itemId"]
+
+	oldItem, err := checklistItem(tenantId, taskId, itemId)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to get checklist item: %v", err),
+		}, nil
+	}
+	if oldItem == nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusNotFound,
+			Body:       "Checklist item not found",
+		}, nil
+	}
+
+	del := &dynamodb.Delete{
+		TableName: aws.String(tableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"id":       {S: aws.String(tenantKey(tenantId, taskId))},
+			"DataType": {S: aws.String("Checklist#" + itemId)},
+		},
+	}
+
+	err = writeTaskMutation(identity, taskId, []*dynamodb.TransactWriteItem{{Delete: del}},
+		fieldChange{Field: "Checklist#" + itemId, OldValue: oldItem.String()})
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to delete checklist item: %v", err),
+		}, nil
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: http.StatusOK,
+		Body:       "Checklist item deleted successfully",
+	}, nil
+}
+
+func parentOfTask(tenantId string, taskId string) (string, error) {
+	parent, _, err := taskFieldValue(tenantId, taskId, "Parent")
+	return parent, err
+}
+
+func checklistItem(tenantId string, taskId string, itemId string) (*ChecklistItem, error) {
+	result, err := Svc.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"id":       {S: aws.String(tenantKey(tenantId, taskId))},
+			"DataType": {S: aws.String("Checklist#" + itemId)},
+		},
+	})
+	if err != nil || len(result.Item) == 0 {
+		return nil, err
+	}
+	return &ChecklistItem{
+		ID:       itemId,
+		Text:     stringAttr(result.Item, "text"),
+		Done:     result.Item["done"] != nil && result.Item["done"].BOOL != nil && *result.Item["done"].BOOL,
+		Position: numberAttr(result.Item, "position"),
+	}, nil
+}
+
+func numberAttr(item map[string]*dynamodb.AttributeValue, name string) int64 {
+	if v, ok := item[name]; ok && v.N != nil {
+		n, _ := strconv.ParseInt(*v.N, 10, 64)
+		return n
+	}
+	return 0
+}
+
+// タスクのパーティションのアイテムからサブタスクとチェックリストを組み立て、進捗を計算する
+func attachChildren(tenantId string, taskMap map[string]*Task, items []map[string]*dynamodb.AttributeValue) error {
+	type link struct {
+		childId  string
+		position int64
+	}
+	links := map[string][]link{}
+	childIds := []string{}
+	for _, i := range items {
+		taskId, ok := stripTenant(tenantId, stringAttr(i, "id"))
+		if !ok || taskMap[taskId] == nil {
+			continue
+		}
+		dataType := stringAttr(i, "DataType")
+		switch {
+		case strings.HasPrefix(dataType, "Subtask#"):
+			childId := strings.TrimPrefix(dataType, "Subtask#")
+			links[taskId] = append(links[taskId], link{childId, numberAttr(i, "position")})
+			childIds = append(childIds, childId)
+		case strings.HasPrefix(dataType, "Checklist#"):
+			done := i["done"] != nil && i["done"].BOOL != nil && *i["done"].BOOL
+			taskMap[taskId].Checklist = append(taskMap[taskId].Checklist, ChecklistItem{
+				ID:       strings.TrimPrefix(dataType, "Checklist#"),
+				Text:     stringAttr(i, "text"),
+				Done:     done,
+				Position: numberAttr(i, "position"),
+			})
+		}
+	}
+
+	children := map[string]*Task{}
+	if len(childIds) > 0 {
+		var err error
+		children, err = GetTasksByTaskIds(tenantId, childIds)
+		if err != nil {
+			return err
+		}
+	}
+
+	for taskId, task := range taskMap {
+		sort.SliceStable(links[taskId], func(i, j int) bool { return links[taskId][i].position < links[taskId][j].position })
+		sort.SliceStable(task.Checklist, func(i, j int) bool { return task.Checklist[i].Position < task.Checklist[j].Position })
+
+		progress := Progress{}
+		for _, l := range links[taskId] {
+			child, ok := children[l.childId]
+			if !ok {
+				continue
+			}
+			task.Subtasks = append(task.Subtasks, *child)
+			progress.Total++
+			if isDone(child.Status) {
+				progress.Done++
+			}
+		}
+		for _, item := range task.Checklist {
+			progress.Total++
+			if item.Done {
+				progress.Done++
+			}
+		}
+		if progress.Total > 0 {
+			task.Progress = &progress
+		}
+	}
+	return nil
+}
+
+// タスクのパーティションから"{prefix}{タスクID}"の形式で関連付けたタスクIDを取得する
+// 依存関係の循環の確認などで直前の書き込みを見落とさないよう、強い整合性で読み取る
+func linkedTaskIds(tenantId string, taskId string, prefix string) ([]string, error) {
+	ids := []string{}
+	var startKey map[string]*dynamodb.AttributeValue
+	for {
+		result, err := Svc.Query(&dynamodb.QueryInput{
+			TableName:              aws.String(tableName),
+			ConsistentRead:         aws.Bool(true),
+			KeyConditionExpression: aws.String("id = :id AND begins_with(DataType, :prefix)"),
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":id":     {S: aws.String(tenantKey(tenantId, taskId))},
+				":prefix": {S: aws.String(prefix)},
+			},
+			ExclusiveStartKey: startKey,
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, i := range result.Items {
+			ids = append(ids, strings.TrimPrefix(stringAttr(i, "DataType"), prefix))
+		}
+		if len(result.LastEvaluatedKey) == 0 {
+			return ids, nil
+		}
+		startKey = result.LastEvaluatedKey
+	}
+}
+
+// ステータスを完了にする場合、それを妨げる未完了のサブタスクの数を返す
+func blockingSubtasks(tenantId string, taskId string, status string) (int, error) {
+	if !isDone(status) || !BlockParentCompletion {
+		return 0, nil
+	}
+	return openSubtasks(tenantId, taskId)
+}
+
+// 未完了のサブタスクの数を返す
+func openSubtasks(tenantId string, taskId string) (int, error) {
+	childIds, err := linkedTaskIds(tenantId, taskId, "Subtask#")
+	if err != nil {
+		return 0, err
+	}
+	return countOpen(tenantId, childIds)
+}
+
+// 指定したタスクのうち完了していないものの数を返す
+func countOpen(tenantId string, ids []string) (int, error) {
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	tasks, err := GetTasksByTaskIds(tenantId, ids)
+	if err != nil {
+		return 0, err
+	}
+
+	open := 0
+	for _, t := range tasks {
+		if !isDone(t.Status) {
+			open++
+		}
+	}
+	return open, nil
+}
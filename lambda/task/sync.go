@@ -0,0 +1,245 @@
+package task
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+const (
+	SyncLastWriterWins = "last-writer-wins"
+	SyncReject         = "reject"
+
+	// 競合の解決結果
+	ResolvedClient = "client"
+	ResolvedServer = "server"
+	Rejected       = "rejected"
+)
+
+// オフラインで編集した属性ごとの操作
+// タイトル・説明・ステータスは値を設定し、タグは追加・削除する
+type SyncOperation struct {
+	Field string `json:"field"`
+	Op    string `json:"op,omitempty"`
+	Value string `json:"value"`
+	// クライアントが編集前に取得していた属性のバージョン
+	BaseVersion int64 `json:"baseVersion"`
+	// クライアントで編集した日時(ミリ秒)
+	ClientTimestamp int64 `json:"clientTimestamp"`
+}
+
+type SyncConflict struct {
+	Field       string `json:"field"`
+	ClientValue string `json:"clientValue"`
+	ServerValue string `json:"serverValue"`
+	Resolution  string `json:"resolution"`
+	Reason      string `json:"reason,omitempty"`
+}
+
+type syncRequest struct {
+	Policy     string          `json:"policy"`
+	Operations []SyncOperation `json:"operations"`
+}
+
+type syncResult struct {
+	Task      *Task          `json:"task"`
+	Applied   []string       `json:"applied"`
+	Conflicts []SyncConflict `json:"conflicts"`
+}
+
+// 同期で変更できる属性。プロジェクトの移動は権限の確認が必要なため含めない
+var syncFields = map[string]bool{"Title": true, "Description": true, "Status": true, "Tags": true}
+
+// オフライン編集をまとめて反映し、正となるタスクを返す
+// 編集前から変わっていない属性はそのまま反映し、他で変更された属性は方針に従って解決するか競合として返す
+func SyncTask(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	identity := IdentityFromRequest(request)
+	tenantId := identity.TenantID
+	if tenantId == "" {
+		return missingTenantResponse(), nil
+	}
+	taskId := request.QueryStringParameters["id"]
+
+	body := syncRequest{}
+	if err := json.Unmarshal([]byte(request.Body), &body); err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       fmt.Sprintf("Failed to unmarshal request: %v", err),
+		}, nil
+	}
+	if body.Policy == "" {
+		body.Policy = SyncLastWriterWins
+	}
+	if body.Policy != SyncLastWriterWins && body.Policy != SyncReject {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       fmt.Sprintf("Unknown policy: %s", body.Policy),
+		}, nil
+	}
+	for _, op := range body.Operations {
+		if !syncFields[op.Field] || (op.Field == "Tags" && op.Op != "add" && op.Op != "remove") {
+			return events.APIGatewayProxyResponse{
+				StatusCode: http.StatusBadRequest,
+				Body:       fmt.Sprintf("Unsupported operation on %s", op.Field),
+			}, nil
+		}
+	}
+
+	current, err := loadTask(tenantId, taskId)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to retrieve task: %v", err),
+		}, nil
+	}
+	if current == nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusNotFound,
+			Body:       "Task not found",
+		}, nil
+	}
+
+	result := syncResult{Applied: []string{}, Conflicts: []SyncConflict{}}
+	transactItems := []*dynamodb.TransactWriteItem{}
+	changes := []fieldChange{}
+
+	// クライアントでの編集順に適用し、同じ属性は最後の編集だけを残す
+	operations := append([]SyncOperation(nil), body.Operations...)
+	sort.SliceStable(operations, func(i, j int) bool { return operations[i].ClientTimestamp < operations[j].ClientTimestamp })
+	latest := map[string]SyncOperation{}
+	tags := map[string]bool{}
+	for _, tag := range current.Tags {
+		tags[tag] = true
+	}
+	tagOps := map[string]bool{}
+	tagOrder := []string{}
+	for _, op := range operations {
+		if op.Field == "Tags" {
+			if _, seen := tagOps[op.Value]; !seen {
+				tagOrder = append(tagOrder, op.Value)
+			}
+			tagOps[op.Value] = op.Op == "add"
+			continue
+		}
+		latest[op.Field] = op
+	}
+
+	for _, field := range revisionFields {
+		op, ok := latest[field]
+		if !ok {
+			continue
+		}
+		serverValue := fieldOf(*current, field)
+		if op.Value == serverValue {
+			continue
+		}
+
+		version := current.Versions[field]
+		if op.BaseVersion != version {
+			conflict := SyncConflict{Field: field, ClientValue: op.Value, ServerValue: serverValue}
+			switch {
+			case body.Policy == SyncReject:
+				conflict.Resolution = Rejected
+			case op.ClientTimestamp*1000 > version:
+				conflict.Resolution = ResolvedClient
+			default:
+				conflict.Resolution = ResolvedServer
+			}
+			result.Conflicts = append(result.Conflicts, conflict)
+			if conflict.Resolution != ResolvedClient {
+				continue
+			}
+		}
+
+		if field == "Status" {
+			open, err := blockingSubtasks(tenantId, taskId, op.Value)
+			if err != nil {
+				return events.APIGatewayProxyResponse{
+					StatusCode: http.StatusInternalServerError,
+					Body:       fmt.Sprintf("Failed to retrieve subtasks: %v", err),
+				}, nil
+			}
+			if open > 0 {
+				result.Conflicts = append(result.Conflicts, SyncConflict{
+					Field:       field,
+					ClientValue: op.Value,
+					ServerValue: serverValue,
+					Resolution:  Rejected,
+					Reason:      fmt.Sprintf("Task has %d open subtasks", open),
+				})
+				continue
+			}
+		}
+
+		transactItems = append(transactItems, fieldWrite(tenantId, taskId, field, serverValue, op.Value))
+		changes = append(changes, fieldChange{field, serverValue, op.Value})
+		result.Applied = append(result.Applied, field)
+	}
+
+	// タグの追加と削除は順序によらず同じ結果になるため、競合として扱わない
+	for _, tag := range tagOrder {
+		add := tagOps[tag]
+		if tag == "" || add == tags[tag] {
+			continue
+		}
+		if add {
+			transactItems = append(transactItems, tagWrite(tenantId, taskId, "", tag))
+			changes = append(changes, fieldChange{"Tags", "", tag})
+		} else {
+			transactItems = append(transactItems, tagWrite(tenantId, taskId, tag, ""))
+			changes = append(changes, fieldChange{"Tags", tag, ""})
+		}
+		result.Applied = append(result.Applied, "Tags#"+tag)
+	}
+
+	if len(transactItems) > 0 {
+		err = writeTaskMutation(identity, taskId, transactItems, changes...)
+		if err != nil {
+			if err == errTooManyItems {
+				return events.APIGatewayProxyResponse{
+					StatusCode: http.StatusBadRequest,
+					Body:       "Too many operations in the request",
+				}, nil
+			}
+			if response, ok := tagErrorResponse(err); ok {
+				return response, nil
+			}
+			if isConditionFailed(err) {
+				return events.APIGatewayProxyResponse{
+					StatusCode: http.StatusConflict,
+					Body:       "Task was modified during sync, retry the request",
+				}, nil
+			}
+			return events.APIGatewayProxyResponse{
+				StatusCode: http.StatusInternalServerError,
+				Body:       fmt.Sprintf("Failed to sync task: %v", err),
+			}, nil
+		}
+
+		current, err = loadTask(tenantId, taskId)
+		if err != nil {
+			return events.APIGatewayProxyResponse{
+				StatusCode: http.StatusInternalServerError,
+				Body:       fmt.Sprintf("Failed to retrieve task: %v", err),
+			}, nil
+		}
+	}
+	result.Task = current
+
+	response, err := json.Marshal(result)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to marshal response: %v", err),
+		}, nil
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: http.StatusOK,
+		Body:       string(response),
+	}, nil
+}
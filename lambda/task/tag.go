@@ -0,0 +1,326 @@
+package task
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+// タグカタログのタグ。Countはタグが付いているタスクの数
+type Tag struct {
+	Name        string `json:"name"`
+	Color       string `json:"color,omitempty"`
+	Description string `json:"description,omitempty"`
+	Count       int64  `json:"count" dynamodbav:"usageCount"`
+}
+
+// 未登録のタグをタスクに付けた場合に拒否する（UNKNOWN_TAGS=reject）。既定ではカタログに自動で作成する
+var RejectUnknownTags = os.Getenv("UNKNOWN_TAGS") == "reject"
+
+var errUnknownTag = errors.New("unknown tag")
+
+var errInvalidTagPath = errors.New("Tag name must not have empty segments")
+
+var tagColor = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+
+// タグは1タグ1アイテムで保持し、プロジェクトと同じくGSI1のDataValue="{TenantId}#Tag"で一覧を取得する
+func tagId(tenantId string, name string) string {
+	return tenantKey(tenantId, "Tag#"+name)
+}
+
+func tagKey(tenantId string, name string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"id":       {S: aws.String(tagId(tenantId, name))},
+		"DataType": {S: aws.String("Tag")},
+	}
+}
+
+// タグの使用数を増減する。カタログにないタグは使用数だけを持つアイテムとして作成する
+func tagCountUpdate(tenantId string, name string, delta int) *dynamodb.TransactWriteItem {
+	update := &dynamodb.Update{
+		TableName:        aws.String(tableName),
+		Key:              tagKey(tenantId, name),
+		UpdateExpression: aws.String("SET DataValue = :list, #name = :name ADD usageCount :delta"),
+		ExpressionAttributeNames: map[string]*string{
+			"#name": aws.String("name"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":list":  {S: aws.String(tenantKey(tenantId, "Tag"))},
+			":name":  {S: aws.String(name)},
+			":delta": {N: aws.String(fmt.Sprint(delta))},
+		},
+	}
+	if RejectUnknownTags && delta > 0 {
+		update.ConditionExpression = aws.String("attribute_exists(id)")
+	}
+	return &dynamodb.TransactWriteItem{Update: update}
+}
+
+// タグの追加・削除をタグごとの使用数の増減にまとめる
+// 同じトランザクションで1つのアイテムを2回書き込めないため、タグごとに1つの更新にする
+// 付けるタグの名前もここで検証する。既に付いている不正な名前のタグは外せるよう、外すタグは検証しない
+func tagCountUpdates(tenantId string, changes []fieldChange) ([]*dynamodb.TransactWriteItem, error) {
+	deltas := map[string]int{}
+	for _, c := range changes {
+		if c.Field != "Tags" {
+			continue
+		}
+		if c.OldValue != "" {
+			deltas[c.OldValue]--
+		}
+		if c.NewValue != "" {
+			deltas[c.NewValue]++
+		}
+	}
+
+	names := make([]string, 0, len(deltas))
+	for name, delta := range deltas {
+		if delta != 0 {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	transactItems := make([]*dynamodb.TransactWriteItem, 0, len(names))
+	for _, name := range names {
+		if deltas[name] > 0 && !validTagPath(name) {
+			return nil, fmt.Errorf("%w: %s", errInvalidTagPath, name)
+		}
+		if RejectUnknownTags && deltas[name] > 0 {
+			tag, err := lookupTag(tenantId, name)
+			if err != nil {
+				return nil, err
+			}
+			if tag == nil {
+				return nil, fmt.Errorf("%w: %s", errUnknownTag, name)
+			}
+		}
+		transactItems = append(transactItems, tagCountUpdate(tenantId, name, deltas[name]))
+	}
+	return transactItems, nil
+}
+
+// タグがなければnilを返す
+func lookupTag(tenantId string, name string) (*Tag, error) {
+	result, err := Svc.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(tableName),
+		Key:       tagKey(tenantId, name),
+	})
+	if err != nil || len(result.Item) == 0 {
+		return nil, err
+	}
+	tag := Tag{}
+	if err := dynamodbattribute.UnmarshalMap(result.Item, &tag); err != nil {
+		return nil, err
+	}
+	return &tag, nil
+}
+
+// 不正な名前のタグや未登録のタグを付けようとした場合は400を返す
+func tagErrorResponse(err error) (events.APIGatewayProxyResponse, bool) {
+	if errors.Is(err, errInvalidTagPath) {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       err.Error(),
+		}, true
+	}
+	if !errors.Is(err, errUnknownTag) {
+		return events.APIGatewayProxyResponse{}, false
+	}
+	return events.APIGatewayProxyResponse{
+		StatusCode: http.StatusBadRequest,
+		Body:       fmt.Sprintf("Tag must be created before use: %v", err),
+	}, true
+}
+
+func CreateTag(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	tenantId := TenantFromRequest(request)
+	if tenantId == "" {
+		return missingTenantResponse(), nil
+	}
+	tag := Tag{}
+	err := json.Unmarshal([]byte(request.Body), &tag)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       fmt.Sprintf("Failed to unmarshal tag from JSON: %v", err),
+		}, nil
+	}
+	if tag.Name == "" {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       "Missing name in the tag",
+		}, nil
+	}
+	if !validTagPath(tag.Name) {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       errInvalidTagPath.Error(),
+		}, nil
+	}
+	if tag.Color != "" && !tagColor.MatchString(tag.Color) {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       "Color must be in #RRGGBB format",
+		}, nil
+	}
+
+	item := tagKey(tenantId, tag.Name)
+	item["DataValue"] = &dynamodb.AttributeValue{S: aws.String(tenantKey(tenantId, "Tag"))}
+	item["name"] = &dynamodb.AttributeValue{S: aws.String(tag.Name)}
+	item["color"] = &dynamodb.AttributeValue{S: aws.String(tag.Color)}
+	item["description"] = &dynamodb.AttributeValue{S: aws.String(tag.Description)}
+	item["usageCount"] = &dynamodb.AttributeValue{N: aws.String("0")}
+
+	// 自動で作成されたタグも含め、既にあるタグは上書きしない
+	_, err = clientFor(request).PutItem(&dynamodb.PutItemInput{
+		TableName:           aws.String(tableName),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(id)"),
+	})
+	if err != nil {
+		if isConditionFailed(err) {
+			return events.APIGatewayProxyResponse{
+				StatusCode: http.StatusConflict,
+				Body:       "Tag already exists",
+			}, nil
+		}
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to create tag: %v", err),
+		}, nil
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: http.StatusCreated,
+		Body:       "Tag created successfully",
+	}, nil
+}
+
+func GetTags(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	tenantId := TenantFromRequest(request)
+	if tenantId == "" {
+		return missingTenantResponse(), nil
+	}
+
+	tags, err := listTags(tenantId, "")
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Query failed: %v", err),
+		}, nil
+	}
+
+	response, err := json.Marshal(tags)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to marshal response: %v", err),
+		}, nil
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: http.StatusOK,
+		Body:       string(response),
+	}, nil
+}
+
+// 名前がprefixで始まるカタログのタグを名前順に返す
+// GSI1のソートキーはタグのidのため、前方一致で絞り込んで検索できる
+func listTags(tenantId string, prefix string) ([]Tag, error) {
+	tags := []Tag{}
+	var startKey map[string]*dynamodb.AttributeValue
+	for {
+		result, err := Svc.Query(&dynamodb.QueryInput{
+			TableName:              aws.String(tableName),
+			IndexName:              aws.String("GSI1"),
+			KeyConditionExpression: aws.String("DataValue = :dataValue AND begins_with(id, :prefix)"),
+			FilterExpression:       aws.String("DataType = :dataType"),
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":dataType":  {S: aws.String("Tag")},
+				":dataValue": {S: aws.String(tenantKey(tenantId, "Tag"))},
+				":prefix":    {S: aws.String(tagId(tenantId, prefix))},
+			},
+			ExclusiveStartKey: startKey,
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, i := range result.Items {
+			if _, ok := stripTenant(tenantId, stringAttr(i, "id")); !ok {
+				continue
+			}
+			tag := Tag{}
+			if err := dynamodbattribute.UnmarshalMap(i, &tag); err != nil {
+				return nil, err
+			}
+			tags = append(tags, tag)
+		}
+		if len(result.LastEvaluatedKey) == 0 {
+			break
+		}
+		startKey = result.LastEvaluatedKey
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i].Name < tags[j].Name })
+	return tags, nil
+}
+
+// 色と説明を変更する。使用数はタスクへの追加・削除でのみ変わる
+func UpdateTag(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	tenantId := TenantFromRequest(request)
+	if tenantId == "" {
+		return missingTenantResponse(), nil
+	}
+	name := request.QueryStringParameters["name"]
+	tag := Tag{}
+	err := json.Unmarshal([]byte(request.Body), &tag)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       fmt.Sprintf("Failed to unmarshal tag from JSON: %v", err),
+		}, nil
+	}
+	if tag.Color != "" && !tagColor.MatchString(tag.Color) {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       "Color must be in #RRGGBB format",
+		}, nil
+	}
+
+	_, err = clientFor(request).UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:           aws.String(tableName),
+		Key:                 tagKey(tenantId, name),
+		ConditionExpression: aws.String("attribute_exists(id)"),
+		UpdateExpression:    aws.String("SET color = :color, description = :description"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":color":       {S: aws.String(tag.Color)},
+			":description": {S: aws.String(tag.Description)},
+		},
+	})
+	if err != nil {
+		if isConditionFailed(err) {
+			return events.APIGatewayProxyResponse{
+				StatusCode: http.StatusNotFound,
+				Body:       "Tag not found",
+			}, nil
+		}
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to update tag: %v", err),
+		}, nil
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: http.StatusOK,
+		Body:       "Tag updated successfully",
+	}, nil
+}
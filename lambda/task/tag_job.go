@@ -0,0 +1,236 @@
+package task
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+const (
+	JobTagRename = "tag-rename"
+	JobTagMerge  = "tag-merge"
+
+	// 1バッチで書き換えるタグのアイテム数
+	tagJobBatchSize = 25
+)
+
+type tagJobRequest struct {
+	To string `json:"to"`
+}
+
+// タグの名前をすべてのタスクで変更する。変更後のタグはカタログに新しく作成し、色と説明を引き継ぐ
+func RenameTag(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	return startTagJob(request, JobTagRename)
+}
+
+// タグをカタログにある別のタグにまとめる
+func MergeTag(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	return startTagJob(request, JobTagMerge)
+}
+
+func startTagJob(request events.APIGatewayProxyRequest, jobType string) (events.APIGatewayProxyResponse, error) {
+	identity := IdentityFromRequest(request)
+	tenantId := identity.TenantID
+	if tenantId == "" {
+		return missingTenantResponse(), nil
+	}
+	from := request.QueryStringParameters["name"]
+	body := tagJobRequest{}
+	if err := json.Unmarshal([]byte(request.Body), &body); err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       fmt.Sprintf("Failed to unmarshal request: %v", err),
+		}, nil
+	}
+	if body.To == "" || body.To == from {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       "Target tag must be set and differ from the source tag",
+		}, nil
+	}
+	if !validTagPath(body.To) {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       errInvalidTagPath.Error(),
+		}, nil
+	}
+
+	source, err := lookupTag(tenantId, from)
+	if err == nil && source == nil {
+		// カタログができる前から使われているタグも書き換えられるようにする
+		var ids []string
+		ids, err = taskIdsByDataValue(tenantId, tagDataType(from), from)
+		if err == nil && len(ids) == 0 {
+			return events.APIGatewayProxyResponse{
+				StatusCode: http.StatusNotFound,
+				Body:       "Tag not found",
+			}, nil
+		}
+		source = &Tag{Name: from}
+	}
+	var target *Tag
+	if err == nil {
+		target, err = lookupTag(tenantId, body.To)
+	}
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to retrieve tag: %v", err),
+		}, nil
+	}
+	if jobType == JobTagRename && target != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusConflict,
+			Body:       fmt.Sprintf("Tag %s already exists, merge into it instead", body.To),
+		}, nil
+	}
+	if jobType == JobTagMerge && target == nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusNotFound,
+			Body:       fmt.Sprintf("Tag %s not found", body.To),
+		}, nil
+	}
+
+	job := newJob(identity, jobType)
+	job.From, job.To = from, body.To
+	put, err := jobPut(tenantId, job)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to marshal job: %v", err),
+		}, nil
+	}
+	transactItems := []*dynamodb.TransactWriteItem{put}
+	if jobType == JobTagRename {
+		item := tagKey(tenantId, body.To)
+		item["DataValue"] = &dynamodb.AttributeValue{S: aws.String(tenantKey(tenantId, "Tag"))}
+		item["name"] = &dynamodb.AttributeValue{S: aws.String(body.To)}
+		item["color"] = &dynamodb.AttributeValue{S: aws.String(source.Color)}
+		item["description"] = &dynamodb.AttributeValue{S: aws.String(source.Description)}
+		item["usageCount"] = &dynamodb.AttributeValue{N: aws.String("0")}
+		transactItems = append(transactItems, &dynamodb.TransactWriteItem{
+			Put: &dynamodb.Put{
+				TableName:           aws.String(tableName),
+				Item:                item,
+				ConditionExpression: aws.String("attribute_not_exists(id)"),
+			},
+		})
+	}
+
+	_, err = identity.db().TransactWriteItems(&dynamodb.TransactWriteItemsInput{TransactItems: transactItems})
+	if err != nil {
+		if isConditionFailed(err) {
+			return events.APIGatewayProxyResponse{
+				StatusCode: http.StatusConflict,
+				Body:       fmt.Sprintf("Tag %s already exists, merge into it instead", body.To),
+			}, nil
+		}
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to start job: %v", err),
+		}, nil
+	}
+	return jobResponse(http.StatusAccepted, job)
+}
+
+// GSI1で変更前のタグが付いたタスクを探し、1バッチ分のタスクのタグを書き換える
+// 書き換えたタスクは次の検索に出てこなくなるが、GSI1の反映の遅れで同じタスクが出てきても重ねて書き換えない
+func runTagJobBatch(tenantId string, job *Job) error {
+	var startKey map[string]*dynamodb.AttributeValue
+	for k, v := range job.Cursor {
+		if startKey == nil {
+			startKey = map[string]*dynamodb.AttributeValue{}
+		}
+		startKey[k] = &dynamodb.AttributeValue{S: aws.String(v)}
+	}
+
+	result, err := Svc.Query(&dynamodb.QueryInput{
+		TableName:              aws.String(tableName),
+		IndexName:              aws.String("GSI1"),
+		KeyConditionExpression: aws.String("DataValue = :dataValue"),
+		FilterExpression:       aws.String("DataType = :dataType"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":dataType":  {S: aws.String(tagDataType(job.From))},
+			":dataValue": {S: aws.String(tenantKey(tenantId, job.From))},
+		},
+		Limit:             aws.Int64(tagJobBatchSize),
+		ExclusiveStartKey: startKey,
+	})
+	if err != nil {
+		return err
+	}
+
+	identity := Identity{Subject: job.CreatedBy, TenantID: tenantId}
+	for _, i := range result.Items {
+		taskId, ok := stripTenant(tenantId, stringAttr(i, "id"))
+		if !ok {
+			continue
+		}
+		retagged, err := retagTask(identity, taskId, job.From, job.To)
+		if isConditionFailed(err) {
+			job.Failed++
+			job.FailedTasks = append(job.FailedTasks, taskId)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("task %s: %w", taskId, err)
+		}
+		if retagged {
+			job.Processed++
+		}
+	}
+
+	job.Cursor = nil
+	for k, v := range result.LastEvaluatedKey {
+		if job.Cursor == nil {
+			job.Cursor = map[string]string{}
+		}
+		job.Cursor[k] = aws.StringValue(v.S)
+	}
+	if job.Cursor != nil {
+		return nil
+	}
+
+	// すべて書き換えられた場合だけ、使われなくなった変更前のタグをカタログから削除する
+	job.Status = JobCompleted
+	if job.Failed == 0 {
+		_, err := Svc.DeleteItem(&dynamodb.DeleteItemInput{
+			TableName:           aws.String(tableName),
+			Key:                 tagKey(tenantId, job.From),
+			ConditionExpression: aws.String("attribute_not_exists(id) OR usageCount <= :zero"),
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":zero": {N: aws.String("0")},
+			},
+		})
+		if err != nil && !isConditionFailed(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// タスクのタグを付け替える。変更後のタグが既に付いている場合は変更前のタグを外すだけにする
+// 変更前のタグが既にない場合はfalseを返す
+func retagTask(identity Identity, taskId string, from string, to string) (bool, error) {
+	tenantId := identity.TenantID
+	_, hasFrom, err := taskFieldValue(tenantId, taskId, tagDataType(from))
+	if err != nil || !hasFrom {
+		return false, err
+	}
+	_, hasTo, err := taskFieldValue(tenantId, taskId, tagDataType(to))
+	if err != nil {
+		return false, err
+	}
+
+	transactItems := []*dynamodb.TransactWriteItem{tagWrite(tenantId, taskId, from, "")}
+	change := fieldChange{"Tags", from, ""}
+	if !hasTo {
+		transactItems = append(transactItems, tagWrite(tenantId, taskId, "", to))
+		change.NewValue = to
+	}
+	return true, writeTaskMutation(identity, taskId, transactItems, change)
+}
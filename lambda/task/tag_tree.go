@@ -0,0 +1,161 @@
+package task
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// タグは"/"で区切って階層にできる（例: area/backend/db）
+const tagSeparator = "/"
+
+// 空の階層を含むタグ名（"/a"、"a//b"、"a/"）は使えない
+func validTagPath(name string) bool {
+	for _, segment := range strings.Split(name, tagSeparator) {
+		if segment == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// タグ自身と上位の階層のタグを上から順に返す。area/backend/db なら area, area/backend, area/backend/db
+func tagAncestors(name string) []string {
+	segments := strings.Split(name, tagSeparator)
+	paths := make([]string, len(segments))
+	for i := range segments {
+		paths[i] = strings.Join(segments[:i+1], tagSeparator)
+	}
+	return paths
+}
+
+// タグ自身と下位の階層のタグのいずれかが付いたタスクのIDをID順に返す
+// 下位のタグはカタログをGSI1の前方一致で探す
+func taskIdsByTag(tenantId string, tag string) ([]string, error) {
+	tags := []string{tag}
+	descendants, err := listTags(tenantId, tag+tagSeparator)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range descendants {
+		tags = append(tags, t.Name)
+	}
+
+	ids := []string{}
+	for _, t := range tags {
+		matched, err := taskIdsByDataValue(tenantId, tagDataType(t), t)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, matched...)
+	}
+	ids = uniqueStrings(ids)
+	sort.Strings(ids)
+	return ids, nil
+}
+
+func getTasksByTag(tenantId string, tag string) (map[string]*Task, error) {
+	ids, err := taskIdsByTag(tenantId, tag)
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return map[string]*Task{}, nil
+	}
+
+	return GetTasksByTaskIds(tenantId, ids)
+}
+
+// タグの階層の1ノード。Countはこのタグ自身が付いたタスク数、Totalは下位のタグを含めた合計
+// カタログにない途中の階層はCountが0のノードになる
+type TagNode struct {
+	Name     string     `json:"name"`
+	Path     string     `json:"path"`
+	Color    string     `json:"color,omitempty"`
+	Count    int64      `json:"count"`
+	Total    int64      `json:"total"`
+	Children []*TagNode `json:"children,omitempty"`
+}
+
+// カタログのタグを階層にして返す。prefixを指定した場合はそのタグ以下だけを返す
+func GetTagTree(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	tenantId := TenantFromRequest(request)
+	if tenantId == "" {
+		return missingTenantResponse(), nil
+	}
+	prefix := strings.Trim(request.QueryStringParameters["prefix"], tagSeparator)
+
+	tags, err := listTags(tenantId, prefix)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Query failed: %v", err),
+		}, nil
+	}
+
+	response, err := json.Marshal(buildTagTree(tags, prefix))
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to marshal response: %v", err),
+		}, nil
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: http.StatusOK,
+		Body:       string(response),
+	}, nil
+}
+
+// 名前順のタグから階層を組み立てる。前方一致で拾った prefix 以外の階層のタグ（area に対する area2）は除く
+func buildTagTree(tags []Tag, prefix string) []*TagNode {
+	roots := []*TagNode{}
+	nodes := map[string]*TagNode{}
+	node := func(path string) *TagNode {
+		if n, ok := nodes[path]; ok {
+			return n
+		}
+		i := strings.LastIndex(path, tagSeparator)
+		n := &TagNode{Name: path[i+1:], Path: path}
+		nodes[path] = n
+		if i >= 0 && path != prefix {
+			parent := nodes[path[:i]]
+			parent.Children = append(parent.Children, n)
+		} else {
+			roots = append(roots, n)
+		}
+		return n
+	}
+
+	for _, tag := range tags {
+		if prefix != "" && tag.Name != prefix && !strings.HasPrefix(tag.Name, prefix+tagSeparator) {
+			continue
+		}
+		if !validTagPath(tag.Name) {
+			continue
+		}
+		ancestors := tagAncestors(tag.Name)
+		if prefix != "" {
+			ancestors = ancestors[len(tagAncestors(prefix))-1:]
+		}
+		for _, path := range ancestors {
+			node(path).Total += tag.Count
+		}
+		n := node(tag.Name)
+		n.Count, n.Color = tag.Count, tag.Color
+	}
+	sortTagNodes(roots)
+	return roots
+}
+
+// 区切り文字より前に並ぶ文字（"-"など）があるため、タグ名の順ではなく階層ごとに名前で並べ直す
+func sortTagNodes(nodes []*TagNode) {
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Name < nodes[j].Name })
+	for _, n := range nodes {
+		sortTagNodes(n.Children)
+	}
+}
@@ -0,0 +1,575 @@
+package task
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+// テンプレートの文字列に書ける"{{version}}"のような置き換え
+var templatePlaceholder = regexp.MustCompile(`\{\{\s*([A-Za-z0-9_.-]+)\s*\}\}`)
+
+var errMissingValues = errors.New("missing values for placeholders")
+
+// テンプレートから作成するタスク1件分。Subtasksはサブタスクとして作成する
+type TemplateTask struct {
+	Title        string                 `json:"title"`
+	Description  string                 `json:"description,omitempty"`
+	Status       string                 `json:"status,omitempty"`
+	Tags         []string               `json:"tags,omitempty"`
+	CustomFields map[string]interface{} `json:"customFields,omitempty"`
+	Subtasks     []TemplateTask         `json:"subtasks,omitempty"`
+}
+
+// タスクテンプレート。Projectは作成先を指定しなかった場合に使う
+type Template struct {
+	ID      string       `json:"id" dynamodbav:"templateId"`
+	Name    string       `json:"name"`
+	Project string       `json:"project,omitempty"`
+	Task    TemplateTask `json:"task"`
+	// テンプレートで使われている置き換えの名前。保存時に集める
+	Placeholders []string `json:"placeholders,omitempty"`
+	CreatedBy    string   `json:"createdBy"`
+	CreatedAt    int64    `json:"createdAt"`
+	UpdatedAt    int64    `json:"updatedAt,omitempty"`
+}
+
+// テンプレートはテナントごとに"{テナントID}#Templates"のパーティションに"Template#{ID}"で置く
+func templateKey(tenantId string, templateId string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"id":       {S: aws.String(tenantKey(tenantId, "Templates"))},
+		"DataType": {S: aws.String("Template#" + templateId)},
+	}
+}
+
+// テンプレートがなければnilを返す
+func loadTemplate(tenantId string, templateId string) (*Template, error) {
+	result, err := Svc.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(tableName),
+		Key:       templateKey(tenantId, templateId),
+	})
+	if err != nil || len(result.Item) == 0 {
+		return nil, err
+	}
+	template := Template{}
+	if err := dynamodbattribute.UnmarshalMap(result.Item, &template); err != nil {
+		return nil, err
+	}
+	return &template, nil
+}
+
+// テンプレートの既定の作成先。作成先を指定しない作成の権限の確認に使う
+func TemplateProject(tenantId string, templateId string) (string, error) {
+	template, err := loadTemplate(tenantId, templateId)
+	if err != nil || template == nil {
+		return "", err
+	}
+	return template.Project, nil
+}
+
+func (t TemplateTask) validate(depth int) error {
+	if depth > maxTaskDepth {
+		return fmt.Errorf("subtasks must not be nested more than %d levels", maxTaskDepth)
+	}
+	if strings.TrimSpace(t.Title) == "" {
+		return errors.New("every task in the template must have a title")
+	}
+	for _, s := range t.Subtasks {
+		if err := s.validate(depth + 1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// タイトル・説明・ステータス・タグ・カスタムフィールドの文字列に書かれた置き換えの名前を集める
+func (t TemplateTask) placeholders(names map[string]bool) {
+	add := func(s string) {
+		for _, m := range templatePlaceholder.FindAllStringSubmatch(s, -1) {
+			names[m[1]] = true
+		}
+	}
+	add(t.Title)
+	add(t.Description)
+	add(t.Status)
+	for _, tag := range t.Tags {
+		add(tag)
+	}
+	for _, value := range t.CustomFields {
+		switch v := value.(type) {
+		case string:
+			add(v)
+		case []interface{}:
+			for _, e := range v {
+				if s, ok := e.(string); ok {
+					add(s)
+				}
+			}
+		}
+	}
+	for _, s := range t.Subtasks {
+		s.placeholders(names)
+	}
+}
+
+func (t Template) placeholderNames() []string {
+	names := map[string]bool{}
+	t.Task.placeholders(names)
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
+
+func fillPlaceholders(s string, values map[string]string) string {
+	return templatePlaceholder.ReplaceAllStringFunc(s, func(m string) string {
+		return values[templatePlaceholder.FindStringSubmatch(m)[1]]
+	})
+}
+
+// 置き換えた値でタスクを組み立て、親から順に返す。IDは新しく振る
+func (t TemplateTask) build(project string, parent string, values map[string]string) []Task {
+	task := Task{
+		ID:          newId(),
+		Title:       fillPlaceholders(t.Title, values),
+		Description: fillPlaceholders(t.Description, values),
+		Status:      fillPlaceholders(t.Status, values),
+		Project:     project,
+		Parent:      parent,
+	}
+	for _, tag := range t.Tags {
+		task.Tags = append(task.Tags, fillPlaceholders(tag, values))
+	}
+	if len(t.CustomFields) > 0 {
+		task.CustomFields = map[string]interface{}{}
+		for name, value := range t.CustomFields {
+			switch v := value.(type) {
+			case string:
+				value = fillPlaceholders(v, values)
+			case []interface{}:
+				filled := make([]interface{}, len(v))
+				for i, e := range v {
+					if s, ok := e.(string); ok {
+						e = fillPlaceholders(s, values)
+					}
+					filled[i] = e
+				}
+				value = filled
+			}
+			task.CustomFields[name] = value
+		}
+	}
+
+	tasks := []Task{task}
+	for _, s := range t.Subtasks {
+		tasks = append(tasks, s.build(project, task.ID, values)...)
+	}
+	return tasks
+}
+
+// 組み立てたタスクを検証する。置き換えた結果の空のタグや不正なタグ名は使えない
+func validateBuiltTasks(tasks []Task, definitions []FieldDefinition) error {
+	for i := range tasks {
+		tags := []string{}
+		for _, tag := range tasks[i].Tags {
+			if tag == "" {
+				continue
+			}
+			if !validTagPath(tag) {
+				return fmt.Errorf("%w: tag %q must not have empty segments", errInvalidField, tag)
+			}
+			tags = append(tags, tag)
+		}
+		tasks[i].Tags = uniqueStrings(tags)
+		if len(tasks[i].Tags) == 0 {
+			tasks[i].Tags = nil
+		}
+		if err := applyFieldDefinitions(definitions, &tasks[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func CreateTemplate(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	identity := IdentityFromRequest(request)
+	if identity.TenantID == "" {
+		return missingTenantResponse(), nil
+	}
+	template := Template{}
+	if err := json.Unmarshal([]byte(request.Body), &template); err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       fmt.Sprintf("Failed to unmarshal template from JSON: %v", err),
+		}, nil
+	}
+	template.ID = newId()
+	template.CreatedBy = identity.Subject
+	template.CreatedAt = now().Unix()
+	template.UpdatedAt = 0
+
+	return saveTemplate(identity.db(), identity.TenantID, template, "attribute_not_exists(id)", http.StatusCreated)
+}
+
+// テンプレートを置き換える。作成者と作成日時は元のものを残す
+func UpdateTemplate(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	tenantId := TenantFromRequest(request)
+	if tenantId == "" {
+		return missingTenantResponse(), nil
+	}
+	template := Template{}
+	if err := json.Unmarshal([]byte(request.Body), &template); err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       fmt.Sprintf("Failed to unmarshal template from JSON: %v", err),
+		}, nil
+	}
+	stored, err := loadTemplate(tenantId, request.QueryStringParameters["id"])
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to retrieve template: %v", err),
+		}, nil
+	}
+	if stored == nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusNotFound,
+			Body:       "Template not found",
+		}, nil
+	}
+	template.ID, template.CreatedBy, template.CreatedAt = stored.ID, stored.CreatedBy, stored.CreatedAt
+	template.UpdatedAt = now().Unix()
+
+	return saveTemplate(clientFor(request), tenantId, template, "attribute_exists(id)", http.StatusOK)
+}
+
+func saveTemplate(svc dynamodbiface.DynamoDBAPI, tenantId string, template Template, condition string, statusCode int) (events.APIGatewayProxyResponse, error) {
+	if template.Name == "" {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       "Missing name in the template",
+		}, nil
+	}
+	if err := template.Task.validate(1); err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       fmt.Sprintf("Invalid template: %v", err),
+		}, nil
+	}
+	template.Placeholders = template.placeholderNames()
+
+	item, err := dynamodbattribute.MarshalMap(template)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to marshal template: %v", err),
+		}, nil
+	}
+	for k, v := range templateKey(tenantId, template.ID) {
+		item[k] = v
+	}
+	_, err = svc.PutItem(&dynamodb.PutItemInput{
+		TableName:           aws.String(tableName),
+		Item:                item,
+		ConditionExpression: aws.String(condition),
+	})
+	if err != nil {
+		if isConditionFailed(err) {
+			return events.APIGatewayProxyResponse{
+				StatusCode: http.StatusNotFound,
+				Body:       "Template not found",
+			}, nil
+		}
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to save template: %v", err),
+		}, nil
+	}
+	return templateResponse(statusCode, template)
+}
+
+func GetTemplates(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	tenantId := TenantFromRequest(request)
+	if tenantId == "" {
+		return missingTenantResponse(), nil
+	}
+
+	templates := []Template{}
+	var startKey map[string]*dynamodb.AttributeValue
+	for {
+		result, err := Svc.Query(&dynamodb.QueryInput{
+			TableName:              aws.String(tableName),
+			KeyConditionExpression: aws.String("id = :id AND begins_with(DataType, :prefix)"),
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":id":     {S: aws.String(tenantKey(tenantId, "Templates"))},
+				":prefix": {S: aws.String("Template#")},
+			},
+			ExclusiveStartKey: startKey,
+		})
+		if err != nil {
+			return events.APIGatewayProxyResponse{
+				StatusCode: http.StatusInternalServerError,
+				Body:       fmt.Sprintf("Query failed: %v", err),
+			}, nil
+		}
+		for _, i := range result.Items {
+			template := Template{}
+			if err := dynamodbattribute.UnmarshalMap(i, &template); err != nil {
+				return events.APIGatewayProxyResponse{
+					StatusCode: http.StatusInternalServerError,
+					Body:       fmt.Sprintf("Failed to unmarshal template: %v", err),
+				}, nil
+			}
+			templates = append(templates, template)
+		}
+		if len(result.LastEvaluatedKey) == 0 {
+			break
+		}
+		startKey = result.LastEvaluatedKey
+	}
+	sort.Slice(templates, func(i, j int) bool { return templates[i].Name < templates[j].Name })
+	return templateResponse(http.StatusOK, templates)
+}
+
+func GetTemplate(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	tenantId := TenantFromRequest(request)
+	if tenantId == "" {
+		return missingTenantResponse(), nil
+	}
+
+	template, err := loadTemplate(tenantId, request.QueryStringParameters["id"])
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to retrieve template: %v", err),
+		}, nil
+	}
+	if template == nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusNotFound,
+			Body:       "Template not found",
+		}, nil
+	}
+	return templateResponse(http.StatusOK, template)
+}
+
+// テンプレートを削除する。作成済みのタスクは残る
+func DeleteTemplate(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	tenantId := TenantFromRequest(request)
+	if tenantId == "" {
+		return missingTenantResponse(), nil
+	}
+
+	_, err := clientFor(request).DeleteItem(&dynamodb.DeleteItemInput{
+		TableName:           aws.String(tableName),
+		Key:                 templateKey(tenantId, request.QueryStringParameters["id"]),
+		ConditionExpression: aws.String("attribute_exists(id)"),
+	})
+	if err != nil {
+		if isConditionFailed(err) {
+			return events.APIGatewayProxyResponse{
+				StatusCode: http.StatusNotFound,
+				Body:       "Template not found",
+			}, nil
+		}
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to delete template: %v", err),
+		}, nil
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: http.StatusOK,
+		Body:       "Template deleted successfully",
+	}, nil
+}
+
+// テンプレートの作成先と置き換えの値。Parentを指定すると最上位のタスクをそのタスクのサブタスクにする
+type templateInstantiation struct {
+	Project string            `json:"project"`
+	Parent  string            `json:"parent"`
+	Values  map[string]string `json:"values"`
+}
+
+// テンプレートのタスクとサブタスクを1つのトランザクションで作成し、作成したタスクのIDを親から順に返す
+func InstantiateTemplate(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	identity := IdentityFromRequest(request)
+	tenantId := identity.TenantID
+	if tenantId == "" {
+		return missingTenantResponse(), nil
+	}
+	body := templateInstantiation{}
+	if request.Body != "" {
+		if err := json.Unmarshal([]byte(request.Body), &body); err != nil {
+			return events.APIGatewayProxyResponse{
+				StatusCode: http.StatusBadRequest,
+				Body:       fmt.Sprintf("Failed to unmarshal request from JSON: %v", err),
+			}, nil
+		}
+	}
+
+	template, err := loadTemplate(tenantId, request.QueryStringParameters["id"])
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to retrieve template: %v", err),
+		}, nil
+	}
+	if template == nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusNotFound,
+			Body:       "Template not found",
+		}, nil
+	}
+	project := body.Project
+	if project == "" {
+		project = template.Project
+	}
+	if project == "" {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       "Missing project to create the tasks in",
+		}, nil
+	}
+
+	missing := []string{}
+	for _, name := range template.placeholderNames() {
+		if _, ok := body.Values[name]; !ok {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       fmt.Sprintf("%v: %s", errMissingValues, strings.Join(missing, ", ")),
+		}, nil
+	}
+
+	tasks := template.Task.build(project, body.Parent, body.Values)
+	definitions, err := fieldDefinitions(tenantId, project)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to get fields of project: %v", err),
+		}, nil
+	}
+	if err := validateBuiltTasks(tasks, definitions); err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       err.Error(),
+		}, nil
+	}
+
+	err = writeTemplateTasks(identity, tasks)
+	if err != nil {
+		if err == errTooManyItems {
+			return events.APIGatewayProxyResponse{
+				StatusCode: http.StatusBadRequest,
+				Body:       "Too many tasks or values in the template to create in one transaction",
+			}, nil
+		}
+		if response, ok := tagErrorResponse(err); ok {
+			return response, nil
+		}
+		if isConditionFailed(err) {
+			return events.APIGatewayProxyResponse{
+				StatusCode: http.StatusNotFound,
+				Body:       "Project not found or archived, or parent task not found in the project",
+			}, nil
+		}
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to create tasks from template: %v", err),
+		}, nil
+	}
+
+	ids := make([]string, len(tasks))
+	for i, t := range tasks {
+		ids[i] = t.ID
+	}
+	response, err := json.Marshal(map[string]interface{}{"id": ids[0], "taskIds": ids})
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to marshal response: %v", err),
+		}, nil
+	}
+	return events.APIGatewayProxyResponse{
+		StatusCode: http.StatusCreated,
+		Body:       string(response),
+	}, nil
+}
+
+// 親から順に並んだタスクを作成する。サブタスクはテンプレートの順に親の末尾へ追加する
+// 同じタグを複数のタスクに付けるため、タグの使用数は全てのタスクの分をまとめて1つの更新にする
+func writeTemplateTasks(identity Identity, tasks []Task) error {
+	tenantId := identity.TenantID
+	timestamp := now()
+	transactItems := []*dynamodb.TransactWriteItem{projectActiveCheck(tenantId, tasks[0].Project)}
+	if tasks[0].Parent != "" {
+		transactItems = append(transactItems, taskInProjectCheck(tenantId, tasks[0].Parent, tasks[0].Project))
+	}
+
+	changes := []fieldChange{}
+	for i, task := range tasks {
+		items := []*dynamodb.TransactWriteItem{}
+		for _, item := range taskItems(tenantId, task) {
+			items = append(items, &dynamodb.TransactWriteItem{
+				Put: &dynamodb.Put{
+					TableName:           aws.String(tableName),
+					Item:                item,
+					ConditionExpression: aws.String("attribute_not_exists(id)"),
+				},
+			})
+		}
+		if task.Parent != "" {
+			items = append(items, subtaskLinkPut(tenantId, task.Parent, task.ID, timestamp.UnixNano()+int64(i)))
+		}
+		created := taskChanges(Task{}, task)
+		items, err := taskRecordItems(identity, task.ID, timestamp, items, created)
+		if err != nil {
+			return err
+		}
+		transactItems = append(transactItems, items...)
+		changes = append(changes, created...)
+	}
+
+	tagCounts, err := tagCountUpdates(tenantId, changes)
+	if err != nil {
+		return err
+	}
+	if len(transactItems)+len(tagCounts) > maxTransactItems {
+		return errTooManyItems
+	}
+	_, err = identity.db().TransactWriteItems(&dynamodb.TransactWriteItemsInput{
+		TransactItems: append(transactItems, tagCounts...),
+	})
+	return err
+}
+
+func templateResponse(statusCode int, body interface{}) (events.APIGatewayProxyResponse, error) {
+	response, err := json.Marshal(body)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to marshal response: %v", err),
+		}, nil
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: statusCode,
+		Body:       string(response),
+	}, nil
+}
@@ -0,0 +1,96 @@
+package task
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+type Identity struct {
+	Subject  string   `json:"subject"`
+	TenantID string   `json:"tenantId"`
+	Roles    []string `json:"roles,omitempty"`
+	// リクエストの書き込みに使うクライアント。nilであればSvcを使う
+	client dynamodbiface.DynamoDBAPI
+}
+
+// オーソライザーコンテキストでリクエストの書き込みに使うクライアントを渡すキー
+// API Gatewayから届くコンテキストにはGoの値が入らないため、呼び出し元が設定することはできない
+const clientAuthorizerKey = "dynamodbClient"
+
+// 認証ミドルウェアがオーソライザーコンテキストに書き込んだ呼び出し元を取得する
+func IdentityFromRequest(request events.APIGatewayProxyRequest) Identity {
+	identity := Identity{TenantID: TenantFromRequest(request)}
+	identity.Subject, _ = request.RequestContext.Authorizer["principalId"].(string)
+	if roles, _ := request.RequestContext.Authorizer["roles"].(string); roles != "" {
+		identity.Roles = strings.Split(roles, ",")
+	}
+	identity.client, _ = request.RequestContext.Authorizer[clientAuthorizerKey].(dynamodbiface.DynamoDBAPI)
+	return identity
+}
+
+// リクエストの書き込みを指定したクライアントで行わせる。アトミックなバッチで書き込みをためるのに使う
+func WithClient(request events.APIGatewayProxyRequest, client dynamodbiface.DynamoDBAPI) events.APIGatewayProxyRequest {
+	authorizer := make(map[string]interface{}, len(request.RequestContext.Authorizer)+1)
+	for k, v := range request.RequestContext.Authorizer {
+		authorizer[k] = v
+	}
+	authorizer[clientAuthorizerKey] = client
+	request.RequestContext.Authorizer = authorizer
+	return request
+}
+
+// 書き込みに使うクライアント
+func (i Identity) db() dynamodbiface.DynamoDBAPI {
+	if i.client != nil {
+		return i.client
+	}
+	return Svc
+}
+
+// リクエストの書き込みに使うクライアント
+func clientFor(request events.APIGatewayProxyRequest) dynamodbiface.DynamoDBAPI {
+	return IdentityFromRequest(request).db()
+}
+
+// テナント全体に付与されたロールを持つか
+func (i Identity) HasRole(role string) bool {
+	for _, r := range i.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// テナントIDは認証済みリクエストのオーソライザーコンテキストから取得する
+func TenantFromRequest(request events.APIGatewayProxyRequest) string {
+	tenantId, _ := request.RequestContext.Authorizer["tenantId"].(string)
+	if strings.Contains(tenantId, "#") {
+		return ""
+	}
+	return tenantId
+}
+
+// パーティションキーとGSI1のキーには必ずテナントIDを前置する
+func tenantKey(tenantId string, value string) string {
+	return tenantId + "#" + value
+}
+
+// 他テナントのキーであればfalseを返す
+func stripTenant(tenantId string, key string) (string, bool) {
+	prefix := tenantId + "#"
+	if tenantId == "" || !strings.HasPrefix(key, prefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(key, prefix), true
+}
+
+func missingTenantResponse() events.APIGatewayProxyResponse {
+	return events.APIGatewayProxyResponse{
+		StatusCode: http.StatusForbidden,
+		Body:       "Missing tenant in the request",
+	}
+}
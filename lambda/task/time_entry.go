@@ -0,0 +1,604 @@
+package task
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+const (
+	timeEntryPrefix = "Time#"
+
+	// レポートで一度に集計できる期間
+	maxReportDays = 366
+)
+
+// タスクの作業時間の記録。日時はUNIX時間（秒）、Durationは秒
+// タイマーで計測中の記録はEndとDurationが0
+type TimeEntry struct {
+	ID       string `json:"id" dynamodbav:"entryId"`
+	TaskID   string `json:"taskId"`
+	User     string `json:"user" dynamodbav:"userId"`
+	Start    int64  `json:"start"`
+	End      int64  `json:"end,omitempty"`
+	Duration int64  `json:"duration"`
+	Note     string `json:"note,omitempty"`
+}
+
+// 記録はタスクのパーティションに"Time#{ID}"で置く。IDは開始日時から始まり、開始順に並ぶ
+func timeEntryKey(tenantId string, taskId string, entryId string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"id":       {S: aws.String(tenantKey(tenantId, taskId))},
+		"DataType": {S: aws.String(timeEntryPrefix + entryId)},
+	}
+}
+
+func newTimeEntryId(start int64) string {
+	return fmt.Sprintf("%020d-%s", start, newId()[:12])
+}
+
+// 終了した記録はGSI1のDataValue="{TenantId}#Time#{YYYY-MM}"で開始月ごとに検索できるようにする
+func timeBucket(start int64) string {
+	return "Time#" + time.Unix(start, 0).UTC().Format("2006-01")
+}
+
+func timeEntryItem(tenantId string, entry TimeEntry) (map[string]*dynamodb.AttributeValue, error) {
+	item, err := dynamodbattribute.MarshalMap(entry)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range timeEntryKey(tenantId, entry.TaskID, entry.ID) {
+		item[k] = v
+	}
+	if entry.End > 0 {
+		item["DataValue"] = &dynamodb.AttributeValue{S: aws.String(tenantKey(tenantId, timeBucket(entry.Start)))}
+	}
+	return item, nil
+}
+
+// 実行中のタイマーはユーザーごとに"{テナントID}#Timers"のパーティションに1つだけ置く
+type runningTimer struct {
+	TaskID  string `json:"taskId"`
+	EntryID string `json:"entryId"`
+	Start   int64  `json:"start"`
+}
+
+func timerKey(tenantId string, user string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"id":       {S: aws.String(tenantKey(tenantId, "Timers"))},
+		"DataType": {S: aws.String("Timer#" + user)},
+	}
+}
+
+// タイマーが実行中でなければnilを返す
+func loadTimer(tenantId string, user string) (*runningTimer, error) {
+	result, err := Svc.GetItem(&dynamodb.GetItemInput{
+		TableName:      aws.String(tableName),
+		Key:            timerKey(tenantId, user),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil || len(result.Item) == 0 {
+		return nil, err
+	}
+	timer := runningTimer{}
+	if err := dynamodbattribute.UnmarshalMap(result.Item, &timer); err != nil {
+		return nil, err
+	}
+	return &timer, nil
+}
+
+// 実行中のタイマーのタスクのプロジェクト。タイマーを止める権限の確認に使う
+func RunningTimerProject(tenantId string, user string) (string, error) {
+	timer, err := loadTimer(tenantId, user)
+	if err != nil || timer == nil {
+		return "", err
+	}
+	return ProjectOfTask(tenantId, timer.TaskID)
+}
+
+// 作業時間を手動で記録する。開始日時と、終了日時または時間を指定する
+func CreateTimeEntry(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	identity := IdentityFromRequest(request)
+	tenantId := identity.TenantID
+	if tenantId == "" {
+		return missingTenantResponse(), nil
+	}
+	entry := TimeEntry{}
+	if err := json.Unmarshal([]byte(request.Body), &entry); err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       fmt.Sprintf("Failed to unmarshal time entry from JSON: %v", err),
+		}, nil
+	}
+	switch {
+	case entry.End == 0 && entry.Duration > 0:
+		entry.End = entry.Start + entry.Duration
+	case entry.Duration == 0 && entry.End > entry.Start:
+		entry.Duration = entry.End - entry.Start
+	}
+	if entry.Start <= 0 || entry.Duration <= 0 || entry.End-entry.Start != entry.Duration {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       "Time entry must have a start and either an end after it or a positive duration",
+		}, nil
+	}
+	entry.ID = newTimeEntryId(entry.Start)
+	entry.TaskID = request.QueryStringParameters["id"]
+	entry.User = identity.Subject
+
+	item, err := timeEntryItem(tenantId, entry)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to marshal time entry: %v", err),
+		}, nil
+	}
+	_, err = identity.db().TransactWriteItems(&dynamodb.TransactWriteItemsInput{
+		TransactItems: []*dynamodb.TransactWriteItem{
+			taskExistsCheck(tenantId, entry.TaskID),
+			{Put: &dynamodb.Put{TableName: aws.String(tableName), Item: item}},
+		},
+	})
+	if err != nil {
+		if isConditionFailed(err) {
+			return events.APIGatewayProxyResponse{
+				StatusCode: http.StatusNotFound,
+				Body:       "Task not found",
+			}, nil
+		}
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to create time entry: %v", err),
+		}, nil
+	}
+	return timeResponse(http.StatusCreated, entry)
+}
+
+// タスクの作業時間の記録を開始順に返す。計測中の記録も含む
+func GetTimeEntries(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	tenantId := TenantFromRequest(request)
+	if tenantId == "" {
+		return missingTenantResponse(), nil
+	}
+
+	entries := []TimeEntry{}
+	var startKey map[string]*dynamodb.AttributeValue
+	for {
+		result, err := Svc.Query(&dynamodb.QueryInput{
+			TableName:              aws.String(tableName),
+			KeyConditionExpression: aws.String("id = :id AND begins_with(DataType, :prefix)"),
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":id":     {S: aws.String(tenantKey(tenantId, request.QueryStringParameters["id"]))},
+				":prefix": {S: aws.String(timeEntryPrefix)},
+			},
+			ExclusiveStartKey: startKey,
+		})
+		if err != nil {
+			return events.APIGatewayProxyResponse{
+				StatusCode: http.StatusInternalServerError,
+				Body:       fmt.Sprintf("Query failed: %v", err),
+			}, nil
+		}
+		for _, i := range result.Items {
+			entry := TimeEntry{}
+			if err := dynamodbattribute.UnmarshalMap(i, &entry); err != nil {
+				return events.APIGatewayProxyResponse{
+					StatusCode: http.StatusInternalServerError,
+					Body:       fmt.Sprintf("Failed to unmarshal time entry: %v", err),
+				}, nil
+			}
+			entries = append(entries, entry)
+		}
+		if len(result.LastEvaluatedKey) == 0 {
+			break
+		}
+		startKey = result.LastEvaluatedKey
+	}
+	return timeResponse(http.StatusOK, entries)
+}
+
+// 自分の終了した記録だけを削除できる。計測中の記録はタイマーを止めてから削除する
+func DeleteTimeEntry(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	identity := IdentityFromRequest(request)
+	tenantId := identity.TenantID
+	if tenantId == "" {
+		return missingTenantResponse(), nil
+	}
+	query := request.QueryStringParameters
+
+	_, err := identity.db().DeleteItem(&dynamodb.DeleteItemInput{
+		TableName:           aws.String(tableName),
+		Key:                 timeEntryKey(tenantId, query["id"], query["entryId"]),
+		ConditionExpression: aws.String("userId = :user AND attribute_exists(#end)"),
+		ExpressionAttributeNames: map[string]*string{
+			"#end": aws.String("end"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":user": {S: aws.String(identity.Subject)},
+		},
+	})
+	if err != nil {
+		if isConditionFailed(err) {
+			return events.APIGatewayProxyResponse{
+				StatusCode: http.StatusNotFound,
+				Body:       "Time entry not found, still running or recorded by another user",
+			}, nil
+		}
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to delete time entry: %v", err),
+		}, nil
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: http.StatusOK,
+		Body:       "Time entry deleted successfully",
+	}, nil
+}
+
+// タスクのタイマーを開始する。ユーザーごとに実行できるタイマーは1つだけ
+func StartTimer(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	identity := IdentityFromRequest(request)
+	tenantId := identity.TenantID
+	if tenantId == "" {
+		return missingTenantResponse(), nil
+	}
+	body := struct {
+		Note string `json:"note"`
+	}{}
+	if request.Body != "" {
+		if err := json.Unmarshal([]byte(request.Body), &body); err != nil {
+			return events.APIGatewayProxyResponse{
+				StatusCode: http.StatusBadRequest,
+				Body:       fmt.Sprintf("Failed to unmarshal request from JSON: %v", err),
+			}, nil
+		}
+	}
+
+	start := now().Unix()
+	entry := TimeEntry{
+		ID:     newTimeEntryId(start),
+		TaskID: request.QueryStringParameters["id"],
+		User:   identity.Subject,
+		Start:  start,
+		Note:   body.Note,
+	}
+	item, err := timeEntryItem(tenantId, entry)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to marshal time entry: %v", err),
+		}, nil
+	}
+	timer, err := dynamodbattribute.MarshalMap(runningTimer{TaskID: entry.TaskID, EntryID: entry.ID, Start: start})
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to marshal timer: %v", err),
+		}, nil
+	}
+	for k, v := range timerKey(tenantId, identity.Subject) {
+		timer[k] = v
+	}
+
+	_, err = identity.db().TransactWriteItems(&dynamodb.TransactWriteItemsInput{
+		TransactItems: []*dynamodb.TransactWriteItem{
+			taskExistsCheck(tenantId, entry.TaskID),
+			{Put: &dynamodb.Put{
+				TableName:           aws.String(tableName),
+				Item:                timer,
+				ConditionExpression: aws.String("attribute_not_exists(id)"),
+			}},
+			{Put: &dynamodb.Put{TableName: aws.String(tableName), Item: item}},
+		},
+	})
+	if err != nil {
+		if conditionFailedAt(err, 1) {
+			return events.APIGatewayProxyResponse{
+				StatusCode: http.StatusConflict,
+				Body:       "Another timer is already running",
+			}, nil
+		}
+		if isConditionFailed(err) {
+			return events.APIGatewayProxyResponse{
+				StatusCode: http.StatusNotFound,
+				Body:       "Task not found",
+			}, nil
+		}
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to start timer: %v", err),
+		}, nil
+	}
+	return timeResponse(http.StatusCreated, entry)
+}
+
+// 実行中のタイマーを止め、計測した時間を記録する
+func StopTimer(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	identity := IdentityFromRequest(request)
+	tenantId := identity.TenantID
+	if tenantId == "" {
+		return missingTenantResponse(), nil
+	}
+
+	timer, err := loadTimer(tenantId, identity.Subject)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to retrieve timer: %v", err),
+		}, nil
+	}
+	if timer == nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusNotFound,
+			Body:       "No timer is running",
+		}, nil
+	}
+
+	end := now().Unix()
+	if end < timer.Start {
+		end = timer.Start
+	}
+	// 同じタイマーを続けて止めた場合は、後の書き込みが条件で失敗する
+	timerDelete := &dynamodb.Delete{
+		TableName:           aws.String(tableName),
+		Key:                 timerKey(tenantId, identity.Subject),
+		ConditionExpression: aws.String("entryId = :entry"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":entry": {S: aws.String(timer.EntryID)},
+		},
+	}
+	_, err = identity.db().TransactWriteItems(&dynamodb.TransactWriteItemsInput{
+		TransactItems: []*dynamodb.TransactWriteItem{
+			{Delete: timerDelete},
+			{Update: &dynamodb.Update{
+				TableName:           aws.String(tableName),
+				Key:                 timeEntryKey(tenantId, timer.TaskID, timer.EntryID),
+				ConditionExpression: aws.String("attribute_exists(id) AND attribute_not_exists(#end)"),
+				UpdateExpression:    aws.String("SET #end = :end, #duration = :duration, DataValue = :bucket"),
+				ExpressionAttributeNames: map[string]*string{
+					"#end":      aws.String("end"),
+					"#duration": aws.String("duration"),
+				},
+				ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+					":end":      {N: aws.String(strconv.FormatInt(end, 10))},
+					":duration": {N: aws.String(strconv.FormatInt(end-timer.Start, 10))},
+					":bucket":   {S: aws.String(tenantKey(tenantId, timeBucket(timer.Start)))},
+				},
+			}},
+		},
+	})
+	if err != nil {
+		if conditionFailedAt(err, 1) && !conditionFailedAt(err, 0) {
+			// 計測中にタスクが削除された場合は記録できないため、タイマーだけを止める
+			if _, err := identity.db().DeleteItem(&dynamodb.DeleteItemInput{
+				TableName:                 timerDelete.TableName,
+				Key:                       timerDelete.Key,
+				ConditionExpression:       timerDelete.ConditionExpression,
+				ExpressionAttributeValues: timerDelete.ExpressionAttributeValues,
+			}); err != nil && !isConditionFailed(err) {
+				return events.APIGatewayProxyResponse{
+					StatusCode: http.StatusInternalServerError,
+					Body:       fmt.Sprintf("Failed to stop timer: %v", err),
+				}, nil
+			}
+			return events.APIGatewayProxyResponse{
+				StatusCode: http.StatusNotFound,
+				Body:       "Task of the timer was deleted",
+			}, nil
+		}
+		if isConditionFailed(err) {
+			return events.APIGatewayProxyResponse{
+				StatusCode: http.StatusConflict,
+				Body:       "Timer was already stopped",
+			}, nil
+		}
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to stop timer: %v", err),
+		}, nil
+	}
+
+	return timeResponse(http.StatusOK, TimeEntry{
+		ID:       timer.EntryID,
+		TaskID:   timer.TaskID,
+		User:     identity.Subject,
+		Start:    timer.Start,
+		End:      end,
+		Duration: end - timer.Start,
+	})
+}
+
+// 自分の実行中のタイマーを返す
+func GetTimer(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	identity := IdentityFromRequest(request)
+	if identity.TenantID == "" {
+		return missingTenantResponse(), nil
+	}
+
+	timer, err := loadTimer(identity.TenantID, identity.Subject)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to retrieve timer: %v", err),
+		}, nil
+	}
+	if timer == nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusNotFound,
+			Body:       "No timer is running",
+		}, nil
+	}
+	return timeResponse(http.StatusOK, timer)
+}
+
+type TimeReportGroup struct {
+	Key      string `json:"key"`
+	Duration int64  `json:"duration"`
+	Entries  int    `json:"entries"`
+}
+
+type TimeReport struct {
+	From    string            `json:"from"`
+	To      string            `json:"to"`
+	GroupBy string            `json:"groupBy"`
+	Total   int64             `json:"total"`
+	Groups  []TimeReportGroup `json:"groups"`
+}
+
+// 期間内（fromとtoの日を含む、UTC）に開始した終了済みの記録の時間を、ユーザー・タグ・プロジェクトごとに合計する
+// タグごとの集計では複数のタグが付いたタスクの時間をそれぞれのタグに数え、タグのないタスクは空のキーにまとめる
+func GetTimeReport(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	tenantId := TenantFromRequest(request)
+	if tenantId == "" {
+		return missingTenantResponse(), nil
+	}
+	query := request.QueryStringParameters
+
+	groupBy := query["groupBy"]
+	if groupBy == "" {
+		groupBy = "user"
+	}
+	if groupBy != "user" && groupBy != "tag" && groupBy != "project" {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       "groupBy must be user, tag or project",
+		}, nil
+	}
+	from, fromErr := time.Parse(dateLayout, query["from"])
+	to, toErr := time.Parse(dateLayout, query["to"])
+	if fromErr != nil || toErr != nil || to.Before(from) || to.Sub(from) >= maxReportDays*24*time.Hour {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       fmt.Sprintf("from and to must be dates in YYYY-MM-DD format within %d days", maxReportDays),
+		}, nil
+	}
+
+	entries, err := timeEntriesBetween(tenantId, from, to.AddDate(0, 0, 1))
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Query failed: %v", err),
+		}, nil
+	}
+
+	project := query["project"]
+	tasks := map[string]*Task{}
+	if (groupBy != "user" || project != "") && len(entries) > 0 {
+		ids := []string{}
+		for _, e := range entries {
+			ids = append(ids, e.TaskID)
+		}
+		if tasks, err = GetTasksByTaskIds(tenantId, uniqueStrings(ids)); err != nil {
+			return events.APIGatewayProxyResponse{
+				StatusCode: http.StatusInternalServerError,
+				Body:       fmt.Sprintf("Failed to retrieve tasks: %v", err),
+			}, nil
+		}
+	}
+
+	report := TimeReport{From: query["from"], To: query["to"], GroupBy: groupBy, Groups: []TimeReportGroup{}}
+	groups := map[string]*TimeReportGroup{}
+	add := func(key string, e TimeEntry) {
+		if groups[key] == nil {
+			groups[key] = &TimeReportGroup{Key: key}
+		}
+		groups[key].Duration += e.Duration
+		groups[key].Entries++
+	}
+	for _, e := range entries {
+		task := tasks[e.TaskID]
+		if task == nil {
+			task = &Task{ID: e.TaskID}
+		}
+		if project != "" && task.Project != project {
+			continue
+		}
+		report.Total += e.Duration
+		switch groupBy {
+		case "user":
+			add(e.User, e)
+		case "project":
+			add(task.Project, e)
+		case "tag":
+			if len(task.Tags) == 0 {
+				add("", e)
+			}
+			for _, tag := range uniqueStrings(task.Tags) {
+				add(tag, e)
+			}
+		}
+	}
+	for _, g := range groups {
+		report.Groups = append(report.Groups, *g)
+	}
+	sort.Slice(report.Groups, func(i, j int) bool { return report.Groups[i].Key < report.Groups[j].Key })
+
+	return timeResponse(http.StatusOK, report)
+}
+
+// fromからuntilの前までに開始した終了済みの記録を、開始月ごとのGSI1で検索する
+func timeEntriesBetween(tenantId string, from time.Time, until time.Time) ([]TimeEntry, error) {
+	entries := []TimeEntry{}
+	for month := time.Date(from.Year(), from.Month(), 1, 0, 0, 0, 0, time.UTC); month.Before(until); month = month.AddDate(0, 1, 0) {
+		var startKey map[string]*dynamodb.AttributeValue
+		for {
+			result, err := Svc.Query(&dynamodb.QueryInput{
+				TableName:              aws.String(tableName),
+				IndexName:              aws.String("GSI1"),
+				KeyConditionExpression: aws.String("DataValue = :dataValue"),
+				FilterExpression:       aws.String("#start >= :from AND #start < :until"),
+				ExpressionAttributeNames: map[string]*string{
+					"#start": aws.String("start"),
+				},
+				ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+					":dataValue": {S: aws.String(tenantKey(tenantId, timeBucket(month.Unix())))},
+					":from":      {N: aws.String(strconv.FormatInt(from.Unix(), 10))},
+					":until":     {N: aws.String(strconv.FormatInt(until.Unix(), 10))},
+				},
+				ExclusiveStartKey: startKey,
+			})
+			if err != nil {
+				return nil, err
+			}
+			for _, i := range result.Items {
+				if _, ok := stripTenant(tenantId, stringAttr(i, "id")); !ok {
+					continue
+				}
+				entry := TimeEntry{}
+				if err := dynamodbattribute.UnmarshalMap(i, &entry); err != nil {
+					return nil, err
+				}
+				entries = append(entries, entry)
+			}
+			if len(result.LastEvaluatedKey) == 0 {
+				break
+			}
+			startKey = result.LastEvaluatedKey
+		}
+	}
+	return entries, nil
+}
+
+func timeResponse(statusCode int, body interface{}) (events.APIGatewayProxyResponse, error) {
+	response, err := json.Marshal(body)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to marshal response: %v", err),
+		}, nil
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: statusCode,
+		Body:       string(response),
+	}, nil
+}
@@ -3,6 +3,7 @@ package task
 import (
 	"fmt"
 	"net/http"
+	"strings"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-sdk-go/aws"
@@ -17,42 +18,57 @@ func UpdateTaskField(task *Task, dataType string, dataValue string) {
 		task.Description = dataValue
 	case "Status":
 		task.Status = dataValue
-	case "Tags":
-		if task.Tags == nil {
-			task.Tags = []string{}
+	case "Project":
+		task.Project = dataValue
+	case "Parent":
+		task.Parent = dataValue
+	case "Due":
+		task.Due = dataValue
+	case "Recurrence":
+		task.Recurrence = dataValue
+	default:
+		if strings.HasPrefix(dataType, "Tags") {
+			if task.Tags == nil {
+				task.Tags = []string{}
+			}
+			task.Tags = append(task.Tags, dataValue)
+		} else if strings.HasPrefix(dataType, customFieldPrefix) {
+			setCustomField(task, dataType, dataValue)
 		}
-		task.Tags = append(task.Tags, dataValue)
 	}
 }
 
+// タグはタスクごとに1タグ1アイテムで保持する
+func tagDataType(tag string) string {
+	return "Tags#" + tag
+}
+
 func UpdateTagOnTask(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	identity := IdentityFromRequest(request)
+	tenantId := identity.TenantID
+	if tenantId == "" {
+		return missingTenantResponse(), nil
+	}
 	taskId := request.QueryStringParameters["id"]
 	old_tag := request.QueryStringParameters["old_tag"]
 	new_tag := request.QueryStringParameters["new_tag"]
 
-	input := &dynamodb.UpdateItemInput{
-		TableName: aws.String(tableName),
-		Key: map[string]*dynamodb.AttributeValue{
-			"id": {
-				S: aws.String(taskId),
-			},
-			"DataType": {
-				S: aws.String("Tags"),
-			},
-		},
-		UpdateExpression: aws.String("DELETE dataValue :old_tag ADD dataValue :new_tag"),
-		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
-			":old_tag": {
-				SS: []*string{aws.String(old_tag)},
-			},
-			":new_tag": {
-				SS: []*string{aws.String(new_tag)},
-			},
-		},
+	transactItems := []*dynamodb.TransactWriteItem{
+		tagWrite(tenantId, taskId, old_tag, ""),
+		tagWrite(tenantId, taskId, "", new_tag),
 	}
 
-	_, err := Svc.UpdateItem(input)
+	err := writeTaskMutation(identity, taskId, transactItems, fieldChange{"Tags", old_tag, new_tag})
 	if err != nil {
+		if response, ok := tagErrorResponse(err); ok {
+			return response, nil
+		}
+		if isConditionFailed(err) {
+			return events.APIGatewayProxyResponse{
+				StatusCode: http.StatusConflict,
+				Body:       "Old tag is not on the task or new tag is already on it",
+			}, nil
+		}
 		return events.APIGatewayProxyResponse{
 			StatusCode: http.StatusInternalServerError,
 			Body:       fmt.Sprintf("Failed to update tag on task: %v", err),
@@ -66,29 +82,57 @@ func UpdateTagOnTask(request events.APIGatewayProxyRequest) (events.APIGatewayPr
 }
 
 func UpdateTaskAttribute(request events.APIGatewayProxyRequest, attributeKey string, attributeValue string) (events.APIGatewayProxyResponse, error) {
+	identity := IdentityFromRequest(request)
+	tenantId := identity.TenantID
+	if tenantId == "" {
+		return missingTenantResponse(), nil
+	}
 	taskId := request.QueryStringParameters["id"]
 	newValue := request.QueryStringParameters[attributeValue]
 
-	input := &dynamodb.UpdateItemInput{
-		TableName: aws.String(tableName),
-		Key: map[string]*dynamodb.AttributeValue{
-			"id": {
-				S: aws.String(taskId),
-			},
-			"DataType": {
-				S: aws.String(attributeKey),
-			},
-		},
-		UpdateExpression: aws.String("SET dataValue = :new_value"),
-		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
-			":new_value": {
-				S: aws.String(newValue),
-			},
-		},
+	if attributeKey == "Status" {
+		open, err := blockingSubtasks(tenantId, taskId, newValue)
+		if err != nil {
+			return events.APIGatewayProxyResponse{
+				StatusCode: http.StatusInternalServerError,
+				Body:       fmt.Sprintf("Failed to retrieve subtasks: %v", err),
+			}, nil
+		}
+		if open > 0 {
+			return events.APIGatewayProxyResponse{
+				StatusCode: http.StatusConflict,
+				Body:       fmt.Sprintf("Task has %d open subtasks", open),
+			}, nil
+		}
+	}
+
+	// 変更前の値を履歴に残すため、読み取った値から変わっていない場合のみ更新する
+	// 属性アイテムがなくても、タスクが存在すれば新しく追加する
+	oldValue, _, err := taskFieldValue(tenantId, taskId, attributeKey)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to get %s of task: %v", attributeKey, err),
+		}, nil
 	}
 
-	_, err := Svc.UpdateItem(input)
+	err = writeTaskMutation(identity, taskId, []*dynamodb.TransactWriteItem{
+		fieldWrite(tenantId, taskId, attributeKey, oldValue, newValue),
+		taskExistsCheck(tenantId, taskId),
+	}, fieldChange{attributeKey, oldValue, newValue})
 	if err != nil {
+		if conditionFailedAt(err, 1) {
+			return events.APIGatewayProxyResponse{
+				StatusCode: http.StatusNotFound,
+				Body:       "Task not found",
+			}, nil
+		}
+		if isConditionFailed(err) {
+			return events.APIGatewayProxyResponse{
+				StatusCode: http.StatusConflict,
+				Body:       fmt.Sprintf("%s was modified by another request", attributeKey),
+			}, nil
+		}
 		return events.APIGatewayProxyResponse{
 			StatusCode: http.StatusInternalServerError,
 			Body:       fmt.Sprintf("Failed to update %s on task: %v", attributeKey, err),
@@ -99,4 +143,50 @@ func UpdateTaskAttribute(request events.APIGatewayProxyRequest, attributeKey str
 		StatusCode: http.StatusOK,
 		Body:       fmt.Sprintf("%s updated on task successfully", attributeKey),
 	}, nil
-}
\ No newline at end of file
+}
+
+// 属性アイテムをoldValueからnewValueに書き換える。読み取った後に他のリクエストが更新していれば失敗する
+// 空の値はアイテムを持たないため、newValueが空であれば削除、oldValueが空であれば追加になる
+func fieldWrite(tenantId string, taskId string, dataType string, oldValue string, newValue string) *dynamodb.TransactWriteItem {
+	key := map[string]*dynamodb.AttributeValue{
+		"id":       {S: aws.String(tenantKey(tenantId, taskId))},
+		"DataType": {S: aws.String(dataType)},
+	}
+	if oldValue == "" {
+		return &dynamodb.TransactWriteItem{
+			Put: &dynamodb.Put{
+				TableName: aws.String(tableName),
+				Item: map[string]*dynamodb.AttributeValue{
+					"id":        key["id"],
+					"DataType":  key["DataType"],
+					"DataValue": {S: aws.String(tenantKey(tenantId, newValue))},
+				},
+				ConditionExpression: aws.String("attribute_not_exists(id)"),
+			},
+		}
+	}
+	if newValue == "" {
+		return &dynamodb.TransactWriteItem{
+			Delete: &dynamodb.Delete{
+				TableName:           aws.String(tableName),
+				Key:                 key,
+				ConditionExpression: aws.String("DataValue = :old_value"),
+				ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+					":old_value": {S: aws.String(tenantKey(tenantId, oldValue))},
+				},
+			},
+		}
+	}
+	return &dynamodb.TransactWriteItem{
+		Update: &dynamodb.Update{
+			TableName:           aws.String(tableName),
+			Key:                 key,
+			ConditionExpression: aws.String("attribute_exists(id) AND DataValue = :old_value"),
+			UpdateExpression:    aws.String("SET DataValue = :new_value"),
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":old_value": {S: aws.String(tenantKey(tenantId, oldValue))},
+				":new_value": {S: aws.String(tenantKey(tenantId, newValue))},
+			},
+		},
+	}
+}
@@ -0,0 +1,636 @@
+package task
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+)
+
+type Webhook struct {
+	ID           string   `json:"id" dynamodbav:"webhookId"`
+	URL          string   `json:"url"`
+	Events       []string `json:"events"`
+	Secret       string   `json:"-" dynamodbav:"secret"`
+	Disabled     bool     `json:"disabled"`
+	FailureCount int      `json:"failureCount"`
+	CreatedAt    int64    `json:"createdAt"`
+}
+
+type WebhookDelivery struct {
+	ID         string `json:"id" dynamodbav:"deliveryId"`
+	WebhookID  string `json:"webhookId"`
+	Event      string `json:"event"`
+	TaskID     string `json:"taskId"`
+	Success    bool   `json:"success"`
+	Attempts   int    `json:"attempts"`
+	StatusCode int    `json:"statusCode,omitempty"`
+	Error      string `json:"error,omitempty"`
+	Timestamp  int64  `json:"timestamp"`
+}
+
+type deliveryPage struct {
+	Deliveries []WebhookDelivery `json:"deliveries"`
+	NextCursor string            `json:"nextCursor,omitempty"`
+}
+
+var (
+	// 受信側が内部のアドレスを指していても送信しないよう、接続先のIPアドレスを確認する
+	// リダイレクト先は確認していないため、追わずに3xxの応答として扱う
+	WebhookClient = &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			DialContext:         (&net.Dialer{Timeout: 5 * time.Second, Control: publicAddressOnly}).DialContext,
+			TLSHandshakeTimeout: 5 * time.Second,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	// 1回目の再送までの待ち時間。再送ごとに倍にする
+	WebhookRetryDelay  = 30 * time.Second
+	WebhookMaxAttempts = 5
+	// 連続して配信に失敗するとWebhookを無効にする
+	WebhookFailureThreshold = 10
+)
+
+var errBlockedAddress = errors.New("webhook url resolves to a private, loopback or link-local address")
+
+// 名前解決した後の接続先で確認するため、DNSの応答が変わっても内部のアドレスには接続しない
+func publicAddressOnly(network string, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified() {
+		return fmt.Errorf("%w: %s", errBlockedAddress, host)
+	}
+	return nil
+}
+
+var webhookEvents = map[string]bool{"*": true, TaskCreated: true, TaskUpdated: true, TaskDeleted: true}
+
+// Webhookはテナントのパーティションにまとめ、配信ログはWebhookごとのパーティションに置く
+func webhookKey(tenantId string, webhookId string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"id":       {S: aws.String(tenantKey(tenantId, "Webhooks"))},
+		"DataType": {S: aws.String("Webhook#" + webhookId)},
+	}
+}
+
+func deliveryPartition(tenantId string, webhookId string) string {
+	return tenantKey(tenantId, "Webhook#"+webhookId)
+}
+
+func CreateWebhook(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	tenantId := TenantFromRequest(request)
+	if tenantId == "" {
+		return missingTenantResponse(), nil
+	}
+
+	body := struct {
+		URL    string   `json:"url"`
+		Events []string `json:"events"`
+		Secret string   `json:"secret"`
+	}{}
+	err := json.Unmarshal([]byte(request.Body), &body)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       fmt.Sprintf("Failed to unmarshal webhook from JSON: %v", err),
+		}, nil
+	}
+	if u, err := url.Parse(body.URL); err != nil || u.Scheme != "https" || u.Host == "" {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       "Webhook url must be an absolute https URL",
+		}, nil
+	}
+	if len(body.Events) == 0 {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       "Missing events in the webhook",
+		}, nil
+	}
+	for _, e := range body.Events {
+		if !webhookEvents[e] {
+			return events.APIGatewayProxyResponse{
+				StatusCode: http.StatusBadRequest,
+				Body:       fmt.Sprintf("Unknown event type %s", e),
+			}, nil
+		}
+	}
+
+	webhook := Webhook{
+		ID:        newId(),
+		URL:       body.URL,
+		Events:    body.Events,
+		Secret:    body.Secret,
+		CreatedAt: now().Unix(),
+	}
+	// シークレットを指定しなければ生成する
+	if webhook.Secret == "" {
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return events.APIGatewayProxyResponse{}, err
+		}
+		webhook.Secret = "whsec_" + base64.RawURLEncoding.EncodeToString(secret)
+	}
+
+	item, err := dynamodbattribute.MarshalMap(webhook)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to marshal webhook: %v", err),
+		}, nil
+	}
+	for k, v := range webhookKey(tenantId, webhook.ID) {
+		item[k] = v
+	}
+
+	_, err = clientFor(request).PutItem(&dynamodb.PutItemInput{
+		TableName:           aws.String(tableName),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(DataType)"),
+	})
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to create webhook: %v", err),
+		}, nil
+	}
+
+	// シークレットは作成時のレスポンスでしか返さない
+	response, err := json.Marshal(struct {
+		Webhook
+		Secret string `json:"secret"`
+	}{webhook, webhook.Secret})
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to marshal response: %v", err),
+		}, nil
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: http.StatusCreated,
+		Body:       string(response),
+	}, nil
+}
+
+func GetWebhooks(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	tenantId := TenantFromRequest(request)
+	if tenantId == "" {
+		return missingTenantResponse(), nil
+	}
+
+	webhooks, err := tenantWebhooks(tenantId)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to retrieve webhooks: %v", err),
+		}, nil
+	}
+
+	response, err := json.Marshal(webhooks)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to marshal response: %v", err),
+		}, nil
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: http.StatusOK,
+		Body:       string(response),
+	}, nil
+}
+
+func DeleteWebhook(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	tenantId := TenantFromRequest(request)
+	if tenantId == "" {
+		return missingTenantResponse(), nil
+	}
+	webhookId := request.QueryStringParameters["id"]
+
+	_, err := clientFor(request).DeleteItem(&dynamodb.DeleteItemInput{
+		TableName: aws.String(tableName),
+		Key:       webhookKey(tenantId, webhookId),
+	})
+	if err == nil {
+		_, err = deletePartition(clientFor(request), deliveryPartition(tenantId, webhookId))
+	}
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to delete webhook: %v", err),
+		}, nil
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: http.StatusOK,
+		Body:       "Webhook deleted successfully",
+	}, nil
+}
+
+// 自動で無効になったWebhookを再び有効にする
+func EnableWebhook(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	tenantId := TenantFromRequest(request)
+	if tenantId == "" {
+		return missingTenantResponse(), nil
+	}
+	webhookId := request.QueryStringParameters["id"]
+
+	_, err := clientFor(request).UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:           aws.String(tableName),
+		Key:                 webhookKey(tenantId, webhookId),
+		ConditionExpression: aws.String("attribute_exists(DataType)"),
+		UpdateExpression:    aws.String("SET disabled = :false, failureCount = :zero"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":false": {BOOL: aws.Bool(false)},
+			":zero":  {N: aws.String("0")},
+		},
+	})
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to enable webhook: %v", err),
+		}, nil
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: http.StatusOK,
+		Body:       "Webhook enabled successfully",
+	}, nil
+}
+
+// 新しい順に配信ログを返す
+func GetWebhookDeliveries(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	tenantId := TenantFromRequest(request)
+	if tenantId == "" {
+		return missingTenantResponse(), nil
+	}
+	partition := deliveryPartition(tenantId, request.QueryStringParameters["id"])
+
+	startKey, err := decodeCursor(request.QueryStringParameters["cursor"], partition)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       err.Error(),
+		}, nil
+	}
+
+	result, err := Svc.Query(&dynamodb.QueryInput{
+		TableName:              aws.String(tableName),
+		KeyConditionExpression: aws.String("id = :id AND begins_with(DataType, :prefix)"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":id":     {S: aws.String(partition)},
+			":prefix": {S: aws.String("Delivery#")},
+		},
+		ScanIndexForward:  aws.Bool(false),
+		Limit:             aws.Int64(pageSize(request.QueryStringParameters["limit"])),
+		ExclusiveStartKey: startKey,
+	})
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Query failed: %v", err),
+		}, nil
+	}
+
+	page := deliveryPage{Deliveries: []WebhookDelivery{}, NextCursor: encodeCursor(result.LastEvaluatedKey)}
+	if err := dynamodbattribute.UnmarshalListOfMaps(result.Items, &page.Deliveries); err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to unmarshal deliveries: %v", err),
+		}, nil
+	}
+
+	response, err := json.Marshal(page)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       fmt.Sprintf("Failed to marshal response: %v", err),
+		}, nil
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: http.StatusOK,
+		Body:       string(response),
+	}, nil
+}
+
+func tenantWebhooks(tenantId string) ([]Webhook, error) {
+	result, err := Svc.Query(&dynamodb.QueryInput{
+		TableName:              aws.String(tableName),
+		KeyConditionExpression: aws.String("id = :id AND begins_with(DataType, :prefix)"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":id":     {S: aws.String(tenantKey(tenantId, "Webhooks"))},
+			":prefix": {S: aws.String("Webhook#")},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	webhooks := []Webhook{}
+	if err := dynamodbattribute.UnmarshalListOfMaps(result.Items, &webhooks); err != nil {
+		return nil, err
+	}
+	sort.Slice(webhooks, func(i, j int) bool { return webhooks[i].CreatedAt < webhooks[j].CreatedAt })
+	return webhooks, nil
+}
+
+func (w Webhook) subscribes(event string) bool {
+	for _, e := range w.Events {
+		if e == "*" || e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// 配信待ちのWebhookの送信。再送でも同じ配信IDを使う
+// 配信IDはストリームのレコードとWebhookから決め、ストリームの処理を再実行しても受信側で重複を除ける
+type WebhookAttempt struct {
+	TenantID   string     `json:"tenantId"`
+	WebhookID  string     `json:"webhookId"`
+	DeliveryID string     `json:"deliveryId"`
+	Change     TaskChange `json:"change"`
+	// これまでに送信した回数
+	Attempts int `json:"attempts"`
+}
+
+// 配信待ちの送信を、指定した時間だけ遅らせて配信するキュー
+type WebhookQueue interface {
+	Enqueue(attempt WebhookAttempt, delay time.Duration) error
+}
+
+// SQSの遅延メッセージで配信を待たせる。遅延は最大15分
+type SQSWebhookQueue struct {
+	Client   sqsiface.SQSAPI
+	QueueURL string
+}
+
+const maxWebhookQueueDelay = 15 * time.Minute
+
+func (q SQSWebhookQueue) Enqueue(attempt WebhookAttempt, delay time.Duration) error {
+	body, err := json.Marshal(attempt)
+	if err != nil {
+		return err
+	}
+	if delay > maxWebhookQueueDelay {
+		delay = maxWebhookQueueDelay
+	}
+	_, err = q.Client.SendMessage(&sqs.SendMessageInput{
+		QueueUrl:     aws.String(q.QueueURL),
+		MessageBody:  aws.String(string(body)),
+		DelaySeconds: aws.Int64(int64(delay / time.Second)),
+	})
+	return err
+}
+
+// 変更イベントを購読しているWebhookごとに配信をキューに入れる
+// 配信と再送はキューを処理する側で行うため、ストリームの処理は受信側の応答を待たない
+// キューがなければ、その場で1回だけ送信する
+type WebhookSink struct {
+	Queue WebhookQueue
+}
+
+func (s WebhookSink) Publish(changes []TaskChange) error {
+	byTenant := map[string][]TaskChange{}
+	tenants := []string{}
+	for _, c := range changes {
+		if _, ok := byTenant[c.TenantID]; !ok {
+			tenants = append(tenants, c.TenantID)
+		}
+		byTenant[c.TenantID] = append(byTenant[c.TenantID], c)
+	}
+
+	for _, tenantId := range tenants {
+		webhooks, err := tenantWebhooks(tenantId)
+		if err != nil {
+			return err
+		}
+		for _, webhook := range webhooks {
+			if webhook.Disabled {
+				continue
+			}
+			for _, change := range byTenant[tenantId] {
+				if !webhook.subscribes(change.Type) {
+					continue
+				}
+				attempt := WebhookAttempt{
+					TenantID:   tenantId,
+					WebhookID:  webhook.ID,
+					DeliveryID: change.EventID + "-" + webhook.ID,
+					Change:     change,
+				}
+				if s.Queue != nil {
+					if err := s.Queue.Enqueue(attempt, 0); err != nil {
+						return err
+					}
+					continue
+				}
+				if err := deliverWebhook(&webhook, attempt, nil); err != nil {
+					return err
+				}
+				if webhook.Disabled {
+					break
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// 署名は"{タイムスタンプ}.{本文}"のHMAC-SHA256
+func SignWebhook(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Webhookがなければnilを返す
+func loadWebhook(tenantId string, webhookId string) (*Webhook, error) {
+	result, err := Svc.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(tableName),
+		Key:       webhookKey(tenantId, webhookId),
+	})
+	if err != nil || len(result.Item) == 0 {
+		return nil, err
+	}
+	webhook := Webhook{}
+	if err := dynamodbattribute.UnmarshalMap(result.Item, &webhook); err != nil {
+		return nil, err
+	}
+	return &webhook, nil
+}
+
+// キューから取り出した配信を1回送信する
+// 再送できる失敗で上限に達していなければ、間隔を倍にしてキューに戻す
+// 削除または無効にされたWebhookには送信しない
+func DeliverWebhook(attempt WebhookAttempt, queue WebhookQueue) error {
+	webhook, err := loadWebhook(attempt.TenantID, attempt.WebhookID)
+	if err != nil {
+		return err
+	}
+	if webhook == nil || webhook.Disabled {
+		return nil
+	}
+	return deliverWebhook(webhook, attempt, queue)
+}
+
+func deliverWebhook(webhook *Webhook, attempt WebhookAttempt, queue WebhookQueue) error {
+	delivery := WebhookDelivery{
+		ID:        attempt.DeliveryID,
+		WebhookID: webhook.ID,
+		Event:     attempt.Change.Type,
+		TaskID:    attempt.Change.TaskID,
+		Attempts:  attempt.Attempts + 1,
+	}
+	body, err := json.Marshal(struct {
+		ID    string     `json:"id"`
+		Event string     `json:"event"`
+		Data  TaskChange `json:"data"`
+	}{delivery.ID, delivery.Event, attempt.Change})
+	if err != nil {
+		return err
+	}
+
+	retry := false
+	delivery.StatusCode, retry, err = postWebhook(webhook, delivery, body)
+	if err == nil {
+		delivery.Success = true
+	} else {
+		delivery.Error = err.Error()
+		if retry && queue != nil && delivery.Attempts < WebhookMaxAttempts {
+			attempt.Attempts = delivery.Attempts
+			return queue.Enqueue(attempt, WebhookRetryDelay<<(delivery.Attempts-1))
+		}
+	}
+	delivery.Timestamp = now().Unix()
+
+	if err := logDelivery(attempt.TenantID, delivery); err != nil {
+		return err
+	}
+	return recordDeliveryResult(attempt.TenantID, webhook, delivery.Success)
+}
+
+// 接続エラー、429、5xxは再送する
+func postWebhook(webhook *Webhook, delivery WebhookDelivery, body []byte) (int, bool, error) {
+	timestamp := now().Unix()
+	req, err := http.NewRequest(http.MethodPost, webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Id", webhook.ID)
+	req.Header.Set("X-Webhook-Delivery", delivery.ID)
+	req.Header.Set("X-Webhook-Event", delivery.Event)
+	req.Header.Set("X-Webhook-Timestamp", strconv.FormatInt(timestamp, 10))
+	req.Header.Set("X-Webhook-Signature", SignWebhook(webhook.Secret, timestamp, body))
+
+	res, err := WebhookClient.Do(req)
+	if err != nil {
+		return 0, !errors.Is(err, errBlockedAddress), err
+	}
+	res.Body.Close()
+
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return res.StatusCode, false, nil
+	}
+	retry := res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500
+	return res.StatusCode, retry, fmt.Errorf("receiver responded with status %d", res.StatusCode)
+}
+
+func logDelivery(tenantId string, delivery WebhookDelivery) error {
+	item, err := dynamodbattribute.MarshalMap(delivery)
+	if err != nil {
+		return err
+	}
+	item["id"] = &dynamodb.AttributeValue{S: aws.String(deliveryPartition(tenantId, delivery.WebhookID))}
+	// 配信IDは変更イベントから決まるため、新しい順に並べられるよう記録した日時を前に付ける
+	item["DataType"] = &dynamodb.AttributeValue{S: aws.String(fmt.Sprintf("Delivery#%020d-%s", now().UnixNano(), delivery.ID))}
+
+	_, err = Svc.PutItem(&dynamodb.PutItemInput{
+		TableName: aws.String(tableName),
+		Item:      item,
+	})
+	return err
+}
+
+// 成功すれば失敗回数を戻し、失敗が続けばWebhookを無効にする
+func recordDeliveryResult(tenantId string, webhook *Webhook, success bool) error {
+	if success {
+		if webhook.FailureCount == 0 {
+			return nil
+		}
+		webhook.FailureCount = 0
+		_, err := Svc.UpdateItem(&dynamodb.UpdateItemInput{
+			TableName:        aws.String(tableName),
+			Key:              webhookKey(tenantId, webhook.ID),
+			UpdateExpression: aws.String("SET failureCount = :zero"),
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":zero": {N: aws.String("0")},
+			},
+		})
+		return err
+	}
+
+	result, err := Svc.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:           aws.String(tableName),
+		Key:                 webhookKey(tenantId, webhook.ID),
+		ConditionExpression: aws.String("attribute_exists(DataType)"),
+		UpdateExpression:    aws.String("ADD failureCount :one"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":one": {N: aws.String("1")},
+		},
+		ReturnValues: aws.String(dynamodb.ReturnValueUpdatedNew),
+	})
+	if err != nil {
+		if isConditionFailed(err) {
+			// 配信中に削除された
+			return nil
+		}
+		return err
+	}
+	webhook.FailureCount = int(numberAttr(result.Attributes, "failureCount"))
+	if webhook.FailureCount < WebhookFailureThreshold {
+		return nil
+	}
+
+	log.Printf("Disabling webhook %s after %d consecutive failures", webhook.ID, webhook.FailureCount)
+	webhook.Disabled = true
+	_, err = Svc.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:        aws.String(tableName),
+		Key:              webhookKey(tenantId, webhook.ID),
+		UpdateExpression: aws.String("SET disabled = :true"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":true": {BOOL: aws.Bool(true)},
+		},
+	})
+	return err
+}
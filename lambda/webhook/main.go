@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+
+	"task-management-app/lambda/task"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// 再送する配信を戻すキュー
+var queue task.WebhookQueue
+
+// キューに入ったWebhookの配信を1件ずつ送信する
+// 処理できなかったメッセージだけを失敗として返し、可視性タイムアウトの後に再処理させる
+func handler(event events.SQSEvent) (events.SQSEventResponse, error) {
+	response := events.SQSEventResponse{BatchItemFailures: []events.SQSBatchItemFailure{}}
+	for _, record := range event.Records {
+		attempt := task.WebhookAttempt{}
+		if err := json.Unmarshal([]byte(record.Body), &attempt); err != nil {
+			// 読めないメッセージは再処理しても変わらないため捨てる
+			log.Printf("Dropping malformed webhook delivery %s: %v", record.MessageId, err)
+			continue
+		}
+		if err := task.DeliverWebhook(attempt, queue); err != nil {
+			log.Printf("Failed to deliver webhook %s: %v", attempt.DeliveryID, err)
+			response.BatchItemFailures = append(response.BatchItemFailures, events.SQSBatchItemFailure{ItemIdentifier: record.MessageId})
+		}
+	}
+	return response, nil
+}
+
+func main() {
+	sess := session.Must(session.NewSession())
+	task.Svc = dynamodb.New(sess)
+	queue = task.SQSWebhookQueue{Client: sqs.New(sess), QueueURL: os.Getenv("WEBHOOK_QUEUE_URL")}
+	lambda.Start(handler)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"task-management-app/lambda/auth"
+	"task-management-app/lambda/task"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+var (
+	verifier *auth.Verifier
+	policy   = auth.DefaultPolicy
+)
+
+type subscriptionRequest struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+func handler(request events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
+	connectionId := request.RequestContext.ConnectionID
+	switch request.RequestContext.RouteKey {
+	case "$connect":
+		return connect(request)
+	case "$disconnect":
+		if err := task.Disconnect(connectionId); err != nil {
+			return response(http.StatusInternalServerError, fmt.Sprintf("Failed to disconnect: %v", err)), nil
+		}
+		return response(http.StatusOK, "Disconnected"), nil
+	case "subscribe", "unsubscribe":
+		return subscribe(request)
+	}
+	return response(http.StatusBadRequest, "Invalid request"), nil
+}
+
+// ブラウザのWebSocketはヘッダーを設定できないため、?token=のJWTも受け付ける
+func connect(request events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
+	headers := map[string]string{}
+	for k, v := range request.Headers {
+		headers[k] = v
+	}
+	if token := request.QueryStringParameters["token"]; token != "" {
+		headers["Authorization"] = "Bearer " + token
+	}
+
+	connected := func(r events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		identity := task.IdentityFromRequest(r)
+		if identity.TenantID == "" {
+			return response(http.StatusForbidden, "Missing tenant"), nil
+		}
+		if err := task.Connect(request.RequestContext.ConnectionID, identity); err != nil {
+			return response(http.StatusInternalServerError, fmt.Sprintf("Failed to connect: %v", err)), nil
+		}
+		return response(http.StatusOK, "Connected"), nil
+	}
+	return auth.Authenticate(verifier, nil)(connected)(events.APIGatewayProxyRequest{Headers: headers})
+}
+
+// タスクの読み取り権限がある対象だけを購読できる
+func subscribe(request events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
+	body := subscriptionRequest{}
+	if err := json.Unmarshal([]byte(request.Body), &body); err != nil {
+		return response(http.StatusBadRequest, fmt.Sprintf("Failed to unmarshal request: %v", err)), nil
+	}
+	topic, err := task.SubscriptionTopic(body.Type, body.Value)
+	if err != nil {
+		return response(http.StatusBadRequest, err.Error()), nil
+	}
+
+	connection, err := task.LookupConnection(request.RequestContext.ConnectionID)
+	if err != nil {
+		return response(http.StatusInternalServerError, fmt.Sprintf("Failed to retrieve connection: %v", err)), nil
+	}
+	if connection == nil {
+		return response(http.StatusGone, "Connection not found"), nil
+	}
+
+	if request.RequestContext.RouteKey == "unsubscribe" {
+		if err := task.Unsubscribe(connection, topic); err != nil {
+			return response(http.StatusInternalServerError, fmt.Sprintf("Failed to unsubscribe: %v", err)), nil
+		}
+		return response(http.StatusOK, "Unsubscribed"), nil
+	}
+
+	project := ""
+	switch body.Type {
+	case "project":
+		project = body.Value
+	case "task":
+		project, err = task.ProjectOfTask(connection.TenantID, body.Value)
+		if err != nil {
+			return response(http.StatusInternalServerError, fmt.Sprintf("Failed to resolve project: %v", err)), nil
+		}
+	}
+	if err := policy.Check("task:read", connection.Roles, project); err != nil {
+		return response(http.StatusForbidden, err.Error()), nil
+	}
+
+	if err := task.Subscribe(connection, topic); err != nil {
+		return response(http.StatusInternalServerError, fmt.Sprintf("Failed to subscribe: %v", err)), nil
+	}
+	return response(http.StatusOK, "Subscribed"), nil
+}
+
+func response(statusCode int, body string) events.APIGatewayProxyResponse {
+	return events.APIGatewayProxyResponse{StatusCode: statusCode, Body: body}
+}
+
+func main() {
+	var err error
+	// 設定に誤りがある場合は起動を続け、すべての接続を拒否する
+	verifier, err = auth.NewVerifierFromEnv()
+	if err != nil {
+		log.Printf("JWT authentication is disabled: %v", err)
+	}
+
+	task.Svc = dynamodb.New(session.Must(session.NewSession()))
+	lambda.Start(handler)
+}